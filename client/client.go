@@ -70,6 +70,50 @@ func (c *Client) UserAdd(user store.User) error {
 	return err
 }
 
+// BanAdd bans the address or network described by the ban provided
+func (c *Client) BanAdd(ban store.Ban) error {
+	_, err := c.Exec(Opts{
+		Method: "POST",
+		Path:   "/ban",
+		JSON:   ban,
+	})
+	return err
+}
+
+// BanDelete removes the ban for the address or network provided
+func (c *Client) BanDelete(cidr string) error {
+	_, err := c.Exec(Opts{
+		Method: "DELETE",
+		Path:   fmt.Sprintf("/ban/%s", cidr),
+	})
+	return err
+}
+
+// BanGetAll fetches all known bans
+func (c *Client) BanGetAll() ([]store.Ban, error) {
+	var bans []store.Ban
+	_, err := c.Exec(Opts{
+		Method: "GET",
+		Path:   "/ban",
+		Recv:   &bans,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+// Stats returns the current global stats of the tracker
+func (c *Client) Stats() (tracker.GlobalStats, error) {
+	var stats tracker.GlobalStats
+	_, err := c.Exec(Opts{
+		Method: "GET",
+		Path:   "/stats",
+		Recv:   &stats,
+	})
+	return stats, err
+}
+
 // Ping tests communication between the API server and the client
 func (c *Client) Ping() error {
 	const msg = "hello world"
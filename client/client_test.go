@@ -30,6 +30,26 @@ func TestClient_Torrent(t *testing.T) {
 
 }
 
+func TestClient_Ban(t *testing.T) {
+	c := New(host, api.DefaultAuthKey)
+	ban, err := store.NewBan("2600::/64", "test ban", "tester", time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, c.BanAdd(ban))
+	bans, err := c.BanGetAll()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(bans))
+	require.Equal(t, ban.CIDR, bans[0].CIDR)
+	require.NoError(t, c.BanDelete(ban.CIDR))
+	require.Error(t, c.BanDelete(ban.CIDR))
+}
+
+func TestClient_Stats(t *testing.T) {
+	c := New(host, api.DefaultAuthKey)
+	stats, err := c.Stats()
+	require.NoError(t, err)
+	require.False(t, stats.Started.IsZero())
+}
+
 func TestClient_Ping(t *testing.T) {
 	c := New(host, api.DefaultAuthKey)
 	require.NoError(t, c.Ping())
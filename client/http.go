@@ -2,6 +2,7 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/leighmacdonald/mika/consts"
@@ -59,6 +60,8 @@ type Opts struct {
 	Data    []byte
 	Headers map[string]string
 	Recv    interface{}
+	// Context is used for the request if set, allowing the caller to cancel it
+	Context context.Context
 }
 
 // Exec handles http requests & response initialization and (un)marshalling of JSON payloads.
@@ -82,7 +85,11 @@ func (c *AuthedClient) Exec(opts Opts) (*http.Response, error) {
 		payload = opts.Data
 	}
 	url := c.u(opts.Path)
-	req, err2 := http.NewRequest(opts.Method, url, bytes.NewReader(payload))
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, err2 := http.NewRequestWithContext(ctx, opts.Method, url, bytes.NewReader(payload))
 	if err2 != nil {
 		return nil, err2
 	}
@@ -0,0 +1,619 @@
+// Package cluster lets several tracker nodes share the peer swarms without a central peer
+// store.
+//
+// Each swarm is owned by a single node, chosen by consistent hashing of the info_hash over
+// the live members. A Cluster wraps the local store.PeerStore of a node and is used as its
+// PeerStore, operations on swarms owned by other nodes are forwarded to the owner over a
+// small internal HTTP RPC served by Handler.
+//
+// Members exchange heartbeats every HeartbeatInterval. With a static member list only the
+// configured members take part, when gossip is enabled the member lists are exchanged so new
+// nodes only need to know one of the seeds to join. When a member joins, leaves or stops
+// sending heartbeats the ring is rebuilt and each node hands the swarms it no longer owns
+// off to their new owner.
+package cluster
+
+import (
+	"context"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/store"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Opts configures a Cluster
+type Opts struct {
+	// Addr is the base URL, eg: http://10.0.0.1:34002, the other members reach the RPC
+	// handler of this node on. It is also used as the nodes identity on the ring.
+	Addr string
+	// Members are the base URLs of the other nodes. When Gossip is enabled they are only
+	// used as seeds to join the cluster, otherwise they are the complete member list.
+	Members []string
+	// Gossip enables discovery of members not listed in Members
+	Gossip bool
+	// HeartbeatInterval is how often the member lists are exchanged
+	HeartbeatInterval time.Duration
+	// DeadTimeout is how long a member can go without a new heartbeat before it is
+	// removed from the ring
+	DeadTimeout time.Duration
+	// Replicas is the number of points each member has on the ring
+	Replicas int
+	// Secret is the shared key the members must send with RPC requests
+	Secret string
+}
+
+// DefaultOpts returns the default cluster options, Addr must still be set
+func DefaultOpts() *Opts {
+	return &Opts{
+		HeartbeatInterval: time.Second,
+		DeadTimeout:       time.Second * 10,
+		Replicas:          128,
+	}
+}
+
+// member is the last known state of another node
+type member struct {
+	// heartbeat is increased by the node every HeartbeatInterval
+	heartbeat uint64
+	// seen is when heartbeat last increased, zero once the node has left
+	seen time.Time
+}
+
+// Cluster is a store.PeerStore which routes each swarm to the member owning it
+type Cluster struct {
+	*sync.RWMutex
+	opts      Opts
+	local     store.PeerStore
+	client    *http.Client
+	ring      *Ring
+	members   map[string]*member
+	seeds     map[string]bool
+	heartbeat uint64
+	leaving   bool
+	// swarms are the info hashes with peers in the local store, used to find the swarms
+	// to hand off
+	swarms   map[store.InfoHash]struct{}
+	swarmsMu *sync.Mutex
+	// listener is notified of the changes to the peers in the local store
+	listener store.PeerListener
+	// handoffMu serializes handoffs, handoffPending is set when one failed and must be retried
+	handoffMu      *sync.Mutex
+	handoffPending bool
+	stop           chan struct{}
+	stopOnce       *sync.Once
+}
+
+// New creates a cluster node storing the swarms it owns in local. Run must be called to
+// start exchanging heartbeats with the other members.
+func New(local store.PeerStore, opts Opts) (*Cluster, error) {
+	if opts.Addr == "" {
+		return nil, errors.Wrap(consts.ErrInvalidConfig, "Cluster address must be set")
+	}
+	if opts.HeartbeatInterval <= 0 || opts.DeadTimeout <= opts.HeartbeatInterval {
+		return nil, errors.Wrap(consts.ErrInvalidConfig, "Cluster dead timeout must exceed the heartbeat interval")
+	}
+	// The RPC handler accepts peer writes from anyone reaching it so it is never run open
+	if opts.Secret == "" {
+		return nil, errors.Wrap(consts.ErrInvalidConfig, "Cluster secret must be set")
+	}
+	opts.Addr = normalizeAddr(opts.Addr)
+	seeds := make(map[string]bool)
+	for _, m := range opts.Members {
+		if m = normalizeAddr(m); m != "" && m != opts.Addr {
+			seeds[m] = true
+		}
+	}
+	c := &Cluster{
+		RWMutex: &sync.RWMutex{},
+		opts:    opts,
+		local:   local,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:         (&net.Dialer{Timeout: time.Second * 5}).DialContext,
+				MaxIdleConnsPerHost: 32,
+			},
+			Timeout: time.Second * 5,
+		},
+		ring:    NewRing(opts.Replicas, []string{opts.Addr}),
+		members: make(map[string]*member),
+		seeds:   seeds,
+		// Restarted nodes must send larger heartbeats than before they stopped, otherwise
+		// the other members would keep them marked as dead
+		heartbeat: uint64(time.Now().UnixNano()),
+		swarms:    make(map[store.InfoHash]struct{}),
+		swarmsMu:  &sync.Mutex{},
+		handoffMu: &sync.Mutex{},
+		stop:      make(chan struct{}),
+		stopOnce:  &sync.Once{},
+	}
+	return c, nil
+}
+
+// normalizeAddr trims the trailing slash so the same member is never known by two addresses
+func normalizeAddr(addr string) string {
+	return strings.TrimRight(strings.TrimSpace(addr), "/")
+}
+
+// Addr returns the address identifying this node
+func (c *Cluster) Addr() string {
+	return c.opts.Addr
+}
+
+// Members returns the live members currently on the ring, including this node
+func (c *Cluster) Members() []string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.ring.Members()
+}
+
+// Owner returns the address of the member owning the swarm
+func (c *Cluster) Owner(ih store.InfoHash) string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.ring.Owner(ih)
+}
+
+// Run exchanges heartbeats with the other members until the cluster is closed
+func (c *Cluster) Run() {
+	c.beat()
+	ticker := time.NewTicker(c.opts.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.beat()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// beat sends our member list to the heartbeat targets, merging their replies, and
+// retries any failed handoff
+func (c *Cluster) beat() {
+	c.Lock()
+	if c.leaving {
+		// A heartbeat sent after the leave message would mark this node live again
+		c.Unlock()
+		return
+	}
+	c.heartbeat++
+	c.Unlock()
+	state := c.gossipState()
+	wg := &sync.WaitGroup{}
+	for _, addr := range c.heartbeatTargets() {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			var reply gossipMsg
+			if err := c.call(addr, pathGossip, state, &reply); err != nil {
+				log.Debugf("Failed to send heartbeat to %s: %s", addr, err)
+				return
+			}
+			c.merge(reply)
+		}(addr)
+	}
+	wg.Wait()
+	c.updateRing()
+	c.Lock()
+	pending := c.handoffPending
+	c.Unlock()
+	if pending {
+		c.handoff()
+	}
+}
+
+// heartbeatTargets returns the members to send heartbeats to. Static clusters send them to
+// every member, gossip clusters to a couple of random live members and one of the seeds
+// not currently live so separated nodes can rejoin.
+func (c *Cluster) heartbeatTargets() []string {
+	c.RLock()
+	defer c.RUnlock()
+	if !c.opts.Gossip {
+		targets := make([]string, 0, len(c.seeds))
+		for addr := range c.seeds {
+			targets = append(targets, addr)
+		}
+		return targets
+	}
+	var live, dead []string
+	for addr, m := range c.members {
+		if c.alive(m) {
+			live = append(live, addr)
+		}
+	}
+	for addr := range c.seeds {
+		if m, found := c.members[addr]; !found || !c.alive(m) {
+			dead = append(dead, addr)
+		}
+	}
+	rand.Shuffle(len(live), func(i, j int) { live[i], live[j] = live[j], live[i] })
+	if len(live) > gossipFanout {
+		live = live[:gossipFanout]
+	}
+	if len(dead) > 0 {
+		live = append(live, dead[rand.Intn(len(dead))])
+	}
+	return live
+}
+
+// gossipFanout is the number of live members each heartbeat is sent to in gossip mode
+const gossipFanout = 2
+
+// gossipState returns the heartbeats of this node and every live member it knows of
+func (c *Cluster) gossipState() gossipMsg {
+	c.RLock()
+	defer c.RUnlock()
+	msg := gossipMsg{From: c.opts.Addr, Members: map[string]uint64{c.opts.Addr: c.heartbeat}}
+	if c.leaving {
+		msg.Members = map[string]uint64{}
+	}
+	for addr, m := range c.members {
+		if c.alive(m) {
+			msg.Members[addr] = m.heartbeat
+		}
+	}
+	return msg
+}
+
+// merge records the newer heartbeats in the message. Static clusters ignore members which
+// are not configured.
+func (c *Cluster) merge(msg gossipMsg) {
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	for addr, hb := range msg.Members {
+		if addr == c.opts.Addr || (!c.opts.Gossip && !c.seeds[addr]) {
+			continue
+		}
+		m, found := c.members[addr]
+		if !found {
+			c.members[addr] = &member{heartbeat: hb, seen: now}
+			continue
+		}
+		if hb > m.heartbeat {
+			m.heartbeat = hb
+			m.seen = now
+		}
+	}
+}
+
+// leave marks the member as gone until it sends a newer heartbeat
+func (c *Cluster) leave(addr string, heartbeat uint64) {
+	c.Lock()
+	if m, found := c.members[addr]; found && heartbeat >= m.heartbeat {
+		m.heartbeat = heartbeat
+		m.seen = time.Time{}
+	}
+	c.Unlock()
+}
+
+func (c *Cluster) alive(m *member) bool {
+	return !m.seen.IsZero() && time.Since(m.seen) < c.opts.DeadTimeout
+}
+
+// updateRing rebuilds the ring from the live members, handing off the swarms owned by
+// another member if it changed
+func (c *Cluster) updateRing() {
+	c.Lock()
+	var live []string
+	if !c.leaving {
+		live = append(live, c.opts.Addr)
+	}
+	for addr, m := range c.members {
+		if c.alive(m) {
+			live = append(live, addr)
+		}
+	}
+	ring := NewRing(c.opts.Replicas, live)
+	changed := !equalMembers(ring.Members(), c.ring.Members())
+	if changed {
+		c.ring = ring
+	}
+	c.Unlock()
+	if changed {
+		log.Infof("Cluster members changed: %s", strings.Join(ring.Members(), ", "))
+		c.handoff()
+	}
+}
+
+func equalMembers(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// swarmPeers returns every local peer of the swarm. GetN only fills the peer list fields
+// so each peer is read in full with Get.
+func (c *Cluster) swarmPeers(ih store.InfoHash) ([]store.Peer, error) {
+	// The limit is not set so every peer is returned
+	listed, err := c.local.GetN(ih, 0, store.PeerFilter{})
+	if err != nil {
+		if err == consts.ErrInvalidTorrentID {
+			return nil, nil
+		}
+		return nil, err
+	}
+	peers := make([]store.Peer, 0, len(listed))
+	for _, p := range listed {
+		var full store.Peer
+		if err := c.local.Get(&full, ih, p.PeerID); err != nil {
+			if err == consts.ErrInvalidPeerID {
+				continue
+			}
+			return nil, err
+		}
+		peers = append(peers, full)
+	}
+	return peers, nil
+}
+
+// handoff moves the local swarms owned by another member to their owner. Swarms which fail
+// to be sent are kept and retried on the next heartbeat.
+func (c *Cluster) handoff() {
+	c.handoffMu.Lock()
+	defer c.handoffMu.Unlock()
+	c.swarmsMu.Lock()
+	hashes := make([]store.InfoHash, 0, len(c.swarms))
+	for ih := range c.swarms {
+		hashes = append(hashes, ih)
+	}
+	c.swarmsMu.Unlock()
+	// Cleared first so swarms received while handing off are moved by the next retry
+	c.Lock()
+	c.handoffPending = false
+	c.Unlock()
+	failed := false
+	for _, ih := range hashes {
+		owner := c.Owner(ih)
+		if owner == c.opts.Addr || owner == "" {
+			continue
+		}
+		peers, err := c.swarmPeers(ih)
+		if err != nil {
+			log.Errorf("Failed to read swarm for handoff: %s", err)
+			failed = true
+			continue
+		}
+		c.swarmsMu.Lock()
+		delete(c.swarms, ih)
+		c.swarmsMu.Unlock()
+		if len(peers) == 0 {
+			continue
+		}
+		// The peers are removed before sending them, the new owner may hand them straight
+		// back if its ring is not yet up to date
+		for _, p := range peers {
+			if err := c.deleteLocal(ih, p.PeerID); err != nil && err != consts.ErrInvalidPeerID {
+				log.Warnf("Failed to remove handed off peer: %s", err)
+			}
+		}
+		if err := c.call(owner, pathSwarm, swarmMsg{InfoHash: ih, Peers: peers}, nil); err != nil {
+			log.Errorf("Failed to hand off swarm %s to %s: %s", ih.String(), owner, err)
+			failed = true
+			for _, p := range peers {
+				if err := c.addLocal(ih, p); err != nil {
+					log.Errorf("Failed to restore peer after failed handoff: %s", err)
+				}
+			}
+			continue
+		}
+		log.Debugf("Handed off swarm %s (%d peers) to %s", ih.String(), len(peers), owner)
+	}
+	if failed {
+		c.Lock()
+		c.handoffPending = true
+		c.Unlock()
+	}
+}
+
+// track records that the local store holds peers of the swarm
+func (c *Cluster) track(ih store.InfoHash) {
+	c.swarmsMu.Lock()
+	c.swarms[ih] = struct{}{}
+	c.swarmsMu.Unlock()
+}
+
+// SetListener sets the listener notified of the changes to the peers in the local store.
+// Peers added to or removed from swarms owned by other members are only reported by
+// their owner.
+func (c *Cluster) SetListener(l store.PeerListener) {
+	c.Lock()
+	c.listener = l
+	c.Unlock()
+}
+
+// peerListener returns the listener of the local store, nil if none is set
+func (c *Cluster) peerListener() store.PeerListener {
+	c.RLock()
+	l := c.listener
+	c.RUnlock()
+	return l
+}
+
+// addLocal adds the peer to the local store, regardless of the owner of the swarm.
+// Forwarded requests are always served locally so members with a different view of
+// the ring can never forward a request in a loop.
+func (c *Cluster) addLocal(ih store.InfoHash, p store.Peer) error {
+	if err := c.local.Add(ih, p); err != nil {
+		return err
+	}
+	c.track(ih)
+	if l := c.peerListener(); l != nil {
+		l.PeerAdded(ih, p)
+	}
+	if c.remote(ih) != "" {
+		// Sent by a member with an outdated ring, moved on the next heartbeat
+		c.Lock()
+		c.handoffPending = true
+		c.Unlock()
+	}
+	return nil
+}
+
+// deleteLocal removes the peer from the local store
+func (c *Cluster) deleteLocal(ih store.InfoHash, id store.PeerID) error {
+	if err := c.local.Delete(ih, id); err != nil {
+		return err
+	}
+	if l := c.peerListener(); l != nil {
+		l.PeerRemoved(ih, id)
+	}
+	return nil
+}
+
+// syncLocal applies the batch to the local store
+func (c *Cluster) syncLocal(b map[store.PeerHash]store.PeerStats) error {
+	if err := c.local.Sync(b); err != nil {
+		return err
+	}
+	if l := c.peerListener(); l != nil {
+		for ph, stats := range b {
+			l.PeerSynced(ph, stats)
+		}
+	}
+	return nil
+}
+
+// remote returns the owner of the swarm, or an empty string if it is owned by this node
+func (c *Cluster) remote(ih store.InfoHash) string {
+	owner := c.Owner(ih)
+	if owner == c.opts.Addr || owner == "" {
+		return ""
+	}
+	return owner
+}
+
+// Add inserts a peer into the swarm on the member owning it
+func (c *Cluster) Add(ih store.InfoHash, p store.Peer) error {
+	if owner := c.remote(ih); owner != "" {
+		return c.call(owner, pathPeerAdd, peerMsg{InfoHash: ih, Peer: p}, nil)
+	}
+	return c.addLocal(ih, p)
+}
+
+// Delete removes the peer from the swarm on the member owning it
+func (c *Cluster) Delete(ih store.InfoHash, p store.PeerID) error {
+	if owner := c.remote(ih); owner != "" {
+		return c.call(owner, pathPeerDelete, peerMsg{InfoHash: ih, PeerID: p}, nil)
+	}
+	return c.deleteLocal(ih, p)
+}
+
+// GetN returns up to limit peers matching the filter from the member owning the swarm
+func (c *Cluster) GetN(ih store.InfoHash, limit int, filter store.PeerFilter) ([]store.Peer, error) {
+	if owner := c.remote(ih); owner != "" {
+		var peers []store.Peer
+		if err := c.call(owner, pathPeerGetN, getNMsg{InfoHash: ih, Limit: limit, Filter: filter}, &peers); err != nil {
+			return nil, err
+		}
+		return peers, nil
+	}
+	return c.local.GetN(ih, limit, filter)
+}
+
+// Get fetches the peer from the member owning the swarm
+func (c *Cluster) Get(peer *store.Peer, ih store.InfoHash, id store.PeerID) error {
+	if owner := c.remote(ih); owner != "" {
+		return c.call(owner, pathPeerGet, peerMsg{InfoHash: ih, PeerID: id}, peer)
+	}
+	return c.local.Get(peer, ih, id)
+}
+
+// Sync splits the batch by the member owning each swarm and applies each part on its owner
+func (c *Cluster) Sync(b map[store.PeerHash]store.PeerStats) error {
+	local := make(map[store.PeerHash]store.PeerStats)
+	remote := make(map[string][]syncEntry)
+	for ph, stats := range b {
+		if owner := c.remote(ph.InfoHash()); owner != "" {
+			remote[owner] = append(remote[owner], syncEntry{PeerHash: ph, Stats: stats})
+		} else {
+			local[ph] = stats
+		}
+	}
+	var err error
+	if len(local) > 0 {
+		err = c.syncLocal(local)
+	}
+	for owner, entries := range remote {
+		if errC := c.call(owner, pathPeerSync, entries, nil); errC != nil {
+			err = errC
+		}
+	}
+	return err
+}
+
+// Reap removes the stale peers from the swarms stored locally, the other members reap
+// their own swarms. Swarms left empty are no longer tracked for handoff.
+func (c *Cluster) Reap() []store.ReapedPeer {
+	reaped := c.local.Reap()
+	l := c.peerListener()
+	reapedSwarms := make(map[store.InfoHash]struct{})
+	for _, rp := range reaped {
+		reapedSwarms[rp.InfoHash()] = struct{}{}
+		if l != nil {
+			l.PeerRemoved(rp.InfoHash(), rp.PeerID())
+		}
+	}
+	// The lock is held while checking so a peer added concurrently is always tracked
+	// again by addLocal after the swarm is removed
+	c.swarmsMu.Lock()
+	for ih := range reapedSwarms {
+		peers, err := c.local.GetN(ih, 1, store.PeerFilter{})
+		if (err == nil && len(peers) == 0) || err == consts.ErrInvalidTorrentID {
+			delete(c.swarms, ih)
+		}
+	}
+	c.swarmsMu.Unlock()
+	return reaped
+}
+
+// Ping checks that the local store is reachable
+func (c *Cluster) Ping(ctx context.Context) error {
+	return c.local.Ping(ctx)
+}
+
+// Name returns the name of the local data store type
+func (c *Cluster) Name() string {
+	return c.local.Name()
+}
+
+// Close leaves the cluster, handing the local swarms off to the remaining members before
+// closing the local store
+func (c *Cluster) Close() error {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		c.Lock()
+		c.leaving = true
+		var live []string
+		for addr, m := range c.members {
+			if c.alive(m) {
+				live = append(live, addr)
+			}
+		}
+		msg := leaveMsg{Addr: c.opts.Addr, Heartbeat: c.heartbeat}
+		c.Unlock()
+		for _, addr := range live {
+			if err := c.call(addr, pathLeave, msg, nil); err != nil {
+				log.Warnf("Failed to notify %s of leaving the cluster: %s", addr, err)
+			}
+		}
+		c.updateRing()
+		// The ring may have been updated by a concurrent request, in which case the handoff
+		// it started must be waited on before the local store is closed
+		c.handoff()
+	})
+	return c.local.Close()
+}
@@ -0,0 +1,311 @@
+package cluster
+
+import (
+	"context"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/store"
+	"github.com/leighmacdonald/mika/store/memory"
+	"github.com/leighmacdonald/mika/tracker"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testNode is a cluster member served over a local test http server
+type testNode struct {
+	*Cluster
+	local  store.PeerStore
+	server *httptest.Server
+}
+
+// newTestNodes starts count nodes which know the members returned by members, it is
+// passed the addresses of every node being started
+func newTestNodes(t *testing.T, count int, gossip bool, members func(addrs []string) []string) []*testNode {
+	servers := make([]*httptest.Server, count)
+	addrs := make([]string, count)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		addrs[i] = "http://" + servers[i].Listener.Addr().String()
+	}
+	nodes := make([]*testNode, count)
+	for i, srv := range servers {
+		opts := DefaultOpts()
+		opts.Addr = addrs[i]
+		opts.Members = members(addrs)
+		opts.Gossip = gossip
+		opts.HeartbeatInterval = time.Millisecond * 20
+		opts.DeadTimeout = time.Millisecond * 500
+		opts.Secret = "secret"
+		local := memory.NewPeerStore()
+		c, err := New(local, *opts)
+		require.NoError(t, err)
+		srv.Config.Handler = c.Handler()
+		srv.Start()
+		go c.Run()
+		nodes[i] = &testNode{Cluster: c, local: local, server: srv}
+	}
+	return nodes
+}
+
+// kill stops the node without leaving the cluster
+func (n *testNode) kill() {
+	n.stopOnce.Do(func() { close(n.stop) })
+	n.server.Close()
+}
+
+func waitMembers(t *testing.T, count int, nodes ...*testNode) {
+	require.Eventually(t, func() bool {
+		for _, n := range nodes {
+			if len(n.Members()) != count {
+				return false
+			}
+		}
+		return true
+	}, time.Second*5, time.Millisecond*10, "Cluster members did not converge")
+}
+
+// requireOwned checks every swarm is only stored by its owner
+func requireOwned(t *testing.T, swarms map[store.InfoHash][]store.Peer, nodes ...*testNode) {
+	require.Eventually(t, func() bool {
+		for ih, peers := range swarms {
+			for _, n := range nodes {
+				found, _ := n.local.GetN(ih, 0, store.PeerFilter{})
+				if n.Owner(ih) == n.Addr() && len(found) != len(peers) {
+					return false
+				}
+				if n.Owner(ih) != n.Addr() && len(found) > 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}, time.Second*5, time.Millisecond*10, "Swarms were not handed off")
+}
+
+func TestRing(t *testing.T) {
+	members := []string{"http://a:1", "http://b:1", "http://c:1"}
+	ring := NewRing(128, members)
+	reordered := NewRing(128, []string{members[2], members[0], members[1]})
+	grown := NewRing(128, append(members, "http://d:1"))
+	counts := map[string]int{}
+	moved := 0
+	const swarms = 3000
+	for i := 0; i < swarms; i++ {
+		ih := store.GenerateTestTorrent().InfoHash
+		owner := ring.Owner(ih)
+		require.Equal(t, owner, reordered.Owner(ih), "Member order changed the owner")
+		counts[owner]++
+		if newOwner := grown.Owner(ih); newOwner != owner {
+			require.Equal(t, "http://d:1", newOwner, "Swarm moved between existing members")
+			moved++
+		}
+	}
+	for _, m := range members {
+		require.InDelta(t, swarms/len(members), counts[m], swarms*0.1, "Unbalanced ring")
+	}
+	require.InDelta(t, swarms/4, moved, swarms*0.1)
+	require.Equal(t, "", NewRing(128, nil).Owner(store.GenerateTestTorrent().InfoHash))
+}
+
+func TestCluster(t *testing.T) {
+	nodes := newTestNodes(t, 3, false, func(addrs []string) []string { return addrs })
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	waitMembers(t, 3, nodes...)
+
+	// Any node can serve any swarm
+	swarms := map[store.InfoHash][]store.Peer{}
+	for i := 0; i < 30; i++ {
+		ih := store.GenerateTestTorrent().InfoHash
+		for j := 0; j < 3; j++ {
+			p := store.GenerateTestPeer()
+			require.NoError(t, nodes[(i+j)%3].Add(ih, p))
+			swarms[ih] = append(swarms[ih], p)
+		}
+	}
+	requireOwned(t, swarms, nodes...)
+	for ih, peers := range swarms {
+		for _, n := range nodes {
+			found, err := n.GetN(ih, 10, store.PeerFilter{Exclude: peers[0].PeerID})
+			require.NoError(t, err)
+			require.Len(t, found, len(peers)-1)
+			var p store.Peer
+			require.NoError(t, n.Get(&p, ih, peers[1].PeerID))
+			require.Equal(t, peers[1].UserID, p.UserID)
+			require.Equal(t, consts.ErrInvalidPeerID, n.Get(&p, ih, store.GenerateTestPeer().PeerID))
+		}
+	}
+	var ih store.InfoHash
+	for ih = range swarms {
+		break
+	}
+	ph := store.NewPeerHash(ih, swarms[ih][0].PeerID)
+	require.NoError(t, a.Sync(map[store.PeerHash]store.PeerStats{ph: {Left: 1234}}))
+	require.NoError(t, b.Delete(ih, swarms[ih][2].PeerID))
+	var p store.Peer
+	require.NoError(t, c.Get(&p, ih, swarms[ih][0].PeerID))
+	require.Equal(t, uint32(1234), p.Left)
+	require.Equal(t, consts.ErrInvalidPeerID, c.Get(&p, ih, swarms[ih][2].PeerID))
+
+	// Only the configured members can join a static cluster
+	stranger := newTestNodes(t, 1, false, func(_ []string) []string { return []string{a.Addr()} })[0]
+	defer stranger.kill()
+	time.Sleep(time.Millisecond * 100)
+	waitMembers(t, 3, nodes...)
+
+	// Members which stop sending heartbeats are removed
+	c.kill()
+	waitMembers(t, 2, a, b)
+	for _, n := range []*testNode{a, b} {
+		require.NoError(t, n.Close())
+		n.server.Close()
+	}
+}
+
+func TestCluster_Handoff(t *testing.T) {
+	// Every node only knows the first as a seed
+	nodes := newTestNodes(t, 3, true, func(addrs []string) []string { return addrs[:1] })
+	waitMembers(t, 3, nodes...)
+	swarms := map[store.InfoHash][]store.Peer{}
+	for i := 0; i < 30; i++ {
+		ih := store.GenerateTestTorrent().InfoHash
+		for j := 0; j < 3; j++ {
+			p := store.GenerateTestPeer()
+			require.NoError(t, nodes[j].Add(ih, p))
+			swarms[ih] = append(swarms[ih], p)
+		}
+	}
+	requireOwned(t, swarms, nodes...)
+
+	// Joining and leaving members take over and hand off their share of the swarms
+	joined := newTestNodes(t, 1, true, func(_ []string) []string { return []string{nodes[2].Addr()} })[0]
+	nodes = append(nodes, joined)
+	waitMembers(t, 4, nodes...)
+	requireOwned(t, swarms, nodes...)
+	owned := 0
+	for ih := range swarms {
+		if joined.Owner(ih) == joined.Addr() {
+			owned++
+		}
+	}
+	require.True(t, owned > 0, "Joined member owns no swarms")
+	require.NoError(t, joined.Close())
+	joined.server.Close()
+	nodes = nodes[:3]
+	waitMembers(t, 3, nodes...)
+	requireOwned(t, swarms, nodes...)
+	for ih, peers := range swarms {
+		found, err := nodes[1].GetN(ih, 0, store.PeerFilter{})
+		require.NoError(t, err)
+		require.Len(t, found, len(peers), "Peers lost by the handoff")
+	}
+	for _, n := range nodes {
+		n.kill()
+	}
+}
+
+func TestCluster_Secret(t *testing.T) {
+	a := newTestNodes(t, 1, false, func(_ []string) []string { return nil })[0]
+	defer a.kill()
+	opts := DefaultOpts()
+	opts.Addr = "http://127.0.0.1:1"
+	opts.Secret = "wrong"
+	c, err := New(memory.NewPeerStore(), *opts)
+	require.NoError(t, err)
+	err = c.call(a.Addr(), pathPeerAdd, peerMsg{}, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), consts.ErrUnauthorized.Error())
+	_, err = New(memory.NewPeerStore(), Opts{Addr: opts.Addr, Secret: "secret"})
+	require.Error(t, err, "Zero heartbeat interval accepted")
+	opts.Secret = ""
+	_, err = New(memory.NewPeerStore(), *opts)
+	require.Equal(t, consts.ErrInvalidConfig, errors.Cause(err), "Missing secret accepted")
+}
+
+func TestCluster_ReapUntracks(t *testing.T) {
+	n := newTestNodes(t, 1, false, func(_ []string) []string { return nil })[0]
+	defer n.kill()
+	expired := store.GenerateTestTorrent().InfoHash
+	active := store.GenerateTestTorrent().InfoHash
+	p := store.GenerateTestPeer()
+	p.AnnounceLast = time.Now().Add(-time.Hour)
+	require.NoError(t, n.Add(expired, p))
+	require.NoError(t, n.Add(active, p))
+	require.NoError(t, n.Add(active, store.GenerateTestPeer()))
+	require.Len(t, n.Reap(), 2)
+	n.swarmsMu.Lock()
+	defer n.swarmsMu.Unlock()
+	require.NotContains(t, n.swarms, expired)
+	require.Contains(t, n.swarms, active)
+}
+
+// requireStats checks each node only counts the peers stored locally, so the sum over the
+// nodes matches the peers in the cluster
+func requireStats(t *testing.T, nodes []*testNode, trackers []*tracker.Tracker, swarms map[store.InfoHash][]store.Peer,
+	peers int, seeders int) {
+	require.Eventually(t, func() bool {
+		total, totalSeeders := 0, 0
+		for i, n := range nodes {
+			local := 0
+			for ih := range swarms {
+				found, _ := n.local.GetN(ih, 0, store.PeerFilter{})
+				local += len(found)
+			}
+			stats := trackers[i].Stats()
+			if stats.Peers != local {
+				return false
+			}
+			total += stats.Peers
+			totalSeeders += stats.Seeders
+		}
+		return total == peers && totalSeeders == seeders
+	}, time.Second*5, time.Millisecond*10, "Peer stats do not match the cluster")
+}
+
+func TestCluster_PeerStats(t *testing.T) {
+	nodes := newTestNodes(t, 3, true, func(addrs []string) []string { return addrs[:1] })
+	waitMembers(t, 3, nodes...)
+	newTracker := func(n *testNode) *tracker.Tracker {
+		opts := tracker.NewDefaultOpts()
+		opts.Peers = n.Cluster
+		tkr, err := tracker.New(context.Background(), opts)
+		require.NoError(t, err)
+		return tkr
+	}
+	var trackers []*tracker.Tracker
+	for _, n := range nodes {
+		trackers = append(trackers, newTracker(n))
+	}
+	swarms := map[store.InfoHash][]store.Peer{}
+	for i := 0; i < 30; i++ {
+		ih := store.GenerateTestTorrent().InfoHash
+		for j := 0; j < 3; j++ {
+			p := store.GenerateTestPeer()
+			p.Left = 1
+			require.NoError(t, trackers[(i+j)%3].PeerAdd(ih, p))
+			swarms[ih] = append(swarms[ih], p)
+		}
+	}
+	requireOwned(t, swarms, nodes...)
+	requireStats(t, nodes, trackers, swarms, 90, 0)
+
+	// Peers completing on a member not owning their swarm are counted by the owner
+	batch := map[store.PeerHash]store.PeerStats{}
+	for ih, peers := range swarms {
+		batch[store.NewPeerHash(ih, peers[0].PeerID)] = store.PeerStats{Left: 0}
+	}
+	require.NoError(t, trackers[0].PeerSync(batch))
+	requireStats(t, nodes, trackers, swarms, 90, 30)
+
+	// Handed off peers are counted by their new owner only
+	joined := newTestNodes(t, 1, true, func(_ []string) []string { return []string{nodes[0].Addr()} })[0]
+	nodes = append(nodes, joined)
+	trackers = append(trackers, newTracker(joined))
+	waitMembers(t, 4, nodes...)
+	requireOwned(t, swarms, nodes...)
+	requireStats(t, nodes, trackers, swarms, 90, 30)
+	for _, n := range nodes {
+		n.kill()
+	}
+}
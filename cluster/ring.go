@@ -0,0 +1,71 @@
+package cluster
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"github.com/leighmacdonald/mika/store"
+	"sort"
+	"strconv"
+)
+
+// Ring maps info hashes onto the cluster members using consistent hashing. Each member is
+// placed on the ring at multiple points so swarms are spread evenly, and when a member joins
+// or leaves only the swarms between its points and their neighbours change owner.
+type Ring struct {
+	points  []uint64
+	owners  map[uint64]string
+	members []string
+}
+
+// NewRing places each member on the ring replicas times
+func NewRing(replicas int, members []string) *Ring {
+	if replicas <= 0 {
+		replicas = 1
+	}
+	r := &Ring{
+		points:  make([]uint64, 0, replicas*len(members)),
+		owners:  make(map[uint64]string, replicas*len(members)),
+		members: make([]string, len(members)),
+	}
+	copy(r.members, members)
+	sort.Strings(r.members)
+	for _, m := range r.members {
+		for i := 0; i < replicas; i++ {
+			p := hashKey([]byte(m + "#" + strconv.Itoa(i)))
+			// Collisions are resolved in favour of the lowest sorted member so every
+			// node builds the same ring from the same member list
+			if _, exists := r.owners[p]; exists {
+				continue
+			}
+			r.owners[p] = m
+			r.points = append(r.points, p)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Owner returns the member owning the swarm of the info hash, or an empty string if the
+// ring has no members
+func (r *Ring) Owner(ih store.InfoHash) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(ih.Bytes())
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Members returns the sorted members of the ring
+func (r *Ring) Members() []string {
+	return r.members
+}
+
+// hashKey returns the position of the key on the ring
+func hashKey(b []byte) uint64 {
+	sum := sha1.Sum(b)
+	return binary.BigEndian.Uint64(sum[:8])
+}
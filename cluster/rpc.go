@@ -0,0 +1,250 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/store"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	pathGossip     = "/cluster/gossip"
+	pathLeave      = "/cluster/leave"
+	pathSwarm      = "/cluster/swarm"
+	pathPeerAdd    = "/cluster/peer/add"
+	pathPeerDelete = "/cluster/peer/delete"
+	pathPeerGet    = "/cluster/peer/get"
+	pathPeerGetN   = "/cluster/peer/getn"
+	pathPeerSync   = "/cluster/peer/sync"
+)
+
+// rpcErrors are the errors the callers compare against, they are returned as the same
+// values by the client side so forwarding is transparent to the tracker
+var rpcErrors = []error{
+	consts.ErrInvalidPeerID,
+	consts.ErrInvalidTorrentID,
+	consts.ErrInvalidInfoHash,
+	consts.ErrInvalidState,
+}
+
+// rpcError is the body sent with non 2xx responses
+type rpcError struct {
+	Err string `json:"error"`
+}
+
+// gossipMsg carries the heartbeats of the live members known to the sender
+type gossipMsg struct {
+	From    string            `json:"from"`
+	Members map[string]uint64 `json:"members"`
+}
+
+// leaveMsg is sent by a node shutting down, Heartbeat is its last heartbeat
+type leaveMsg struct {
+	Addr      string `json:"addr"`
+	Heartbeat uint64 `json:"heartbeat"`
+}
+
+// swarmMsg carries the peers of a swarm handed off to its new owner
+type swarmMsg struct {
+	InfoHash store.InfoHash `json:"info_hash"`
+	Peers    []store.Peer   `json:"peers"`
+}
+
+// peerMsg is used by the single peer operations, PeerID is set instead of Peer when
+// only the peer id is required
+type peerMsg struct {
+	InfoHash store.InfoHash `json:"info_hash"`
+	PeerID   store.PeerID   `json:"peer_id"`
+	Peer     store.Peer     `json:"peer"`
+}
+
+type getNMsg struct {
+	InfoHash store.InfoHash   `json:"info_hash"`
+	Limit    int              `json:"limit"`
+	Filter   store.PeerFilter `json:"filter"`
+}
+
+// syncEntry is a single entry of a Sync batch, the batch map keys cannot be encoded as JSON
+type syncEntry struct {
+	PeerHash store.PeerHash  `json:"peer_hash"`
+	Stats    store.PeerStats `json:"stats"`
+}
+
+// Handler returns the router serving the RPC requests of the other members. It should only
+// be reachable by the other members.
+func (c *Cluster) Handler() http.Handler {
+	r := gin.New()
+	r.Use(gin.Recovery(), c.authenticate)
+	r.POST(pathGossip, c.gossip)
+	r.POST(pathLeave, c.leaveReq)
+	r.POST(pathSwarm, c.swarmAdd)
+	r.POST(pathPeerAdd, c.peerAdd)
+	r.POST(pathPeerDelete, c.peerDelete)
+	r.POST(pathPeerGet, c.peerGet)
+	r.POST(pathPeerGetN, c.peerGetN)
+	r.POST(pathPeerSync, c.peerSync)
+	return r
+}
+
+func (c *Cluster) authenticate(ctx *gin.Context) {
+	key := ctx.GetHeader("Authorization")
+	if subtle.ConstantTimeCompare([]byte(key), []byte(c.opts.Secret)) != 1 {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, rpcError{Err: consts.ErrUnauthorized.Error()})
+	}
+}
+
+// respond sends the result of a RPC request, errors are sent as a rpcError
+func respond(ctx *gin.Context, err error, result interface{}) {
+	if err != nil {
+		status := http.StatusInternalServerError
+		for _, known := range rpcErrors {
+			if errors.Cause(err) == known {
+				status = http.StatusNotFound
+				break
+			}
+		}
+		ctx.AbortWithStatusJSON(status, rpcError{Err: err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+func bind(ctx *gin.Context, msg interface{}) bool {
+	if err := ctx.BindJSON(msg); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, rpcError{Err: consts.ErrMalformedRequest.Error()})
+		return false
+	}
+	return true
+}
+
+func (c *Cluster) gossip(ctx *gin.Context) {
+	var msg gossipMsg
+	if !bind(ctx, &msg) {
+		return
+	}
+	c.merge(msg)
+	respond(ctx, nil, c.gossipState())
+	// Any handoff is performed in the background so the sender is not kept waiting
+	go c.updateRing()
+}
+
+func (c *Cluster) leaveReq(ctx *gin.Context) {
+	var msg leaveMsg
+	if !bind(ctx, &msg) {
+		return
+	}
+	c.leave(msg.Addr, msg.Heartbeat)
+	respond(ctx, nil, nil)
+	go c.updateRing()
+}
+
+func (c *Cluster) swarmAdd(ctx *gin.Context) {
+	var msg swarmMsg
+	if !bind(ctx, &msg) {
+		return
+	}
+	for _, p := range msg.Peers {
+		if err := c.addLocal(msg.InfoHash, p); err != nil {
+			respond(ctx, err, nil)
+			return
+		}
+	}
+	respond(ctx, nil, nil)
+}
+
+func (c *Cluster) peerAdd(ctx *gin.Context) {
+	var msg peerMsg
+	if !bind(ctx, &msg) {
+		return
+	}
+	respond(ctx, c.addLocal(msg.InfoHash, msg.Peer), nil)
+}
+
+func (c *Cluster) peerDelete(ctx *gin.Context) {
+	var msg peerMsg
+	if !bind(ctx, &msg) {
+		return
+	}
+	respond(ctx, c.deleteLocal(msg.InfoHash, msg.PeerID), nil)
+}
+
+func (c *Cluster) peerGet(ctx *gin.Context) {
+	var msg peerMsg
+	if !bind(ctx, &msg) {
+		return
+	}
+	var peer store.Peer
+	respond(ctx, c.local.Get(&peer, msg.InfoHash, msg.PeerID), peer)
+}
+
+func (c *Cluster) peerGetN(ctx *gin.Context) {
+	var msg getNMsg
+	if !bind(ctx, &msg) {
+		return
+	}
+	peers, err := c.local.GetN(msg.InfoHash, msg.Limit, msg.Filter)
+	respond(ctx, err, peers)
+}
+
+func (c *Cluster) peerSync(ctx *gin.Context) {
+	var entries []syncEntry
+	if !bind(ctx, &entries) {
+		return
+	}
+	batch := make(map[store.PeerHash]store.PeerStats, len(entries))
+	for _, e := range entries {
+		batch[e.PeerHash] = e.Stats
+	}
+	respond(ctx, c.syncLocal(batch), nil)
+}
+
+// call sends the RPC request to the member, decoding the response into recv if not nil
+func (c *Cluster) call(addr string, path string, msg interface{}, recv interface{}) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode cluster request")
+	}
+	req, err := http.NewRequest(http.MethodPost, addr+path, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Failed to create cluster request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", c.opts.Secret)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "Cluster request to %s failed", addr)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err.Error())
+		}
+	}()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "Could not read cluster response body")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var rpcErr rpcError
+		if err := json.Unmarshal(respBody, &rpcErr); err != nil || rpcErr.Err == "" {
+			return errors.Wrapf(consts.ErrBadResponseCode, "Cluster request to %s failed", addr)
+		}
+		for _, known := range rpcErrors {
+			if rpcErr.Err == known.Error() {
+				return known
+			}
+		}
+		return errors.Errorf("Cluster request to %s failed: %s", addr, rpcErr.Err)
+	}
+	if recv != nil {
+		if err := json.Unmarshal(respBody, recv); err != nil {
+			return errors.Wrap(err, "Could not decode cluster response body")
+		}
+	}
+	return nil
+}
@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // clientCmd represents the client command
@@ -53,6 +54,29 @@ var pingCmd = &cobra.Command{
 	},
 }
 
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show the current tracker stats",
+	Long:  "Show the current tracker stats",
+	Run: func(cmd *cobra.Command, args []string) {
+		s, err := newClient(cmd).Stats()
+		if err != nil {
+			log.Fatalf("Failed to fetch stats: %s", err.Error())
+		}
+		fmt.Printf("Started:       %s (%s)\n", s.Started.Format(time.RFC3339),
+			time.Since(s.Started).Round(time.Second))
+		fmt.Printf("Torrents:      %d\n", s.Torrents)
+		fmt.Printf("Swarms:        %d\n", s.Swarms)
+		fmt.Printf("Seeders:       %d\n", s.Seeders)
+		fmt.Printf("Leechers:      %d\n", s.Leechers)
+		fmt.Printf("Peers:         %d (ipv4: %d ipv6: %d)\n", s.Peers, s.PeersIPv4, s.PeersIPv6)
+		fmt.Printf("Active Users:  %d\n", s.Users)
+		fmt.Printf("Announces:     %d (%.2f/sec)\n", s.Announces, s.AnnouncesPerSec)
+		fmt.Printf("Uploaded:      %s\n", util.HumanIBytesString(s.Uploaded))
+		fmt.Printf("Downloaded:    %s\n", util.HumanIBytesString(s.Downloaded))
+	},
+}
+
 // torrentCmd represents the base client torrent command set
 var torrentCmd = &cobra.Command{
 	Use:     "torrent",
@@ -220,12 +244,96 @@ var userDeleteCmd = &cobra.Command{
 	},
 }
 
+// banCmd represents the base client ban command set
+var banCmd = &cobra.Command{
+	Use:     "ban",
+	Aliases: []string{"b"},
+	Short:   "IP/CIDR ban related operations",
+	Long:    "IP/CIDR ban related operations",
+}
+
+var banAddCmd = &cobra.Command{
+	Use:     "add",
+	Aliases: []string{"a"},
+	Short:   "Ban one or more addresses or networks",
+	Long:    "Ban one or more addresses or networks, eg: mika client ban add 1.2.3.4 10.0.0.0/8 -r spam -d 24h",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return errors.New("requires at least 1 address or network")
+		}
+		for _, cidr := range args {
+			if _, err := store.ParseBanCIDR(cidr); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		c := newClient(cmd)
+		reason := cmd.Flag("reason").Value.String()
+		createdBy := cmd.Flag("by").Value.String()
+		duration, err := cmd.Flags().GetDuration("duration")
+		if err != nil {
+			log.Fatalf("Invalid duration: %s", err.Error())
+		}
+		for _, cidr := range args {
+			ban, err := store.NewBan(cidr, reason, createdBy, duration)
+			if err != nil {
+				log.Fatalf(err.Error())
+			}
+			if err := c.BanAdd(ban); err != nil {
+				log.Fatalf("Error trying to ban %s: %s", cidr, err.Error())
+			}
+			log.Infof("Banned: %s", ban.CIDR)
+		}
+	},
+}
+
+var banDeleteCmd = &cobra.Command{
+	Use:     "delete",
+	Aliases: []string{"del", "d"},
+	Short:   "Remove the ban for one or more addresses or networks",
+	Long:    "Remove the ban for one or more addresses or networks",
+	Args:    cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c := newClient(cmd)
+		for _, cidr := range args {
+			if err := c.BanDelete(cidr); err != nil {
+				log.Fatalf("Error trying to remove ban %s: %s", cidr, err.Error())
+			}
+		}
+	},
+}
+
+var banListCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls", "l"},
+	Short:   "List all bans",
+	Long:    "List all bans",
+	Run: func(cmd *cobra.Command, args []string) {
+		bans, err := newClient(cmd).BanGetAll()
+		if err != nil {
+			log.Fatalf("Failed to fetch bans: %s", err.Error())
+		}
+		for _, ban := range bans {
+			expires := "never"
+			if !ban.Expires.IsZero() {
+				expires = ban.Expires.Format(time.RFC3339)
+			}
+			fmt.Printf("%-43s %-20s %-25s %s\n", ban.CIDR, ban.CreatedBy, expires, ban.Reason)
+		}
+	},
+}
+
 func init() {
 	clientCmd.PersistentFlags().StringP("host", "H", "localhost:34001", "Tracker host")
 	clientCmd.PersistentFlags().StringP("key", "k", "", "Tracker key")
 	userAddCmd.PersistentFlags().StringP("passkey", "P", "", "User Passkey")
 	userAddCmd.PersistentFlags().StringP("id", "u", "", "Your internal user ID")
 	userDeleteCmd.PersistentFlags().StringP("passkey", "P", "", "User Passkey")
+	banAddCmd.PersistentFlags().StringP("reason", "r", "Banned", "Reason displayed to the client")
+	banAddCmd.PersistentFlags().DurationP("duration", "d", 0, "How long the ban lasts, 0 is permanent")
+	banAddCmd.PersistentFlags().StringP("by", "b", util.CurrentUser(), "Name of the admin creating the ban")
 
 	torrentCmd.AddCommand(torrentAddCmd)
 	torrentCmd.AddCommand(torrentAddFileCmd)
@@ -233,7 +341,12 @@ func init() {
 	userCmd.AddCommand(userAddCmd)
 	userCmd.AddCommand(userDeleteCmd)
 	clientCmd.AddCommand(pingCmd)
+	clientCmd.AddCommand(statsCmd)
 	clientCmd.AddCommand(torrentCmd)
+	banCmd.AddCommand(banAddCmd)
+	banCmd.AddCommand(banDeleteCmd)
+	banCmd.AddCommand(banListCmd)
 	clientCmd.AddCommand(userCmd)
+	clientCmd.AddCommand(banCmd)
 	rootCmd.AddCommand(clientCmd)
 }
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/leighmacdonald/mika/config"
+	"github.com/leighmacdonald/mika/journal"
+	"github.com/leighmacdonald/mika/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"time"
+)
+
+// newJournalOpts returns the configured journal options for the path provided
+func newJournalOpts(path string) journal.Opts {
+	return journal.Opts{
+		Dir:          path,
+		SegmentSize:  int64(config.GetInt(config.TrackerJournalSegmentSize)),
+		SyncInterval: config.GetDuration(config.TrackerJournalSyncInterval),
+	}
+}
+
+// openJournal opens the journal at the --path flag, or the configured path if not set
+func openJournal(cmd *cobra.Command, readOnly bool) *journal.Journal {
+	path, err := cmd.Flags().GetString("path")
+	if err != nil {
+		log.Fatalf("Failed to read path flag: %s", err)
+	}
+	if path == "" {
+		path = config.GetString(config.TrackerJournalPath)
+	}
+	if path == "" {
+		log.Fatalf("No journal path configured, set tracker_journal_path or use --path")
+	}
+	if !util.Exists(path) {
+		log.Fatalf("Journal path does not exist: %s", path)
+	}
+	opts := newJournalOpts(path)
+	opts.ReadOnly = readOnly
+	j, err := journal.Open(opts)
+	if err != nil {
+		log.Fatalf("Failed to open journal: %s", err)
+	}
+	return j
+}
+
+// journalCmd represents the journal command
+var journalCmd = &cobra.Command{
+	Use:   "journal",
+	Short: "Inspect and maintain the stat update journal",
+	Long: `Inspect and maintain the write-ahead journal of stat updates.
+The tracker must be stopped before compacting the journal.`,
+}
+
+var journalInspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "Show the journal segments and unacknowledged updates",
+	Long:  `Show the journal segments and unacknowledged updates`,
+	Run: func(cmd *cobra.Command, args []string) {
+		j := openJournal(cmd, true)
+		defer func() {
+			if err := j.Close(); err != nil {
+				log.Errorf("Failed to close journal: %s", err)
+			}
+		}()
+		segments, err := j.Segments()
+		if err != nil {
+			log.Fatalf("Failed to read journal segments: %s", err)
+		}
+		fmt.Printf("%-25s %-12s %-12s %-8s %-10s %s\n", "Segment", "First", "Last", "Records", "Size", "Corrupt")
+		for _, s := range segments {
+			fmt.Printf("%-25s %-12d %-12d %-8d %-10s %t\n", s.Name, s.First, s.Last, s.Records,
+				util.HumanIBytesString(uint64(s.Size)), s.Corrupt)
+		}
+		records, _ := cmd.Flags().GetBool("records")
+		unacked := 0
+		if err := j.Replay(func(r journal.Record) error {
+			unacked++
+			if records {
+				fmt.Printf("%d %s %s %s up=%d down=%d left=%d event=%q paused=%t\n",
+					r.Seq, r.State.Timestamp.Format(time.RFC3339), r.State.InfoHash.String(),
+					r.State.Passkey, r.State.Uploaded, r.State.Downloaded, r.State.Left,
+					r.State.Event, r.State.Paused)
+			}
+			return nil
+		}); err != nil {
+			log.Fatalf("Failed to read journal: %s", err)
+		}
+		fmt.Printf("Last seq: %d Acknowledged: %d Unacknowledged records: %d\n",
+			j.Seq(), j.Acked(), unacked)
+	},
+}
+
+var journalCompactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Remove acknowledged updates from the journal",
+	Long: `Remove acknowledged updates from the journal.
+This must only be run while the tracker is stopped.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		j := openJournal(cmd, false)
+		before, err := j.Segments()
+		if err != nil {
+			log.Fatalf("Failed to read journal segments: %s", err)
+		}
+		if err := j.Compact(); err != nil {
+			log.Fatalf("Failed to compact journal: %s", err)
+		}
+		after, err := j.Segments()
+		if err != nil {
+			log.Fatalf("Failed to read journal segments: %s", err)
+		}
+		if err := j.Close(); err != nil {
+			log.Fatalf("Failed to close journal: %s", err)
+		}
+		log.Infof("Compacted journal from %d to %d segments", len(before), len(after))
+	},
+}
+
+func init() {
+	journalCmd.PersistentFlags().StringP("path", "p", "", "Journal directory (default is tracker_journal_path)")
+	journalInspectCmd.Flags().BoolP("records", "r", false, "Print each unacknowledged record")
+	journalCmd.AddCommand(journalInspectCmd)
+	journalCmd.AddCommand(journalCompactCmd)
+	rootCmd.AddCommand(journalCmd)
+}
@@ -2,13 +2,16 @@ package cmd
 
 import (
 	"context"
+	"github.com/leighmacdonald/mika/cluster"
 	"github.com/leighmacdonald/mika/config"
 	"github.com/leighmacdonald/mika/geo"
+	"github.com/leighmacdonald/mika/journal"
 	"github.com/leighmacdonald/mika/store"
 	"github.com/leighmacdonald/mika/tracker"
 	"github.com/leighmacdonald/mika/util"
 	"github.com/spf13/cobra"
 	"log"
+	"net"
 	"net/http"
 )
 
@@ -27,11 +30,40 @@ var serveCmd = &cobra.Command{
 		opts.AnnInterval = config.GetDuration(config.TrackerAnnounceInterval)
 		opts.AnnIntervalMin = config.GetDuration(config.TrackerAnnounceIntervalMin)
 		opts.AllowNonRoutable = config.GetBool(config.TrackerAllowNonRoutable)
+		opts.IPv6 = config.GetBool(config.TrackerIPv6)
+		trustedProxies, errTP := util.ParseCIDRs(config.GetStringSlice(config.TrackerTrustedProxies))
+		if errTP != nil {
+			log.Fatalf("Invalid trusted proxy list: %s", errTP)
+		}
+		opts.TrustedProxies = trustedProxies
+		opts.ProxyHeader = config.GetString(config.TrackerProxyHeader)
+		opts.IPv6Only = config.GetBool(config.TrackerIPv6Only)
+		opts.RateLimitIP = config.GetFloat64(config.TrackerRateLimitIP)
+		opts.RateLimitIPBurst = config.GetInt(config.TrackerRateLimitIPBurst)
+		opts.RateLimitPasskey = config.GetFloat64(config.TrackerRateLimitPasskey)
+		opts.RateLimitPasskeyBurst = config.GetInt(config.TrackerRateLimitPasskeyBurst)
+		opts.HealthEndpoints = config.GetBool(config.TrackerHealthEndpoints)
 		opts.AutoRegister = config.GetBool(config.TrackerAutoRegister)
 		opts.Public = config.GetBool(config.TrackerPublic)
 		opts.TorrentCacheEnabled = config.GetBool(config.StoreTorrentCache)
 		opts.PeerCacheEnabled = config.GetBool(config.StorePeersCache)
 		opts.UserCacheEnabled = config.GetBool(config.StoreUsersCache)
+		negativeTTL := config.GetDuration(config.StoreCacheNegativeTTL)
+		opts.TorrentCache = store.CacheOpts{
+			MaxEntries:  config.GetInt(config.StoreTorrentCacheSize),
+			TTL:         config.GetDuration(config.StoreTorrentCacheTTL),
+			NegativeTTL: negativeTTL,
+		}
+		opts.PeerCache = store.CacheOpts{
+			MaxEntries: config.GetInt(config.StorePeersCacheSize),
+			TTL:        config.GetDuration(config.StorePeersCacheTTL),
+		}
+		opts.UserCache = store.CacheOpts{
+			MaxEntries:  config.GetInt(config.StoreUsersCacheSize),
+			TTL:         config.GetDuration(config.StoreUsersCacheTTL),
+			NegativeTTL: negativeTTL,
+		}
+		opts.CacheRefreshInterval = config.GetDuration(config.StoreCacheRefreshInterval)
 		ts, err := store.NewTorrentStore(
 			config.GetString(config.StoreTorrentType),
 			config.GetStoreConfig(config.Torrent))
@@ -45,6 +77,27 @@ var serveCmd = &cobra.Command{
 			log.Fatalf("Failed to setup peer store: %s", err2)
 		}
 		opts.Peers = p
+		var cl *cluster.Cluster
+		if config.GetBool(config.ClusterEnabled) {
+			clusterOpts := cluster.DefaultOpts()
+			clusterOpts.Addr = config.GetString(config.ClusterAdvertise)
+			clusterOpts.Members = config.GetStringSlice(config.ClusterMembers)
+			clusterOpts.Gossip = config.GetBool(config.ClusterGossip)
+			clusterOpts.HeartbeatInterval = config.GetDuration(config.ClusterHeartbeatInterval)
+			clusterOpts.DeadTimeout = config.GetDuration(config.ClusterDeadTimeout)
+			clusterOpts.Replicas = config.GetInt(config.ClusterReplicas)
+			clusterOpts.Secret = config.GetString(config.ClusterSecret)
+			cl, err = cluster.New(p, *clusterOpts)
+			if err != nil {
+				log.Fatalf("Failed to setup cluster: %s", err)
+			}
+			opts.Peers = cl
+			// Swarms owned by other nodes change without this node seeing it
+			if opts.PeerCacheEnabled {
+				log.Printf("Peer cache is not used when clustering is enabled")
+				opts.PeerCacheEnabled = false
+			}
+		}
 		u, err3 := store.NewUserStore(config.GetString(config.StoreUsersType),
 			config.GetStoreConfig(config.Users))
 		if err3 != nil {
@@ -61,44 +114,149 @@ var serveCmd = &cobra.Command{
 			geodb = &geo.DummyProvider{}
 		}
 		opts.Geodb = geodb
+		if journalPath := config.GetString(config.TrackerJournalPath); journalPath != "" {
+			j, errJ := journal.Open(newJournalOpts(journalPath))
+			if errJ != nil {
+				log.Fatalf("Failed to open journal: %s", errJ)
+			}
+			opts.Journal = j
+		}
+		if busType := config.GetString(config.StoreCacheBusType); busType != "" {
+			busStore, errBS := config.ParseStoreType(config.GetString(config.StoreCacheBusStore))
+			if errBS != nil {
+				log.Fatalf("Invalid cache bus store: %s", config.GetString(config.StoreCacheBusStore))
+			}
+			bus, errB := store.NewInvalidationBus(busType, config.GetStoreConfig(busStore))
+			if errB != nil {
+				log.Fatalf("Failed to setup cache invalidation bus: %s", errB)
+			}
+			opts.Bus = bus
+		}
+		queuePolicy, errQ := tracker.ParseQueuePolicy(config.GetString(config.TrackerQueuePolicy))
+		if errQ != nil {
+			log.Fatalf("Invalid queue policy: %s", config.GetString(config.TrackerQueuePolicy))
+		}
+		opts.StatWorkers = config.GetInt(config.TrackerStatWorkers)
+		opts.QueueSize = config.GetInt(config.TrackerQueueSize)
+		opts.QueuePolicy = queuePolicy
+		opts.QueueTimeout = config.GetDuration(config.TrackerQueueTimeout)
+		opts.OverloadThreshold = config.GetFloat64(config.TrackerOverloadThreshold)
+		opts.OverloadFactor = config.GetFloat64(config.TrackerOverloadIntervalFactor)
+		if queuePolicy == tracker.QueueSpill {
+			spillPath := config.GetString(config.TrackerQueueSpillPath)
+			if spillPath == "" {
+				log.Fatalf("The spill queue policy requires tracker_queue_spill_path to be set")
+			}
+			spill, errS := journal.Open(newJournalOpts(spillPath))
+			if errS != nil {
+				log.Fatalf("Failed to open spill journal: %s", errS)
+			}
+			opts.Spill = spill
+		}
+		var policy geo.Policy
+		if err := config.UnmarshalKey(config.GeodbPolicy, &policy); err != nil {
+			log.Fatalf("Failed to read geo policy: %s", err)
+		}
+		if err := policy.Validate(); err != nil {
+			log.Fatalf("Invalid geo policy: %s", err)
+		}
+		opts.GeoPolicy = &policy
 		tkr, err4 := tracker.New(ctx, opts)
 		if err4 != nil {
 			log.Fatalf("Failed to initialize tracker: %s", err)
 		}
 		_ = tkr.LoadWhitelist()
+		if err := tkr.LoadBans(); err != nil {
+			log.Fatalf("Failed to load bans: %s", err)
+		}
 
 		btOpts := tracker.DefaultHTTPOpts()
 		btOpts.ListenAddr = config.GetString(config.TrackerListen)
 		btOpts.UseTLS = config.GetBool(config.TrackerTLS)
 		btOpts.Handler = tracker.NewBitTorrentHandler(tkr)
+		btOpts.ProxyProtocol = config.GetBool(config.TrackerProxyProtocol)
+		btOpts.ProxyTrusted, err = util.ParseCIDRs(config.GetStringSlice(config.TrackerProxyProtocolTrusted))
+		if err != nil {
+			log.Fatalf("Invalid tracker PROXY protocol trusted list: %s", err)
+		}
 		btServer := tracker.NewHTTPServer(btOpts)
+		btListener, err := tracker.NewListener(btOpts)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %s", btOpts.ListenAddr, err)
+		}
 
 		apiOpts := tracker.DefaultHTTPOpts()
 		apiOpts.ListenAddr = config.GetString(config.APIListen)
 		apiOpts.UseTLS = config.GetBool(config.APITLS)
 		apiOpts.Handler = tracker.NewAPIHandler(tkr)
+		apiOpts.ProxyProtocol = config.GetBool(config.APIProxyProtocol)
+		apiOpts.ProxyTrusted, err = util.ParseCIDRs(config.GetStringSlice(config.APIProxyProtocolTrusted))
+		if err != nil {
+			log.Fatalf("Invalid API PROXY protocol trusted list: %s", err)
+		}
 		apiServer := tracker.NewHTTPServer(apiOpts)
+		apiListener, err := tracker.NewListener(apiOpts)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %s", apiOpts.ListenAddr, err)
+		}
+
+		var clusterServer *http.Server
+		var clusterListener net.Listener
+		if cl != nil {
+			clusterOpts := tracker.DefaultHTTPOpts()
+			clusterOpts.ListenAddr = config.GetString(config.ClusterListen)
+			clusterOpts.Handler = cl.Handler()
+			clusterServer = tracker.NewHTTPServer(clusterOpts)
+			clusterListener, err = tracker.NewListener(clusterOpts)
+			if err != nil {
+				log.Fatalf("Failed to listen on %s: %s", clusterOpts.ListenAddr, err)
+			}
+		}
 
 		go tkr.PeerReaper()
+		go tkr.CacheRefresher()
 		go tkr.StatWorker()
 
 		go func() {
-			if err := btServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			if err := btServer.Serve(btListener); err != nil && err != http.ErrServerClosed {
 				log.Fatalf("listen: %s\n", err)
 			}
 		}()
 
 		go func() {
-			if err := apiServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			if err := apiServer.Serve(apiListener); err != nil && err != http.ErrServerClosed {
 				log.Fatalf("listen: %s\n", err)
 			}
 		}()
 
+		if cl != nil {
+			go func() {
+				if err := clusterServer.Serve(clusterListener); err != nil && err != http.ErrServerClosed {
+					log.Fatalf("listen: %s\n", err)
+				}
+			}()
+			go cl.Run()
+		}
+
 		util.WaitForSignal(ctx, func(ctx context.Context) error {
+			// Stop accepting announces first so nothing new is queued for the StatWorker
+			if err := btServer.Shutdown(ctx); err != nil {
+				log.Printf("Error closing tracker server gracefully: %s", err)
+			}
 			if err := apiServer.Shutdown(ctx); err != nil {
-				log.Fatalf("Error closing servers gracefully; %s", err)
+				log.Printf("Error closing API server gracefully: %s", err)
+			}
+			// Drains the queued stat updates, performs the final store syncs and closes
+			// the stores and geo database
+			err := tkr.Shutdown(ctx)
+			// Closing the peer store left the cluster, the other nodes may have still been
+			// forwarding requests until then
+			if clusterServer != nil {
+				if err := clusterServer.Shutdown(ctx); err != nil {
+					log.Printf("Error closing cluster server gracefully: %s", err)
+				}
 			}
-			return nil
+			return err
 		})
 	},
 }
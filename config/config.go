@@ -80,6 +80,73 @@ const (
 
 	TrackerAllowClientIP Key = "tracker_allow_client_ip"
 
+	// TrackerTrustedProxies is a list of proxy addresses or networks which are allowed to set
+	// the client address using the TrackerProxyHeader
+	// [10.0.0.0/8, 192.168.1.10]
+	TrackerTrustedProxies Key = "tracker_trusted_proxies"
+	// TrackerProxyHeader is the single header read for the client address on requests from a
+	// trusted proxy. It must be one the proxies overwrite or append to.
+	// X-Forwarded-For|Forwarded|X-Real-IP
+	TrackerProxyHeader Key = "tracker_proxy_header"
+	// TrackerProxyProtocol enables HAProxy PROXY protocol (v1 & v2) support on the tracker listener
+	// true|false
+	TrackerProxyProtocol Key = "tracker_proxy_protocol"
+	// TrackerProxyProtocolTrusted is a list of upstream addresses or networks allowed to send PROXY headers
+	// [10.0.0.0/8, 192.168.1.10]
+	TrackerProxyProtocolTrusted Key = "tracker_proxy_protocol_trusted"
+	// TrackerRateLimitIP is the number of announce/scrape requests per second allowed from a single
+	// address, ipv6 addresses are limited by their /64 network. 0 disables the limit.
+	// 2.5
+	TrackerRateLimitIP Key = "tracker_rate_limit_ip"
+	// TrackerRateLimitIPBurst is the number of requests a single address can make in a burst
+	// 20
+	TrackerRateLimitIPBurst Key = "tracker_rate_limit_ip_burst"
+	// TrackerRateLimitPasskey is the number of announce/scrape requests per second allowed for a
+	// single passkey. 0 disables the limit.
+	// 5
+	TrackerRateLimitPasskey Key = "tracker_rate_limit_passkey"
+	// TrackerRateLimitPasskeyBurst is the number of requests a single passkey can make in a burst
+	// 50
+	TrackerRateLimitPasskeyBurst Key = "tracker_rate_limit_passkey_burst"
+	// TrackerHealthEndpoints serves the /healthz and /readyz checks on the tracker listener in
+	// addition to the API listener
+	// true|false
+	TrackerHealthEndpoints Key = "tracker_health_endpoints"
+	// TrackerJournalPath is the directory of the write-ahead journal of stat updates. An empty
+	// path disables the journal.
+	// ./journal
+	TrackerJournalPath Key = "tracker_journal_path"
+	// TrackerJournalSegmentSize is the size in bytes at which a new journal segment is started
+	// 67108864
+	TrackerJournalSegmentSize Key = "tracker_journal_segment_size"
+	// TrackerJournalSyncInterval is how often journal writes are fsynced, 0 syncs every write
+	// 1s
+	TrackerJournalSyncInterval Key = "tracker_journal_sync_interval"
+	// TrackerStatWorkers is the number of workers summing stat updates in parallel, each
+	// handling the swarms selected by info_hash
+	// 4
+	TrackerStatWorkers Key = "tracker_stat_workers"
+	// TrackerQueueSize is the capacity of the queue of stat updates waiting to be batched
+	// 1000
+	TrackerQueueSize Key = "tracker_queue_size"
+	// TrackerQueuePolicy is what happens to stat updates when the queue is full
+	// block|drop|spill
+	TrackerQueuePolicy Key = "tracker_queue_policy"
+	// TrackerQueueTimeout is how long the block policy waits for space before dropping the
+	// update, 0 waits forever
+	// 100ms
+	TrackerQueueTimeout Key = "tracker_queue_timeout"
+	// TrackerQueueSpillPath is the directory the spill policy writes stat updates to
+	// ./spill
+	TrackerQueueSpillPath Key = "tracker_queue_spill_path"
+	// TrackerOverloadThreshold is the fraction of the queue in use at which the tracker is
+	// considered overloaded, 0 disables it
+	// 0.8
+	TrackerOverloadThreshold Key = "tracker_overload_threshold"
+	// TrackerOverloadIntervalFactor scales the announce intervals sent to clients while overloaded
+	// 2
+	TrackerOverloadIntervalFactor Key = "tracker_overload_interval_factor"
+
 	// TrackerMaxPeers sets the max number of peers to return on an announce
 	TrackerMaxPeers Key = "tracker_max_peers"
 
@@ -95,6 +162,12 @@ const (
 	// APIIPv6Only disabled ipv4 to the admin interface
 	// true|false
 	APIIPv6Only Key = "api_ipv6_only"
+	// APIProxyProtocol enables HAProxy PROXY protocol (v1 & v2) support on the admin API listener
+	// true|false
+	APIProxyProtocol Key = "api_proxy_protocol"
+	// APIProxyProtocolTrusted is a list of upstream addresses or networks allowed to send PROXY headers
+	// [10.0.0.0/8, 192.168.1.10]
+	APIProxyProtocolTrusted Key = "api_proxy_protocol_trusted"
 	// APIKey Basic key authentication token for API calls
 	APIKey Key = "api_key"
 	// StoreTorrentType sets the backing store type to be used for torrents
@@ -120,6 +193,13 @@ const (
 	StoreTorrentProperties Key = "store_torrent_properties"
 	// StoreTorrentCache enabled the in-memory cache
 	StoreTorrentCache Key = "store_torrent_cache"
+	// StoreTorrentCacheSize is the max number of cached torrents, the least recently used are evicted
+	// once full. 0 is unbounded
+	// 100000
+	StoreTorrentCacheSize Key = "store_torrent_cache_size"
+	// StoreTorrentCacheTTL is how long cached torrents are served before expiring, 0 never expires
+	// 5m
+	StoreTorrentCacheTTL Key = "store_torrent_cache_ttl"
 
 	// StoreUsersType sets the backing store type to be used for users
 	// memory|redis|postgres|mysql|http
@@ -144,6 +224,13 @@ const (
 	StoreUsersProperties Key = "store_users_properties"
 	// StoreUsersCache enabled the in-memory cache
 	StoreUsersCache Key = "store_users_cache"
+	// StoreUsersCacheSize is the max number of cached users, the least recently used are evicted
+	// once full. 0 is unbounded
+	// 100000
+	StoreUsersCacheSize Key = "store_users_cache_size"
+	// StoreUsersCacheTTL is how long cached users are served before expiring, 0 never expires
+	// 5m
+	StoreUsersCacheTTL Key = "store_users_cache_ttl"
 
 	// StorePeersType sets the backing store type to be used for peers
 	// memory|redis|postgres|mysql|http
@@ -168,6 +255,57 @@ const (
 	StorePeersProperties Key = "store_peers_properties"
 	// StorePeersCache enabled the in-memory cache
 	StorePeersCache Key = "store_peers_cache"
+	// StorePeersCacheSize is the max number of cached peers, the least recently used are evicted
+	// once full. 0 is unbounded
+	// 500000
+	StorePeersCacheSize Key = "store_peers_cache_size"
+	// StorePeersCacheTTL is how long cached peers are served before expiring, 0 never expires
+	// 10m
+	StorePeersCacheTTL Key = "store_peers_cache_ttl"
+	// StoreCacheNegativeTTL is how long unknown passkeys and info_hashes are cached, 0 disables
+	// negative caching
+	// 30s
+	StoreCacheNegativeTTL Key = "store_cache_negative_ttl"
+	// StoreCacheRefreshInterval is how often cached torrents and users in use are reloaded
+	// from the backing store before they expire
+	// 30s
+	StoreCacheRefreshInterval Key = "store_cache_refresh_interval"
+	// StoreCacheBusType sets the transport used to invalidate the caches of the other tracker
+	// nodes when data is changed, empty disables it. The postgres bus also delivers changes
+	// made directly to the database by other applications.
+	// memory|redis|postgres
+	StoreCacheBusType Key = "store_cache_bus_type"
+	// StoreCacheBusStore selects the store whose connection settings are used by the bus
+	// torrent|peers|users
+	StoreCacheBusStore Key = "store_cache_bus_store"
+	// ClusterEnabled shares the peer swarms between several tracker nodes, each swarm being
+	// owned by a single node chosen by consistent hashing of its info_hash
+	// true|false
+	ClusterEnabled Key = "cluster_enabled"
+	// ClusterListen sets the host and port the internal cluster RPC should bind to
+	// :34002
+	ClusterListen Key = "cluster_listen"
+	// ClusterAdvertise is the base URL the other nodes reach this node's cluster RPC on
+	// http://10.0.0.1:34002
+	ClusterAdvertise Key = "cluster_advertise"
+	// ClusterMembers are the base URLs of the other nodes, only used as seeds when gossip is enabled
+	// [http://10.0.0.2:34002, http://10.0.0.3:34002]
+	ClusterMembers Key = "cluster_members"
+	// ClusterGossip enables discovery of nodes not listed in the members
+	// true|false
+	ClusterGossip Key = "cluster_gossip"
+	// ClusterHeartbeatInterval is how often the nodes exchange heartbeats
+	// 1s
+	ClusterHeartbeatInterval Key = "cluster_heartbeat_interval"
+	// ClusterDeadTimeout is how long a node can miss heartbeats before its swarms are taken over
+	// 10s
+	ClusterDeadTimeout Key = "cluster_dead_timeout"
+	// ClusterReplicas is the number of points each node has on the hash ring
+	// 128
+	ClusterReplicas Key = "cluster_replicas"
+	// ClusterSecret is the shared key the nodes must send with cluster RPC requests, required
+	// when clustering is enabled
+	ClusterSecret Key = "cluster_secret"
 	// GeodbPath sets the path to use for downloading and loading the geo database. Relative to the binary's path.
 	// ./path/to/file.mmdb
 	GeodbPath Key = "geodb_path"
@@ -177,6 +315,9 @@ const (
 	// GeodbEnabled toggles use of the geo database
 	// true|false
 	GeodbEnabled Key = "geodb_enabled"
+	// GeodbPolicy defines the country/ASN allow/deny rules applied to peers, see mika.yaml.dist
+	// {default: allow, rules: [{name: embargo, countries: [KP], action: deny}]}
+	GeodbPolicy Key = "geodb_policy"
 )
 
 // StoreConfig provides a common config struct for backing stores
@@ -210,6 +351,20 @@ func (c StoreConfig) DSN() string {
 	return u.String()
 }
 
+// ParseStoreType returns the StoreType matching the store config prefix name
+func ParseStoreType(s string) (StoreType, error) {
+	switch s {
+	case "torrent":
+		return Torrent, nil
+	case "peers":
+		return Peers, nil
+	case "users":
+		return Users, nil
+	default:
+		return Torrent, consts.ErrInvalidConfig
+	}
+}
+
 // GetStoreConfig returns the config options for the store type provided
 func GetStoreConfig(storeType StoreType) *StoreConfig {
 	switch storeType {
@@ -261,6 +416,21 @@ func GetInt(key Key) int {
 	return viper.GetInt(string(key))
 }
 
+// GetFloat64 enforces use of our consts for config keys
+func GetFloat64(key Key) float64 {
+	return viper.GetFloat64(string(key))
+}
+
+// GetStringSlice enforces use of our consts for config keys
+func GetStringSlice(key Key) []string {
+	return viper.GetStringSlice(string(key))
+}
+
+// UnmarshalKey decodes a nested config value into the struct provided
+func UnmarshalKey(key Key, out interface{}) error {
+	return viper.UnmarshalKey(string(key), out)
+}
+
 // GetDuration enforces use of our consts for config keys
 func GetDuration(key Key) time.Duration {
 	return viper.GetDuration(string(key))
@@ -327,11 +497,32 @@ func init() {
 	viper.SetDefault(string(TrackerBatchUpdateInterval), "30s")
 	viper.SetDefault(string(TrackerAllowNonRoutable), false)
 	viper.SetDefault(string(TrackerAllowClientIP), false)
+	viper.SetDefault(string(TrackerTrustedProxies), []string{})
+	viper.SetDefault(string(TrackerProxyHeader), "X-Forwarded-For")
+	viper.SetDefault(string(TrackerProxyProtocol), false)
+	viper.SetDefault(string(TrackerProxyProtocolTrusted), []string{})
+	viper.SetDefault(string(TrackerRateLimitIP), 0)
+	viper.SetDefault(string(TrackerRateLimitIPBurst), 20)
+	viper.SetDefault(string(TrackerRateLimitPasskey), 0)
+	viper.SetDefault(string(TrackerRateLimitPasskeyBurst), 50)
+	viper.SetDefault(string(TrackerHealthEndpoints), false)
+	viper.SetDefault(string(TrackerJournalPath), "")
+	viper.SetDefault(string(TrackerJournalSegmentSize), 64<<20)
+	viper.SetDefault(string(TrackerJournalSyncInterval), "1s")
+	viper.SetDefault(string(TrackerStatWorkers), 1)
+	viper.SetDefault(string(TrackerQueueSize), 1000)
+	viper.SetDefault(string(TrackerQueuePolicy), "block")
+	viper.SetDefault(string(TrackerQueueTimeout), "0s")
+	viper.SetDefault(string(TrackerQueueSpillPath), "")
+	viper.SetDefault(string(TrackerOverloadThreshold), 0.8)
+	viper.SetDefault(string(TrackerOverloadIntervalFactor), 2.0)
 
 	viper.SetDefault(string(APIListen), "0.0.0.0:34001")
 	viper.SetDefault(string(APITLS), false)
 	viper.SetDefault(string(APIIPv6), false)
 	viper.SetDefault(string(APIIPv6Only), false)
+	viper.SetDefault(string(APIProxyProtocol), false)
+	viper.SetDefault(string(APIProxyProtocolTrusted), []string{})
 
 	viper.SetDefault(string(StoreTorrentType), "memory")
 	viper.SetDefault(string(StoreTorrentHost), "")
@@ -340,6 +531,8 @@ func init() {
 	viper.SetDefault(string(StoreTorrentPassword), "")
 	viper.SetDefault(string(StoreTorrentDatabase), "")
 	viper.SetDefault(string(StoreTorrentProperties), "")
+	viper.SetDefault(string(StoreTorrentCacheSize), 100000)
+	viper.SetDefault(string(StoreTorrentCacheTTL), "5m")
 
 	viper.SetDefault(string(StorePeersType), "memory")
 	viper.SetDefault(string(StorePeersHost), "")
@@ -348,6 +541,8 @@ func init() {
 	viper.SetDefault(string(StorePeersPassword), "")
 	viper.SetDefault(string(StorePeersDatabase), "")
 	viper.SetDefault(string(StorePeersProperties), "")
+	viper.SetDefault(string(StorePeersCacheSize), 500000)
+	viper.SetDefault(string(StorePeersCacheTTL), "10m")
 
 	viper.SetDefault(string(StoreUsersType), "memory")
 	viper.SetDefault(string(StoreUsersHost), "")
@@ -356,8 +551,26 @@ func init() {
 	viper.SetDefault(string(StoreUsersPassword), "")
 	viper.SetDefault(string(StoreUsersDatabase), "")
 	viper.SetDefault(string(StoreUsersProperties), "")
+	viper.SetDefault(string(StoreUsersCacheSize), 100000)
+	viper.SetDefault(string(StoreUsersCacheTTL), "5m")
+
+	viper.SetDefault(string(StoreCacheNegativeTTL), "30s")
+	viper.SetDefault(string(StoreCacheRefreshInterval), "30s")
+	viper.SetDefault(string(StoreCacheBusType), "")
+	viper.SetDefault(string(StoreCacheBusStore), "peers")
+
+	viper.SetDefault(string(ClusterEnabled), false)
+	viper.SetDefault(string(ClusterListen), ":34002")
+	viper.SetDefault(string(ClusterAdvertise), "")
+	viper.SetDefault(string(ClusterMembers), []string{})
+	viper.SetDefault(string(ClusterGossip), false)
+	viper.SetDefault(string(ClusterHeartbeatInterval), "1s")
+	viper.SetDefault(string(ClusterDeadTimeout), "10s")
+	viper.SetDefault(string(ClusterReplicas), 128)
+	viper.SetDefault(string(ClusterSecret), "")
 
 	viper.SetDefault(string(GeodbEnabled), false)
 	viper.SetDefault(string(GeodbAPIKey), "")
 	viper.SetDefault(string(GeodbPath), "./")
+	viper.SetDefault(string(GeodbPolicy), map[string]interface{}{})
 }
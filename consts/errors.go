@@ -30,6 +30,8 @@ var (
 
 	// ErrInvalidClient is used when an invalid client is requested/used
 	ErrInvalidClient = errors.New("invalid torrent client")
+	// ErrInvalidBan is used when an unknown ban is requested
+	ErrInvalidBan = errors.New("invalid ban")
 	// ErrBadResponseCode is returned when a HTTP request returns a non 200 code
 	ErrBadResponseCode = errors.New("bad response code returned")
 )
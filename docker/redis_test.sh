@@ -0,0 +1,53 @@
+#!/usr/bin/env sh
+# Starts local redis processes for testing the sentinel and cluster modes of the redis store:
+#
+# - A master on 6390 with a replica on 6391, monitored by sentinels on 26390-26392
+# - A 3 node cluster on 7000-7002
+#
+# Usage: eval "$(./docker/redis_test.sh start)" && go test ./store/redis/ && ./docker/redis_test.sh stop
+set -e
+
+DIR=${MIKA_REDIS_TEST_DIR:-/tmp/mika_redis_test}
+
+start() {
+    mkdir -p "$DIR"
+    redis-server --port 6390 --daemonize yes --dir "$DIR" --dbfilename 6390.rdb \
+        --pidfile "$DIR/6390.pid" --logfile "$DIR/6390.log"
+    redis-server --port 6391 --daemonize yes --dir "$DIR" --dbfilename 6391.rdb \
+        --pidfile "$DIR/6391.pid" --logfile "$DIR/6391.log" --replicaof 127.0.0.1 6390
+    for port in 26390 26391 26392; do
+        cat > "$DIR/sentinel_$port.conf" <<EOF
+port $port
+sentinel monitor mymaster 127.0.0.1 6390 2
+sentinel down-after-milliseconds mymaster 1000
+sentinel failover-timeout mymaster 5000
+EOF
+        redis-server "$DIR/sentinel_$port.conf" --sentinel --daemonize yes \
+            --pidfile "$DIR/$port.pid" --logfile "$DIR/$port.log"
+    done
+    for port in 7000 7001 7002; do
+        redis-server --port $port --daemonize yes --dir "$DIR" --dbfilename $port.rdb \
+            --pidfile "$DIR/$port.pid" --logfile "$DIR/$port.log" \
+            --cluster-enabled yes --cluster-config-file "$DIR/nodes_$port.conf"
+    done
+    sleep 1
+    redis-cli --cluster create 127.0.0.1:7000 127.0.0.1:7001 127.0.0.1:7002 --cluster-yes > /dev/null
+    until redis-cli -p 7000 cluster info | grep -q "cluster_state:ok"; do
+        sleep 1
+    done
+    echo "export MIKA_REDIS_SENTINEL='mode=sentinel&master_name=mymaster&addrs=127.0.0.1:26390,127.0.0.1:26391,127.0.0.1:26392'"
+    echo "export MIKA_REDIS_CLUSTER='mode=cluster&addrs=127.0.0.1:7000,127.0.0.1:7001,127.0.0.1:7002'"
+}
+
+stop() {
+    for pid in "$DIR"/*.pid; do
+        [ -f "$pid" ] && kill "$(cat "$pid")" 2> /dev/null || true
+    done
+    rm -rf "$DIR"
+}
+
+case "$1" in
+    start) start ;;
+    stop) stop ;;
+    *) echo "Usage: $0 start|stop" && exit 1 ;;
+esac
@@ -4,13 +4,16 @@
 package api
 
 import (
+	"encoding/hex"
 	"github.com/gin-gonic/gin"
+	"github.com/leighmacdonald/mika/consts"
 	"github.com/leighmacdonald/mika/store"
 	"github.com/leighmacdonald/mika/store/memory"
 	"github.com/leighmacdonald/mika/tracker"
 	"github.com/leighmacdonald/mika/util"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -72,6 +75,10 @@ func getPeerIDParam(peerID *store.PeerID, c *gin.Context) bool {
 	return true
 }
 
+func (s *ServerExample) ping(c *gin.Context) {
+	okResponse(c, "pong")
+}
+
 func (s *ServerExample) getTorrent(c *gin.Context) {
 	var infoHash store.InfoHash
 	if !getInfoHashParam(&infoHash, c) {
@@ -146,6 +153,33 @@ func (s *ServerExample) addWhitelist(c *gin.Context) {
 	c.JSON(http.StatusOK, wlc)
 }
 
+func (s *ServerExample) getBans(c *gin.Context) {
+	bans, _ := s.Torrents.BanGetAll()
+	c.JSON(http.StatusOK, bans)
+}
+
+func (s *ServerExample) deleteBan(c *gin.Context) {
+	cidr := strings.TrimPrefix(c.Param("cidr"), "/")
+	if err := s.Torrents.BanDelete(store.Ban{CIDR: cidr}); err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	okResponse(c, "Deleted ban successfully")
+}
+
+func (s *ServerExample) addBan(c *gin.Context) {
+	var ban store.Ban
+	if err := c.BindJSON(&ban); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if err := s.Torrents.BanAdd(ban); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, ban)
+}
+
 func (s *ServerExample) getUserByPasskey(c *gin.Context) {
 	passkey := c.Param("passkey")
 	if passkey == "" {
@@ -317,25 +351,23 @@ func (s *ServerExample) peersGetN(c *gin.Context) {
 		return
 	}
 	maxLimit := 100
-	limit := 25
-	limitStr, found := c.GetQuery("limit")
-	if found {
-		limit = util.StringToUInt(limitStr, limit)
-	}
+	limit := util.StringToUInt(c.Param("count"), 25)
 	if limit > maxLimit {
 		limit = maxLimit
 	}
-	swarm, err := s.Peers.GetN(infoHash, limit)
+	filter := store.PeerFilter{
+		IPv4:        c.Query("ipv4") == "true",
+		IPv6:        c.Query("ipv6") == "true",
+		CryptoLevel: consts.CryptoLevel(util.StringToUInt(c.DefaultQuery("crypto", "0"), 0)),
+	}
+	if exclude, err := hex.DecodeString(c.Query("exclude")); err == nil {
+		copy(filter.Exclude[:], exclude)
+	}
+	peers, err := s.Peers.GetN(infoHash, limit, filter)
 	if err != nil {
 		errResponse(c, http.StatusInternalServerError, err.Error())
 		return
 	}
-	swarm.RLock()
-	var peers []store.Peer
-	for _, p := range swarm.Peers {
-		peers = append(peers, p)
-	}
-	swarm.RUnlock()
 	c.JSON(http.StatusOK, peers)
 
 }
@@ -415,6 +447,9 @@ func New(listenAddr string, pathPrefix string, authKey string) *http.Server {
 	// Conn() and Close() do not need any endpoints, they are noop when using http backed
 	// stores.
 
+	// UserStore.Ping, TorrentStore.Ping and PeerStore.Ping
+	s.Router.GET(pathPrefix+"/api/ping", s.ping)
+
 	// UserStore implementations
 
 	// UserStore.Add
@@ -436,6 +471,12 @@ func New(listenAddr string, pathPrefix string, authKey string) *http.Server {
 	s.Router.DELETE(pathPrefix+"/api/whitelist/:prefix", s.deleteWhitelist)
 	// TorrentStore.WhiteListAdd
 	s.Router.POST(pathPrefix+"/api/whitelist", s.addWhitelist)
+	// TorrentStore.BanGetAll
+	s.Router.GET(pathPrefix+"/api/ban", s.getBans)
+	// TorrentStore.BanDelete
+	s.Router.DELETE(pathPrefix+"/api/ban/*cidr", s.deleteBan)
+	// TorrentStore.BanAdd
+	s.Router.POST(pathPrefix+"/api/ban", s.addBan)
 	// TorrentStore.Add
 	s.Router.POST(pathPrefix+"/api/torrent", s.addTorrent)
 	// TorrentStore.Get
@@ -40,6 +40,8 @@ const (
 // Provider defines our interface for querying geo location data stores
 type Provider interface {
 	GetLocation(ip net.IP) Location
+	// Loaded returns true when a geo database is available for lookups
+	Loaded() bool
 	Close()
 }
 
@@ -54,6 +56,11 @@ func (d *DummyProvider) DownloadDB(_ string, _ string) error {
 // Close does nothing for the dummy provider
 func (d *DummyProvider) Close() {}
 
+// Loaded is always false for the dummy provider
+func (d *DummyProvider) Loaded() bool {
+	return false
+}
+
 // GetLocation will always return 0, 0 coordinates
 func (d *DummyProvider) GetLocation(_ net.IP) Location {
 	return defaultLocation()
@@ -385,6 +392,11 @@ func (db *DB) Close() {
 	db.db.Close()
 }
 
+// Loaded returns true when the location database has been opened
+func (db *DB) Loaded() bool {
+	return db.db != nil
+}
+
 // GetLocation returns the geo location of the input IP addr
 func (db *DB) GetLocation(ip net.IP) Location {
 	const invalidErr = "Invalid IP address."
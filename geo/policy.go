@@ -0,0 +1,192 @@
+package geo
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// Action defines what happens to a peer when a policy rule matches its location
+type Action string
+
+const (
+	// Allow accepts the peer and stops further rule evaluation
+	Allow Action = "allow"
+	// Deny rejects the peer and stops further rule evaluation
+	Deny Action = "deny"
+	// DenyLeech rejects the peer only when it is leeching, seeders are allowed
+	DenyLeech Action = "deny_leech"
+	// Flag records the match and continues evaluating the remaining rules
+	Flag Action = "flag"
+)
+
+// Rule matches peers by country code and/or ASN. Empty lists match any value, so a rule with
+// both lists empty matches every peer.
+type Rule struct {
+	// Name identifies the rule in metrics and logs
+	Name string `mapstructure:"name" json:"name"`
+	// Countries are ISO 3166-1 alpha-2 country codes
+	Countries []string `mapstructure:"countries" json:"countries"`
+	// ASNs are autonomous system numbers
+	ASNs   []uint32 `mapstructure:"asns" json:"asns"`
+	Action Action   `mapstructure:"action" json:"action"`
+	// Reason is returned to the client when denied, a generic reason is generated when empty
+	Reason string `mapstructure:"reason" json:"reason"`
+}
+
+// Matches returns true if the location is covered by the rule
+func (r Rule) Matches(loc Location) bool {
+	if len(r.Countries) > 0 {
+		found := false
+		for _, cc := range r.Countries {
+			if strings.EqualFold(cc, loc.ISOCode) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.ASNs) > 0 {
+		found := false
+		for _, asn := range r.ASNs {
+			if asn == loc.ASN {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// RuleSet is an ordered list of rules evaluated first match wins, similar to a firewall.
+// Default is applied when no allow or deny rule matches.
+type RuleSet struct {
+	Default Action `mapstructure:"default" json:"default"`
+	Rules   []Rule `mapstructure:"rules" json:"rules"`
+}
+
+// Policy defines the location based allow/deny rules for peers. Classes map user classes
+// to a RuleSet which replaces the default rule set entirely for users of that class.
+type Policy struct {
+	RuleSet `mapstructure:",squash"`
+	Classes map[string]RuleSet `mapstructure:"classes" json:"classes"`
+}
+
+// Result is the outcome of evaluating a policy for a peer
+type Result struct {
+	// Allowed is false if the peer must be rejected
+	Allowed bool
+	// Rule is the name of the rule that made the final decision, "default" if none matched
+	Rule string
+	// Reason is the failure reason sent to the client when not allowed
+	Reason string
+	// Flagged contains the names of any flag rules that matched
+	Flagged []string
+}
+
+// Validate checks that all rules use known actions and assigns names to unnamed rules
+func (p *Policy) Validate() error {
+	if err := p.RuleSet.validate("default"); err != nil {
+		return err
+	}
+	for class, rs := range p.Classes {
+		if err := rs.validate(class); err != nil {
+			return err
+		}
+		p.Classes[class] = rs
+	}
+	return nil
+}
+
+func (rs *RuleSet) validate(prefix string) error {
+	switch rs.Default {
+	case "":
+		rs.Default = Allow
+	case Allow, Deny, DenyLeech:
+	default:
+		return errors.Errorf("Invalid default geo policy action for %s: %s", prefix, rs.Default)
+	}
+	for i := range rs.Rules {
+		switch rs.Rules[i].Action {
+		case Allow, Deny, DenyLeech, Flag:
+		default:
+			return errors.Errorf("Invalid geo policy action for %s rule %d: %s",
+				prefix, i, rs.Rules[i].Action)
+		}
+		if rs.Rules[i].Name == "" {
+			rs.Rules[i].Name = fmt.Sprintf("%s_%d", prefix, i)
+		}
+	}
+	return nil
+}
+
+// Check evaluates the policy for a peer of the user class at the location provided.
+// Leeching should be true when the peer still has data left to download.
+func (p *Policy) Check(class string, loc Location, leeching bool) Result {
+	rs := p.RuleSet
+	if override, found := p.Classes[class]; found {
+		rs = override
+	}
+	res := Result{Allowed: true}
+	for _, rule := range rs.Rules {
+		if !rule.Matches(loc) {
+			continue
+		}
+		if rule.Action == Flag {
+			res.Flagged = append(res.Flagged, rule.Name)
+			continue
+		}
+		res.Rule = rule.Name
+		res.Allowed = permitted(rule.Action, leeching)
+		if !res.Allowed {
+			res.Reason = rule.Reason
+			if res.Reason == "" {
+				res.Reason = denyReason(rule, loc, leeching)
+			}
+		}
+		return res
+	}
+	res.Rule = "default"
+	res.Allowed = permitted(rs.Default, leeching)
+	if !res.Allowed {
+		res.Reason = denyReason(Rule{Action: rs.Default}, loc, leeching)
+	}
+	return res
+}
+
+func permitted(action Action, leeching bool) bool {
+	switch action {
+	case Deny:
+		return false
+	case DenyLeech:
+		return !leeching
+	default:
+		return true
+	}
+}
+
+// denyReason builds a client facing failure reason from the parts of the location the rule
+// matched on
+func denyReason(rule Rule, loc Location, leeching bool) string {
+	var what string
+	switch {
+	case len(rule.ASNs) > 0:
+		what = fmt.Sprintf("network AS%d", loc.ASN)
+		if loc.AS != "" {
+			what = fmt.Sprintf("%s (%s)", what, loc.AS)
+		}
+	case len(rule.Countries) > 0:
+		what = fmt.Sprintf("country %s", strings.ToUpper(loc.ISOCode))
+	default:
+		what = "your location"
+	}
+	if leeching && rule.Action == DenyLeech {
+		return fmt.Sprintf("Leeching not permitted from %s", what)
+	}
+	return fmt.Sprintf("Access not permitted from %s", what)
+}
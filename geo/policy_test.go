@@ -0,0 +1,62 @@
+package geo
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	p := Policy{
+		RuleSet: RuleSet{
+			Default: Allow,
+			Rules: []Rule{
+				{Name: "vpn", ASNs: []uint32{9009}, Action: Flag},
+				{Name: "embargo", Countries: []string{"kp"}, Action: Deny},
+				{Name: "hosting", ASNs: []uint32{16509, 14061}, Action: DenyLeech},
+				{ASNs: []uint32{1234}, Action: Deny, Reason: "Go away"},
+			},
+		},
+		Classes: map[string]RuleSet{
+			"staff": {},
+			"trial": {
+				Default: Deny,
+				Rules:   []Rule{{Name: "trial_ca", Countries: []string{"CA"}, Action: Allow}},
+			},
+		},
+	}
+	require.NoError(t, p.Validate())
+	require.Equal(t, "default_3", p.Rules[3].Name)
+	require.Equal(t, Allow, p.Classes["staff"].Default)
+
+	cases := []struct {
+		class    string
+		loc      Location
+		leeching bool
+		allowed  bool
+		rule     string
+		reason   string
+		flagged  []string
+	}{
+		{"", Location{ISOCode: "CA", ASN: 1}, true, true, "default", "", nil},
+		{"", Location{ISOCode: "KP", ASN: 1}, false, false, "embargo", "Access not permitted from country KP", nil},
+		{"", Location{ISOCode: "US", ASN: 16509, AS: "AMAZON-02"}, true, false, "hosting",
+			"Leeching not permitted from network AS16509 (AMAZON-02)", nil},
+		{"", Location{ISOCode: "US", ASN: 16509}, false, true, "hosting", "", nil},
+		{"", Location{ISOCode: "US", ASN: 1234}, false, false, "default_3", "Go away", nil},
+		{"", Location{ISOCode: "KP", ASN: 9009}, false, false, "embargo",
+			"Access not permitted from country KP", []string{"vpn"}},
+		{"staff", Location{ISOCode: "KP", ASN: 1}, true, true, "default", "", nil},
+		{"trial", Location{ISOCode: "CA", ASN: 1}, true, true, "trial_ca", "", nil},
+		{"trial", Location{ISOCode: "US", ASN: 1}, true, false, "default",
+			"Access not permitted from your location", nil},
+	}
+	for i, c := range cases {
+		res := p.Check(c.class, c.loc, c.leeching)
+		require.Equal(t, c.allowed, res.Allowed, "Invalid allowed (%d)", i)
+		require.Equal(t, c.rule, res.Rule, "Invalid rule (%d)", i)
+		require.Equal(t, c.reason, res.Reason, "Invalid reason (%d)", i)
+		require.Equal(t, c.flagged, res.Flagged, "Invalid flags (%d)", i)
+	}
+	require.Error(t, (&Policy{RuleSet: RuleSet{Default: Flag}}).Validate())
+	require.Error(t, (&Policy{RuleSet: RuleSet{Rules: []Rule{{Action: "block"}}}}).Validate())
+}
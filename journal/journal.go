@@ -0,0 +1,604 @@
+// Package journal implements an append-only write-ahead journal of announce state updates.
+//
+// The StatWorker appends each update before summing it into its in-memory batches and
+// acknowledges the sequence number of the last update included once a batch has been
+// successfully synced to the backing stores. On startup any unacknowledged updates are
+// replayed so that a crash loses at most the updates which were not yet fsynced.
+// Consumers which sync independently, such as each backing store, track their progress
+// with named cursors so a replay only re-applies what each of them is missing.
+//
+// Records are written to segment files named after the sequence number of their first
+// record. Once every record in a segment has been acknowledged the segment is removed.
+package journal
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/store"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentExt = ".wal"
+	ackFile    = "ack"
+	// DefaultSegmentSize is the size a segment is rotated at if not configured
+	DefaultSegmentSize = 64 << 20
+)
+
+// Opts configures a Journal
+type Opts struct {
+	// Dir is the directory the segments are stored in, it is created if it does not exist
+	Dir string
+	// SegmentSize is the size in bytes at which a new segment is started
+	SegmentSize int64
+	// SyncInterval is how often written records are fsynced to disk. 0 will fsync on
+	// every append.
+	SyncInterval time.Duration
+	// ReadOnly opens the journal for inspection only, it is safe to use while the journal
+	// is being written to by a running tracker
+	ReadOnly bool
+}
+
+// Journal is a segmented append-only log of store.UpdateState records
+type Journal struct {
+	*sync.Mutex
+	opts Opts
+	// segments holds the first sequence number of each segment in ascending order
+	segments []uint64
+	file     *os.File
+	size     int64
+	seq      uint64
+	acked    uint64
+	dirty    bool
+	buf      []byte
+	stop     chan struct{}
+	done     chan struct{}
+
+	// cursors holds the last sequence number acknowledged by each named consumer
+	cursors map[string]uint64
+}
+
+// SegmentInfo describes a single segment file
+type SegmentInfo struct {
+	Name    string `json:"name"`
+	First   uint64 `json:"first"`
+	Last    uint64 `json:"last"`
+	Records int    `json:"records"`
+	Size    int64  `json:"size"`
+	// Corrupt is true if the segment ends with a torn or invalid record
+	Corrupt bool `json:"corrupt"`
+}
+
+func segmentName(first uint64) string {
+	return fmt.Sprintf("%020d%s", first, segmentExt)
+}
+
+func (j *Journal) segmentPath(first uint64) string {
+	return filepath.Join(j.opts.Dir, segmentName(first))
+}
+
+// Open opens or creates the journal in the configured directory. A torn record at the
+// end of the newest segment, left by a crash mid write, is truncated.
+func Open(opts Opts) (*Journal, error) {
+	if opts.Dir == "" {
+		return nil, consts.ErrInvalidConfig
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "Failed to create journal directory")
+	}
+	j := &Journal{
+		Mutex:   &sync.Mutex{},
+		opts:    opts,
+		cursors: make(map[string]uint64),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := j.readAck(); err != nil {
+		return nil, err
+	}
+	if err := j.scan(); err != nil {
+		return nil, err
+	}
+	if opts.SyncInterval > 0 && !opts.ReadOnly {
+		go j.syncer()
+	} else {
+		close(j.done)
+	}
+	return j, nil
+}
+
+func (j *Journal) readAck() error {
+	acked, err := readAckFile(filepath.Join(j.opts.Dir, ackFile))
+	if err != nil {
+		return err
+	}
+	j.acked = acked
+	names, err := filepath.Glob(filepath.Join(j.opts.Dir, ackFile+".*"))
+	if err != nil {
+		return errors.Wrap(err, "Failed to list journal cursors")
+	}
+	for _, name := range names {
+		cursor := strings.TrimPrefix(filepath.Base(name), ackFile+".")
+		if strings.HasSuffix(cursor, ".tmp") {
+			continue
+		}
+		seq, err := readAckFile(name)
+		if err != nil {
+			return err
+		}
+		j.cursors[cursor] = seq
+	}
+	return nil
+}
+
+func readAckFile(path string) (uint64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "Failed to read journal ack")
+	}
+	acked, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "Invalid journal ack")
+	}
+	return acked, nil
+}
+
+// writeAckFile atomically replaces the ack file
+func (j *Journal) writeAckFile(name string, seq uint64) error {
+	path := filepath.Join(j.opts.Dir, name)
+	if err := ioutil.WriteFile(path+".tmp", []byte(strconv.FormatUint(seq, 10)), 0600); err != nil {
+		return errors.Wrap(err, "Failed to write journal ack")
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return errors.Wrap(err, "Failed to write journal ack")
+	}
+	return nil
+}
+
+// scan finds the existing segments and opens the newest for appending
+func (j *Journal) scan() error {
+	names, err := filepath.Glob(filepath.Join(j.opts.Dir, "*"+segmentExt))
+	if err != nil {
+		return errors.Wrap(err, "Failed to list journal segments")
+	}
+	for _, name := range names {
+		first, errParse := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), segmentExt), 10, 64)
+		if errParse != nil {
+			log.Warnf("Ignoring unknown journal file: %s", name)
+			continue
+		}
+		j.segments = append(j.segments, first)
+	}
+	sort.Slice(j.segments, func(a, b int) bool { return j.segments[a] < j.segments[b] })
+	j.seq = j.acked
+	if len(j.segments) == 0 {
+		return nil
+	}
+	last := j.segments[len(j.segments)-1]
+	info, err := j.readSegment(last, nil)
+	if err != nil {
+		return err
+	}
+	if info.Last > j.seq {
+		j.seq = info.Last
+	} else if last-1 > j.seq {
+		j.seq = last - 1
+	}
+	if j.opts.ReadOnly {
+		return nil
+	}
+	if info.Corrupt {
+		log.Warnf("Truncating torn journal record in %s at offset %d", info.Name, info.Size)
+		if err := os.Truncate(j.segmentPath(last), info.Size); err != nil {
+			return errors.Wrap(err, "Failed to truncate journal segment")
+		}
+	}
+	f, err := os.OpenFile(j.segmentPath(last), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Failed to open journal segment")
+	}
+	j.file = f
+	j.size = info.Size
+	return nil
+}
+
+// readSegment reads every valid record of the segment calling fn for each. The returned
+// size is the offset of the end of the last valid record.
+func (j *Journal) readSegment(first uint64, fn func(r Record) error) (SegmentInfo, error) {
+	info := SegmentInfo{Name: segmentName(first), First: first}
+	f, err := os.Open(j.segmentPath(first))
+	if err != nil {
+		return info, errors.Wrap(err, "Failed to open journal segment")
+	}
+	rd := bufio.NewReader(f)
+	var (
+		r   Record
+		buf []byte
+		n   int
+	)
+	for {
+		buf, n, err = readRecord(rd, buf, &r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			info.Corrupt = true
+			break
+		}
+		info.Size += int64(n)
+		info.Records++
+		info.Last = r.Seq
+		if fn != nil {
+			if err := fn(r); err != nil {
+				_ = f.Close()
+				return info, err
+			}
+		}
+	}
+	return info, f.Close()
+}
+
+// rotate starts a new segment, must be called with the lock held
+func (j *Journal) rotate() error {
+	if j.file != nil {
+		if err := j.file.Sync(); err != nil {
+			return errors.Wrap(err, "Failed to sync journal segment")
+		}
+		if err := j.file.Close(); err != nil {
+			return errors.Wrap(err, "Failed to close journal segment")
+		}
+	}
+	first := j.seq + 1
+	f, err := os.OpenFile(j.segmentPath(first), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create journal segment")
+	}
+	j.file = f
+	j.size = 0
+	j.dirty = false
+	j.segments = append(j.segments, first)
+	return nil
+}
+
+// Append writes the update to the journal returning its sequence number. The record is
+// written to the OS immediately, so it survives the process crashing, but is only
+// fsynced every SyncInterval.
+func (j *Journal) Append(u store.UpdateState) (uint64, error) {
+	if j.opts.ReadOnly {
+		return 0, consts.ErrInvalidState
+	}
+	j.Lock()
+	if j.file == nil || j.size >= j.opts.SegmentSize {
+		if err := j.rotate(); err != nil {
+			j.Unlock()
+			return 0, err
+		}
+	}
+	seq := j.seq + 1
+	j.buf = encode(j.buf[:0], Record{Seq: seq, State: u})
+	n, err := j.file.Write(j.buf)
+	j.size += int64(n)
+	if err != nil {
+		j.Unlock()
+		return 0, errors.Wrap(err, "Failed to write journal record")
+	}
+	j.seq = seq
+	j.dirty = true
+	if j.opts.SyncInterval <= 0 {
+		err = j.sync()
+	}
+	j.Unlock()
+	return seq, err
+}
+
+// sync fsyncs the current segment if it has been written to, must be called with the lock held
+func (j *Journal) sync() error {
+	if !j.dirty || j.file == nil {
+		return nil
+	}
+	j.dirty = false
+	if err := j.file.Sync(); err != nil {
+		return errors.Wrap(err, "Failed to sync journal segment")
+	}
+	return nil
+}
+
+// Sync fsyncs any records written since the last sync
+func (j *Journal) Sync() error {
+	j.Lock()
+	err := j.sync()
+	j.Unlock()
+	return err
+}
+
+func (j *Journal) syncer() {
+	defer close(j.done)
+	t := time.NewTicker(j.opts.SyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := j.Sync(); err != nil {
+				log.Errorf(err.Error())
+			}
+		case <-j.stop:
+			return
+		}
+	}
+}
+
+// Ack marks every record up to and including seq as successfully synced to the backing
+// stores. Segments containing only acknowledged records are removed.
+func (j *Journal) Ack(seq uint64) error {
+	j.Lock()
+	defer j.Unlock()
+	if seq <= j.acked || j.opts.ReadOnly {
+		return nil
+	}
+	if err := j.writeAckFile(ackFile, seq); err != nil {
+		return err
+	}
+	j.acked = seq
+	return j.removeAcked()
+}
+
+// AckCursor marks every record up to and including seq as applied by the named consumer.
+// Records are only removed once acknowledged with Ack, which should be given the lowest
+// of the consumers cursors.
+func (j *Journal) AckCursor(name string, seq uint64) error {
+	j.Lock()
+	defer j.Unlock()
+	if seq <= j.cursor(name) || j.opts.ReadOnly {
+		return nil
+	}
+	if err := j.writeAckFile(ackFile+"."+name, seq); err != nil {
+		return err
+	}
+	j.cursors[name] = seq
+	return nil
+}
+
+// Cursor returns the last sequence number acknowledged by the named consumer. Consumers
+// which have never acknowledged a record start from the journal ack.
+func (j *Journal) Cursor(name string) uint64 {
+	j.Lock()
+	defer j.Unlock()
+	return j.cursor(name)
+}
+
+// cursor must be called with the lock held
+func (j *Journal) cursor(name string) uint64 {
+	if seq, found := j.cursors[name]; found && seq > j.acked {
+		return seq
+	}
+	return j.acked
+}
+
+// removeAcked deletes the segments which only hold acknowledged records, never removing
+// the segment currently being written to. Must be called with the lock held.
+func (j *Journal) removeAcked() error {
+	for len(j.segments) > 1 && j.segments[1]-1 <= j.acked {
+		if err := os.Remove(j.segmentPath(j.segments[0])); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "Failed to remove journal segment")
+		}
+		j.segments = j.segments[1:]
+	}
+	return nil
+}
+
+// Acked returns the sequence number of the last acknowledged record
+func (j *Journal) Acked() uint64 {
+	j.Lock()
+	defer j.Unlock()
+	return j.acked
+}
+
+// Seq returns the sequence number of the last appended record
+func (j *Journal) Seq() uint64 {
+	j.Lock()
+	defer j.Unlock()
+	return j.seq
+}
+
+// Replay calls fn, in order, for every record which has not been acknowledged
+func (j *Journal) Replay(fn func(r Record) error) error {
+	return j.Walk(func(r Record) error {
+		if r.Seq <= j.acked {
+			return nil
+		}
+		return fn(r)
+	})
+}
+
+// Walk calls fn, in order, for every record in the journal including acknowledged
+// records which have not yet been removed
+func (j *Journal) Walk(fn func(r Record) error) error {
+	j.Lock()
+	defer j.Unlock()
+	for _, first := range j.segments {
+		info, err := j.readSegment(first, fn)
+		if err != nil {
+			return err
+		}
+		if info.Corrupt {
+			log.Warnf("Journal segment %s has a corrupt record after seq %d", info.Name, info.Last)
+		}
+	}
+	return nil
+}
+
+// errReadLimit stops reading a segment once Read has reached its limit
+var errReadLimit = errors.New("read limit reached")
+
+// Read calls fn, in order, for at most limit records following the sequence number after,
+// up to the last record appended when Read was called. Unlike Walk the lock is only held
+// while selecting the segments to read so appends are not blocked by a long read. The
+// records read must not be acknowledged until Read returns.
+func (j *Journal) Read(after uint64, limit int, fn func(r Record) error) (int, error) {
+	j.Lock()
+	last := j.seq
+	var segments []uint64
+	for i, first := range j.segments {
+		// Every record of the segment precedes the first record of the next
+		if i+1 < len(j.segments) && j.segments[i+1] <= after+1 {
+			continue
+		}
+		segments = append(segments, first)
+	}
+	j.Unlock()
+	read := 0
+	for _, first := range segments {
+		_, err := j.readSegment(first, func(r Record) error {
+			if r.Seq <= after {
+				return nil
+			}
+			if r.Seq > last || read >= limit {
+				return errReadLimit
+			}
+			read++
+			return fn(r)
+		})
+		if err == errReadLimit {
+			break
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// Segments returns the details of each segment
+func (j *Journal) Segments() ([]SegmentInfo, error) {
+	j.Lock()
+	defer j.Unlock()
+	var infos []SegmentInfo
+	for _, first := range j.segments {
+		info, err := j.readSegment(first, nil)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Compact removes every acknowledged record, rewriting the oldest remaining segment if
+// it is only partially acknowledged. This must not be run against a journal which is
+// in use by a running tracker.
+func (j *Journal) Compact() error {
+	if j.opts.ReadOnly {
+		return consts.ErrInvalidState
+	}
+	j.Lock()
+	defer j.Unlock()
+	if err := j.removeAcked(); err != nil {
+		return err
+	}
+	if len(j.segments) == 0 || j.segments[0] > j.acked {
+		return nil
+	}
+	first := j.segments[0]
+	if len(j.segments) == 1 {
+		// Only the active segment remains, all of it may already be acknowledged
+		if j.seq <= j.acked {
+			return j.reset()
+		}
+	}
+	var kept []byte
+	next := uint64(0)
+	if _, err := j.readSegment(first, func(r Record) error {
+		if r.Seq > j.acked {
+			if next == 0 {
+				next = r.Seq
+			}
+			kept = encode(kept, r)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if next == 0 {
+		return nil
+	}
+	tmp := j.segmentPath(next) + ".tmp"
+	if err := ioutil.WriteFile(tmp, kept, 0600); err != nil {
+		return errors.Wrap(err, "Failed to write compacted segment")
+	}
+	if err := os.Rename(tmp, j.segmentPath(next)); err != nil {
+		return errors.Wrap(err, "Failed to write compacted segment")
+	}
+	active := len(j.segments) == 1
+	if active && j.file != nil {
+		_ = j.file.Close()
+	}
+	if err := os.Remove(j.segmentPath(first)); err != nil {
+		return errors.Wrap(err, "Failed to remove compacted segment")
+	}
+	j.segments[0] = next
+	if active {
+		f, err := os.OpenFile(j.segmentPath(next), os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return errors.Wrap(err, "Failed to open journal segment")
+		}
+		j.file = f
+		j.size = int64(len(kept))
+	}
+	return nil
+}
+
+// reset removes the active segment when every record has been acknowledged, must be
+// called with the lock held
+func (j *Journal) reset() error {
+	if j.file != nil {
+		_ = j.file.Close()
+		j.file = nil
+	}
+	for _, first := range j.segments {
+		if err := os.Remove(j.segmentPath(first)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "Failed to remove journal segment")
+		}
+	}
+	j.segments = nil
+	j.size = 0
+	return nil
+}
+
+// Close fsyncs and closes the journal
+func (j *Journal) Close() error {
+	select {
+	case <-j.stop:
+		return nil
+	default:
+		close(j.stop)
+	}
+	<-j.done
+	j.Lock()
+	defer j.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.sync()
+	if errClose := j.file.Close(); errClose != nil && err == nil {
+		err = errors.Wrap(errClose, "Failed to close journal segment")
+	}
+	j.file = nil
+	return err
+}
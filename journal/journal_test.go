@@ -0,0 +1,183 @@
+package journal
+
+import (
+	"bytes"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/store"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testState(i int) store.UpdateState {
+	return store.UpdateState{
+		InfoHash:   store.InfoHash{byte(i)},
+		PeerID:     store.PeerID{byte(i), 1},
+		Passkey:    "12345678901234567890",
+		Uploaded:   uint64(i) * 1000,
+		Downloaded: uint64(i) * 500,
+		Left:       uint32(i),
+		Timestamp:  time.Unix(0, int64(i)*int64(time.Second)),
+		Event:      consts.STARTED,
+		Paused:     i%2 == 0,
+	}
+}
+
+func collect(t *testing.T, j *Journal) []Record {
+	var records []Record
+	require.NoError(t, j.Replay(func(r Record) error {
+		records = append(records, r)
+		return nil
+	}))
+	return records
+}
+
+func TestRecord(t *testing.T) {
+	in := Record{Seq: 42, State: testState(7)}
+	buf := encode(nil, in)
+	var out Record
+	_, n, err := readRecord(bytes.NewReader(buf), nil, &out)
+	require.NoError(t, err)
+	require.Equal(t, len(buf), n)
+	require.Equal(t, in.Seq, out.Seq)
+	require.True(t, in.State.Timestamp.Equal(out.State.Timestamp))
+	out.State.Timestamp = in.State.Timestamp
+	require.Equal(t, in.State, out.State)
+
+	buf[len(buf)-1] ^= 0xff
+	_, _, err = readRecord(bytes.NewReader(buf), nil, &out)
+	require.Equal(t, consts.ErrInvalidState, err)
+}
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mika-journal")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	opts := Opts{Dir: dir, SegmentSize: 500, SyncInterval: time.Millisecond}
+	j, err := Open(opts)
+	require.NoError(t, err)
+	for i := 1; i <= 20; i++ {
+		seq, errAppend := j.Append(testState(i))
+		require.NoError(t, errAppend)
+		require.Equal(t, uint64(i), seq)
+	}
+	segments, err := j.Segments()
+	require.NoError(t, err)
+	require.True(t, len(segments) > 1, "Segments not rotated")
+	require.NoError(t, j.Ack(12))
+	remaining, err := j.Segments()
+	require.NoError(t, err)
+	require.True(t, len(remaining) < len(segments), "Acked segments not removed")
+	require.Len(t, collect(t, j), 8)
+	require.NoError(t, j.Close())
+
+	// Simulate a crash mid write leaving a torn record
+	last := remaining[len(remaining)-1]
+	f, err := os.OpenFile(filepath.Join(dir, last.Name), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write(encode(nil, Record{Seq: 21, State: testState(21)})[:20])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	ro, err := Open(Opts{Dir: dir, ReadOnly: true})
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), ro.Seq())
+	_, err = ro.Append(testState(21))
+	require.Error(t, err)
+	require.NoError(t, ro.Close())
+
+	j, err = Open(opts)
+	require.NoError(t, err)
+	require.Equal(t, uint64(12), j.Acked())
+	require.Equal(t, uint64(20), j.Seq())
+	records := collect(t, j)
+	require.Len(t, records, 8)
+	require.Equal(t, uint64(13), records[0].Seq)
+	require.Equal(t, testState(13).Uploaded, records[0].State.Uploaded)
+	seq, err := j.Append(testState(21))
+	require.NoError(t, err)
+	require.Equal(t, uint64(21), seq)
+	require.Len(t, collect(t, j), 9)
+
+	// Compaction leaves only unacknowledged records
+	require.NoError(t, j.Compact())
+	var walked int
+	require.NoError(t, j.Walk(func(r Record) error {
+		require.True(t, r.Seq > 12)
+		walked++
+		return nil
+	}))
+	require.Equal(t, 9, walked)
+	require.NoError(t, j.Ack(21))
+	require.NoError(t, j.Compact())
+	segments, err = j.Segments()
+	require.NoError(t, err)
+	require.Len(t, segments, 0)
+	seq, err = j.Append(testState(22))
+	require.NoError(t, err)
+	require.Equal(t, uint64(22), seq)
+	require.NoError(t, j.Close())
+}
+
+func TestJournal_Cursors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mika-journal")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	j, err := Open(Opts{Dir: dir})
+	require.NoError(t, err)
+	for i := 1; i <= 10; i++ {
+		_, err = j.Append(testState(i))
+		require.NoError(t, err)
+	}
+	require.NoError(t, j.Ack(2))
+	require.Equal(t, uint64(2), j.Cursor("users"))
+	require.NoError(t, j.AckCursor("users", 8))
+	require.NoError(t, j.AckCursor("peers", 5))
+	require.NoError(t, j.AckCursor("peers", 4))
+	require.NoError(t, j.Close())
+
+	j, err = Open(Opts{Dir: dir})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), j.Acked())
+	require.Equal(t, uint64(8), j.Cursor("users"))
+	require.Equal(t, uint64(5), j.Cursor("peers"))
+	require.Equal(t, uint64(2), j.Cursor("torrents"))
+	// Cursors behind the journal ack follow it
+	require.NoError(t, j.Ack(6))
+	require.Equal(t, uint64(6), j.Cursor("peers"))
+	require.Len(t, collect(t, j), 4)
+	require.NoError(t, j.Close())
+}
+
+func TestJournal_Read(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mika-journal")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	j, err := Open(Opts{Dir: dir, SegmentSize: 500})
+	require.NoError(t, err)
+	for i := 1; i <= 20; i++ {
+		_, err = j.Append(testState(i))
+		require.NoError(t, err)
+	}
+	var seqs []uint64
+	read := func(after uint64, limit int) int {
+		seqs = nil
+		n, errRead := j.Read(after, limit, func(r Record) error {
+			seqs = append(seqs, r.Seq)
+			return nil
+		})
+		require.NoError(t, errRead)
+		return n
+	}
+	require.Equal(t, 5, read(0, 5))
+	require.Equal(t, []uint64{1, 2, 3, 4, 5}, seqs)
+	require.Equal(t, 4, read(13, 4))
+	require.Equal(t, []uint64{14, 15, 16, 17}, seqs)
+	require.Equal(t, 3, read(17, 10))
+	require.Equal(t, []uint64{18, 19, 20}, seqs)
+	require.Equal(t, 0, read(20, 10))
+	require.NoError(t, j.Close())
+}
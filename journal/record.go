@@ -0,0 +1,111 @@
+package journal
+
+import (
+	"encoding/binary"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/store"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+const (
+	// headerSize is the length and crc32 prefix of each record
+	headerSize = 8
+	// fixedSize is the encoded size of a record payload excluding the variable length strings
+	fixedSize = 8 + 20 + 20 + 8 + 8 + 4 + 8 + 1 + 1 + 1
+	// maxRecordSize guards against allocating huge buffers when reading a corrupt length
+	maxRecordSize = fixedSize + 2*255
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Record is a single journaled state update
+type Record struct {
+	Seq   uint64
+	State store.UpdateState
+}
+
+// encode appends the framed record to buf.
+//
+// Layout: len(4) crc(4) | seq(8) info_hash(20) peer_id(20) uploaded(8) downloaded(8)
+// left(4) timestamp(8) paused(1) event_len(1) event passkey_len(1) passkey
+func encode(buf []byte, r Record) []byte {
+	u := r.State
+	event := string(u.Event)
+	payloadLen := fixedSize + len(event) + len(u.Passkey)
+	start := len(buf)
+	buf = append(buf, make([]byte, headerSize+payloadLen)...)
+	p := buf[start+headerSize:]
+	binary.BigEndian.PutUint64(p[0:], r.Seq)
+	copy(p[8:], u.InfoHash[:])
+	copy(p[28:], u.PeerID[:])
+	binary.BigEndian.PutUint64(p[48:], u.Uploaded)
+	binary.BigEndian.PutUint64(p[56:], u.Downloaded)
+	binary.BigEndian.PutUint32(p[64:], u.Left)
+	binary.BigEndian.PutUint64(p[68:], uint64(u.Timestamp.UnixNano()))
+	if u.Paused {
+		p[76] = 1
+	}
+	p[77] = byte(len(event))
+	n := 78 + copy(p[78:], event)
+	p[n] = byte(len(u.Passkey))
+	copy(p[n+1:], u.Passkey)
+	binary.BigEndian.PutUint32(buf[start:], uint32(payloadLen))
+	binary.BigEndian.PutUint32(buf[start+4:], crc32.Checksum(p, crcTable))
+	return buf
+}
+
+// decode parses a record payload which has already had its checksum verified
+func decode(p []byte, r *Record) error {
+	if len(p) < fixedSize {
+		return consts.ErrInvalidState
+	}
+	r.Seq = binary.BigEndian.Uint64(p[0:])
+	copy(r.State.InfoHash[:], p[8:28])
+	copy(r.State.PeerID[:], p[28:48])
+	r.State.Uploaded = binary.BigEndian.Uint64(p[48:])
+	r.State.Downloaded = binary.BigEndian.Uint64(p[56:])
+	r.State.Left = binary.BigEndian.Uint32(p[64:])
+	r.State.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(p[68:])))
+	r.State.Paused = p[76] == 1
+	eventLen := int(p[77])
+	if len(p) < fixedSize+eventLen {
+		return consts.ErrInvalidState
+	}
+	r.State.Event = consts.AnnounceType(p[78 : 78+eventLen])
+	n := 78 + eventLen
+	passkeyLen := int(p[n])
+	if len(p) != fixedSize+eventLen+passkeyLen {
+		return consts.ErrInvalidState
+	}
+	r.State.Passkey = string(p[n+1 : n+1+passkeyLen])
+	return nil
+}
+
+// readRecord reads the next record from the reader. io.EOF is returned at a clean end of
+// the stream, consts.ErrInvalidState for a torn or corrupt record.
+func readRecord(rd io.Reader, buf []byte, r *Record) ([]byte, int, error) {
+	var header [headerSize]byte
+	if n, err := io.ReadFull(rd, header[:]); err != nil {
+		if err == io.EOF {
+			return buf, 0, io.EOF
+		}
+		return buf, n, consts.ErrInvalidState
+	}
+	size := int(binary.BigEndian.Uint32(header[0:]))
+	if size < fixedSize || size > maxRecordSize {
+		return buf, headerSize, consts.ErrInvalidState
+	}
+	if cap(buf) < size {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	if n, err := io.ReadFull(rd, buf); err != nil {
+		return buf, headerSize + n, consts.ErrInvalidState
+	}
+	if crc32.Checksum(buf, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return buf, headerSize + size, consts.ErrInvalidState
+	}
+	return buf, headerSize + size, decode(buf, r)
+}
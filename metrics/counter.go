@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// CounterVec is a set of counters partitioned by label values. Counters are created
+// on first use and are never removed.
+type CounterVec struct {
+	*family
+}
+
+// NewCounterVec creates and registers a new counter set which is included in the
+// prometheus formatted metrics output
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{family: newFamily(name, help, labels, func() interface{} {
+		return new(int64)
+	})}
+	register(cv)
+	return cv
+}
+
+// Add increments the counter for the label values by n. Values must be supplied in
+// the same order as the labels were defined.
+func (cv *CounterVec) Add(n int64, values ...string) {
+	atomic.AddInt64(cv.child(values).(*int64), n)
+}
+
+// Inc increments the counter for the label values by 1
+func (cv *CounterVec) Inc(values ...string) {
+	cv.Add(1, values...)
+}
+
+// Get returns the current value of the counter for the label values
+func (cv *CounterVec) Get(values ...string) int64 {
+	return atomic.LoadInt64(cv.child(values).(*int64))
+}
+
+func (cv *CounterVec) write(out *strings.Builder) {
+	writeHeader(out, cv.name, cv.help, "counter")
+	cv.each(func(key string, child interface{}) {
+		out.WriteString(fmt.Sprintf("%s%s %d\n", cv.name, formatLabels(cv.labels, key),
+			atomic.LoadInt64(child.(*int64))))
+	})
+}
+
+// String returns the prometheus text format of all the counters in the set
+func (cv *CounterVec) String() string {
+	var out strings.Builder
+	cv.write(&out)
+	return out.String()
+}
+
+// GaugeFunc is a gauge whose value is read from a callback each time the metrics are
+// collected. This allows exposing values which are already maintained elsewhere.
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// RegisterGaugeFunc registers a gauge reading its value from fn. Registering the same name
+// again replaces the previous callback.
+func RegisterGaugeFunc(name string, help string, fn func() float64) {
+	register(&GaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *GaugeFunc) metricName() string {
+	return g.name
+}
+
+func (g *GaugeFunc) write(out *strings.Builder) {
+	writeHeader(out, g.name, g.help, "gauge")
+	out.WriteString(fmt.Sprintf("%s %v\n", g.name, g.fn()))
+}
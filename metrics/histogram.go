@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLatencyBuckets are the histogram bucket upper bounds, in seconds, used for
+// request and store latencies
+var DefaultLatencyBuckets = []float64{
+	.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5,
+}
+
+// Histogram counts observations into fixed buckets. All updates are atomic so
+// observing values never blocks.
+type Histogram struct {
+	upper []float64
+	// counts holds the non-cumulative count of each bucket, the last being +Inf
+	counts []uint64
+	count  uint64
+	// sumBits is the float64 bit pattern of the sum of all observations
+	sumBits uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		upper:  buckets,
+		counts: make([]uint64, len(buckets)+1),
+	}
+}
+
+// Observe adds a single value to the histogram
+func (h *Histogram) Observe(v float64) {
+	atomic.AddUint64(&h.counts[sort.SearchFloat64s(h.upper, v)], 1)
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			return
+		}
+	}
+}
+
+// ObserveDuration adds the duration to the histogram in seconds
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// Count returns the total number of observations
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// Sum returns the sum of all observed values
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+}
+
+// HistogramVec is a set of histograms partitioned by label values
+type HistogramVec struct {
+	*family
+	buckets []float64
+}
+
+// NewHistogramVec creates and registers a new histogram set using the bucket upper
+// bounds provided, which must be sorted in increasing order.
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	hv := &HistogramVec{buckets: buckets}
+	hv.family = newFamily(name, help, labels, func() interface{} {
+		return newHistogram(hv.buckets)
+	})
+	register(hv)
+	return hv
+}
+
+// With returns the histogram for the label values. Values must be supplied in the same
+// order as the labels were defined.
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	return hv.child(values).(*Histogram)
+}
+
+// Since observes the time elapsed since start for the label values
+func (hv *HistogramVec) Since(start time.Time, values ...string) {
+	hv.With(values...).ObserveDuration(time.Since(start))
+}
+
+func (hv *HistogramVec) write(out *strings.Builder) {
+	writeHeader(out, hv.name, hv.help, "histogram")
+	hv.each(func(key string, child interface{}) {
+		h := child.(*Histogram)
+		var cumulative uint64
+		for i, upper := range hv.buckets {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			out.WriteString(fmt.Sprintf("%s_bucket%s %d\n", hv.name,
+				formatLabels(hv.labels, key, "le", strconv.FormatFloat(upper, 'g', -1, 64)), cumulative))
+		}
+		cumulative += atomic.LoadUint64(&h.counts[len(hv.buckets)])
+		out.WriteString(fmt.Sprintf("%s_bucket%s %d\n", hv.name,
+			formatLabels(hv.labels, key, "le", "+Inf"), cumulative))
+		out.WriteString(fmt.Sprintf("%s_sum%s %v\n", hv.name, formatLabels(hv.labels, key), h.Sum()))
+		out.WriteString(fmt.Sprintf("%s_count%s %d\n", hv.name, formatLabels(hv.labels, key), cumulative))
+	})
+}
+
+// String returns the prometheus text format of all the histograms in the set
+func (hv *HistogramVec) String() string {
+	var out strings.Builder
+	hv.write(&out)
+	return out.String()
+}
@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// latencySubBits sets the number of linear sub buckets per power of two (2^4 = 16),
+	// giving a worst case relative error of 1/16 (6.25%)
+	latencySubBits    = 4
+	latencySubBuckets = 1 << latencySubBits
+	// latencyBuckets covers the full uint64 nanosecond range
+	latencyBuckets = (64 - latencySubBits + 1) * latencySubBuckets
+)
+
+// latencyWindow holds the bucket counts for a single reporting window
+type latencyWindow struct {
+	counts [latencyBuckets]uint64
+	sum    uint64
+	max    uint64
+}
+
+// LatencyHistogram records durations into fixed log-linear buckets (HDR style) so memory
+// use is constant regardless of the number of observations. Recording is lock-free.
+// Observations are grouped into windows, Reset closes the current window and starts a
+// new one.
+type LatencyHistogram struct {
+	windows [2]*latencyWindow
+	active  uint32
+}
+
+// LatencySummary contains the quantiles of a LatencyHistogram window. Quantiles are
+// reported as the upper bound of the bucket they fall into.
+type LatencySummary struct {
+	Count uint64        `json:"count"`
+	Avg   time.Duration `json:"avg"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// NewLatencyHistogram returns a new empty histogram
+func NewLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{windows: [2]*latencyWindow{{}, {}}}
+}
+
+// latencyIndex returns the bucket index for the value
+func latencyIndex(v uint64) int {
+	if v < latencySubBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(v) - 1 - latencySubBits
+	sub := (v >> uint(shift)) & (latencySubBuckets - 1)
+	return (shift+1)*latencySubBuckets + int(sub)
+}
+
+// latencyUpper returns the largest value stored in the bucket index
+func latencyUpper(idx int) uint64 {
+	if idx < latencySubBuckets {
+		return uint64(idx)
+	}
+	shift := uint(idx/latencySubBuckets - 1)
+	sub := uint64(idx % latencySubBuckets)
+	return ((latencySubBuckets+sub)<<shift + 1<<shift) - 1
+}
+
+// Record adds a duration to the current window
+func (h *LatencyHistogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	v := uint64(d)
+	w := h.windows[atomic.LoadUint32(&h.active)]
+	atomic.AddUint64(&w.counts[latencyIndex(v)], 1)
+	atomic.AddUint64(&w.sum, v)
+	for {
+		cur := atomic.LoadUint64(&w.max)
+		if v <= cur || atomic.CompareAndSwapUint64(&w.max, cur, v) {
+			return
+		}
+	}
+}
+
+// Snapshot returns the summary of the current window without resetting it
+func (h *LatencyHistogram) Snapshot() LatencySummary {
+	w := h.windows[atomic.LoadUint32(&h.active)]
+	var counts [latencyBuckets]uint64
+	for i := range w.counts {
+		counts[i] = atomic.LoadUint64(&w.counts[i])
+	}
+	return summarize(&counts, atomic.LoadUint64(&w.sum), atomic.LoadUint64(&w.max))
+}
+
+// Reset closes the current window, returning its summary, and starts a new window.
+// Observations racing with the reset are carried into the following window.
+func (h *LatencyHistogram) Reset() LatencySummary {
+	var old uint32
+	for {
+		old = atomic.LoadUint32(&h.active)
+		if atomic.CompareAndSwapUint32(&h.active, old, old^1) {
+			break
+		}
+	}
+	w := h.windows[old]
+	var counts [latencyBuckets]uint64
+	for i := range w.counts {
+		counts[i] = atomic.SwapUint64(&w.counts[i], 0)
+	}
+	return summarize(&counts, atomic.SwapUint64(&w.sum, 0), atomic.SwapUint64(&w.max, 0))
+}
+
+func summarize(counts *[latencyBuckets]uint64, sum uint64, max uint64) LatencySummary {
+	var s LatencySummary
+	for _, c := range counts {
+		s.Count += c
+	}
+	if s.Count == 0 {
+		return s
+	}
+	s.Avg = time.Duration(sum / s.Count)
+	s.Max = time.Duration(max)
+	quantiles := []struct {
+		q   float64
+		out *time.Duration
+	}{{0.50, &s.P50}, {0.90, &s.P90}, {0.99, &s.P99}}
+	var seen uint64
+	qi := 0
+	for idx, c := range counts {
+		if c == 0 {
+			continue
+		}
+		seen += c
+		for qi < len(quantiles) && float64(seen) >= quantiles[qi].q*float64(s.Count) {
+			v := latencyUpper(idx)
+			if v > max {
+				v = max
+			}
+			*quantiles[qi].out = time.Duration(v)
+			qi++
+		}
+		if qi == len(quantiles) {
+			break
+		}
+	}
+	return s
+}
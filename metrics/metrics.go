@@ -6,8 +6,8 @@ import (
 	"runtime"
 	"runtime/debug"
 	"strings"
-	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var promHelp = map[string]string{
@@ -42,66 +42,110 @@ var promHelp = map[string]string{
 		"forced by the application calling the GC function.",
 	"gc_cpu_fraction": "gc_cpu_fraction is the fraction of this program's available " +
 		"CPU time used by the GC since the program started.",
-	"t_cache_torrents":              "t_cache_torrents is the total count of cached torrents",
-	"t_cache_users":                 "t_cache_users is the total count of cached users",
-	"t_cache_peers":                 "t_cache_peers is the total count of cached peers",
 	"t_ann_total":                   "t_ann_total is the total count of announces",
 	"t_ann_status_ok":               "t_ann_status_ok is the total count of successful announces",
 	"t_ann_status_unauthorized":     "t_ann_status_unauthorized is the total count of unauthorized users requests",
+	"t_ann_status_banned":           "t_ann_status_banned is the total count of requests from banned addresses",
 	"t_ann_status_invalid_infohash": "t_ann_status_invalid_infohash is the total count of invalid info hash requests",
 	"t_ann_status_malformed":        "t_ann_status_malformed is the total count of malformed queries",
 	"t_ann_time_ns":                 "t_ann_time_ns is the average time it takes to fulfill a successful announce in nanoseconds",
+	"t_ann_time_p50_ns":             "t_ann_time_p50_ns is the median successful announce time in nanoseconds",
+	"t_ann_time_p90_ns":             "t_ann_time_p90_ns is the 90th percentile successful announce time in nanoseconds",
+	"t_ann_time_p99_ns":             "t_ann_time_p99_ns is the 99th percentile successful announce time in nanoseconds",
+	"t_ann_time_max_ns":             "t_ann_time_max_ns is the slowest successful announce time in nanoseconds",
+	"pause_total":                   "pause_total is the total time spent in GC pauses in milliseconds",
+	"go_routines":                   "go_routines is the number of goroutines that currently exist",
 }
 
+// Labeled metrics included in the prometheus output after the RuntimeMetrics fields
 var (
-	TorrentsTotalCached int64
-	PeersTotalCached    int64
-	UsersTotalCached    int64
+	// RequestStatus counts tracker responses by handler and status code
+	RequestStatus = NewCounterVec("t_requests_total",
+		"t_requests_total is the total count of tracker requests by handler and response status code",
+		"handler", "status")
+	// AnnounceEvents counts announces by their event type
+	AnnounceEvents = NewCounterVec("t_ann_events_total",
+		"t_ann_events_total is the total count of announces by event",
+		"event")
+	// AnnounceClients counts announces by the client family parsed from the peer_id
+	AnnounceClients = NewCounterVec("t_ann_clients_total",
+		"t_ann_clients_total is the total count of announces by client family",
+		"client")
+	// AnnounceDuration is the latency of successful announces
+	AnnounceDuration = NewHistogramVec("t_ann_duration_seconds",
+		"t_ann_duration_seconds is the time taken to fulfill an announce",
+		DefaultLatencyBuckets)
+	// ScrapeDuration is the latency of scrapes
+	ScrapeDuration = NewHistogramVec("t_scrape_duration_seconds",
+		"t_scrape_duration_seconds is the time taken to fulfill a scrape",
+		DefaultLatencyBuckets)
+	// StoreDuration is the latency of backing store operations by store, driver and method
+	StoreDuration = NewHistogramVec("t_store_duration_seconds",
+		"t_store_duration_seconds is the time taken by backing store operations",
+		DefaultLatencyBuckets, "store", "driver", "method")
+	// StoreErrors counts the backing store operations which returned an error
+	StoreErrors = NewCounterVec("t_store_errors_total",
+		"t_store_errors_total is the total count of backing store operations returning an error",
+		"store", "driver", "method")
+	// GeoPolicyMatches counts the geo policy rules matched by peers
+	GeoPolicyMatches = NewCounterVec("t_geo_policy_matches_total",
+		"t_geo_policy_matches_total is the total count of peers matching each geo policy rule",
+		"rule", "action")
+	// RateLimited counts the tracker requests rejected by each rate limiter
+	RateLimited = NewCounterVec("t_rate_limited_total",
+		"t_rate_limited_total is the total count of requests rejected by the rate limiters",
+		"limiter")
+	// StateUpdatesDropped counts the state updates discarded because the stat update queue was full
+	StateUpdatesDropped = NewCounterVec("t_state_updates_dropped_total",
+		"t_state_updates_dropped_total is the total count of state updates dropped while the queue was full",
+		"reason")
+	// StateUpdatesSpilled counts the state updates written to the spill journal
+	StateUpdatesSpilled = NewCounterVec("t_state_updates_spilled_total",
+		"t_state_updates_spilled_total is the total count of state updates spilled to disk while the queue was full")
+	// CacheHits counts the lookups served by the store caches, negative hits are lookups of
+	// keys cached as unknown
+	CacheHits = NewCounterVec("t_cache_hits_total",
+		"t_cache_hits_total is the total count of lookups served from the cache", "cache", "type")
+	// CacheMisses counts the lookups which fell through to the backing store
+	CacheMisses = NewCounterVec("t_cache_misses_total",
+		"t_cache_misses_total is the total count of lookups not found in the cache", "cache")
+	// CacheEvictions counts the entries removed because the cache was full or they expired
+	CacheEvictions = NewCounterVec("t_cache_evictions_total",
+		"t_cache_evictions_total is the total count of entries evicted from the cache", "cache", "reason")
+)
 
+var (
 	AnnounceTotal                 int64
 	AnnounceStatusOK              int64
 	AnnounceStatusUnauthorized    int64
+	AnnounceStatusBanned          int64
 	AnnounceStatusInvalidInfoHash int64
 	AnnounceStatusMalformed       int64
-	execLock                      *sync.Mutex
-	AnnounceExecTimesNs           []int64
+
+	// AnnounceLatency holds the latency of successful announces for the current window
+	AnnounceLatency = NewLatencyHistogram()
 )
 
+// AddAnnounceTime records the duration of a successful announce in nanoseconds
 func AddAnnounceTime(t int64) {
-	execLock.Lock()
-	AnnounceExecTimesNs = append(AnnounceExecTimesNs, t)
-	execLock.Unlock()
-}
-
-func avgExecTime() int64 {
-	execLock.Lock()
-	var t int64
-	var avg int64
-	for _, v := range AnnounceExecTimesNs {
-		t += v
-	}
-	s := int64(len(AnnounceExecTimesNs))
-	if s > 0 {
-		avg = t / s
-		AnnounceExecTimesNs = nil
-	}
-	execLock.Unlock()
-	return avg
+	AnnounceLatency.Record(time.Duration(t))
 }
 
 type RuntimeMetrics struct {
-	TorrentsTotalCached           int64 `prom:"t_cache_torrents" prom_type:"counter"`
-	UsersTotalCached              int64 `prom:"t_cache_users" prom_type:"counter"`
-	PeersTotalCached              int64 `prom:"t_cache_peers" prom_type:"counter"`
 	AnnounceTotal                 int64 `prom:"t_ann_total" prom_type:"gauge"`
 	AnnounceStatusOK              int64 `prom:"t_ann_status_ok" prom_type:"gauge"`
 	AnnounceStatusUnauthorized    int64 `prom:"t_ann_status_unauthorized" prom_type:"gauge"`
+	AnnounceStatusBanned          int64 `prom:"t_ann_status_banned" prom_type:"gauge"`
 	AnnounceStatusInvalidInfoHash int64 `prom:"t_ann_status_invalid_infohash" prom_type:"gauge"`
 	AnnounceStatusMalformed       int64 `prom:"t_ann_status_malformed" prom_type:"gauge"`
 	AnnounceExecTimesNsAvg        int64 `prom:"t_ann_time_ns" prom_type:"gauge"`
+	AnnounceExecTimesNsP50        int64 `prom:"t_ann_time_p50_ns" prom_type:"gauge"`
+	AnnounceExecTimesNsP90        int64 `prom:"t_ann_time_p90_ns" prom_type:"gauge"`
+	AnnounceExecTimesNsP99        int64 `prom:"t_ann_time_p99_ns" prom_type:"gauge"`
+	AnnounceExecTimesNsMax        int64 `prom:"t_ann_time_max_ns" prom_type:"gauge"`
 
 	// GC stats
-	NumGC      int64 `prom:"num_gc" prom_type:"gauge"`
+	NumGC      int64 `prom:"num_gc" prom_type:"counter"`
 	PauseTotal int64 `prom:"pause_total" prom_type:"gauge"`
 
 	// Goro stats
@@ -111,7 +155,7 @@ type RuntimeMetrics struct {
 	AllocHeap      uint64  `prom:"alloc_heap" prom_type:"gauge"`
 	AllocTotal     uint64  `prom:"alloc_total" prom_type:"counter"`
 	MemSys         uint64  `prom:"mem_sys" prom_type:"gauge"`
-	Mallocs        uint64  `prom:"mallocs" prom_type:"gauge"`
+	Mallocs        uint64  `prom:"mallocs" prom_type:"counter"`
 	Frees          uint64  `prom:"frees" prom_type:"counter"`
 	HeapSys        uint64  `prom:"heap_sys" prom_type:"gauge"`
 	HeapIdle       uint64  `prom:"heap_idle" prom_type:"gauge"`
@@ -129,11 +173,11 @@ type RuntimeMetrics struct {
 	OtherSys       uint64  `prom:"other_sys" prom_type:"gauge"`
 	GCNext         uint64  `prom:"gc_next" prom_type:"gauge"`
 	GCLast         uint64  `prom:"gc_last" prom_type:"gauge"`
-	GCPauseTotalNS uint64  `prom:"gc_pause_total_ns" prom_type:"gauge"`
-	GCPauseNS      uint64  `prom:"gc_pause_ns" prom_type:""`
-	GCPauseEnd     uint64  `prom:"gc_pause_end" prom_type:""`
-	GCNum          uint32  `prom:"gc_num" prom_type:""`
-	GCNumForced    uint32  `prom:"gc_num_forced" prom_type:""`
+	GCPauseTotalNS uint64  `prom:"gc_pause_total_ns" prom_type:"counter"`
+	GCPauseNS      uint64  `prom:"gc_pause_ns" prom_type:"gauge"`
+	GCPauseEnd     uint64  `prom:"gc_pause_end" prom_type:"gauge"`
+	GCNum          uint32  `prom:"gc_num" prom_type:"counter"`
+	GCNumForced    uint32  `prom:"gc_num_forced" prom_type:"counter"`
 	GCCPUFraction  float64 `prom:"gc_cpu_fraction" prom_type:"gauge"`
 }
 
@@ -148,6 +192,7 @@ func (m RuntimeMetrics) String() string {
 		out.WriteString(fmt.Sprintf("# TYPE %s %s\n", tagKey, field.Tag.Get("prom_type")))
 		out.WriteString(fmt.Sprintf("%s %v\n", tagKey, v.Field(i).Interface()))
 	}
+	writeRegistered(&out)
 	return out.String()
 }
 
@@ -160,15 +205,19 @@ func Get() RuntimeMetrics {
 	debug.ReadGCStats(&gc)
 	var m RuntimeMetrics
 
-	m.TorrentsTotalCached = atomic.LoadInt64(&TorrentsTotalCached)
-	m.UsersTotalCached = atomic.LoadInt64(&UsersTotalCached)
-	m.PeersTotalCached = atomic.LoadInt64(&PeersTotalCached)
 	m.AnnounceTotal = atomic.SwapInt64(&AnnounceTotal, 0)
 	m.AnnounceStatusOK = atomic.SwapInt64(&AnnounceStatusOK, 0)
 	m.AnnounceStatusUnauthorized = atomic.SwapInt64(&AnnounceStatusUnauthorized, 0)
+	m.AnnounceStatusBanned = atomic.SwapInt64(&AnnounceStatusBanned, 0)
 	m.AnnounceStatusInvalidInfoHash = atomic.SwapInt64(&AnnounceStatusInvalidInfoHash, 0)
 	m.AnnounceStatusMalformed = atomic.SwapInt64(&AnnounceStatusMalformed, 0)
-	m.AnnounceExecTimesNsAvg = avgExecTime()
+	// The latency window is only closed through the admin API so scrapes do not clear it
+	latency := AnnounceLatency.Snapshot()
+	m.AnnounceExecTimesNsAvg = latency.Avg.Nanoseconds()
+	m.AnnounceExecTimesNsP50 = latency.P50.Nanoseconds()
+	m.AnnounceExecTimesNsP90 = latency.P90.Nanoseconds()
+	m.AnnounceExecTimesNsP99 = latency.P99.Nanoseconds()
+	m.AnnounceExecTimesNsMax = latency.Max.Nanoseconds()
 	m.NumGC = gc.NumGC
 	m.PauseTotal = gc.PauseTotal.Milliseconds()
 
@@ -203,7 +252,3 @@ func Get() RuntimeMetrics {
 
 	return m
 }
-
-func init() {
-	execLock = &sync.Mutex{}
-}
@@ -2,12 +2,136 @@ package metrics
 
 import (
 	"github.com/stretchr/testify/require"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
+var sampleRx = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[^}]*\})? (\S+)$`)
+
+// requireExposition validates the output against the prometheus text format rules
+// that matter to scrapers: every sample belongs to a family with a single preceding TYPE
+func requireExposition(t *testing.T, s string) {
+	types := map[string]string{}
+	for i, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		if strings.HasPrefix(line, "# TYPE ") {
+			parts := strings.Fields(line)
+			require.Len(t, parts, 4, "Invalid TYPE line (%d): %s", i, line)
+			_, dupe := types[parts[2]]
+			require.False(t, dupe, "Duplicate TYPE (%d): %s", i, line)
+			require.Contains(t, []string{"counter", "gauge", "histogram"}, parts[3], "Invalid type (%d)", i)
+			types[parts[2]] = parts[3]
+			continue
+		}
+		m := sampleRx.FindStringSubmatch(line)
+		require.NotNil(t, m, "Invalid sample line (%d): %s", i, line)
+		_, err := strconv.ParseFloat(m[3], 64)
+		require.NoError(t, err, "Invalid value (%d): %s", i, line)
+		name := m[1]
+		if _, found := types[name]; !found {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				name = strings.TrimSuffix(name, suffix)
+			}
+			require.Equal(t, "histogram", types[name], "Sample without TYPE (%d): %s", i, line)
+		}
+	}
+}
+
 func TestMetrics_String(t *testing.T) {
+	AnnounceLatency.Record(time.Millisecond)
 	m := Get()
 	require.Greater(t, m.GoRoutines, 0)
+	require.Equal(t, AnnounceLatency.Snapshot().Max.Nanoseconds(), m.AnnounceExecTimesNsMax)
+	require.NotZero(t, Get().AnnounceExecTimesNsMax, "Latency window cleared by Get")
 	s := m.String()
 	require.True(t, len(s) > 100)
+	requireExposition(t, s)
+}
+
+func TestHistogramVec(t *testing.T) {
+	hv := NewHistogramVec("t_test_hist", "test histogram", []float64{0.1, 1}, "op")
+	hv.With("get").Observe(0.05)
+	hv.With("get").Observe(0.5)
+	hv.With("get").Observe(5)
+	hv.Since(time.Now(), "set")
+	require.Equal(t, uint64(3), hv.With("get").Count())
+	require.InDelta(t, 5.55, hv.With("get").Sum(), 0.0001)
+	out := hv.String()
+	require.Contains(t, out, "# TYPE t_test_hist histogram\n")
+	require.Contains(t, out, "t_test_hist_bucket{op=\"get\",le=\"0.1\"} 1\n")
+	require.Contains(t, out, "t_test_hist_bucket{op=\"get\",le=\"1\"} 2\n")
+	require.Contains(t, out, "t_test_hist_bucket{op=\"get\",le=\"+Inf\"} 3\n")
+	require.Contains(t, out, "t_test_hist_count{op=\"get\"} 3\n")
+	require.Contains(t, out, "t_test_hist_count{op=\"set\"} 1\n")
+	RegisterGaugeFunc("t_test_gauge", "test gauge", func() float64 { return 42 })
+	RegisterGaugeFunc("t_test_gauge", "test gauge", func() float64 { return 43 })
+	s := Get().String()
+	require.Contains(t, s, "t_test_gauge 43\n")
+	requireExposition(t, s)
+}
+
+func TestCounterVec(t *testing.T) {
+	cv := NewCounterVec("t_test_vec", "test counter", "rule", "action")
+	cv.Inc("b", "deny")
+	cv.Inc("a", "flag")
+	cv.Add(2, "a", "flag")
+	require.Equal(t, int64(3), cv.Get("a", "flag"))
+	require.Equal(t, int64(0), cv.Get("c", "deny"))
+	require.Equal(t, "# HELP t_test_vec test counter\n"+
+		"# TYPE t_test_vec counter\n"+
+		"t_test_vec{rule=\"a\",action=\"flag\"} 3\n"+
+		"t_test_vec{rule=\"b\",action=\"deny\"} 1\n"+
+		"t_test_vec{rule=\"c\",action=\"deny\"} 0\n", cv.String())
+	require.Contains(t, Get().String(), "t_test_vec{rule=\"b\",action=\"deny\"} 1")
+}
+
+func TestLatencyIndex(t *testing.T) {
+	for _, v := range []uint64{0, 1, 15, 16, 17, 31, 32, 1000, 123456789, 1 << 40, 1<<64 - 1} {
+		idx := latencyIndex(v)
+		require.True(t, idx < latencyBuckets, "Index out of range: %d", v)
+		require.True(t, v <= latencyUpper(idx), "Value above bucket: %d", v)
+		if idx > 0 {
+			require.True(t, v > latencyUpper(idx-1), "Value below bucket: %d", v)
+		}
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	h := NewLatencyHistogram()
+	require.Equal(t, LatencySummary{}, h.Snapshot())
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Microsecond)
+	}
+	s := h.Snapshot()
+	require.Equal(t, uint64(1000), s.Count)
+	require.Equal(t, time.Millisecond, s.Max)
+	require.InDelta(t, 500500*time.Nanosecond, s.Avg, float64(time.Microsecond))
+	// Bucket precision is 1/16
+	for _, q := range []struct {
+		expected time.Duration
+		actual   time.Duration
+	}{{500 * time.Microsecond, s.P50}, {900 * time.Microsecond, s.P90}, {990 * time.Microsecond, s.P99}} {
+		require.InEpsilon(t, float64(q.expected), float64(q.actual), 1.0/16)
+	}
+	require.Equal(t, s, h.Reset())
+	require.Equal(t, LatencySummary{}, h.Snapshot())
+	h.Record(time.Second)
+	require.Equal(t, time.Second, h.Reset().P99)
+	require.Equal(t, LatencySummary{}, h.Reset())
+}
+
+func BenchmarkLatencyHistogram(b *testing.B) {
+	h := NewLatencyHistogram()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			h.Record(time.Duration(i))
+			i++
+		}
+	})
 }
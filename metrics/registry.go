@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// labelSep is used to join label values into a single map key
+const labelSep = "\xff"
+
+// collector is implemented by the metric types which are written in the prometheus
+// text exposition format
+type collector interface {
+	// metricName returns the metric family name
+	metricName() string
+	// write appends the HELP, TYPE and sample lines to out
+	write(out *strings.Builder)
+}
+
+var (
+	registryMu    = &sync.RWMutex{}
+	registry      = make(map[string]collector)
+	registryNames []string
+)
+
+// register adds the collector to the set written by RuntimeMetrics.String. Registering
+// a name a second time replaces the existing collector.
+func register(c collector) {
+	registryMu.Lock()
+	if _, found := registry[c.metricName()]; !found {
+		registryNames = append(registryNames, c.metricName())
+	}
+	registry[c.metricName()] = c
+	registryMu.Unlock()
+}
+
+// writeRegistered writes all registered collectors in registration order
+func writeRegistered(out *strings.Builder) {
+	registryMu.RLock()
+	for _, name := range registryNames {
+		registry[name].write(out)
+	}
+	registryMu.RUnlock()
+}
+
+func writeHeader(out *strings.Builder, name string, help string, promType string) {
+	out.WriteString(fmt.Sprintf("# HELP %s %s\n", name, help))
+	out.WriteString(fmt.Sprintf("# TYPE %s %s\n", name, promType))
+}
+
+// formatLabels returns the label set for a sample in the form {a="1",b="2"}. extra holds
+// additional name/value pairs appended after the regular labels. An empty string is
+// returned when there are no labels.
+func formatLabels(names []string, key string, extra ...string) string {
+	var values []string
+	if len(names) > 0 {
+		values = strings.Split(key, labelSep)
+	}
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, value))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// family holds the children of a labeled metric keyed by their label values
+type family struct {
+	*sync.RWMutex
+	name     string
+	help     string
+	labels   []string
+	children map[string]interface{}
+	newChild func() interface{}
+}
+
+func newFamily(name string, help string, labels []string, newChild func() interface{}) *family {
+	return &family{
+		RWMutex:  &sync.RWMutex{},
+		name:     name,
+		help:     help,
+		labels:   labels,
+		children: make(map[string]interface{}),
+		newChild: newChild,
+	}
+}
+
+func (f *family) metricName() string {
+	return f.name
+}
+
+// child returns the child for the label values, creating it if required
+func (f *family) child(values []string) interface{} {
+	key := strings.Join(values, labelSep)
+	f.RLock()
+	c, found := f.children[key]
+	f.RUnlock()
+	if found {
+		return c
+	}
+	f.Lock()
+	c, found = f.children[key]
+	if !found {
+		c = f.newChild()
+		f.children[key] = c
+	}
+	f.Unlock()
+	return c
+}
+
+// each calls fn for every child sorted by label values. Must not be called with
+// the lock held.
+func (f *family) each(fn func(key string, child interface{})) {
+	f.RLock()
+	keys := make([]string, 0, len(f.children))
+	for k := range f.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fn(k, f.children[k])
+	}
+	f.RUnlock()
+}
@@ -0,0 +1,206 @@
+package store
+
+import (
+	"github.com/leighmacdonald/mika/util"
+	"github.com/pkg/errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Ban defines a banned IP address or network. Requests originating from a banned
+// address are rejected before any other processing takes place.
+type Ban struct {
+	// CIDR is the banned network in CIDR notation, single hosts are stored as /32 or /128
+	CIDR string `db:"cidr" json:"cidr"`
+	// Reason is displayed to the client
+	Reason string `db:"reason" json:"reason"`
+	// CreatedBy is the name of the admin who created the ban
+	CreatedBy string `db:"created_by" json:"created_by"`
+	// CreatedOn is when the ban was created
+	CreatedOn time.Time `db:"created_on" json:"created_on"`
+	// Expires is when the ban is lifted, zero values never expire
+	Expires time.Time `db:"expires" json:"expires"`
+}
+
+// NewBan creates a new ban for the address or network provided. A zero duration creates
+// a permanent ban.
+func NewBan(cidr string, reason string, createdBy string, duration time.Duration) (Ban, error) {
+	network, err := ParseBanCIDR(cidr)
+	if err != nil {
+		return Ban{}, err
+	}
+	ban := Ban{
+		CIDR:      network.String(),
+		Reason:    reason,
+		CreatedBy: createdBy,
+		CreatedOn: time.Now(),
+	}
+	if duration > 0 {
+		ban.Expires = ban.CreatedOn.Add(duration)
+	}
+	return ban, nil
+}
+
+// ParseBanCIDR parses the address or network into its canonical network form. IPv4-mapped
+// IPv6 networks such as ::ffff:1.2.3.0/120 are converted to their IPv4 form (1.2.3.0/24)
+// so they match the same addresses as the equivalent IPv4 ban.
+func ParseBanCIDR(cidr string) (*net.IPNet, error) {
+	networks, err := util.ParseCIDRs([]string{cidr})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid ban address: %s", cidr)
+	}
+	network := networks[0]
+	ones, bits := network.Mask.Size()
+	if v4 := network.IP.To4(); v4 != nil && bits == 8*net.IPv6len {
+		if ones < 8*(net.IPv6len-net.IPv4len) {
+			return nil, errors.Errorf("Invalid ban address: %s", cidr)
+		}
+		network = &net.IPNet{
+			IP:   v4,
+			Mask: net.CIDRMask(ones-8*(net.IPv6len-net.IPv4len), 8*net.IPv4len),
+		}
+	}
+	return network, nil
+}
+
+// Expired returns true if the ban is no longer in effect
+func (b Ban) Expired() bool {
+	return !b.Expires.IsZero() && time.Now().After(b.Expires)
+}
+
+// banNode is a single bit position within the BanTree
+type banNode struct {
+	children [2]*banNode
+	ban      *Ban
+}
+
+// BanTree is a binary prefix tree (trie) of banned networks allowing lookups in
+// O(address bits) regardless of the number of bans loaded. IPv4 and IPv6 networks
+// are stored in separate roots.
+type BanTree struct {
+	*sync.RWMutex
+	v4   *banNode
+	v6   *banNode
+	size int
+}
+
+// NewBanTree returns a new empty BanTree
+func NewBanTree() *BanTree {
+	return &BanTree{
+		RWMutex: &sync.RWMutex{},
+		v4:      &banNode{},
+		v6:      &banNode{},
+	}
+}
+
+// root returns the tree root and address bytes for the network family of the ip
+func (t *BanTree) root(ip net.IP) (*banNode, net.IP) {
+	if v4 := ip.To4(); v4 != nil {
+		return t.v4, v4
+	}
+	return t.v6, ip.To16()
+}
+
+// Add inserts or replaces the ban in the tree
+func (t *BanTree) Add(ban Ban) error {
+	network, err := ParseBanCIDR(ban.CIDR)
+	if err != nil {
+		return err
+	}
+	ban.CIDR = network.String()
+	ones, _ := network.Mask.Size()
+	t.Lock()
+	node, ip := t.root(network.IP)
+	for i := 0; i < ones && i < len(ip)*8; i++ {
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &banNode{}
+		}
+		node = node.children[bit]
+	}
+	if node.ban == nil {
+		t.size++
+	}
+	node.ban = &ban
+	t.Unlock()
+	return nil
+}
+
+// Delete removes the ban matching the network exactly. Returns false if no
+// such ban exists.
+func (t *BanTree) Delete(cidr string) bool {
+	network, err := ParseBanCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	ones, _ := network.Mask.Size()
+	t.Lock()
+	node, ip := t.root(network.IP)
+	for i := 0; i < ones && i < len(ip)*8 && node != nil; i++ {
+		node = node.children[(ip[i/8]>>(7-uint(i%8)))&1]
+	}
+	if node == nil || node.ban == nil {
+		t.Unlock()
+		return false
+	}
+	node.ban = nil
+	t.size--
+	t.Unlock()
+	return true
+}
+
+// Match returns the most specific active ban covering the ip, if any
+func (t *BanTree) Match(ip net.IP) (Ban, bool) {
+	if ip == nil {
+		return Ban{}, false
+	}
+	var found *Ban
+	t.RLock()
+	node, addr := t.root(ip)
+	for i := 0; node != nil; i++ {
+		if node.ban != nil && !node.ban.Expired() {
+			found = node.ban
+		}
+		if i == len(addr)*8 {
+			break
+		}
+		node = node.children[(addr[i/8]>>(7-uint(i%8)))&1]
+	}
+	t.RUnlock()
+	if found == nil {
+		return Ban{}, false
+	}
+	return *found, true
+}
+
+// All returns all bans in the tree including expired entries
+func (t *BanTree) All() []Ban {
+	var bans []Ban
+	t.RLock()
+	for _, root := range []*banNode{t.v4, t.v6} {
+		stack := []*banNode{root}
+		for len(stack) > 0 {
+			node := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if node.ban != nil {
+				bans = append(bans, *node.ban)
+			}
+			for _, child := range node.children {
+				if child != nil {
+					stack = append(stack, child)
+				}
+			}
+		}
+	}
+	t.RUnlock()
+	return bans
+}
+
+// Len returns the number of bans in the tree
+func (t *BanTree) Len() int {
+	t.RLock()
+	size := t.size
+	t.RUnlock()
+	return size
+}
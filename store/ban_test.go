@@ -0,0 +1,101 @@
+package store
+
+import (
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBanTree(t *testing.T) {
+	tree := NewBanTree()
+	b1, err := NewBan("10.0.0.0/8", "network", "admin", 0)
+	require.NoError(t, err)
+	b2, err := NewBan("10.1.2.3", "host", "admin", 0)
+	require.NoError(t, err)
+	require.Equal(t, "10.1.2.3/32", b2.CIDR)
+	b3, err := NewBan("2600::/16", "v6", "admin", time.Hour)
+	require.NoError(t, err)
+	b4 := Ban{CIDR: "8.8.8.8/32", Reason: "expired", Expires: time.Now().Add(-time.Minute)}
+	for _, b := range []Ban{b1, b2, b3, b4} {
+		require.NoError(t, tree.Add(b))
+	}
+	require.Error(t, tree.Add(Ban{CIDR: "invalid"}))
+	require.Equal(t, 4, tree.Len())
+	require.Len(t, tree.All(), 4)
+
+	cases := []struct {
+		ip     string
+		reason string
+	}{
+		{"10.9.9.9", "network"},
+		{"10.1.2.3", "host"},
+		{"2600::1", "v6"},
+		{"8.8.8.8", ""},
+		{"11.0.0.1", ""},
+		{"2601::1", ""},
+	}
+	for _, c := range cases {
+		ban, found := tree.Match(net.ParseIP(c.ip))
+		require.Equal(t, c.reason != "", found, c.ip)
+		require.Equal(t, c.reason, ban.Reason, c.ip)
+	}
+	require.True(t, tree.Delete("10.1.2.3"))
+	require.False(t, tree.Delete("10.1.2.3"))
+	ban, found := tree.Match(net.ParseIP("10.1.2.3"))
+	require.True(t, found)
+	require.Equal(t, "network", ban.Reason)
+	require.Equal(t, 3, tree.Len())
+}
+
+func TestParseBanCIDR(t *testing.T) {
+	cases := []struct {
+		cidr     string
+		expected string
+		valid    bool
+	}{
+		{"1.2.3.0/24", "1.2.3.0/24", true},
+		{"1.2.3.4", "1.2.3.4/32", true},
+		{"::ffff:1.2.3.0/120", "1.2.3.0/24", true},
+		{"::ffff:1.2.3.4", "1.2.3.4/32", true},
+		{"::ffff:0:0/96", "0.0.0.0/0", true},
+		{"::ffff:1.2.3.4/95", "::fffe:0:0/95", true},
+		{"2600::/16", "2600::/16", true},
+		{"2600::1", "2600::1/128", true},
+		{"1.2.3.0/120", "", false},
+		{"invalid", "", false},
+	}
+	for _, c := range cases {
+		network, err := ParseBanCIDR(c.cidr)
+		if !c.valid {
+			require.Error(t, err, c.cidr)
+			continue
+		}
+		require.NoError(t, err, c.cidr)
+		require.Equal(t, c.expected, network.String(), c.cidr)
+	}
+}
+
+func TestBanTreeMappedCIDR(t *testing.T) {
+	tree := NewBanTree()
+	require.NoError(t, tree.Add(Ban{CIDR: "::ffff:1.2.3.0/120", Reason: "mapped"}))
+	require.NoError(t, tree.Add(Ban{CIDR: "2600::/16", Reason: "v6"}))
+	cases := []struct {
+		ip     string
+		reason string
+	}{
+		{"1.2.3.4", "mapped"},
+		{"::ffff:1.2.3.4", "mapped"},
+		{"1.2.4.1", ""},
+		{"2600::1", "v6"},
+		{"::1.2.3.4", ""},
+	}
+	for _, c := range cases {
+		ban, found := tree.Match(net.ParseIP(c.ip))
+		require.Equal(t, c.reason != "", found, c.ip)
+		require.Equal(t, c.reason, ban.Reason, c.ip)
+	}
+	require.True(t, tree.Delete("1.2.3.0/24"))
+	require.False(t, tree.Delete("::ffff:1.2.3.0/120"))
+	require.Equal(t, 1, tree.Len())
+}
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"encoding/json"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+// InvalidationKind identifies the cached data an Invalidation applies to
+type InvalidationKind string
+
+const (
+	// InvalidateTorrent applies to a TorrentCache entry, the key is the hex info hash
+	InvalidateTorrent InvalidationKind = "torrent"
+	// InvalidateUser applies to a UserCache entry, the key is the passkey
+	InvalidateUser InvalidationKind = "user"
+	// InvalidateWhitelist reloads the client whitelist, the key is unused
+	InvalidateWhitelist InvalidationKind = "whitelist"
+	// InvalidateBans reloads the ban list, the key is unused
+	InvalidateBans InvalidationKind = "bans"
+)
+
+// InvalidationAction is what a node receiving an Invalidation does with the cached entry
+type InvalidationAction string
+
+const (
+	// ActionEvict removes the cached entry, it is loaded again on the next lookup
+	ActionEvict InvalidationAction = "evict"
+	// ActionRefresh reloads the cached entry from the backing store if it is cached
+	ActionRefresh InvalidationAction = "refresh"
+)
+
+// Invalidation describes a change made to the backing store which cached copies of the
+// data held by other nodes must reflect
+type Invalidation struct {
+	Kind   InvalidationKind   `json:"kind"`
+	Action InvalidationAction `json:"action"`
+	Key    string             `json:"key,omitempty"`
+}
+
+// InvalidationMsg is a batch of invalidations sent over an InvalidationBus
+type InvalidationMsg struct {
+	// Node is the id of the sending node, nodes ignore their own messages
+	Node  string         `json:"node"`
+	Items []Invalidation `json:"items"`
+}
+
+// Encode returns the wire format of the message shared by the bus transports
+func (m InvalidationMsg) Encode() ([]byte, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to encode invalidation message")
+	}
+	return b, nil
+}
+
+// DecodeInvalidationMsg parses a message in the format written by Encode
+func DecodeInvalidationMsg(msg *InvalidationMsg, b []byte) error {
+	if err := json.Unmarshal(b, msg); err != nil {
+		return errors.Wrap(err, "Failed to decode invalidation message")
+	}
+	return nil
+}
+
+// InvalidationBus delivers cache invalidations between the tracker nodes sharing the
+// same backing stores
+type InvalidationBus interface {
+	// Publish sends the message to every subscribed node, which may include the sender
+	Publish(msg InvalidationMsg) error
+	// Subscribe starts delivering received messages to the handler until the bus is
+	// closed. It may only be called once.
+	Subscribe(handler func(msg InvalidationMsg)) error
+	// Close stops any subscription and releases the transport
+	Close() error
+}
+
+// BusDriver provides a interface to enable registration of InvalidationBus transports
+type BusDriver interface {
+	// New instantiates a new InvalidationBus
+	New(config interface{}) (InvalidationBus, error)
+}
+
+var (
+	busDriversMutex = sync.RWMutex{}
+	busDrivers      = make(map[string]BusDriver)
+)
+
+// AddBusDriver will register a new driver able to instantiate a InvalidationBus
+func AddBusDriver(name string, driver BusDriver) {
+	busDriversMutex.Lock()
+	defer busDriversMutex.Unlock()
+	busDrivers[name] = driver
+	log.Debugf("Registered invalidation bus driver: %s", name)
+}
+
+// NewInvalidationBus will attempt to initialize a InvalidationBus using the driver name provided
+func NewInvalidationBus(busType string, config interface{}) (InvalidationBus, error) {
+	busDriversMutex.RLock()
+	defer busDriversMutex.RUnlock()
+	driver, found := busDrivers[busType]
+	if !found {
+		return nil, consts.ErrInvalidDriver
+	}
+	return driver.New(config)
+}
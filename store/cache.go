@@ -1,163 +1,440 @@
 package store
 
 import (
+	"container/list"
 	"github.com/leighmacdonald/mika/metrics"
+	"github.com/leighmacdonald/mika/util"
+	"github.com/pkg/errors"
 	"sync"
-	"sync/atomic"
+	"time"
 )
 
-type UserCache struct {
-	*sync.RWMutex
-	users map[string]User
+// CacheOpts bounds the size and lifetime of the entries held by a cache
+type CacheOpts struct {
+	// MaxEntries is the number of entries held before the least recently used entry is
+	// evicted. 0 is unbounded.
+	MaxEntries int
+	// TTL is how long an entry is served before it expires, entries in use are refreshed
+	// before expiring by Refresh. 0 never expires.
+	TTL time.Duration
+	// NegativeTTL is how long a failed lookup is remembered so repeated requests for unknown
+	// keys do not reach the backing store. 0 disables negative caching.
+	NegativeTTL time.Duration
 }
 
-// TorrentCache is a simple (dumb) in-memory cache for torrent items
-type TorrentCache struct {
-	*sync.RWMutex
-	torrents map[InfoHash]Torrent
+// cacheEntry is the element value stored in the lru list
+type cacheEntry struct {
+	key   interface{}
+	value interface{}
+	// err is returned for negative entries, which have no value
+	err error
+	// expires is the unix time in nanoseconds the entry is valid until, 0 never expires
+	expires int64
+	// used is set when the entry is read, only entries in use are refreshed
+	used bool
 }
 
-type PeerCache struct {
-	*sync.RWMutex
-	swarms map[InfoHash]Swarm
+// lru is the bounded, expiring map shared by the caches. The most recently used entries
+// are at the front of the list.
+type lru struct {
+	*sync.Mutex
+	name  string
+	opts  CacheOpts
+	items map[interface{}]*list.Element
+	order *list.List
 }
 
-func NewUserCache() *UserCache {
-	return &UserCache{
-		RWMutex: &sync.RWMutex{},
-		users:   make(map[string]User),
+func newLRU(name string, opts CacheOpts) *lru {
+	c := &lru{
+		Mutex: &sync.Mutex{},
+		name:  name,
+		opts:  opts,
+		items: make(map[interface{}]*list.Element),
+		order: list.New(),
 	}
+	metrics.RegisterGaugeFunc("t_cache_"+name,
+		"t_cache_"+name+" is the current count of cached "+name,
+		func() float64 { return float64(c.len()) })
+	return c
 }
 
-// NewTorrentCache configures and returns a new instance of TorrentCache
-func NewTorrentCache() *TorrentCache {
-	return &TorrentCache{
-		RWMutex:  &sync.RWMutex{},
-		torrents: make(map[InfoHash]Torrent),
+func expiry(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
 	}
+	return time.Now().Add(ttl).UnixNano()
 }
 
-func NewPeerCache() *PeerCache {
-	return &PeerCache{
-		RWMutex: &sync.RWMutex{},
-		swarms:  map[InfoHash]Swarm{},
+// get returns the value, or error for negative entries, of the key. Expired entries are
+// removed and reported as a miss.
+func (c *lru) get(key interface{}) (interface{}, bool, error) {
+	c.Lock()
+	defer c.Unlock()
+	elem, found := c.items[key]
+	if !found {
+		metrics.CacheMisses.Inc(c.name)
+		return nil, false, nil
+	}
+	e := elem.Value.(*cacheEntry)
+	if e.expires > 0 && e.expires < time.Now().UnixNano() {
+		c.removeElement(elem, "expired")
+		metrics.CacheMisses.Inc(c.name)
+		return nil, false, nil
 	}
+	c.order.MoveToFront(elem)
+	if e.err != nil {
+		metrics.CacheHits.Inc(c.name, "negative")
+		return nil, true, e.err
+	}
+	e.used = true
+	metrics.CacheHits.Inc(c.name, "positive")
+	return e.value, true, nil
 }
 
-// Add inserts a torrent into the cache
-func (cache *TorrentCache) Set(t Torrent) {
-	cache.Lock()
-	cache.torrents[t.InfoHash] = t
-	cache.Unlock()
-	atomic.AddInt64(&metrics.TorrentsTotalCached, 1)
+// set inserts or replaces the entry, evicting the least recently used entry when full
+func (c *lru) set(key interface{}, value interface{}) {
+	c.put(&cacheEntry{key: key, value: value, expires: expiry(c.opts.TTL)})
 }
 
-func (cache *TorrentCache) Update(infoHash InfoHash, stats TorrentStats) {
-	var t Torrent
-	if !cache.Get(&t, infoHash) {
+// setMissing records that the key does not exist in the backing store, err is returned
+// by get until the entry expires
+func (c *lru) setMissing(key interface{}, err error) {
+	if c.opts.NegativeTTL <= 0 {
 		return
 	}
-	t.Announces += stats.Announces
-	t.Downloaded += stats.Downloaded
-	t.Uploaded += stats.Uploaded
-	t.Snatches += stats.Snatches
-	t.Leechers += stats.Leechers
-	t.Seeders += stats.Seeders
-	cache.Set(t)
+	c.put(&cacheEntry{key: key, err: err, expires: expiry(c.opts.NegativeTTL)})
+}
+
+func (c *lru) put(e *cacheEntry) {
+	c.Lock()
+	defer c.Unlock()
+	if elem, found := c.items[e.key]; found {
+		e.used = elem.Value.(*cacheEntry).used
+		elem.Value = e
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.items[e.key] = c.order.PushFront(e)
+	if c.opts.MaxEntries > 0 && c.order.Len() > c.opts.MaxEntries {
+		c.removeElement(c.order.Back(), "size")
+	}
+}
+
+// update replaces the value of a positive entry using fn without changing its expiry or
+// position, returning false if the key is not cached
+func (c *lru) update(key interface{}, fn func(value interface{}) interface{}) bool {
+	c.Lock()
+	defer c.Unlock()
+	elem, found := c.items[key]
+	if !found {
+		return false
+	}
+	e := elem.Value.(*cacheEntry)
+	if e.err != nil {
+		return false
+	}
+	e.value = fn(e.value)
+	return true
+}
+
+func (c *lru) remove(key interface{}) {
+	c.Lock()
+	if elem, found := c.items[key]; found {
+		c.removeElement(elem, "")
+	}
+	c.Unlock()
+}
+
+// removeElement deletes the entry, the caller must hold the lock. A non empty reason is
+// counted as an eviction.
+func (c *lru) removeElement(elem *list.Element, reason string) {
+	c.order.Remove(elem)
+	delete(c.items, elem.Value.(*cacheEntry).key)
+	if reason != "" {
+		metrics.CacheEvictions.Inc(c.name, reason)
+	}
+}
+
+// expiring removes the expired entries and returns the keys of the entries read since the
+// last call which expire within the window. Negative entries are never refreshed.
+func (c *lru) expiring(window time.Duration) []interface{} {
+	var keys []interface{}
+	now := time.Now()
+	deadline := now.Add(window).UnixNano()
+	c.Lock()
+	for elem := c.order.Back(); elem != nil; {
+		prev := elem.Prev()
+		e := elem.Value.(*cacheEntry)
+		if e.expires > 0 {
+			if e.expires < now.UnixNano() {
+				c.removeElement(elem, "expired")
+			} else if e.used && e.err == nil && e.expires < deadline {
+				keys = append(keys, e.key)
+				e.used = false
+			}
+		}
+		elem = prev
+	}
+	c.Unlock()
+	return keys
+}
+
+// contains returns true if the key is cached, without counting the lookup or changing
+// its position
+func (c *lru) contains(key interface{}) bool {
+	c.Lock()
+	_, found := c.items[key]
+	c.Unlock()
+	return found
+}
+
+func (c *lru) len() int {
+	c.Lock()
+	n := c.order.Len()
+	c.Unlock()
+	return n
+}
+
+// TorrentCache is a bounded in-memory cache of torrents which also remembers unknown
+// info hashes
+type TorrentCache struct {
+	cache *lru
+}
+
+// NewTorrentCache configures and returns a new instance of TorrentCache
+func NewTorrentCache(opts CacheOpts) *TorrentCache {
+	return &TorrentCache{cache: newLRU("torrents", opts)}
+}
+
+// Set inserts a torrent into the cache
+func (cache *TorrentCache) Set(t Torrent) {
+	cache.cache.set(t.InfoHash, t)
+}
+
+// SetMissing caches the failed lookup of an unknown info hash, err is returned by Get
+// for the negative TTL
+func (cache *TorrentCache) SetMissing(ih InfoHash, err error) {
+	cache.cache.setMissing(ih, err)
+}
+
+// Update applies the batched stats to the cached torrent
+func (cache *TorrentCache) Update(infoHash InfoHash, stats TorrentStats) {
+	cache.cache.update(infoHash, func(v interface{}) interface{} {
+		t := v.(Torrent)
+		t.Announces += stats.Announces
+		t.Downloaded += stats.Downloaded
+		t.Uploaded += stats.Uploaded
+		t.Snatches += stats.Snatches
+		t.Leechers += stats.Leechers
+		t.Seeders += stats.Seeders
+		return t
+	})
 }
 
 // Delete will mark a torrent as deleted in the backing store.
 // If dropRow is true, it will permanently remove the torrent from the store
 func (cache *TorrentCache) Delete(ih InfoHash, dropRow bool) {
-	cache.Lock()
-	defer cache.Unlock()
 	if dropRow {
-		delete(cache.torrents, ih)
-		atomic.AddInt64(&metrics.TorrentsTotalCached, -1)
-	} else {
-		t, found := cache.torrents[ih]
-		if !found {
-			return
-		}
+		cache.cache.remove(ih)
+		return
+	}
+	cache.cache.update(ih, func(v interface{}) interface{} {
+		t := v.(Torrent)
 		t.IsDeleted = true
-		cache.torrents[ih] = t
+		return t
+	})
+}
+
+// Invalidate removes any cached entry, positive or negative, for the info hash
+func (cache *TorrentCache) Invalidate(ih InfoHash) {
+	cache.cache.remove(ih)
+}
+
+// Get returns true if the info hash is cached, copying the torrent into torrent. If the
+// info hash is cached as unknown the lookup error is returned.
+func (cache *TorrentCache) Get(torrent *Torrent, hash InfoHash) (bool, error) {
+	v, found, err := cache.cache.get(hash)
+	if !found || err != nil {
+		return found, err
 	}
+	*torrent = v.(Torrent)
+	return true, nil
 }
 
-// Get returns the Torrent matching the infohash.
-// consts.ErrInvalidInfoHash is returned on failed lookup
-func (cache *TorrentCache) Get(torrent *Torrent, hash InfoHash) bool {
-	t, found := cache.torrents[hash]
-	if !found {
-		return false
+// Refresh reloads the torrents in use which expire within the window using load.
+// Expired entries are removed. If load fails with the error returned for unknown info
+// hashes, missingErr, the torrent is cached as missing, otherwise it is removed.
+func (cache *TorrentCache) Refresh(window time.Duration, missingErr error,
+	load func(torrent *Torrent, hash InfoHash) error) {
+	for _, key := range cache.cache.expiring(window) {
+		cache.reload(key.(InfoHash), missingErr, load)
 	}
-	*torrent = t
-	return true
 }
 
+// Reload replaces the cached entry for the info hash with the result of load, the info
+// hash is ignored if it is not cached.
+func (cache *TorrentCache) Reload(ih InfoHash, missingErr error, load func(torrent *Torrent, hash InfoHash) error) {
+	if cache.cache.contains(ih) {
+		cache.reload(ih, missingErr, load)
+	}
+}
+
+func (cache *TorrentCache) reload(ih InfoHash, missingErr error, load func(torrent *Torrent, hash InfoHash) error) {
+	var t Torrent
+	if err := load(&t, ih); err != nil {
+		if errors.Is(err, missingErr) {
+			cache.SetMissing(ih, err)
+		} else {
+			cache.Invalidate(ih)
+		}
+		return
+	}
+	cache.Set(t)
+}
+
+// Len returns the number of cached entries
+func (cache *TorrentCache) Len() int {
+	return cache.cache.len()
+}
+
+// UserCache is a bounded in-memory cache of users which also remembers unknown passkeys
+type UserCache struct {
+	cache *lru
+}
+
+// NewUserCache configures and returns a new instance of UserCache
+func NewUserCache(opts CacheOpts) *UserCache {
+	return &UserCache{cache: newLRU("users", opts)}
+}
+
+// Set inserts a user into the cache
 func (cache *UserCache) Set(user User) {
-	cache.Lock()
-	cache.users[user.Passkey] = user
-	cache.Unlock()
-	atomic.AddInt64(&metrics.UsersTotalCached, 1)
+	cache.cache.set(user.Passkey, user)
 }
 
-func (cache *UserCache) Get(user *User, passkey string) bool {
-	cache.RLock()
-	u, found := cache.users[passkey]
-	cache.RUnlock()
-	if !found {
-		return false
+// SetMissing caches the failed lookup of an unknown passkey, err is returned by Get
+// for the negative TTL
+func (cache *UserCache) SetMissing(passkey string, err error) {
+	cache.cache.setMissing(passkey, err)
+}
+
+// Get returns true if the passkey is cached, copying the user into user. If the passkey
+// is cached as unknown the lookup error is returned.
+func (cache *UserCache) Get(user *User, passkey string) (bool, error) {
+	v, found, err := cache.cache.get(passkey)
+	if !found || err != nil {
+		return found, err
 	}
-	*user = u
-	return true
+	*user = v.(User)
+	return true, nil
 }
 
+// Update applies the batched stats to the cached user
+func (cache *UserCache) Update(passkey string, stats UserStats) {
+	cache.cache.update(passkey, func(v interface{}) interface{} {
+		u := v.(User)
+		u.Downloaded += stats.Downloaded
+		u.Uploaded += stats.Uploaded
+		u.Announces += stats.Announces
+		return u
+	})
+}
+
+// Delete removes any cached entry, positive or negative, for the passkey
 func (cache *UserCache) Delete(passkey string) {
-	cache.Lock()
-	delete(cache.users, passkey)
-	cache.Unlock()
-	atomic.AddInt64(&metrics.UsersTotalCached, -1)
+	cache.cache.remove(passkey)
 }
 
-func (cache *PeerCache) Set(infoHash InfoHash, peer Peer) {
-	cache.RLock()
-	_, found := cache.swarms[infoHash]
-	cache.RUnlock()
-	if !found {
-		cache.swarms[infoHash] = NewSwarm()
+// Refresh reloads the users in use which expire within the window using load.
+// Expired entries are removed. If load fails with the error returned for unknown
+// passkeys, missingErr, the passkey is cached as missing, otherwise it is removed.
+func (cache *UserCache) Refresh(window time.Duration, missingErr error,
+	load func(user *User, passkey string) error) {
+	for _, key := range cache.cache.expiring(window) {
+		cache.reload(key.(string), missingErr, load)
 	}
-	cache.Lock()
-	cache.swarms[infoHash].Add(peer)
-	cache.Unlock()
-	atomic.AddInt64(&metrics.PeersTotalCached, 1)
 }
 
+// Reload replaces the cached entry for the passkey with the result of load, the passkey
+// is ignored if it is not cached.
+func (cache *UserCache) Reload(passkey string, missingErr error, load func(user *User, passkey string) error) {
+	if cache.cache.contains(passkey) {
+		cache.reload(passkey, missingErr, load)
+	}
+}
+
+func (cache *UserCache) reload(passkey string, missingErr error, load func(user *User, passkey string) error) {
+	var u User
+	if err := load(&u, passkey); err != nil {
+		if errors.Is(err, missingErr) {
+			cache.SetMissing(passkey, err)
+		} else {
+			cache.Delete(passkey)
+		}
+		return
+	}
+	cache.Set(u)
+}
+
+// Len returns the number of cached entries
+func (cache *UserCache) Len() int {
+	return cache.cache.len()
+}
+
+// PeerCache is a bounded in-memory cache of peers keyed by their swarm and peer id
+type PeerCache struct {
+	cache *lru
+}
+
+// NewPeerCache configures and returns a new instance of PeerCache. Peers are always
+// found through their swarm so negative caching is not used.
+func NewPeerCache(opts CacheOpts) *PeerCache {
+	opts.NegativeTTL = 0
+	return &PeerCache{cache: newLRU("peers", opts)}
+}
+
+// Set inserts a peer into the cache
+func (cache *PeerCache) Set(infoHash InfoHash, peer Peer) {
+	cache.cache.set(NewPeerHash(infoHash, peer.PeerID), peer)
+}
+
+// Get returns true if the peer is cached, copying it into peer
 func (cache *PeerCache) Get(peer *Peer, infoHash InfoHash, peerID PeerID) bool {
-	cache.RLock()
-	_, found := cache.swarms[infoHash]
-	cache.RUnlock()
+	v, found, _ := cache.cache.get(NewPeerHash(infoHash, peerID))
 	if !found {
 		return false
 	}
-	cache.RLock()
-	if err := cache.swarms[infoHash].Get(peer, peerID); err != nil {
-		cache.RUnlock()
-		return false
-	}
-	cache.RUnlock()
+	*peer = v.(Peer)
 	return true
 }
 
+// Update applies the batched stats to the cached peer
+func (cache *PeerCache) Update(ph PeerHash, stats PeerStats) {
+	cache.cache.update(ph, func(v interface{}) interface{} {
+		p := v.(Peer)
+		sum := stats.Totals()
+		p.Downloaded += sum.TotalDn
+		p.Uploaded += sum.TotalUp
+		p.SpeedDN = uint32(sum.SpeedDn)
+		p.SpeedUP = uint32(sum.SpeedUp)
+		p.SpeedDNMax = util.UMax32(p.SpeedDNMax, uint32(sum.SpeedDn))
+		p.SpeedUPMax = util.UMax32(p.SpeedUPMax, uint32(sum.SpeedUp))
+		return p
+	})
+}
+
+// Delete removes the peer from the cache
 func (cache *PeerCache) Delete(infoHash InfoHash, peerID PeerID) {
-	cache.RLock()
-	_, found := cache.swarms[infoHash]
-	cache.RUnlock()
-	if !found {
-		return
-	}
-	cache.RLock()
-	cache.swarms[infoHash].Remove(peerID)
-	cache.RUnlock()
-	atomic.AddInt64(&metrics.PeersTotalCached, -1)
+	cache.cache.remove(NewPeerHash(infoHash, peerID))
+}
+
+// Expire removes the expired peers, peers are written through on every announce so they
+// are never refreshed
+func (cache *PeerCache) Expire() {
+	cache.cache.expiring(0)
+}
+
+// Len returns the number of cached entries
+func (cache *PeerCache) Len() int {
+	return cache.cache.len()
 }
@@ -0,0 +1,127 @@
+package store
+
+import (
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestTorrentCache_LRU(t *testing.T) {
+	cache := NewTorrentCache(CacheOpts{MaxEntries: 2})
+	t1, t2, t3 := GenerateTestTorrent(), GenerateTestTorrent(), GenerateTestTorrent()
+	evicted := metrics.CacheEvictions.Get("torrents", "size")
+	cache.Set(t1)
+	cache.Set(t2)
+	var torrent Torrent
+	// Reading t1 makes t2 the least recently used
+	found, err := cache.Get(&torrent, t1.InfoHash)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, t1.InfoHash, torrent.InfoHash)
+	cache.Set(t3)
+	require.Equal(t, 2, cache.Len())
+	require.Equal(t, evicted+1, metrics.CacheEvictions.Get("torrents", "size"))
+	found, _ = cache.Get(&torrent, t2.InfoHash)
+	require.False(t, found)
+	for _, ih := range []InfoHash{t1.InfoHash, t3.InfoHash} {
+		found, _ = cache.Get(&torrent, ih)
+		require.True(t, found)
+	}
+
+	cache.Update(t1.InfoHash, TorrentStats{Seeders: 2, Announces: 1})
+	_, _ = cache.Get(&torrent, t1.InfoHash)
+	require.Equal(t, t1.Seeders+2, torrent.Seeders)
+	cache.Delete(t1.InfoHash, false)
+	_, _ = cache.Get(&torrent, t1.InfoHash)
+	require.True(t, torrent.IsDeleted)
+	cache.Delete(t1.InfoHash, true)
+	found, _ = cache.Get(&torrent, t1.InfoHash)
+	require.False(t, found)
+}
+
+func TestTorrentCache_TTL(t *testing.T) {
+	cache := NewTorrentCache(CacheOpts{TTL: time.Millisecond * 20, NegativeTTL: time.Millisecond * 20})
+	t1 := GenerateTestTorrent()
+	unknown := GenerateTestTorrent()
+	cache.Set(t1)
+	cache.SetMissing(unknown.InfoHash, consts.ErrInvalidInfoHash)
+	var torrent Torrent
+	hits := metrics.CacheHits.Get("torrents", "negative")
+	found, err := cache.Get(&torrent, unknown.InfoHash)
+	require.True(t, found)
+	require.Equal(t, consts.ErrInvalidInfoHash, err)
+	require.Equal(t, hits+1, metrics.CacheHits.Get("torrents", "negative"))
+	found, err = cache.Get(&torrent, t1.InfoHash)
+	require.True(t, found)
+	require.NoError(t, err)
+
+	time.Sleep(time.Millisecond * 30)
+	misses := metrics.CacheMisses.Get("torrents")
+	for _, ih := range []InfoHash{t1.InfoHash, unknown.InfoHash} {
+		found, err = cache.Get(&torrent, ih)
+		require.False(t, found)
+		require.NoError(t, err)
+	}
+	require.Equal(t, misses+2, metrics.CacheMisses.Get("torrents"))
+	require.Equal(t, 0, cache.Len())
+}
+
+func TestUserCache_Refresh(t *testing.T) {
+	cache := NewUserCache(CacheOpts{TTL: time.Minute, NegativeTTL: time.Minute})
+	active, idle, deleted := GenerateTestUser(), GenerateTestUser(), GenerateTestUser()
+	for _, u := range []User{active, idle, deleted} {
+		cache.Set(u)
+	}
+	var usr User
+	for _, pk := range []string{active.Passkey, deleted.Passkey} {
+		found, err := cache.Get(&usr, pk)
+		require.NoError(t, err)
+		require.True(t, found)
+	}
+	var loaded []string
+	cache.Refresh(time.Hour, consts.ErrInvalidUser, func(user *User, passkey string) error {
+		loaded = append(loaded, passkey)
+		if passkey == deleted.Passkey {
+			return consts.ErrInvalidUser
+		}
+		*user = active
+		user.DownloadEnabled = false
+		return nil
+	})
+	// Only the users read since they were cached are reloaded
+	require.ElementsMatch(t, []string{active.Passkey, deleted.Passkey}, loaded)
+	found, err := cache.Get(&usr, active.Passkey)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.False(t, usr.DownloadEnabled)
+	found, err = cache.Get(&usr, deleted.Passkey)
+	require.True(t, found)
+	require.Equal(t, consts.ErrInvalidUser, err)
+
+	// Nothing expires within the window
+	loaded = nil
+	cache.Refresh(time.Second, consts.ErrInvalidUser, func(user *User, passkey string) error {
+		loaded = append(loaded, passkey)
+		return nil
+	})
+	require.Empty(t, loaded)
+}
+
+func TestPeerCache(t *testing.T) {
+	cache := NewPeerCache(CacheOpts{MaxEntries: 10, TTL: time.Millisecond * 20})
+	ih := GenerateTestTorrent().InfoHash
+	p := GenerateTestPeer()
+	cache.Set(ih, p)
+	cache.Update(NewPeerHash(ih, p.PeerID), PeerStats{Hist: []AnnounceHist{{Uploaded: 100}}})
+	var peer Peer
+	require.True(t, cache.Get(&peer, ih, p.PeerID))
+	require.Equal(t, p.Uploaded+100, peer.Uploaded)
+	cache.Delete(ih, p.PeerID)
+	require.False(t, cache.Get(&peer, ih, p.PeerID))
+	cache.Set(ih, p)
+	time.Sleep(time.Millisecond * 30)
+	cache.Expire()
+	require.Equal(t, 0, cache.Len())
+}
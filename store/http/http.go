@@ -10,6 +10,7 @@
 package http
 
 import (
+	"context"
 	"fmt"
 	"github.com/leighmacdonald/mika/client"
 	"github.com/leighmacdonald/mika/config"
@@ -115,6 +116,39 @@ func (ts TorrentStore) WhiteListGetAll() ([]store.WhiteListClient, error) {
 	return wl, nil
 }
 
+// BanAdd will insert a new IP/CIDR ban
+func (ts TorrentStore) BanAdd(ban store.Ban) error {
+	_, err := ts.Exec(client.Opts{
+		Method: "POST",
+		Path:   "/api/ban",
+		JSON:   ban,
+	})
+	return err
+}
+
+// BanDelete removes the ban matching the CIDR of the ban provided
+func (ts TorrentStore) BanDelete(ban store.Ban) error {
+	_, err := ts.Exec(client.Opts{
+		Method: "DELETE",
+		Path:   fmt.Sprintf("/api/ban/%s", ban.CIDR),
+	})
+	return err
+}
+
+// BanGetAll fetches all known bans, including expired bans
+func (ts TorrentStore) BanGetAll() ([]store.Ban, error) {
+	var bans []store.Ban
+	_, err := ts.Exec(client.Opts{
+		Method: "GET",
+		Path:   "/api/ban",
+		Recv:   &bans,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
 // Add adds a new torrent to the HTTP API backing store
 func (ts TorrentStore) Add(t store.Torrent) error {
 	_, err := ts.Exec(client.Opts{
@@ -161,6 +195,16 @@ func (ts TorrentStore) Get(t *store.Torrent, hash store.InfoHash, deletedOk bool
 	return nil
 }
 
+// Ping checks the backing http api is reachable
+func (ts TorrentStore) Ping(ctx context.Context) error {
+	_, err := ts.Exec(client.Opts{
+		Method:  "GET",
+		Path:    "/api/ping",
+		Context: ctx,
+	})
+	return err
+}
+
 // Close will close all the remaining http connections
 func (ts TorrentStore) Close() error {
 	ts.CloseIdleConnections()
@@ -219,19 +263,27 @@ func (ps PeerStore) Delete(ih store.InfoHash, p store.PeerID) error {
 	return err
 }
 
-// GetN will fetch peers for a torrents active swarm up to N users
-func (ps PeerStore) GetN(ih store.InfoHash, limit int) (store.Swarm, error) {
-	swarm := store.NewSwarm()
+// GetN returns up to limit peers matching the filter, chosen uniformly at random
+func (ps PeerStore) GetN(ih store.InfoHash, limit int, filter store.PeerFilter) ([]store.Peer, error) {
 	var peers []store.Peer
+	ipv4, ipv6 := filter.Families()
 	_, err := ps.Exec(client.Opts{
 		Method: "GET",
-		Path:   fmt.Sprintf("/api/peers/swarm/%s/%d", ih.String(), limit),
-		Recv:   &peers,
+		Path: fmt.Sprintf("/api/peers/swarm/%s/%d?ipv4=%t&ipv6=%t&crypto=%d&exclude=%s",
+			ih.String(), limit, ipv4, ipv6, filter.CryptoLevel, filter.Exclude.String()),
+		Recv: &peers,
 	})
-	for _, peer := range peers {
-		swarm.Peers[peer.PeerID] = peer
-	}
-	return swarm, err
+	return peers, err
+}
+
+// Ping checks the backing http api is reachable
+func (ps PeerStore) Ping(ctx context.Context) error {
+	_, err := ps.Exec(client.Opts{
+		Method:  "GET",
+		Path:    "/api/ping",
+		Context: ctx,
+	})
+	return err
 }
 
 // Close will close all the remaining http connections
@@ -358,6 +410,16 @@ func (u *UserStore) Delete(_ store.User) error {
 	panic("implement me")
 }
 
+// Ping checks the backing http api is reachable
+func (u *UserStore) Ping(ctx context.Context) error {
+	_, err := u.Exec(client.Opts{
+		Method:  "GET",
+		Path:    "/api/ping",
+		Context: ctx,
+	})
+	return err
+}
+
 // Close will close all the remaining http connections
 func (u *UserStore) Close() error {
 	u.CloseIdleConnections()
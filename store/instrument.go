@@ -0,0 +1,270 @@
+package store
+
+import (
+	"context"
+	"github.com/leighmacdonald/mika/metrics"
+	"time"
+)
+
+// observe records the latency and, if the call failed, the error for a store method
+func observe(kind string, driver string, method string, start time.Time, err error) {
+	metrics.StoreDuration.Since(start, kind, driver, method)
+	if err != nil {
+		metrics.StoreErrors.Inc(kind, driver, method)
+	}
+}
+
+// instrumentedTorrentStore wraps a TorrentStore recording the latency and errors of each call
+type instrumentedTorrentStore struct {
+	TorrentStore
+	driver string
+}
+
+// InstrumentTorrentStore wraps the TorrentStore so that the latency and error count of
+// every method is recorded under the driver name provided
+func InstrumentTorrentStore(driver string, s TorrentStore) TorrentStore {
+	if _, ok := s.(*instrumentedTorrentStore); ok {
+		return s
+	}
+	return &instrumentedTorrentStore{TorrentStore: s, driver: driver}
+}
+
+func (s *instrumentedTorrentStore) Add(t Torrent) error {
+	start := time.Now()
+	err := s.TorrentStore.Add(t)
+	observe("torrent", s.driver, "Add", start, err)
+	return err
+}
+
+func (s *instrumentedTorrentStore) Delete(ih InfoHash, dropRow bool) error {
+	start := time.Now()
+	err := s.TorrentStore.Delete(ih, dropRow)
+	observe("torrent", s.driver, "Delete", start, err)
+	return err
+}
+
+func (s *instrumentedTorrentStore) Get(torrent *Torrent, hash InfoHash, deletedOk bool) error {
+	start := time.Now()
+	err := s.TorrentStore.Get(torrent, hash, deletedOk)
+	observe("torrent", s.driver, "Get", start, err)
+	return err
+}
+
+func (s *instrumentedTorrentStore) InfoHashes() ([]InfoHash, error) {
+	start := time.Now()
+	hashes, err := s.TorrentStore.InfoHashes()
+	observe("torrent", s.driver, "InfoHashes", start, err)
+	return hashes, err
+}
+
+func (s *instrumentedTorrentStore) Update(torrent Torrent) error {
+	start := time.Now()
+	err := s.TorrentStore.Update(torrent)
+	observe("torrent", s.driver, "Update", start, err)
+	return err
+}
+
+func (s *instrumentedTorrentStore) Close() error {
+	start := time.Now()
+	err := s.TorrentStore.Close()
+	observe("torrent", s.driver, "Close", start, err)
+	return err
+}
+
+func (s *instrumentedTorrentStore) WhiteListDelete(client WhiteListClient) error {
+	start := time.Now()
+	err := s.TorrentStore.WhiteListDelete(client)
+	observe("torrent", s.driver, "WhiteListDelete", start, err)
+	return err
+}
+
+func (s *instrumentedTorrentStore) WhiteListAdd(client WhiteListClient) error {
+	start := time.Now()
+	err := s.TorrentStore.WhiteListAdd(client)
+	observe("torrent", s.driver, "WhiteListAdd", start, err)
+	return err
+}
+
+func (s *instrumentedTorrentStore) WhiteListGetAll() ([]WhiteListClient, error) {
+	start := time.Now()
+	clients, err := s.TorrentStore.WhiteListGetAll()
+	observe("torrent", s.driver, "WhiteListGetAll", start, err)
+	return clients, err
+}
+
+func (s *instrumentedTorrentStore) BanAdd(ban Ban) error {
+	start := time.Now()
+	err := s.TorrentStore.BanAdd(ban)
+	observe("torrent", s.driver, "BanAdd", start, err)
+	return err
+}
+
+func (s *instrumentedTorrentStore) BanDelete(ban Ban) error {
+	start := time.Now()
+	err := s.TorrentStore.BanDelete(ban)
+	observe("torrent", s.driver, "BanDelete", start, err)
+	return err
+}
+
+func (s *instrumentedTorrentStore) BanGetAll() ([]Ban, error) {
+	start := time.Now()
+	bans, err := s.TorrentStore.BanGetAll()
+	observe("torrent", s.driver, "BanGetAll", start, err)
+	return bans, err
+}
+
+func (s *instrumentedTorrentStore) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := s.TorrentStore.Ping(ctx)
+	observe("torrent", s.driver, "Ping", start, err)
+	return err
+}
+
+func (s *instrumentedTorrentStore) Sync(b map[InfoHash]TorrentStats) error {
+	start := time.Now()
+	err := s.TorrentStore.Sync(b)
+	observe("torrent", s.driver, "Sync", start, err)
+	return err
+}
+
+// instrumentedPeerStore wraps a PeerStore recording the latency and errors of each call
+type instrumentedPeerStore struct {
+	PeerStore
+	driver string
+}
+
+// InstrumentPeerStore wraps the PeerStore so that the latency and error count of
+// every method is recorded under the driver name provided
+func InstrumentPeerStore(driver string, s PeerStore) PeerStore {
+	if _, ok := s.(*instrumentedPeerStore); ok {
+		return s
+	}
+	return &instrumentedPeerStore{PeerStore: s, driver: driver}
+}
+
+func (s *instrumentedPeerStore) Add(ih InfoHash, p Peer) error {
+	start := time.Now()
+	err := s.PeerStore.Add(ih, p)
+	observe("peer", s.driver, "Add", start, err)
+	return err
+}
+
+func (s *instrumentedPeerStore) Delete(ih InfoHash, p PeerID) error {
+	start := time.Now()
+	err := s.PeerStore.Delete(ih, p)
+	observe("peer", s.driver, "Delete", start, err)
+	return err
+}
+
+func (s *instrumentedPeerStore) GetN(ih InfoHash, limit int, filter PeerFilter) ([]Peer, error) {
+	start := time.Now()
+	peers, err := s.PeerStore.GetN(ih, limit, filter)
+	observe("peer", s.driver, "GetN", start, err)
+	return peers, err
+}
+
+func (s *instrumentedPeerStore) Get(peer *Peer, ih InfoHash, id PeerID) error {
+	start := time.Now()
+	err := s.PeerStore.Get(peer, ih, id)
+	observe("peer", s.driver, "Get", start, err)
+	return err
+}
+
+func (s *instrumentedPeerStore) Close() error {
+	start := time.Now()
+	err := s.PeerStore.Close()
+	observe("peer", s.driver, "Close", start, err)
+	return err
+}
+
+func (s *instrumentedPeerStore) Reap() []ReapedPeer {
+	start := time.Now()
+	expired := s.PeerStore.Reap()
+	observe("peer", s.driver, "Reap", start, nil)
+	return expired
+}
+
+func (s *instrumentedPeerStore) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := s.PeerStore.Ping(ctx)
+	observe("peer", s.driver, "Ping", start, err)
+	return err
+}
+
+func (s *instrumentedPeerStore) Sync(b map[PeerHash]PeerStats) error {
+	start := time.Now()
+	err := s.PeerStore.Sync(b)
+	observe("peer", s.driver, "Sync", start, err)
+	return err
+}
+
+// instrumentedUserStore wraps a UserStore recording the latency and errors of each call
+type instrumentedUserStore struct {
+	UserStore
+	driver string
+}
+
+// InstrumentUserStore wraps the UserStore so that the latency and error count of
+// every method is recorded under the driver name provided
+func InstrumentUserStore(driver string, s UserStore) UserStore {
+	if _, ok := s.(*instrumentedUserStore); ok {
+		return s
+	}
+	return &instrumentedUserStore{UserStore: s, driver: driver}
+}
+
+func (s *instrumentedUserStore) Add(u User) error {
+	start := time.Now()
+	err := s.UserStore.Add(u)
+	observe("user", s.driver, "Add", start, err)
+	return err
+}
+
+func (s *instrumentedUserStore) GetByPasskey(user *User, passkey string) error {
+	start := time.Now()
+	err := s.UserStore.GetByPasskey(user, passkey)
+	observe("user", s.driver, "GetByPasskey", start, err)
+	return err
+}
+
+func (s *instrumentedUserStore) GetByID(user *User, userID uint32) error {
+	start := time.Now()
+	err := s.UserStore.GetByID(user, userID)
+	observe("user", s.driver, "GetByID", start, err)
+	return err
+}
+
+func (s *instrumentedUserStore) Delete(user User) error {
+	start := time.Now()
+	err := s.UserStore.Delete(user)
+	observe("user", s.driver, "Delete", start, err)
+	return err
+}
+
+func (s *instrumentedUserStore) Update(user User, oldPasskey string) error {
+	start := time.Now()
+	err := s.UserStore.Update(user, oldPasskey)
+	observe("user", s.driver, "Update", start, err)
+	return err
+}
+
+func (s *instrumentedUserStore) Close() error {
+	start := time.Now()
+	err := s.UserStore.Close()
+	observe("user", s.driver, "Close", start, err)
+	return err
+}
+
+func (s *instrumentedUserStore) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := s.UserStore.Ping(ctx)
+	observe("user", s.driver, "Ping", start, err)
+	return err
+}
+
+func (s *instrumentedUserStore) Sync(b map[string]UserStats) error {
+	start := time.Now()
+	err := s.UserStore.Sync(b)
+	observe("user", s.driver, "Sync", start, err)
+	return err
+}
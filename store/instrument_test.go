@@ -0,0 +1,33 @@
+package store
+
+import (
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// stubTorrentStore only implements Get, any other call panics
+type stubTorrentStore struct {
+	TorrentStore
+}
+
+func (s stubTorrentStore) Get(_ *Torrent, hash InfoHash, _ bool) error {
+	if hash == (InfoHash{}) {
+		return consts.ErrInvalidInfoHash
+	}
+	return nil
+}
+
+func TestInstrumentTorrentStore(t *testing.T) {
+	ts := InstrumentTorrentStore("stub", stubTorrentStore{})
+	require.Equal(t, ts, InstrumentTorrentStore("stub", ts), "Store wrapped twice")
+	hist := metrics.StoreDuration.With("torrent", "stub", "Get")
+	count := hist.Count()
+	errCount := metrics.StoreErrors.Get("torrent", "stub", "Get")
+	var torrent Torrent
+	require.NoError(t, ts.Get(&torrent, InfoHash{1}, false))
+	require.Equal(t, consts.ErrInvalidInfoHash, ts.Get(&torrent, InfoHash{}, false))
+	require.Equal(t, count+2, hist.Count())
+	require.Equal(t, errCount+1, metrics.StoreErrors.Get("torrent", "stub", "Get"))
+}
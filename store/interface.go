@@ -10,6 +10,7 @@
 package store
 
 import (
+	"context"
 	"github.com/leighmacdonald/mika/consts"
 	log "github.com/sirupsen/logrus"
 	"sync"
@@ -82,6 +83,8 @@ type UserStore interface {
 	Update(user User, oldPasskey string) error
 	// Close will cleanup and close the underlying storage driver if necessary
 	Close() error
+	// Ping checks that the backing store is reachable and able to serve requests
+	Ping(ctx context.Context) error
 	// Sync batch updates the backing store with the new UserStats provided
 	Sync(b map[string]UserStats) error
 	// Name returns the name of the data store type
@@ -98,6 +101,8 @@ type TorrentStore interface {
 	Delete(ih InfoHash, dropRow bool) error
 	// Get returns the Torrent matching the infohash
 	Get(torrent *Torrent, hash InfoHash, deletedOk bool) error
+	// InfoHashes returns the info hash of every torrent which has not been deleted
+	InfoHashes() ([]InfoHash, error)
 	// Update will update certain parameters within the torrent
 	Update(torrent Torrent) error
 	// Close will cleanup and close the underlying storage driver if necessary
@@ -108,6 +113,14 @@ type TorrentStore interface {
 	WhiteListAdd(client WhiteListClient) error
 	// WhiteListGetAll fetches all known whitelisted clients
 	WhiteListGetAll() ([]WhiteListClient, error)
+	// BanAdd will insert a new IP/CIDR ban
+	BanAdd(ban Ban) error
+	// BanDelete removes the ban matching the CIDR of the ban provided
+	BanDelete(ban Ban) error
+	// BanGetAll fetches all known bans, including expired bans
+	BanGetAll() ([]Ban, error)
+	// Ping checks that the backing store is reachable and able to serve requests
+	Ping(ctx context.Context) error
 	// Sync batch updates the backing store with the new TorrentStats provided
 	Sync(b map[InfoHash]TorrentStats) error
 	// Conn returns the underlying connection, if any
@@ -124,20 +137,46 @@ type PeerStore interface {
 	Add(ih InfoHash, p Peer) error
 	// Delete will remove a user from a torrents swarm
 	Delete(ih InfoHash, p PeerID) error
-	// GetN will fetch peers for a torrents active swarm up to N users
-	GetN(ih InfoHash, limit int) (Swarm, error)
+	// GetN returns up to limit peers matching the filter, chosen uniformly at random
+	// from the torrents active swarm. Only the fields needed for peer lists, the peer id,
+	// addresses, port, left, crypto level, paused state and last announce, are required
+	// to be set, Get returns the complete peer.
+	GetN(ih InfoHash, limit int, filter PeerFilter) ([]Peer, error)
 	// Get will fetch the peer from the swarm if it exists
 	Get(peer *Peer, ih InfoHash, id PeerID) error
 	// Close will cleanup and close the underlying storage driver if necessary
 	Close() error
-	// Reap will loop through the peers removing any stale entries from active swarms
-	Reap() []PeerHash
+	// Reap will loop through the peers removing any stale entries from active swarms,
+	// returning the removed peers
+	Reap() []ReapedPeer
+	// Ping checks that the backing store is reachable and able to serve requests
+	Ping(ctx context.Context) error
 	// Sync batch updates the backing store with the new PeerStats provided
 	Sync(b map[PeerHash]PeerStats) error
 	// Name returns the name of the data store type
 	Name() string
 }
 
+// PeerListener is notified of the changes made to the peers held by a PeerStore
+type PeerListener interface {
+	// PeerAdded is called when the peer is added to, or replaced in, the swarm
+	PeerAdded(ih InfoHash, p Peer)
+	// PeerSynced is called with the stats synced to the peer
+	PeerSynced(ph PeerHash, stats PeerStats)
+	// PeerRemoved is called when the peer is removed from the swarm, including by Reap
+	PeerRemoved(ih InfoHash, id PeerID)
+}
+
+// ListenedPeerStore is a PeerStore which only holds some of the swarms it serves, such
+// as a cluster node forwarding the swarms owned by other nodes. Changes to the peers it
+// holds, including those made on behalf of other nodes, are reported to the listener so
+// each peer is only counted by the node holding it.
+type ListenedPeerStore interface {
+	PeerStore
+	// SetListener sets the listener notified of changes to the peers held locally
+	SetListener(l PeerListener)
+}
+
 // NewTorrentStore will attempt to initialize a TorrentStore using the driver name provided
 func NewTorrentStore(storeType string, config interface{}) (TorrentStore, error) {
 	torrentDriversMutex.RLock()
@@ -146,7 +185,11 @@ func NewTorrentStore(storeType string, config interface{}) (TorrentStore, error)
 	if !found {
 		return nil, consts.ErrInvalidDriver
 	}
-	return driver.New(config)
+	s, err := driver.New(config)
+	if err != nil {
+		return nil, err
+	}
+	return InstrumentTorrentStore(storeType, s), nil
 }
 
 // NewPeerStore will attempt to initialize a PeerStore using the driver name provided
@@ -157,7 +200,11 @@ func NewPeerStore(storeType string, config interface{}) (PeerStore, error) {
 	if !found {
 		return nil, consts.ErrInvalidDriver
 	}
-	return driver.New(config)
+	s, err := driver.New(config)
+	if err != nil {
+		return nil, err
+	}
+	return InstrumentPeerStore(storeType, s), nil
 }
 
 // NewUserStore will attempt to initialize a UserStore using the driver name provided
@@ -168,5 +215,9 @@ func NewUserStore(storeType string, config interface{}) (UserStore, error) {
 	if !found {
 		return nil, consts.ErrInvalidDriver
 	}
-	return driver.New(config)
+	s, err := driver.New(config)
+	if err != nil {
+		return nil, err
+	}
+	return InstrumentUserStore(storeType, s), nil
 }
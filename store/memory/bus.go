@@ -0,0 +1,89 @@
+package memory
+
+import (
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/store"
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+var (
+	hubsMu = &sync.Mutex{}
+	hubs   = make(map[string]*hub)
+)
+
+// hub connects the buses opened with the same name in this process
+type hub struct {
+	sync.RWMutex
+	buses map[*Bus]func(msg store.InvalidationMsg)
+}
+
+// Bus is an in-process store.InvalidationBus. Every bus opened with the same name receives
+// the messages published by the others, allowing several trackers to share caches within
+// a single process such as in tests.
+type Bus struct {
+	hub *hub
+}
+
+// NewBus returns a bus connected to the named hub
+func NewBus(name string) *Bus {
+	hubsMu.Lock()
+	h, found := hubs[name]
+	if !found {
+		h = &hub{buses: make(map[*Bus]func(msg store.InvalidationMsg))}
+		hubs[name] = h
+	}
+	hubsMu.Unlock()
+	return &Bus{hub: h}
+}
+
+// Publish delivers the message to the subscribed buses before returning. The message is
+// encoded and decoded for each subscriber as it would be by a network transport.
+func (b *Bus) Publish(msg store.InvalidationMsg) error {
+	body, err := msg.Encode()
+	if err != nil {
+		return err
+	}
+	b.hub.RLock()
+	handlers := make([]func(msg store.InvalidationMsg), 0, len(b.hub.buses))
+	for _, handler := range b.hub.buses {
+		handlers = append(handlers, handler)
+	}
+	b.hub.RUnlock()
+	for _, handler := range handlers {
+		var received store.InvalidationMsg
+		if err := store.DecodeInvalidationMsg(&received, body); err != nil {
+			log.Errorf("Dropped invalidation message: %s", err)
+			continue
+		}
+		handler(received)
+	}
+	return nil
+}
+
+// Subscribe registers the handler for messages published on the hub
+func (b *Bus) Subscribe(handler func(msg store.InvalidationMsg)) error {
+	b.hub.Lock()
+	defer b.hub.Unlock()
+	if _, found := b.hub.buses[b]; found {
+		return consts.ErrInvalidState
+	}
+	b.hub.buses[b] = handler
+	return nil
+}
+
+// Close removes the subscription of the bus
+func (b *Bus) Close() error {
+	b.hub.Lock()
+	delete(b.hub.buses, b)
+	b.hub.Unlock()
+	return nil
+}
+
+type busDriver struct{}
+
+// New creates a new in-process bus, the config may be a string naming the hub to join
+func (bd busDriver) New(cfg interface{}) (store.InvalidationBus, error) {
+	name, _ := cfg.(string)
+	return NewBus(name), nil
+}
@@ -1,9 +1,12 @@
 package memory
 
 import (
+	"context"
+	"encoding/binary"
 	"github.com/leighmacdonald/mika/consts"
 	"github.com/leighmacdonald/mika/store"
 	"sync"
+	"time"
 )
 
 const (
@@ -15,6 +18,7 @@ type TorrentStore struct {
 	sync.RWMutex
 	torrents  map[store.InfoHash]store.Torrent
 	whitelist []store.WhiteListClient
+	bans      []store.Ban
 }
 
 func (ts *TorrentStore) Name() string {
@@ -38,6 +42,7 @@ func NewTorrentStore() *TorrentStore {
 		RWMutex:   sync.RWMutex{},
 		torrents:  map[store.InfoHash]store.Torrent{},
 		whitelist: []store.WhiteListClient{},
+		bans:      []store.Ban{},
 	}
 }
 
@@ -120,6 +125,61 @@ func (ts *TorrentStore) WhiteListGetAll() ([]store.WhiteListClient, error) {
 	return wl, nil
 }
 
+// BanAdd will insert a new IP/CIDR ban, replacing any existing ban for the same network
+func (ts *TorrentStore) BanAdd(ban store.Ban) error {
+	ts.Lock()
+	for i := range ts.bans {
+		if ts.bans[i].CIDR == ban.CIDR {
+			ts.bans[i] = ban
+			ts.Unlock()
+			return nil
+		}
+	}
+	ts.bans = append(ts.bans, ban)
+	ts.Unlock()
+	return nil
+}
+
+// BanDelete removes the ban matching the CIDR of the ban provided
+func (ts *TorrentStore) BanDelete(ban store.Ban) error {
+	ts.Lock()
+	defer ts.Unlock()
+	for i := len(ts.bans) - 1; i >= 0; i-- {
+		if ts.bans[i].CIDR == ban.CIDR {
+			ts.bans = append(ts.bans[:i], ts.bans[i+1:]...)
+			return nil
+		}
+	}
+	return consts.ErrInvalidBan
+}
+
+// BanGetAll fetches all known bans, including expired bans
+func (ts *TorrentStore) BanGetAll() ([]store.Ban, error) {
+	ts.RLock()
+	bans := make([]store.Ban, len(ts.bans))
+	copy(bans, ts.bans)
+	ts.RUnlock()
+	return bans, nil
+}
+
+// InfoHashes returns the info hash of every torrent in the store
+func (ts *TorrentStore) InfoHashes() ([]store.InfoHash, error) {
+	ts.RLock()
+	defer ts.RUnlock()
+	hashes := make([]store.InfoHash, 0, len(ts.torrents))
+	for ih, t := range ts.torrents {
+		if !t.IsDeleted {
+			hashes = append(hashes, ih)
+		}
+	}
+	return hashes, nil
+}
+
+// Ping always succeeds for the in-memory torrent store
+func (ts *TorrentStore) Ping(_ context.Context) error {
+	return nil
+}
+
 // Close will delete/free all the underlying torrent data
 func (ts *TorrentStore) Close() error {
 	ts.Lock()
@@ -143,11 +203,27 @@ func (ts *TorrentStore) Get(torrent *store.Torrent, hash store.InfoHash, deleted
 	return nil
 }
 
-// PeerStore is a memory backed store.PeerStore implementation
-// TODO shard peer storage
-type PeerStore struct {
+// peerShards is the number of independently locked swarm maps in a PeerStore
+const peerShards = 64
+
+// peerTTL is how long a peer may go without announcing before it is reaped, matching
+// store.Peer.Expired
+const peerTTL = 300 * time.Second
+
+// peerShard holds the swarms of the info hashes mapped to it. The shard lock guards the
+// map itself, the peers within each swarm are guarded by the swarms own lock.
+type peerShard struct {
 	sync.RWMutex
-	swarms map[store.InfoHash]store.Swarm
+	swarms map[store.InfoHash]*swarm
+}
+
+// PeerStore is a memory backed store.PeerStore implementation. Swarms are partitioned
+// into shards by info_hash so that writes and reaping only block the swarms sharing
+// a shard rather than the whole store. Peers are held in a packed form and only
+// expanded to store.Peer when read.
+type PeerStore struct {
+	shards  [peerShards]*peerShard
+	strings *interner
 }
 
 func (ps *PeerStore) Name() string {
@@ -156,104 +232,164 @@ func (ps *PeerStore) Name() string {
 
 // NewPeerStore instantiates a new in-memory peer store
 func NewPeerStore() *PeerStore {
-	return &PeerStore{
-		RWMutex: sync.RWMutex{},
-		swarms:  make(map[store.InfoHash]store.Swarm),
+	ps := &PeerStore{strings: newInterner()}
+	for i := range ps.shards {
+		ps.shards[i] = &peerShard{swarms: make(map[store.InfoHash]*swarm)}
 	}
+	return ps
+}
+
+// shard returns the shard owning the info hash. Info hashes are uniformly distributed
+// so the leading bytes are used directly.
+func (ps *PeerStore) shard(ih store.InfoHash) *peerShard {
+	return ps.shards[binary.BigEndian.Uint32(ih[:4])%peerShards]
+}
+
+// swarm returns the swarm for the info hash if it exists
+func (ps *PeerStore) swarm(ih store.InfoHash) (*swarm, bool) {
+	s := ps.shard(ih)
+	s.RLock()
+	sw, ok := s.swarms[ih]
+	s.RUnlock()
+	return sw, ok
 }
 
 // Sync batch updates the backing store with the new PeerStats provided
 func (ps *PeerStore) Sync(b map[store.PeerHash]store.PeerStats) error {
-	ps.Lock()
-	defer ps.Unlock()
 	for ph, stats := range b {
-		swarm, ok := ps.swarms[ph.InfoHash()]
-		if ok {
-			_, _ = swarm.UpdatePeer(ph.PeerID(), stats)
+		// The shard lock is held while syncing so the reaper can't remove the swarm
+		// between it being fetched and the peer being updated
+		s := ps.shard(ph.InfoHash())
+		s.RLock()
+		if sw, ok := s.swarms[ph.InfoHash()]; ok {
+			sw.sync(ph.PeerID(), stats)
 		}
+		s.RUnlock()
 	}
 	return nil
 }
 
-// Reap will loop through the swarms removing any stale entries from active swarms
-func (ps *PeerStore) Reap() []store.PeerHash {
-	var peerHashes []store.PeerHash
-	ps.Lock()
-	for k := range ps.swarms {
-		swarm, ok := ps.swarms[k]
-		if !ok {
-			continue
+// Reap will loop through the swarms removing any stale entries from active swarms.
+// The shards are walked one at a time, only holding the lock of the swarm being reaped,
+// so announces are never blocked by more than a single swarm. Swarms left empty are
+// removed from their shard.
+func (ps *PeerStore) Reap() []store.ReapedPeer {
+	var peerHashes []store.ReapedPeer
+	expiry := time.Now().Add(-peerTTL)
+	for _, s := range ps.shards {
+		peerHashes = append(peerHashes, s.reap(expiry)...)
+	}
+	return peerHashes
+}
+
+func (s *peerShard) reap(expiry time.Time) []store.ReapedPeer {
+	var (
+		peerHashes []store.ReapedPeer
+		empty      []store.InfoHash
+	)
+	// Only new swarms require the write lock so announces to existing swarms continue
+	// while the shard is reaped
+	s.RLock()
+	for ih, sw := range s.swarms {
+		peerHashes = append(peerHashes, sw.reap(ih, expiry)...)
+		if sw.len() == 0 {
+			empty = append(empty, ih)
+		}
+	}
+	s.RUnlock()
+	if len(empty) == 0 {
+		return peerHashes
+	}
+	s.Lock()
+	for _, ih := range empty {
+		// A peer may have been added since the swarm was reaped
+		if sw, ok := s.swarms[ih]; ok && sw.len() == 0 {
+			delete(s.swarms, ih)
 		}
-		peerHashes = append(peerHashes, swarm.ReapExpired(k)...)
 	}
-	ps.Unlock()
+	s.Unlock()
 	return peerHashes
 }
 
 // Get will fetch the peer from the swarm if it exists
 func (ps *PeerStore) Get(p *store.Peer, ih store.InfoHash, peerID store.PeerID) error {
-	ps.RLock()
-	defer ps.RUnlock()
-	swarm, ok := ps.swarms[ih]
+	sw, ok := ps.swarm(ih)
 	if !ok {
 		return consts.ErrInvalidPeerID
 	}
-	return swarm.Get(p, peerID)
+	return sw.get(p, ih, peerID, ps.strings)
+}
+
+// Ping always succeeds for the in-memory peer store
+func (ps *PeerStore) Ping(_ context.Context) error {
+	return nil
 }
 
 // Close flushes allocated memory
-// TODO flush mem
 func (ps *PeerStore) Close() error {
-	ps.Lock()
-	ps.swarms = make(map[store.InfoHash]store.Swarm)
-	ps.Unlock()
+	for _, s := range ps.shards {
+		s.Lock()
+		s.swarms = make(map[store.InfoHash]*swarm)
+		s.Unlock()
+	}
 	return nil
 }
 
 // Add inserts a peer into the active swarm for the torrent provided
 func (ps *PeerStore) Add(ih store.InfoHash, p store.Peer) error {
-	ps.Lock()
-	_, ok := ps.swarms[ih]
+	s := ps.shard(ih)
+	// The shard lock is held while adding so the reaper can't remove the swarm
+	// between it being fetched and the peer being added
+	s.RLock()
+	sw, ok := s.swarms[ih]
+	if ok {
+		sw.add(p, ps.strings)
+		s.RUnlock()
+		return nil
+	}
+	s.RUnlock()
+	s.Lock()
+	sw, ok = s.swarms[ih]
 	if !ok {
-		ps.swarms[ih] = store.NewSwarm()
+		sw = newSwarm()
+		s.swarms[ih] = sw
 	}
-	ps.swarms[ih].Peers[p.PeerID] = p
-	ps.Unlock()
+	sw.add(p, ps.strings)
+	s.Unlock()
 	return nil
 }
 
-// Update is a no-op for memory backed store
+// Update replaces the peer in the swarm with the new peer state
 // TODO this is incomplete
 func (ps *PeerStore) Update(ih store.InfoHash, p store.Peer) error {
-	ps.RLock()
-	swarm, found := ps.swarms[ih]
-	ps.RUnlock()
+	s := ps.shard(ih)
+	// Held for the same reason as Add, an update must not be applied to a removed swarm
+	s.RLock()
+	defer s.RUnlock()
+	sw, found := s.swarms[ih]
 	if !found {
 		return consts.ErrInvalidInfoHash
 	}
-	ps.Lock()
-	_ = swarm.Update(p)
-	ps.Unlock()
+	_ = sw.update(p, ps.strings)
 	return nil
 }
 
 // Delete will remove a user from a torrents swarm
 func (ps *PeerStore) Delete(ih store.InfoHash, p store.PeerID) error {
-	ps.RLock()
-	ps.swarms[ih].Remove(p)
-	ps.RUnlock()
+	if sw, ok := ps.swarm(ih); ok {
+		sw.remove(p)
+	}
 	return nil
 }
 
-// GetN will fetch swarms for a torrents active swarm up to N users
-func (ps *PeerStore) GetN(ih store.InfoHash, _ int) (store.Swarm, error) {
-	ps.RLock()
-	p, found := ps.swarms[ih]
-	ps.RUnlock()
+// GetN returns up to limit peers matching the filter, chosen uniformly at random. Only
+// the fields needed for peer lists are set.
+func (ps *PeerStore) GetN(ih store.InfoHash, limit int, filter store.PeerFilter) ([]store.Peer, error) {
+	sw, found := ps.swarm(ih)
 	if !found {
-		return store.Swarm{}, consts.ErrInvalidTorrentID
+		return nil, consts.ErrInvalidTorrentID
 	}
-	return p, nil
+	return sw.sample(ih, limit, filter), nil
 }
 
 type torrentDriver struct{}
@@ -374,6 +510,11 @@ func (u *UserStore) Delete(user store.User) error {
 	return nil
 }
 
+// Ping always succeeds for the in-memory user store
+func (u *UserStore) Ping(_ context.Context) error {
+	return nil
+}
+
 // Close will delete/free the underlying memory store
 func (u *UserStore) Close() error {
 	u.Lock()
@@ -393,4 +534,5 @@ func init() {
 	store.AddUserDriver(driverName, userDriver{})
 	store.AddPeerDriver(driverName, peerDriver{})
 	store.AddTorrentDriver(driverName, torrentDriver{})
+	store.AddBusDriver(driverName, busDriver{})
 }
@@ -1,8 +1,13 @@
 package memory
 
 import (
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/geo"
 	"github.com/leighmacdonald/mika/store"
+	"github.com/stretchr/testify/require"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestMemoryTorrentStore(t *testing.T) {
@@ -16,3 +21,107 @@ func TestMemoryPeerStore(t *testing.T) {
 func TestMemoryUserStore(t *testing.T) {
 	store.TestUserStore(t, NewUserStore())
 }
+
+func TestMemoryBus(t *testing.T) {
+	store.TestInvalidationBus(t, NewBus(t.Name()), NewBus(t.Name()))
+}
+
+func TestMemoryPeerStoreReap(t *testing.T) {
+	ps := NewPeerStore()
+	var hashes []store.InfoHash
+	seeders := map[store.PeerHash]bool{}
+	for i := 0; i < 200; i++ {
+		ih := store.GenerateTestTorrent().InfoHash
+		hashes = append(hashes, ih)
+		expired := store.GenerateTestPeer()
+		expired.AnnounceLast = time.Now().Add(-time.Hour)
+		if i%3 != 0 {
+			expired.Left = 1000
+		}
+		require.NoError(t, ps.Add(ih, expired))
+		seeders[store.NewPeerHash(ih, expired.PeerID)] = expired.Left == 0
+		if i%2 == 0 {
+			require.NoError(t, ps.Add(ih, store.GenerateTestPeer()))
+		}
+	}
+	reaped := ps.Reap()
+	require.Len(t, reaped, 200)
+	for _, rp := range reaped {
+		require.Equal(t, seeders[rp.PeerHash], rp.Seeder)
+	}
+	for i, ih := range hashes {
+		peers, err := ps.GetN(ih, 10, store.PeerFilter{})
+		if i%2 == 0 {
+			require.NoError(t, err)
+			require.Len(t, peers, 1)
+		} else {
+			require.Error(t, err, "Empty swarm not removed")
+		}
+	}
+	require.Len(t, ps.Reap(), 0)
+}
+
+func TestPackPeer(t *testing.T) {
+	in := newInterner()
+	p := store.NewPeer(10, store.PeerID{1, 2, 3}, net.ParseIP("1.2.3.4"), net.ParseIP("2001:db8::1"), 6881)
+	p.InfoHash = store.InfoHash{9}
+	p.Uploaded = 1000
+	p.Downloaded = 2000
+	p.Left = 300
+	p.Announces = 4
+	p.AS = "OVH SAS"
+	p.ASN = 16276
+	p.Client = "qBittorrent/4.2.5"
+	p.CountryCode = "CA"
+	p.Location = geo.LatLong{Latitude: 45.5, Longitude: -73.5}
+	p.CryptoLevel = consts.Required
+	p.Paused = true
+	h, c := pack(p, in)
+	var out store.Peer
+	unpack(&out, p.InfoHash, p.PeerID, &h, &c, in)
+	require.True(t, p.AnnounceLast.Equal(out.AnnounceLast))
+	require.True(t, p.AnnounceFirst.Equal(out.AnnounceFirst))
+	out.AnnounceLast, out.AnnounceFirst = p.AnnounceLast, p.AnnounceFirst
+	require.Equal(t, p, out)
+	id, interned := in.intern("OVH SAS")
+	require.True(t, interned)
+	require.Equal(t, c.as, id, "AS name not interned")
+	require.Nil(t, c.overflow)
+
+	// Once the interner is full new strings are kept with the peer
+	in.values = append(in.values, make([]string, maxInterned-len(in.values))...)
+	p.Client = "NewClient/1.0"
+	h, c = pack(p, in)
+	require.NotNil(t, c.overflow)
+	unpack(&out, p.InfoHash, p.PeerID, &h, &c, in)
+	require.Equal(t, "NewClient/1.0", out.Client)
+	require.Equal(t, "OVH SAS", out.AS)
+}
+
+func TestMemoryPeerStoreGetNSample(t *testing.T) {
+	ps := NewPeerStore()
+	ih := store.GenerateTestTorrent().InfoHash
+	dual := store.GenerateTestPeer()
+	dual.IPv6 = net.ParseIP("2001:db8::1")
+	dual.CryptoLevel = consts.Supported
+	require.NoError(t, ps.Add(ih, dual))
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ps.Add(ih, store.GenerateTestPeer()))
+	}
+	seen := make(map[store.PeerID]int)
+	for i := 0; i < 1000; i++ {
+		peers, err := ps.GetN(ih, 3, store.PeerFilter{})
+		require.NoError(t, err)
+		require.Len(t, peers, 3)
+		for _, p := range peers {
+			seen[p.PeerID]++
+		}
+	}
+	require.Len(t, seen, 10, "Sampling did not reach every peer")
+	for _, filter := range []store.PeerFilter{{IPv6: true}, {CryptoLevel: consts.Required}} {
+		peers, err := ps.GetN(ih, 5, filter)
+		require.NoError(t, err)
+		require.Len(t, peers, 1)
+		require.Equal(t, dual.PeerID, peers[0].PeerID)
+	}
+}
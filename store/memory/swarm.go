@@ -0,0 +1,376 @@
+package memory
+
+import (
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/geo"
+	"github.com/leighmacdonald/mika/store"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxInterned limits the number of distinct strings held by an interner. The client
+// string is supplied by peers so this prevents unbounded growth, once full any new
+// values are stored with the peer instead.
+const maxInterned = 1 << 16
+
+// interner deduplicates the low cardinality strings of peers, such as AS names and
+// client strings, so each peer only holds a small id
+type interner struct {
+	sync.RWMutex
+	ids    map[string]uint32
+	values []string
+}
+
+func newInterner() *interner {
+	return &interner{
+		ids:    make(map[string]uint32),
+		values: []string{""},
+	}
+}
+
+// intern returns the id of the string, adding it if it is not known. The empty string
+// is always 0. False is returned if the string is new and the interner is full.
+func (in *interner) intern(s string) (uint32, bool) {
+	if s == "" {
+		return 0, true
+	}
+	in.RLock()
+	id, found := in.ids[s]
+	in.RUnlock()
+	if found {
+		return id, true
+	}
+	in.Lock()
+	defer in.Unlock()
+	if id, found = in.ids[s]; found {
+		return id, true
+	}
+	if len(in.values) >= maxInterned {
+		return 0, false
+	}
+	id = uint32(len(in.values))
+	in.ids[s] = id
+	in.values = append(in.values, s)
+	return id, true
+}
+
+// get returns the string for the id
+func (in *interner) get(id uint32) string {
+	if id == 0 {
+		return ""
+	}
+	in.RLock()
+	s := in.values[id]
+	in.RUnlock()
+	return s
+}
+
+const (
+	flagIPv4 uint8 = 1 << iota
+	flagIPv6
+	flagPaused
+)
+
+// hotPeer holds the fields read on every announce to build the peer lists. Addresses are
+// kept inline so a swarm can be scanned without chasing pointers.
+type hotPeer struct {
+	// announceLast is the unix time in nanoseconds of the last announce
+	announceLast int64
+	left         uint32
+	ipv4         [4]byte
+	ipv6         [16]byte
+	port         uint16
+	flags        uint8
+	crypto       uint8
+}
+
+// coldPeer holds the remaining peer metadata which is only needed when a complete
+// store.Peer is requested
+type coldPeer struct {
+	uploaded      uint64
+	downloaded    uint64
+	announceFirst int64
+	totalTime     uint32
+	speedUp       uint32
+	speedDn       uint32
+	speedUpMax    uint32
+	speedDnMax    uint32
+	announces     uint32
+	userID        uint32
+	asn           uint32
+	latitude      float32
+	longitude     float32
+	as            uint32
+	client        uint32
+	country       [2]byte
+	// overflow holds the strings which could not be interned
+	overflow *peerStrings
+}
+
+// peerStrings are the peer strings stored when the interner is full
+type peerStrings struct {
+	as     string
+	client string
+}
+
+// swarm is the packed in-memory representation of a torrents peers. Peers are stored in
+// parallel slices, hot and cold, indexed by the position of their peer id. Removal swaps
+// the last peer into the vacated position.
+type swarm struct {
+	sync.RWMutex
+	index map[store.PeerID]int32
+	ids   []store.PeerID
+	hot   []hotPeer
+	cold  []coldPeer
+}
+
+func newSwarm() *swarm {
+	return &swarm{index: make(map[store.PeerID]int32)}
+}
+
+// pack converts the peer into its hot and cold parts
+func pack(p store.Peer, in *interner) (hotPeer, coldPeer) {
+	h := hotPeer{
+		announceLast: p.AnnounceLast.UnixNano(),
+		left:         p.Left,
+		port:         p.Port,
+		crypto:       uint8(p.CryptoLevel),
+	}
+	if ip := p.IPv4.To4(); ip != nil {
+		copy(h.ipv4[:], ip)
+		h.flags |= flagIPv4
+	}
+	if ip := p.IPv6.To16(); ip != nil {
+		copy(h.ipv6[:], ip)
+		h.flags |= flagIPv6
+	}
+	if p.Paused {
+		h.flags |= flagPaused
+	}
+	c := coldPeer{
+		uploaded:      p.Uploaded,
+		downloaded:    p.Downloaded,
+		announceFirst: p.AnnounceFirst.UnixNano(),
+		totalTime:     p.TotalTime,
+		speedUp:       p.SpeedUP,
+		speedDn:       p.SpeedDN,
+		speedUpMax:    p.SpeedUPMax,
+		speedDnMax:    p.SpeedDNMax,
+		announces:     p.Announces,
+		userID:        p.UserID,
+		asn:           p.ASN,
+		latitude:      float32(p.Location.Latitude),
+		longitude:     float32(p.Location.Longitude),
+	}
+	var asOk, clientOk bool
+	c.as, asOk = in.intern(p.AS)
+	c.client, clientOk = in.intern(p.Client)
+	if !asOk || !clientOk {
+		c.overflow = &peerStrings{}
+		if !asOk {
+			c.overflow.as = p.AS
+		}
+		if !clientOk {
+			c.overflow.client = p.Client
+		}
+	}
+	if len(p.CountryCode) == len(c.country) {
+		copy(c.country[:], p.CountryCode)
+	}
+	return h, c
+}
+
+// unpackHot sets the fields of the peer held in its hot part, which are all that is
+// needed to build peer lists
+func unpackHot(p *store.Peer, ih store.InfoHash, id store.PeerID, h *hotPeer) {
+	*p = store.Peer{
+		Left:         h.left,
+		Port:         h.port,
+		AnnounceLast: time.Unix(0, h.announceLast),
+		PeerID:       id,
+		InfoHash:     ih,
+		CryptoLevel:  consts.CryptoLevel(h.crypto),
+		Paused:       h.flags&flagPaused != 0,
+	}
+	if h.flags&flagIPv4 != 0 {
+		p.IPv4 = net.IP{h.ipv4[0], h.ipv4[1], h.ipv4[2], h.ipv4[3]}
+	}
+	if h.flags&flagIPv6 != 0 {
+		p.IPv6 = make(net.IP, net.IPv6len)
+		copy(p.IPv6, h.ipv6[:])
+	}
+}
+
+// unpack expands the packed peer into a store.Peer
+func unpack(p *store.Peer, ih store.InfoHash, id store.PeerID, h *hotPeer, c *coldPeer, in *interner) {
+	unpackHot(p, ih, id, h)
+	p.Uploaded = c.uploaded
+	p.Downloaded = c.downloaded
+	p.TotalTime = c.totalTime
+	p.SpeedUP = c.speedUp
+	p.SpeedDN = c.speedDn
+	p.SpeedUPMax = c.speedUpMax
+	p.SpeedDNMax = c.speedDnMax
+	p.Announces = c.announces
+	p.AnnounceFirst = time.Unix(0, c.announceFirst)
+	p.Location = geo.LatLong{
+		Latitude:  float64(c.latitude),
+		Longitude: float64(c.longitude),
+	}
+	p.ASN = c.asn
+	p.AS = in.get(c.as)
+	p.UserID = c.userID
+	p.Client = in.get(c.client)
+	if c.overflow != nil {
+		if c.overflow.as != "" {
+			p.AS = c.overflow.as
+		}
+		if c.overflow.client != "" {
+			p.Client = c.overflow.client
+		}
+	}
+	if c.country != [2]byte{} {
+		p.CountryCode = string(c.country[:])
+	}
+}
+
+// len returns the number of peers in the swarm
+func (s *swarm) len() int {
+	s.RLock()
+	n := len(s.ids)
+	s.RUnlock()
+	return n
+}
+
+// add inserts the peer, replacing any existing peer with the same peer id
+func (s *swarm) add(p store.Peer, in *interner) {
+	h, c := pack(p, in)
+	s.Lock()
+	if i, found := s.index[p.PeerID]; found {
+		s.hot[i] = h
+		s.cold[i] = c
+	} else {
+		s.index[p.PeerID] = int32(len(s.ids))
+		s.ids = append(s.ids, p.PeerID)
+		s.hot = append(s.hot, h)
+		s.cold = append(s.cold, c)
+	}
+	s.Unlock()
+}
+
+// update replaces the peer if it is a member of the swarm
+func (s *swarm) update(p store.Peer, in *interner) bool {
+	h, c := pack(p, in)
+	s.Lock()
+	i, found := s.index[p.PeerID]
+	if found {
+		s.hot[i] = h
+		s.cold[i] = c
+	}
+	s.Unlock()
+	return found
+}
+
+// removeAt deletes the peer at position i, the caller must hold the write lock
+func (s *swarm) removeAt(i int) {
+	last := len(s.ids) - 1
+	delete(s.index, s.ids[i])
+	if i != last {
+		s.ids[i] = s.ids[last]
+		s.hot[i] = s.hot[last]
+		s.cold[i] = s.cold[last]
+		s.index[s.ids[i]] = int32(i)
+	}
+	s.ids = s.ids[:last]
+	s.hot = s.hot[:last]
+	s.cold = s.cold[:last]
+}
+
+// remove deletes the peer from the swarm
+func (s *swarm) remove(id store.PeerID) {
+	s.Lock()
+	if i, found := s.index[id]; found {
+		s.removeAt(int(i))
+	}
+	s.Unlock()
+}
+
+// get copies the peer into p if it exists
+func (s *swarm) get(p *store.Peer, ih store.InfoHash, id store.PeerID, in *interner) error {
+	s.RLock()
+	i, found := s.index[id]
+	if !found {
+		s.RUnlock()
+		return consts.ErrInvalidPeerID
+	}
+	unpack(p, ih, id, &s.hot[i], &s.cold[i], in)
+	s.RUnlock()
+	return nil
+}
+
+// sync applies the batched stats to the peer if it is a member of the swarm
+func (s *swarm) sync(id store.PeerID, stats store.PeerStats) {
+	s.Lock()
+	if i, found := s.index[id]; found {
+		h, c := &s.hot[i], &s.cold[i]
+		for _, hist := range stats.Hist {
+			c.uploaded += hist.Uploaded
+			c.downloaded += hist.Downloaded
+			h.announceLast = hist.Timestamp.UnixNano()
+		}
+		c.announces += uint32(len(stats.Hist))
+		h.left = stats.Left
+	}
+	s.Unlock()
+}
+
+// reap removes the peers which have not announced since the expiry time
+func (s *swarm) reap(ih store.InfoHash, expiry time.Time) []store.ReapedPeer {
+	var peerHashes []store.ReapedPeer
+	cutoff := expiry.UnixNano()
+	s.Lock()
+	for i := len(s.ids) - 1; i >= 0; i-- {
+		if h := &s.hot[i]; h.announceLast < cutoff {
+			peerHashes = append(peerHashes, store.ReapedPeer{
+				PeerHash: store.NewPeerHash(ih, s.ids[i]),
+				Seeder:   h.left == 0 || h.flags&flagPaused != 0,
+			})
+			s.removeAt(i)
+		}
+	}
+	s.Unlock()
+	return peerHashes
+}
+
+// sample returns up to n peers matching the filter, chosen uniformly at random using
+// reservoir sampling. Only the hot data is read, the peers returned only have the fields
+// needed for peer lists set. n <= 0 returns every matching peer.
+func (s *swarm) sample(ih store.InfoHash, n int, filter store.PeerFilter) []store.Peer {
+	s.RLock()
+	if n <= 0 {
+		n = len(s.ids)
+	}
+	selected := make([]int, 0, n)
+	matched := 0
+	for i := range s.hot {
+		h := &s.hot[i]
+		if !filter.MatchFields(s.ids[i], h.flags&flagIPv4 != 0, h.flags&flagIPv6 != 0,
+			consts.CryptoLevel(h.crypto)) {
+			continue
+		}
+		matched++
+		if len(selected) < n {
+			selected = append(selected, i)
+		} else if j := rand.Intn(matched); j < n {
+			selected[j] = i
+		}
+	}
+	peers := make([]store.Peer, len(selected))
+	for j, i := range selected {
+		unpackHot(&peers[j], ih, s.ids[i], &s.hot[i])
+	}
+	s.RUnlock()
+	return peers
+}
@@ -8,7 +8,8 @@ BEGIN
            Enabled      as is_deleted,
            Downloaded   as downloaded,
            Uploaded     as uploaded,
-           0            as announces
+           0            as announces,
+           cast(PermissionID as char) as class
     FROM users
     WHERE torrent_pass = in_passkey;
 end;
@@ -22,7 +23,8 @@ BEGIN
            Enabled      as is_deleted,
            Downloaded   as downloaded,
            Uploaded     as uploaded,
-           0            as announces
+           0            as announces,
+           cast(PermissionID as char) as class
     FROM users
     WHERE `ID` = in_user_id;
 end;
@@ -7,7 +7,6 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"strings"
 
 	// imported for side-effects
 	_ "github.com/go-sql-driver/mysql"
@@ -17,6 +16,7 @@ import (
 	"github.com/leighmacdonald/mika/store"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"math"
 	"net"
 	"sync"
 	"time"
@@ -69,9 +69,9 @@ func (u *UserStore) Sync(b map[string]store.UserStats) error {
 
 // Add will add a new user to the backing store
 func (u *UserStore) Add(user store.User) error {
-	const q = `CALL user_add(?, ?, ?, ?, ?, ?, ?)`
+	const q = `CALL user_add(?, ?, ?, ?, ?, ?, ?, ?)`
 	_, err := u.db.Exec(q, user.UserID, user.Passkey, user.DownloadEnabled,
-		user.IsDeleted, user.Downloaded, user.Uploaded, user.Announces)
+		user.IsDeleted, user.Downloaded, user.Uploaded, user.Announces, user.Class)
 	if err != nil {
 		return errors.Wrap(err, "Failed to add user to store")
 	}
@@ -119,15 +119,20 @@ func (u *UserStore) Delete(user store.User) error {
 }
 
 func (u *UserStore) Update(user store.User, oldPasskey string) error {
-	const q = `CALL user_update(?, ?, ?, ?, ?, ?, ?, ?)`
+	const q = `CALL user_update(?, ?, ?, ?, ?, ?, ?, ?, ?)`
 	if _, err := u.db.Exec(q, user.UserID, user.Passkey, user.DownloadEnabled,
 		user.IsDeleted, user.Downloaded, user.Uploaded, user.Announces,
-		oldPasskey); err != nil {
+		user.Class, oldPasskey); err != nil {
 		return errors.Wrapf(err, "Failed to update user")
 	}
 	return nil
 }
 
+// Ping checks the database connection is alive
+func (u *UserStore) Ping(ctx context.Context) error {
+	return u.db.PingContext(ctx)
+}
+
 // Close will close the underlying database connection and clear the local caches
 func (u *UserStore) Close() error {
 	return u.db.Close()
@@ -244,6 +249,83 @@ func (s *TorrentStore) WhiteListGetAll() ([]store.WhiteListClient, error) {
 	return wl, nil
 }
 
+// BanAdd will insert a new IP/CIDR ban, replacing any existing ban for the same network.
+// Any bans which have expired are purged.
+func (s *TorrentStore) BanAdd(ban store.Ban) error {
+	const q = `CALL ban_add(?, ?, ?, ?, ?)`
+	var expires interface{}
+	if !ban.Expires.IsZero() {
+		expires = ban.Expires
+	}
+	if _, err := s.db.Exec(q, ban.CIDR, ban.Reason, ban.CreatedBy, ban.CreatedOn, expires); err != nil {
+		return errors.Wrap(err, "Failed to insert new ban")
+	}
+	return nil
+}
+
+// BanDelete removes the ban matching the CIDR of the ban provided
+func (s *TorrentStore) BanDelete(ban store.Ban) error {
+	const q = `CALL ban_delete(?)`
+	res, err := s.db.Exec(q, ban.CIDR)
+	if err != nil {
+		return errors.Wrap(err, "Failed to delete ban")
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "Failed to get ban delete count")
+	}
+	if rows == 0 {
+		return consts.ErrInvalidBan
+	}
+	return nil
+}
+
+// BanGetAll fetches all known bans, including expired bans
+func (s *TorrentStore) BanGetAll() ([]store.Ban, error) {
+	const q = `CALL ban_all()`
+	rows, err := s.db.Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to select bans")
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Errorf("failed to close query rows: %s", err)
+		}
+	}()
+	var bans []store.Ban
+	for rows.Next() {
+		var ban store.Ban
+		var expires sql.NullTime
+		if err := rows.Scan(&ban.CIDR, &ban.Reason, &ban.CreatedBy, &ban.CreatedOn, &expires); err != nil {
+			return nil, errors.Wrap(err, "Failed to fetch ban")
+		}
+		if expires.Valid {
+			ban.Expires = expires.Time
+		}
+		bans = append(bans, ban)
+	}
+	return bans, nil
+}
+
+// InfoHashes returns the info hash of every torrent which has not been deleted
+func (s *TorrentStore) InfoHashes() ([]store.InfoHash, error) {
+	const q = `CALL torrent_info_hashes()`
+	var rows [][]byte
+	if err := s.db.Select(&rows, q); err != nil {
+		return nil, errors.Wrap(err, "Failed to select torrent info hashes")
+	}
+	hashes := make([]store.InfoHash, len(rows))
+	for i, b := range rows {
+		copy(hashes[i][:], b)
+	}
+	return hashes, nil
+}
+
+// Ping checks the database connection is alive
+func (s *TorrentStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
 // Close will close the underlying mysql database connection
 func (s *TorrentStore) Close() error {
 	return s.db.Close()
@@ -332,8 +414,8 @@ func (ps *PeerStore) Sync(b map[store.PeerHash]store.PeerStats) error {
 
 // Reap will loop through the peers removing any stale entries from active swarms
 // TODO fetch peer hashes for expired peers to flush local caches
-func (ps *PeerStore) Reap() []store.PeerHash {
-	var peerHashes []store.PeerHash
+func (ps *PeerStore) Reap() []store.ReapedPeer {
+	var peerHashes []store.ReapedPeer
 	const q = `CALL peer_reap(?)`
 	rows, err := ps.db.Exec(q, time.Now().Add(-15*time.Minute))
 	if err != nil {
@@ -348,6 +430,11 @@ func (ps *PeerStore) Reap() []store.PeerHash {
 	return peerHashes
 }
 
+// Ping checks the database connection is alive
+func (ps *PeerStore) Ping(ctx context.Context) error {
+	return ps.db.PingContext(ctx)
+}
+
 // Close will close the underlying database connection
 func (ps *PeerStore) Close() error {
 	return ps.db.Close()
@@ -357,8 +444,7 @@ func (ps *PeerStore) Close() error {
 func (ps *PeerStore) Add(ih store.InfoHash, p store.Peer) error {
 	const q = `CALL peer_add(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 	point := fmt.Sprintf("POINT(%s)", p.Location.String())
-	ip6 := strings.Count(p.IP.String(), ":") > 1
-	_, err := ps.db.Exec(q, ih.Bytes(), p.PeerID.Bytes(), p.UserID, ip6, p.IP.String(), p.Port, point,
+	_, err := ps.db.Exec(q, ih.Bytes(), p.PeerID.Bytes(), p.UserID, ipString(p.IPv4), ipString(p.IPv6), p.Port, point,
 		p.AnnounceFirst, p.AnnounceLast, p.Downloaded, p.Uploaded, p.Left, p.Client,
 		p.CountryCode, p.ASN, p.AS, int(p.CryptoLevel))
 	if err != nil {
@@ -386,13 +472,18 @@ func (ps *PeerStore) Get(peer *store.Peer, ih store.InfoHash, peerID store.PeerI
 	return nil
 }
 
-// GetN will fetch the torrents swarm member peers
-func (ps *PeerStore) GetN(ih store.InfoHash, limit int) (store.Swarm, error) {
-	const q = `CALL peer_get_n(?, ?)`
-	swarm := store.NewSwarm()
-	rows, err := ps.db.Query(q, ih.Bytes(), limit)
+// GetN returns up to limit peers matching the filter, chosen uniformly at random
+func (ps *PeerStore) GetN(ih store.InfoHash, limit int, filter store.PeerFilter) ([]store.Peer, error) {
+	const q = `CALL peer_get_n(?, ?, ?, ?, ?, ?)`
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	ipv4, ipv6 := filter.Families()
+	var peers []store.Peer
+	rows, err := ps.db.Query(q, ih.Bytes(), limit, ipv4, ipv6, filter.CryptoLevel == consts.Required,
+		filter.Exclude.Bytes())
 	if err != nil {
-		return swarm, err
+		return nil, err
 	}
 	defer func() {
 		if err := rows.Close(); err != nil {
@@ -400,18 +491,34 @@ func (ps *PeerStore) GetN(ih store.InfoHash, limit int) (store.Swarm, error) {
 		}
 	}()
 	var p store.Peer
-	var ip string
+	var ip4, ip6 sql.NullString
 
 	for rows.Next() {
-		if err := rows.Scan(&p.PeerID, &p.InfoHash, &p.UserID, &p.IPv6, &ip, &p.Port, &p.Downloaded, &p.Uploaded,
+		if err := rows.Scan(&p.PeerID, &p.InfoHash, &p.UserID, &ip4, &ip6, &p.Port, &p.Downloaded, &p.Uploaded,
 			&p.Left, &p.TotalTime, &p.Announces, &p.SpeedUP, &p.SpeedDN, &p.SpeedUPMax, &p.SpeedDNMax,
 			&p.Location, &p.AnnounceLast, &p.AnnounceFirst, &p.CountryCode, &p.ASN, &p.AS, &p.CryptoLevel); err != nil {
-			return swarm, err
+			return nil, err
+		}
+		p.IPv4 = nil
+		p.IPv6 = nil
+		if ip4.Valid {
+			p.IPv4 = net.ParseIP(ip4.String).To4()
 		}
-		p.IP = net.ParseIP(ip)
-		swarm.Add(p)
+		if ip6.Valid {
+			p.IPv6 = net.ParseIP(ip6.String)
+		}
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
+
+// ipString returns the string form of the address, or nil for peers missing an
+// address of that family so it is stored as NULL
+func ipString(ip net.IP) interface{} {
+	if ip == nil {
+		return nil
 	}
-	return swarm, nil
+	return ip.String()
 }
 
 var (
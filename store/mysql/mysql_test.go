@@ -8,9 +8,11 @@ import (
 	"github.com/leighmacdonald/mika/store/memory"
 	"github.com/leighmacdonald/mika/util"
 	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 var schemaSets = []string{"store/mysql/schema.sql"}
@@ -24,6 +26,22 @@ func TestTorrentDriver(t *testing.T) {
 	}
 }
 
+func TestBanPurge(t *testing.T) {
+	db := sqlx.MustConnect(driverName, config.GetStoreConfig(config.Torrent).DSN())
+	setupDB(t, db, schemaSets[0])
+	ts := &TorrentStore{db: db}
+	expired, _ := store.NewBan("10.0.0.0/8", "Expired", "admin", time.Hour)
+	expired.CreatedOn = time.Now().Add(-time.Hour * 2)
+	expired.Expires = time.Now().Add(-time.Hour)
+	require.NoError(t, ts.BanAdd(expired))
+	active, _ := store.NewBan("2600::1", "Active", "admin", time.Hour)
+	require.NoError(t, ts.BanAdd(active))
+	bans, err := ts.BanGetAll()
+	require.NoError(t, err)
+	require.Len(t, bans, 1)
+	require.Equal(t, active.CIDR, bans[0].CIDR)
+}
+
 func TestUserDriver(t *testing.T) {
 	db := sqlx.MustConnect(driverName, config.GetStoreConfig(config.Torrent).DSN())
 	for _, p := range schemaSets {
@@ -45,7 +63,7 @@ func TestPeerStore(t *testing.T) {
 }
 
 func clearDB(db *sqlx.DB) {
-	for _, table := range []string{"peers", "torrent", "users", "whitelist"} {
+	for _, table := range []string{"peers", "torrent", "users", "whitelist", "bans"} {
 		if _, err := db.Exec(fmt.Sprintf(`drop table if exists %s cascade;`, table)); err != nil {
 			log.Panicf("Failed to prep database: %s", err.Error())
 		}
@@ -28,6 +28,7 @@ create table users
     downloaded       bigint unsigned default 0 not null,
     uploaded         bigint unsigned default 0 not null,
     announces        int             default 0 not null,
+    class            varchar(32)     default '' not null,
     constraint user_passkey_uindex unique (passkey)
 );
 
@@ -37,8 +38,8 @@ create table peers
     peer_id          binary(20)                not null,
     info_hash        binary(20)                not null,
     user_id          int unsigned              not null,
-    ipv6             boolean                   not null,
-    addr_ip          int unsigned              not null,
+    addr_ip          int unsigned              null,
+    addr_ip6         varbinary(16)             null,
     addr_port        smallint unsigned         not null,
     total_downloaded bigint unsigned default 0 not null,
     total_uploaded   bigint unsigned default 0 not null,
@@ -68,6 +69,16 @@ create table whitelist
     client_name   varchar(20) not null
 );
 
+DROP TABLE IF EXISTS bans;
+create table bans
+(
+    cidr       varchar(43)  not null primary key,
+    reason     varchar(255) not null,
+    created_by varchar(64)  not null,
+    created_on datetime     not null,
+    expires    datetime     null
+);
+
 
 -- USERS
 DROP PROCEDURE IF EXISTS user_by_passkey;
@@ -79,7 +90,8 @@ BEGIN
            is_deleted,
            downloaded,
            uploaded,
-           announces
+           announces,
+           class
     FROM users
     WHERE passkey = in_passkey;
 end;
@@ -93,7 +105,8 @@ BEGIN
            is_deleted,
            downloaded,
            uploaded,
-           announces
+           announces,
+           class
     FROM users
     WHERE user_id = in_user_id;
 end;
@@ -113,12 +126,13 @@ CREATE PROCEDURE user_add(IN in_user_id int,
                           IN in_is_deleted bool,
                           IN in_downloaded bigint unsigned,
                           IN in_uploaded bigint unsigned,
-                          IN in_announces bigint)
+                          IN in_announces bigint,
+                          IN in_class varchar(32))
 BEGIN
     INSERT INTO users
-    (user_id, passkey, download_enabled, is_deleted, downloaded, uploaded, announces)
+    (user_id, passkey, download_enabled, is_deleted, downloaded, uploaded, announces, class)
     VALUES (in_user_id, in_passkey, in_download_enabled, in_is_deleted,
-            in_downloaded, in_uploaded, in_announces);
+            in_downloaded, in_uploaded, in_announces, in_class);
 end;
 
 DROP PROCEDURE IF EXISTS user_update;
@@ -129,6 +143,7 @@ CREATE PROCEDURE user_update(IN in_user_id int,
                              IN in_downloaded bigint unsigned,
                              IN in_uploaded bigint unsigned,
                              IN in_announces bigint,
+                             IN in_class varchar(32),
                              IN in_old_passkey varchar(40))
 BEGIN
     UPDATE users
@@ -138,7 +153,8 @@ BEGIN
         is_deleted       = in_is_deleted,
         downloaded       = in_downloaded,
         uploaded         = in_uploaded,
-        announces        = in_announces
+        announces        = in_announces,
+        class            = in_class
     WHERE passkey = if(in_old_passkey = '', in_passkey, in_old_passkey);
 end;
 
@@ -180,6 +196,14 @@ BEGIN
       AND is_deleted = in_deleted;
 end;
 
+DROP PROCEDURE IF EXISTS torrent_info_hashes;
+CREATE PROCEDURE torrent_info_hashes()
+BEGIN
+    SELECT info_hash
+    FROM torrent
+    WHERE is_deleted = false;
+end;
+
 DROP PROCEDURE IF EXISTS torrent_delete;
 CREATE PROCEDURE torrent_delete(IN in_info_hash binary(20))
 BEGIN
@@ -246,6 +270,36 @@ BEGIN
     WHERE client_prefix = in_client_prefix;
 end;
 
+DROP PROCEDURE IF EXISTS ban_all;
+CREATE PROCEDURE ban_all()
+BEGIN
+    SELECT cidr, reason, created_by, created_on, expires
+    FROM bans;
+end;
+
+DROP PROCEDURE IF EXISTS ban_add;
+CREATE PROCEDURE ban_add(IN in_cidr varchar(43),
+                         IN in_reason varchar(255),
+                         IN in_created_by varchar(64),
+                         IN in_created_on datetime,
+                         IN in_expires datetime)
+BEGIN
+    -- Bans are written in UTC, expired bans are purged so the table only holds active bans
+    DELETE
+    FROM bans
+    WHERE expires < UTC_TIMESTAMP();
+    REPLACE INTO bans (cidr, reason, created_by, created_on, expires)
+    VALUES (in_cidr, in_reason, in_created_by, in_created_on, in_expires);
+end;
+
+DROP PROCEDURE IF EXISTS ban_delete;
+CREATE PROCEDURE ban_delete(IN in_cidr varchar(43))
+BEGIN
+    DELETE
+    FROM bans
+    WHERE cidr = in_cidr;
+end;
+
 -- END TORRENTS
 
 -- PEERS
@@ -288,8 +342,8 @@ DROP PROCEDURE IF EXISTS peer_add;
 CREATE PROCEDURE peer_add(IN in_info_hash binary(20),
                           IN in_peer_id binary(20),
                           IN in_user_id int,
-                          IN in_ipv6 boolean,
                           IN in_addr_ip varchar(255),
+                          IN in_addr_ip6 varchar(255),
                           IN in_addr_port int,
                           IN in_location varchar(255),
                           IN in_announce_first datetime,
@@ -304,13 +358,13 @@ CREATE PROCEDURE peer_add(IN in_info_hash binary(20),
                           IN in_crypto_level int)
 BEGIN
     INSERT INTO peers
-    (peer_id, info_hash, user_id, ipv6, addr_ip, addr_port, location, announce_first, announce_last, announce_prev,
+    (peer_id, info_hash, user_id, addr_ip, addr_ip6, addr_port, location, announce_first, announce_last, announce_prev,
      total_downloaded, total_uploaded, total_left, agent, country_code, asn, as_name, crypto_level)
     VALUES (in_peer_id,
             in_info_hash,
             in_user_id,
-            in_ipv6,
-            if(in_ipv6 = false, INET_ATON(in_addr_ip), INET6_ATON(in_addr_ip)),
+            INET_ATON(in_addr_ip),
+            INET6_ATON(in_addr_ip6),
             in_addr_port,
             ST_PointFromText(in_location),
             in_announce_first,
@@ -342,8 +396,8 @@ BEGIN
     SELECT peer_id,
            info_hash,
            user_id,
-           ipv6,
-           if(ipv6 = false, INET_NTOA(addr_ip), INET6_NTOA(addr_ip)) as addr_ip,
+           INET_NTOA(addr_ip)   as addr_ip,
+           INET6_NTOA(addr_ip6) as addr_ip6,
            addr_port,
            total_downloaded,
            total_uploaded,
@@ -367,13 +421,14 @@ BEGIN
 end;
 
 DROP PROCEDURE IF EXISTS peer_get_n;
-CREATE PROCEDURE peer_get_n(IN in_info_hash binary(20), IN in_limit int)
+CREATE PROCEDURE peer_get_n(IN in_info_hash binary(20), IN in_limit int, IN in_ipv4 bool, IN in_ipv6 bool,
+                            IN in_crypto_required bool, IN in_exclude_peer_id binary(20))
 BEGIN
     SELECT peer_id,
            info_hash,
            user_id,
-           ipv6,
-           if(ipv6 = false, INET_NTOA(addr_ip), INET6_NTOA(addr_ip)) as addr_ip,
+           INET_NTOA(addr_ip)   as addr_ip,
+           INET6_NTOA(addr_ip6) as addr_ip6,
            addr_port,
            total_downloaded,
            total_uploaded,
@@ -393,6 +448,10 @@ BEGIN
            crypto_level                                              as crypto_level
     FROM peers
     WHERE info_hash = in_info_hash
+      AND peer_id != in_exclude_peer_id
+      AND ((in_ipv4 AND addr_ip IS NOT NULL) OR (in_ipv6 AND addr_ip6 IS NOT NULL))
+      AND (NOT in_crypto_required OR crypto_level > 0)
+    ORDER BY RAND()
     LIMIT in_limit;
 end;
 -- END PEERS
\ No newline at end of file
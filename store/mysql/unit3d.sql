@@ -14,6 +14,43 @@ BEGIN
     FROM whitelist;
 end;
 
+DROP TABLE IF EXISTS bans;
+create table bans
+(
+    cidr       varchar(43)  not null primary key,
+    reason     varchar(255) not null,
+    created_by varchar(64)  not null,
+    created_on datetime     not null,
+    expires    datetime     null
+);
+
+CREATE OR REPLACE PROCEDURE ban_all()
+BEGIN
+    SELECT cidr, reason, created_by, created_on, expires
+    FROM bans;
+end;
+
+CREATE OR REPLACE PROCEDURE ban_add(IN in_cidr varchar(43),
+                                   IN in_reason varchar(255),
+                                   IN in_created_by varchar(64),
+                                   IN in_created_on datetime,
+                                   IN in_expires datetime)
+BEGIN
+    -- Bans are written in UTC, expired bans are purged so the table only holds active bans
+    DELETE
+    FROM bans
+    WHERE expires < UTC_TIMESTAMP();
+    REPLACE INTO bans (cidr, reason, created_by, created_on, expires)
+    VALUES (in_cidr, in_reason, in_created_by, in_created_on, in_expires);
+end;
+
+CREATE OR REPLACE PROCEDURE ban_delete(IN in_cidr varchar(43))
+BEGIN
+    DELETE
+    FROM bans
+    WHERE cidr = in_cidr;
+end;
+
 -- USERS
 CREATE OR REPLACE PROCEDURE user_by_passkey(
     IN in_passkey varchar(32)
@@ -25,7 +62,8 @@ BEGIN
            if(active = true, false, true) as is_deleted,
            downloaded                     as downloaded,
            uploaded                       as uploaded,
-           0                              as announces
+           0                              as announces,
+           cast(group_id as char)         as class
     FROM users
     WHERE passkey = in_passkey collate utf8mb4_unicode_ci;
 end;
@@ -40,7 +78,8 @@ BEGIN
            if(active = true, false, true) as is_deleted,
            downloaded                     as downloaded,
            uploaded                       as uploaded,
-           0                              as announces
+           0                              as announces,
+           cast(group_id as char)         as class
     FROM users
     WHERE `id` = in_user_id;
 end;
@@ -59,7 +98,8 @@ CREATE OR REPLACE PROCEDURE user_add(IN in_user_id int,
                                      IN in_is_deleted bool,
                                      IN in_downloaded bigint unsigned,
                                      IN in_uploaded bigint unsigned,
-                                     IN in_announces bigint)
+                                     IN in_announces bigint,
+                                     IN in_class varchar(32))
 BEGIN
     SIGNAL SQLSTATE '45000'
         SET MESSAGE_TEXT = 'not compatible';
@@ -72,6 +112,7 @@ CREATE OR REPLACE PROCEDURE user_update(IN in_user_id int,
                                         IN in_downloaded bigint unsigned,
                                         IN in_uploaded bigint unsigned,
                                         IN in_announces bigint,
+                                        IN in_class varchar(32),
                                         IN in_old_passkey varchar(40))
 BEGIN
     UPDATE users
@@ -118,6 +159,12 @@ BEGIN
     WHERE info_hash = HEX(in_info_hash);
 end;
 
+CREATE OR REPLACE PROCEDURE torrent_info_hashes()
+BEGIN
+    SELECT UNHEX(info_hash) as info_hash
+    FROM torrents;
+end;
+
 CREATE OR REPLACE PROCEDURE torrent_delete(IN in_info_hash binary(20))
 BEGIN
     DELETE FROM torrents WHERE info_hash = HEX(in_info_hash);
@@ -186,8 +233,8 @@ end;
 CREATE OR REPLACE PROCEDURE peer_add(IN in_info_hash binary(20),
                                      IN in_peer_id binary(20),
                                      IN in_user_id int,
-                                     IN in_ipv6 boolean,
                                      IN in_addr_ip varchar(255),
+                                     IN in_addr_ip6 varchar(255),
                                      IN in_addr_port int,
                                      IN in_location varchar(255),
                                      IN in_announce_first datetime,
@@ -209,8 +256,8 @@ BEGIN
             md5(HEX(in_peer_id)),
             HEX(in_info_hash),
             in_user_id,
-            in_ipv6,
-            in_addr_ip,
+            in_addr_ip IS NULL,
+            COALESCE(in_addr_ip, in_addr_ip6),
             in_addr_port,
             ST_PointFromText(in_location),
             in_announce_first,
@@ -260,8 +307,8 @@ BEGIN
     SELECT UNHEX(peer_id)      as peer_id,
            UNHEX(info_hash)    as info_hash,
            user_id             as user_id,
-           ipv6                as ipv6,
-           ip                  as addr_ip,
+           if(ipv6, NULL, ip)  as addr_ip,
+           if(ipv6, ip, NULL)  as addr_ip6,
            port                as addr_port,
            downloaded          as total_downloaded,
            uploaded            as total_uploaded,
@@ -284,13 +331,15 @@ BEGIN
       and peer_id = HEX(in_peer_id);
 END;
 
-CREATE OR REPLACE PROCEDURE peer_get_n(IN in_info_hash binary(20), IN in_limit int)
+CREATE OR REPLACE PROCEDURE peer_get_n(IN in_info_hash binary(20), IN in_limit int, IN in_ipv4 bool,
+                                       IN in_ipv6 bool, IN in_crypto_required bool,
+                                       IN in_exclude_peer_id binary(20))
 BEGIN
     SELECT UNHEX(peer_id)      as peer_id,
            UNHEX(info_hash)    as info_hash,
            user_id             as user_id,
-           ipv6                as ipv6,
-           ip                  as addr_ip,
+           if(ipv6, NULL, ip)  as addr_ip,
+           if(ipv6, ip, NULL)  as addr_ip6,
            port                as addr_port,
            downloaded          as total_downloaded,
            uploaded            as total_uploaded,
@@ -310,6 +359,10 @@ BEGIN
            crypto_level        as crypto_level
     FROM peers
     WHERE info_hash = HEX(in_info_hash)
+      AND peer_id != HEX(in_exclude_peer_id)
+      AND ((in_ipv4 AND NOT ipv6) OR (in_ipv6 AND ipv6))
+      AND (NOT in_crypto_required OR crypto_level > 0)
+    ORDER BY RAND()
     LIMIT in_limit;
 END;
 
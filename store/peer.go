@@ -82,9 +82,11 @@ type Peer struct {
 	SpeedUPMax uint32 `db:"speed_up_max"  redis:"speed_up_max" json:"speed_up_max"`
 	// Max recorded dn speed, bytes/sec
 	SpeedDNMax uint32 `db:"speed_dn_max" redis:"speed_dn_max" json:"speed_dn_max"`
-	// Clients IPv4 Address detected automatically, does not use client supplied value
-	IP   net.IP `db:"addr_ip" redis:"addr_ip" json:"addr_ip"`
-	IPv6 bool   `db:"ipv6" json:"ipv6"`
+	// Clients IPv4 endpoint, nil if the peer does not have one
+	IPv4 net.IP `db:"addr_ip" redis:"addr_ip" json:"addr_ip"`
+	// Clients IPv6 endpoint, nil if the peer does not have one. Dual-stack peers (BEP 7)
+	// will have both IPv4 and IPv6 set.
+	IPv6 net.IP `db:"addr_ip6" redis:"addr_ip6" json:"addr_ip6"`
 	// Clients reported port
 	Port uint16 `db:"addr_port" redis:"addr_port" json:"addr_port"`
 	// Total number of announces the peer has made
@@ -124,7 +126,54 @@ func (peer *Peer) IsNew() bool {
 
 // Valid returns true if the peer data meets the minimum requirements to participate in swarms
 func (peer *Peer) Valid() bool {
-	return peer.UserID > 0 && peer.Port >= 1024 && util.IsPrivateIP(peer.IP)
+	return peer.UserID > 0 && peer.Port >= 1024 && util.IsPrivateIP(peer.Addr())
+}
+
+// Addr returns the primary address of the peer. IPv4 is preferred for dual-stack peers.
+func (peer *Peer) Addr() net.IP {
+	if peer.IPv4 != nil {
+		return peer.IPv4
+	}
+	return peer.IPv6
+}
+
+// PeerFilter restricts the peers returned by PeerStore.GetN
+type PeerFilter struct {
+	// IPv4 and IPv6 select peers with an endpoint of that address family. Peers matching
+	// either requested family are returned, if neither is set every peer matches.
+	IPv4 bool
+	IPv6 bool
+	// CryptoLevel is the level of the requesting peer. When consts.Required only peers
+	// supporting encryption are returned.
+	CryptoLevel consts.CryptoLevel
+	// Exclude is the peer id of the requesting peer, which is never returned
+	Exclude PeerID
+}
+
+// Families returns the address families matched by the filter
+func (f PeerFilter) Families() (ipv4 bool, ipv6 bool) {
+	if !f.IPv4 && !f.IPv6 {
+		return true, true
+	}
+	return f.IPv4, f.IPv6
+}
+
+// Match returns true if the peer satisfies the filter
+func (f PeerFilter) Match(p *Peer) bool {
+	return f.MatchFields(p.PeerID, p.IPv4 != nil, p.IPv6 != nil, p.CryptoLevel)
+}
+
+// MatchFields is Match for stores which can check the individual fields without
+// building a full Peer
+func (f PeerFilter) MatchFields(peerID PeerID, hasIPv4 bool, hasIPv6 bool, cl consts.CryptoLevel) bool {
+	if peerID == f.Exclude {
+		return false
+	}
+	if f.CryptoLevel == consts.Required && cl == consts.Unencrypted {
+		return false
+	}
+	ipv4, ipv6 := f.Families()
+	return (ipv4 && hasIPv4) || (ipv6 && hasIPv6)
 }
 
 // Swarm is a set of users participating in a torrent
@@ -218,10 +267,12 @@ func (swarm Swarm) Update(p Peer) error {
 	return nil
 }
 
-// NewPeer create a new peer instance for inserting into a swarm
-func NewPeer(userID uint32, peerID PeerID, ip net.IP, port uint16) Peer {
+// NewPeer create a new peer instance for inserting into a swarm. Either ipv4 or ipv6
+// may be nil for peers that are not dual-stack.
+func NewPeer(userID uint32, peerID PeerID, ipv4 net.IP, ipv6 net.IP, port uint16) Peer {
 	return Peer{
-		IP:            ip,
+		IPv4:          ipv4.To4(),
+		IPv6:          ipv6,
 		Port:          port,
 		AnnounceLast:  time.Now(),
 		AnnounceFirst: time.Now(),
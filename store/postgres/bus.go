@@ -0,0 +1,143 @@
+package postgres
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"github.com/leighmacdonald/mika/config"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/store"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// busChannel is the LISTEN/NOTIFY channel used by the bus and the triggers installed by Migrate
+const busChannel = "mika_invalidate"
+
+// Bus is the postgres LISTEN/NOTIFY backed store.InvalidationBus implementation. Along with
+// the messages published by other nodes it receives those sent by the triggers installed by
+// Migrate, so edits made directly to the database by a site frontend reach the caches.
+type Bus struct {
+	// db is used to publish, listening requires a dedicated connection
+	db     *pgx.Conn
+	dbMu   *sync.Mutex
+	dsn    string
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewBus connects the bus. The triggers it relies on are installed by the migrations
+// the postgres store drivers apply, so the schema must already be migrated.
+func NewBus(dsn string) (*Bus, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	db, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		cancel()
+		return nil, errors.Wrap(err, "failed to connect to postgres bus")
+	}
+	if err := requireMigrated(ctx, db); err != nil {
+		cancel()
+		_ = db.Close(context.Background())
+		return nil, err
+	}
+	return &Bus{db: db, dbMu: &sync.Mutex{}, dsn: dsn, ctx: ctx, cancel: cancel}, nil
+}
+
+// Publish sends the message as a notification on the bus channel
+func (b *Bus) Publish(msg store.InvalidationMsg) error {
+	body, err := msg.Encode()
+	if err != nil {
+		return err
+	}
+	c, cancel := context.WithTimeout(b.ctx, time.Second*5)
+	defer cancel()
+	b.dbMu.Lock()
+	defer b.dbMu.Unlock()
+	if _, err := b.db.Exec(c, `SELECT pg_notify($1, $2)`, busChannel, string(body)); err != nil {
+		return errors.Wrap(err, "Failed to publish invalidation message")
+	}
+	return nil
+}
+
+// Subscribe starts listening on the bus channel, delivering messages to the handler from
+// a background goroutine until the bus is closed
+func (b *Bus) Subscribe(handler func(msg store.InvalidationMsg)) error {
+	if b.done != nil {
+		return consts.ErrInvalidState
+	}
+	conn, err := b.listen()
+	if err != nil {
+		return err
+	}
+	b.done = make(chan struct{})
+	go b.receive(conn, handler)
+	return nil
+}
+
+// listen opens a new connection listening on the bus channel
+func (b *Bus) listen() (*pgx.Conn, error) {
+	conn, err := pgx.Connect(b.ctx, b.dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect postgres bus listener")
+	}
+	if _, err := conn.Exec(b.ctx, "LISTEN "+busChannel); err != nil {
+		_ = conn.Close(context.Background())
+		return nil, errors.Wrap(err, "Failed to listen on invalidation channel")
+	}
+	return conn, nil
+}
+
+// receive delivers notifications to the handler, reconnecting if the listener connection
+// is lost. Notifications sent while disconnected are missed, the cached entries they
+// applied to are corrected once they expire.
+func (b *Bus) receive(conn *pgx.Conn, handler func(msg store.InvalidationMsg)) {
+	defer close(b.done)
+	for {
+		n, err := conn.WaitForNotification(b.ctx)
+		if err != nil {
+			_ = conn.Close(context.Background())
+			if b.ctx.Err() != nil {
+				return
+			}
+			log.Errorf("Lost postgres bus listener: %s", err)
+			for conn, err = b.listen(); err != nil; conn, err = b.listen() {
+				select {
+				case <-b.ctx.Done():
+					return
+				case <-time.After(time.Second * 5):
+				}
+			}
+			continue
+		}
+		var msg store.InvalidationMsg
+		if err := store.DecodeInvalidationMsg(&msg, []byte(n.Payload)); err != nil {
+			log.Errorf("Dropped invalidation message: %s", err)
+			continue
+		}
+		handler(msg)
+	}
+}
+
+// Close stops the listener and closes the underlying connections
+func (b *Bus) Close() error {
+	b.cancel()
+	if b.done != nil {
+		<-b.done
+	}
+	b.dbMu.Lock()
+	defer b.dbMu.Unlock()
+	return b.db.Close(context.Background())
+}
+
+type busDriver struct{}
+
+// New initialize a InvalidationBus implementation using postgres LISTEN/NOTIFY
+func (bd busDriver) New(cfg interface{}) (store.InvalidationBus, error) {
+	c, ok := cfg.(*config.StoreConfig)
+	if !ok {
+		return nil, consts.ErrInvalidConfig
+	}
+	return NewBus(makeDSN(c))
+}
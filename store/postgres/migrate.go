@@ -0,0 +1,181 @@
+package postgres
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// migrationLockID is the advisory lock held while migrating so concurrently starting
+// nodes apply each migration once
+const migrationLockID = 0x6d696b61
+
+// migration is a schema change applied on top of schema.sql. Migrations are applied in
+// order and recorded in the schema_migrations table, they must never be edited once released.
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "notify_cache_invalidation",
+		// The payloads use the store.InvalidationMsg format so they are delivered by the
+		// postgres bus like any other invalidation. Updates only changing the stat columns
+		// written by Sync are ignored, the nodes already share those over the bus.
+		sql: `
+			CREATE OR REPLACE FUNCTION mika_notify(p_kind text, p_action text, p_key text) RETURNS void AS $$
+			BEGIN
+				PERFORM pg_notify('` + busChannel + `', json_build_object(
+					'node', 'postgres',
+					'items', json_build_array(json_build_object('kind', p_kind, 'action', p_action, 'key', p_key))
+				)::text);
+			END;
+			$$ LANGUAGE plpgsql;
+
+			CREATE OR REPLACE FUNCTION mika_notify_users() RETURNS trigger AS $$
+			BEGIN
+				-- OLD is not assigned for inserts so it must not be read in the same expression
+				IF TG_OP = 'UPDATE' THEN
+					IF OLD.passkey = NEW.passkey THEN
+						PERFORM mika_notify('user', 'refresh', NEW.passkey);
+						RETURN NULL;
+					END IF;
+				END IF;
+				IF TG_OP <> 'INSERT' THEN
+					PERFORM mika_notify('user', 'evict', OLD.passkey);
+				END IF;
+				IF TG_OP <> 'DELETE' THEN
+					PERFORM mika_notify('user', 'evict', NEW.passkey);
+				END IF;
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql;
+
+			CREATE OR REPLACE FUNCTION mika_notify_torrent() RETURNS trigger AS $$
+			BEGIN
+				IF TG_OP = 'UPDATE' THEN
+					PERFORM mika_notify('torrent', 'refresh', encode(NEW.info_hash, 'hex'));
+				ELSIF TG_OP = 'DELETE' THEN
+					PERFORM mika_notify('torrent', 'evict', encode(OLD.info_hash, 'hex'));
+				ELSE
+					PERFORM mika_notify('torrent', 'evict', encode(NEW.info_hash, 'hex'));
+				END IF;
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql;
+
+			CREATE OR REPLACE FUNCTION mika_notify_reload() RETURNS trigger AS $$
+			BEGIN
+				PERFORM mika_notify(TG_ARGV[0], 'refresh', '');
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql;
+
+			DROP TRIGGER IF EXISTS mika_notify_users_change ON users;
+			CREATE TRIGGER mika_notify_users_change AFTER INSERT OR DELETE ON users
+				FOR EACH ROW EXECUTE PROCEDURE mika_notify_users();
+			DROP TRIGGER IF EXISTS mika_notify_users_update ON users;
+			CREATE TRIGGER mika_notify_users_update AFTER UPDATE ON users
+				FOR EACH ROW
+				WHEN ((OLD.user_id, OLD.passkey, OLD.download_enabled, OLD.is_deleted, OLD.class)
+					IS DISTINCT FROM (NEW.user_id, NEW.passkey, NEW.download_enabled, NEW.is_deleted, NEW.class))
+				EXECUTE PROCEDURE mika_notify_users();
+
+			DROP TRIGGER IF EXISTS mika_notify_torrent_change ON torrent;
+			CREATE TRIGGER mika_notify_torrent_change AFTER INSERT OR DELETE ON torrent
+				FOR EACH ROW EXECUTE PROCEDURE mika_notify_torrent();
+			DROP TRIGGER IF EXISTS mika_notify_torrent_update ON torrent;
+			CREATE TRIGGER mika_notify_torrent_update AFTER UPDATE ON torrent
+				FOR EACH ROW
+				WHEN ((OLD.is_deleted, OLD.is_enabled, OLD.reason, OLD.multi_up, OLD.multi_dn)
+					IS DISTINCT FROM (NEW.is_deleted, NEW.is_enabled, NEW.reason, NEW.multi_up, NEW.multi_dn))
+				EXECUTE PROCEDURE mika_notify_torrent();
+
+			DROP TRIGGER IF EXISTS mika_notify_whitelist ON whitelist;
+			CREATE TRIGGER mika_notify_whitelist AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON whitelist
+				FOR EACH STATEMENT EXECUTE PROCEDURE mika_notify_reload('whitelist');
+			DROP TRIGGER IF EXISTS mika_notify_bans ON bans;
+			CREATE TRIGGER mika_notify_bans AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON bans
+				FOR EACH STATEMENT EXECUTE PROCEDURE mika_notify_reload('bans');
+		`,
+	},
+	{
+		version: 2,
+		name:    "peers_crypto_level",
+		// Databases created from schema.sql before the column was added
+		sql: `ALTER TABLE peers ADD COLUMN IF NOT EXISTS crypto_level smallint default 0 not null`,
+	},
+}
+
+// Migrate applies the migrations not yet recorded in the schema_migrations table. The
+// tables from schema.sql must already exist. Each of the store drivers runs it on connect.
+func Migrate(ctx context.Context, db *pgx.Conn) error {
+	const createQ = `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version int not null primary key,
+			name varchar(64) not null,
+			applied_on timestamptz default now() not null
+		)`
+	if _, err := db.Exec(ctx, createQ); err != nil {
+		return errors.Wrap(err, "Failed to create schema_migrations table")
+	}
+	if _, err := db.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return errors.Wrap(err, "Failed to acquire migration lock")
+	}
+	defer func() {
+		if _, err := db.Exec(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockID); err != nil {
+			log.Errorf("Failed to release migration lock: %s", err)
+		}
+	}()
+	var current int
+	if err := db.QueryRow(ctx, `SELECT coalesce(max(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return errors.Wrap(err, "Failed to read schema version")
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(ctx, db, m); err != nil {
+			return err
+		}
+		log.Infof("Applied postgres migration %d: %s", m.version, m.name)
+	}
+	return nil
+}
+
+// requireMigrated returns an error unless every migration has been applied. They are
+// applied by the store drivers so the stores must be created first.
+func requireMigrated(ctx context.Context, db *pgx.Conn) error {
+	var current int
+	if err := db.QueryRow(ctx, `SELECT coalesce(max(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return errors.Wrap(err, "Failed to read schema version, postgres migrations not applied")
+	}
+	if latest := migrations[len(migrations)-1].version; current < latest {
+		return errors.Wrapf(consts.ErrInvalidState, "Postgres schema at version %d, %d required", current, latest)
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *pgx.Conn, m migration) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to begin migration %d", m.version)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+	if _, err := tx.Exec(ctx, m.sql); err != nil {
+		return errors.Wrapf(err, "Failed to apply migration %d", m.version)
+	}
+	if _, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`,
+		m.version, m.name); err != nil {
+		return errors.Wrapf(err, "Failed to record migration %d", m.version)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return errors.Wrapf(err, "Failed to commit migration %d", m.version)
+	}
+	return nil
+}
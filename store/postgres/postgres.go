@@ -11,6 +11,7 @@ import (
 	"github.com/leighmacdonald/mika/store"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"math"
 	"time"
 )
 
@@ -39,9 +40,10 @@ func (us UserStore) Update(user store.User, oldPasskey string) error {
 		    download_enabled = $4,
 		    downloaded = $5,
 		    uploaded = $6,
-		    announces = $7
+		    announces = $7,
+		    class = $8
 		WHERE
-			passkey = $8
+			passkey = $9
 	`
 	passkey := user.Passkey
 	if oldPasskey != "" {
@@ -49,7 +51,7 @@ func (us UserStore) Update(user store.User, oldPasskey string) error {
 	}
 	c, cancel := context.WithDeadline(us.ctx, time.Now().Add(5*time.Second))
 	defer cancel()
-	_, err := us.db.Exec(c, q, user.UserID, user.Passkey, user.IsDeleted, user.DownloadEnabled, user.Downloaded, user.Uploaded, user.Announces, passkey)
+	_, err := us.db.Exec(c, q, user.UserID, user.Passkey, user.IsDeleted, user.DownloadEnabled, user.Downloaded, user.Uploaded, user.Announces, user.Class, passkey)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to update user: %d", user.UserID)
 	}
@@ -98,11 +100,11 @@ func (us UserStore) Add(user store.User) error {
 	defer cancel()
 	const q = `
 		INSERT INTO users 
-		    (user_id, passkey, download_enabled, is_deleted, downloaded, uploaded, announces) 
+		    (user_id, passkey, download_enabled, is_deleted, downloaded, uploaded, announces, class) 
 		VALUES
-		    ($1, $2, $3, $4, $5, $6, $7)`
+		    ($1, $2, $3, $4, $5, $6, $7, $8)`
 	_, err := us.db.Exec(c, q, user.UserID, user.Passkey, user.DownloadEnabled, user.IsDeleted,
-		user.Downloaded, user.Uploaded, user.Announces)
+		user.Downloaded, user.Uploaded, user.Announces, user.Class)
 	if err != nil {
 		return errors.Wrap(err, "Failed to add user to store")
 	}
@@ -116,7 +118,7 @@ func (us UserStore) Add(user store.User) error {
 func (us UserStore) GetByPasskey(user *store.User, passkey string) error {
 	const q = `
 		SELECT 
-		    user_id, passkey, download_enabled, is_deleted, downloaded, uploaded, announces 
+		    user_id, passkey, download_enabled, is_deleted, downloaded, uploaded, announces, class 
 		FROM 
 		    users 
 		WHERE 
@@ -124,7 +126,7 @@ func (us UserStore) GetByPasskey(user *store.User, passkey string) error {
 	c, cancel := context.WithDeadline(us.ctx, time.Now().Add(5*time.Second))
 	defer cancel()
 	err := us.db.QueryRow(c, q, passkey).Scan(&user.UserID, &user.Passkey, &user.DownloadEnabled, &user.IsDeleted,
-		&user.Downloaded, &user.Uploaded, &user.Announces)
+		&user.Downloaded, &user.Uploaded, &user.Announces, &user.Class)
 	if err != nil {
 		return errors.Wrap(err, "Failed to fetch user by passkey")
 	}
@@ -135,7 +137,7 @@ func (us UserStore) GetByPasskey(user *store.User, passkey string) error {
 func (us UserStore) GetByID(user *store.User, userID uint32) error {
 	const q = `
 		SELECT 
-		    user_id, passkey, download_enabled, is_deleted, downloaded, uploaded, announces 
+		    user_id, passkey, download_enabled, is_deleted, downloaded, uploaded, announces, class 
 		FROM 
 		    users 
 		WHERE 
@@ -143,7 +145,7 @@ func (us UserStore) GetByID(user *store.User, userID uint32) error {
 	c, cancel := context.WithDeadline(us.ctx, time.Now().Add(5*time.Second))
 	defer cancel()
 	err := us.db.QueryRow(c, q, userID).Scan(&user.UserID, &user.Passkey, &user.DownloadEnabled, &user.IsDeleted,
-		&user.Downloaded, &user.Uploaded, &user.Announces)
+		&user.Downloaded, &user.Uploaded, &user.Announces, &user.Class)
 	if err != nil {
 		return errors.Wrap(err, "Failed to fetch user by user_id")
 	}
@@ -165,6 +167,11 @@ func (us UserStore) Delete(user store.User) error {
 	return nil
 }
 
+// Ping checks the database connection is alive
+func (us UserStore) Ping(ctx context.Context) error {
+	return us.db.Ping(ctx)
+}
+
 // Close will close the underlying database connection and clear the local caches
 func (us UserStore) Close() error {
 	c, cancel := context.WithDeadline(us.ctx, time.Now().Add(15*time.Second))
@@ -337,6 +344,34 @@ func (ts TorrentStore) Get(t *store.Torrent, ih store.InfoHash, deletedOk bool)
 	return nil
 }
 
+// InfoHashes returns the info hash of every torrent which has not been deleted
+func (ts TorrentStore) InfoHashes() ([]store.InfoHash, error) {
+	const q = `SELECT info_hash::bytea FROM torrent WHERE is_deleted = false`
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(30*time.Second))
+	defer cancel()
+	rows, err := ts.db.Query(c, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to select torrent info hashes")
+	}
+	defer rows.Close()
+	var hashes []store.InfoHash
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, errors.Wrap(err, "Failed to fetch torrent info hash")
+		}
+		var ih store.InfoHash
+		copy(ih[:], b)
+		hashes = append(hashes, ih)
+	}
+	return hashes, rows.Err()
+}
+
+// Ping checks the database connection is alive
+func (ts TorrentStore) Ping(ctx context.Context) error {
+	return ts.db.Ping(ctx)
+}
+
 // Close will close the underlying postgres database connection
 func (ts TorrentStore) Close() error {
 	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(15*time.Second))
@@ -396,6 +431,65 @@ func (ts TorrentStore) WhiteListGetAll() ([]store.WhiteListClient, error) {
 	return wl, nil
 }
 
+// BanAdd will insert a new IP/CIDR ban, replacing any existing ban for the same network
+func (ts TorrentStore) BanAdd(ban store.Ban) error {
+	const q = `
+		INSERT INTO bans (cidr, reason, created_by, created_on, expires) 
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (cidr) DO UPDATE 
+		    SET reason = $2, created_by = $3, created_on = $4, expires = $5`
+	var expires *time.Time
+	if !ban.Expires.IsZero() {
+		expires = &ban.Expires
+	}
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	if _, err := ts.db.Exec(c, q, ban.CIDR, ban.Reason, ban.CreatedBy, ban.CreatedOn, expires); err != nil {
+		return errors.Wrap(err, "Failed to insert new ban")
+	}
+	return nil
+}
+
+// BanDelete removes the ban matching the CIDR of the ban provided
+func (ts TorrentStore) BanDelete(ban store.Ban) error {
+	const q = `DELETE FROM bans WHERE cidr = $1`
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	commandTag, err := ts.db.Exec(c, q, ban.CIDR)
+	if err != nil {
+		return errors.Wrap(err, "Failed to delete ban")
+	}
+	if commandTag.RowsAffected() != 1 {
+		return consts.ErrInvalidBan
+	}
+	return nil
+}
+
+// BanGetAll fetches all known bans, including expired bans
+func (ts TorrentStore) BanGetAll() ([]store.Ban, error) {
+	const q = `SELECT cidr::text, reason, created_by, created_on, expires FROM bans`
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	rows, err := ts.db.Query(c, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to select bans")
+	}
+	defer rows.Close()
+	var bans []store.Ban
+	for rows.Next() {
+		var ban store.Ban
+		var expires *time.Time
+		if err := rows.Scan(&ban.CIDR, &ban.Reason, &ban.CreatedBy, &ban.CreatedOn, &expires); err != nil {
+			return nil, errors.Wrap(err, "Failed to fetch ban")
+		}
+		if expires != nil {
+			ban.Expires = *expires
+		}
+		bans = append(bans, ban)
+	}
+	return bans, nil
+}
+
 // PeerStore is the postgres backed implementation of store.PeerStore
 type PeerStore struct {
 	db  *pgx.Conn
@@ -446,20 +540,37 @@ func (ps PeerStore) Sync(batch map[store.PeerHash]store.PeerStats) error {
 }
 
 // Reap will loop through the peers removing any stale entries from active swarms
-// TODO fetch peer hashes for expired peers to flush local caches
-func (ps PeerStore) Reap() []store.PeerHash {
+func (ps PeerStore) Reap() []store.ReapedPeer {
 	// NOW() - INTERVAL '15 minutes'
-	var peerHashes []store.PeerHash
-	const q = `DELETE FROM peers WHERE announce_last < $1`
+	var peerHashes []store.ReapedPeer
+	const q = `
+		DELETE FROM peers WHERE announce_last < $1 
+		RETURNING info_hash::bytea, peer_id::bytea, total_left`
 	c, cancel := context.WithDeadline(ps.ctx, time.Now().Add(5*time.Second))
 	defer cancel()
-	rows, err := ps.db.Exec(c, q, time.Now().Add(-(15 * time.Minute)))
+	rows, err := ps.db.Query(c, q, time.Now().Add(-(15 * time.Minute)))
 	if err != nil {
 		log.Errorf("failed to reap peers: %s", err.Error())
 		return nil
 	}
-	if rows.RowsAffected() > 0 {
-		log.Debugf("Reaped %d peers", rows.RowsAffected())
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			ih   store.InfoHash
+			pid  store.PeerID
+			left uint32
+		)
+		if err := rows.Scan(&ih, &pid, &left); err != nil {
+			log.Errorf("failed to read reaped peer: %s", err.Error())
+			continue
+		}
+		peerHashes = append(peerHashes, store.ReapedPeer{PeerHash: store.NewPeerHash(ih, pid), Seeder: left == 0})
+	}
+	if err := rows.Err(); err != nil {
+		log.Errorf("failed to reap peers: %s", err.Error())
+	}
+	if len(peerHashes) > 0 {
+		log.Debugf("Reaped %d peers", len(peerHashes))
 	}
 	return peerHashes
 }
@@ -468,15 +579,16 @@ func (ps PeerStore) Reap() []store.PeerHash {
 func (ps PeerStore) Add(ih store.InfoHash, p store.Peer) error {
 	const q = `
 	INSERT INTO peers 
-	    (peer_id, info_hash, addr_ip, addr_port, location, user_id, announce_first, announce_last)
+	    (peer_id, info_hash, addr_ip, addr_ip6, addr_port, location, user_id, announce_first, announce_last,
+	     crypto_level)
 	VALUES 
-	    ($1, $2, $3, $4::int, ST_MakePoint($6, $5), $7, $8, $9)
+	    ($1, $2, $3, $4, $5::int, ST_MakePoint($7, $6), $8, $9, $10, $11)
 	`
 	c, cancel := context.WithDeadline(ps.ctx, time.Now().Add(5*time.Second))
 	defer cancel()
 	commandTag, err := ps.db.Exec(c, q,
-		p.PeerID.Bytes(), ih.Bytes(), p.IP, p.Port, p.Location.Latitude, p.Location.Longitude, p.UserID,
-		p.AnnounceFirst, p.AnnounceLast)
+		p.PeerID.Bytes(), ih.Bytes(), p.IPv4, p.IPv6, p.Port, p.Location.Latitude, p.Location.Longitude, p.UserID,
+		p.AnnounceFirst, p.AnnounceLast, int16(p.CryptoLevel))
 	if err != nil {
 		return err
 	}
@@ -495,62 +607,90 @@ func (ps PeerStore) Delete(ih store.InfoHash, p store.PeerID) error {
 	return err
 }
 
-// GetN will fetch the torrents swarm member peers
-func (ps PeerStore) GetN(ih store.InfoHash, limit int) (store.Swarm, error) {
+// GetN returns up to limit peers matching the filter, chosen uniformly at random
+func (ps PeerStore) GetN(ih store.InfoHash, limit int, filter store.PeerFilter) ([]store.Peer, error) {
 	const q = `
 		SELECT 
-		    peer_id::bytea, info_hash::bytea, user_id, addr_ip, addr_port, downloaded, uploaded, 
-			announces, speed_up, speed_dn, speed_up_max, speed_dn_max, ST_x(location), ST_y(location)
+		    peer_id::bytea, info_hash::bytea, user_id, addr_ip, addr_ip6, addr_port, downloaded, uploaded, 
+			announces, speed_up, speed_dn, speed_up_max, speed_dn_max, ST_x(location), ST_y(location),
+			crypto_level
 		FROM
 		    peers 
 		WHERE
 		      info_hash = $1 
+		  AND peer_id != $3
+		  AND (($4 AND addr_ip IS NOT NULL) OR ($5 AND addr_ip6 IS NOT NULL))
+		  AND (NOT $6 OR crypto_level > 0)
+		ORDER BY 
+		    random()
 		LIMIT 
 		    $2`
-	swarm := store.NewSwarm()
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	ipv4, ipv6 := filter.Families()
+	var peers []store.Peer
 	c, cancel := context.WithDeadline(ps.ctx, time.Now().Add(5*time.Second))
 	defer cancel()
-	rows, err := ps.db.Query(c, q, ih.Bytes(), limit)
+	rows, err := ps.db.Query(c, q, ih.Bytes(), limit, filter.Exclude.Bytes(), ipv4, ipv6,
+		filter.CryptoLevel == consts.Required)
 	if err != nil {
-		return swarm, err
+		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var p store.Peer
-		err = rows.Scan(&p.PeerID, &p.InfoHash, &p.UserID, &p.IP, &p.Port, &p.Downloaded, &p.Uploaded,
-			&p.Announces, &p.SpeedUP, &p.SpeedDN, &p.SpeedUPMax, &p.SpeedDNMax, &p.Location.Longitude, &p.Location.Latitude)
+		var (
+			p           store.Peer
+			cryptoLevel int16
+		)
+		err = rows.Scan(&p.PeerID, &p.InfoHash, &p.UserID, &p.IPv4, &p.IPv6, &p.Port, &p.Downloaded, &p.Uploaded,
+			&p.Announces, &p.SpeedUP, &p.SpeedDN, &p.SpeedUPMax, &p.SpeedDNMax, &p.Location.Longitude, &p.Location.Latitude,
+			&cryptoLevel)
 		if err != nil {
-			return swarm, errors.Wrap(err, "failed to fetch N swarm from store")
+			return nil, errors.Wrap(err, "failed to fetch N swarm from store")
 		}
-		swarm.Add(p)
+		p.CryptoLevel = consts.CryptoLevel(cryptoLevel)
+		peers = append(peers, p)
 	}
 	if rows.Err() != nil {
-		return swarm, errors.Wrap(err, "error in peer query")
+		return nil, errors.Wrap(err, "error in peer query")
 	}
-	return swarm, nil
+	return peers, nil
 }
 
 // Get will fetch the peer from the swarm if it exists
 func (ps PeerStore) Get(p *store.Peer, ih store.InfoHash, peerID store.PeerID) error {
 	const q = `
 		SELECT 
-		       peer_id, info_hash, user_id, addr_ip, addr_port, downloaded, uploaded, announces,
-		       speed_up, speed_dn, speed_up_max, speed_dn_max, location
+		       peer_id::bytea, info_hash::bytea, user_id, addr_ip, addr_ip6, addr_port, downloaded, uploaded,
+		       total_left, announces, speed_up, speed_dn, speed_up_max, speed_dn_max, ST_x(location),
+		       ST_y(location), crypto_level
 		FROM
 		    peers 
 		WHERE 
 			info_hash = $1 AND peer_id = $2`
 	c, cancel := context.WithDeadline(ps.ctx, time.Now().Add(5*time.Second))
 	defer cancel()
-	err := ps.db.QueryRow(c, q, ih, peerID).Scan(
-		p.PeerID, p.InfoHash, p.UserID, p.IP, p.Port, p.Downloaded, p.Uploaded,
-		p.Announces, p.SpeedUP, p.SpeedDN, p.SpeedUPMax, p.SpeedDNMax, p.Location)
+	var cryptoLevel int16
+	err := ps.db.QueryRow(c, q, ih.Bytes(), peerID.Bytes()).Scan(
+		&p.PeerID, &p.InfoHash, &p.UserID, &p.IPv4, &p.IPv6, &p.Port, &p.Downloaded, &p.Uploaded,
+		&p.Left, &p.Announces, &p.SpeedUP, &p.SpeedDN, &p.SpeedUPMax, &p.SpeedDNMax,
+		&p.Location.Longitude, &p.Location.Latitude, &cryptoLevel)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return consts.ErrInvalidPeerID
+		}
 		return errors.Wrap(err, "Unknown peer")
 	}
+	p.CryptoLevel = consts.CryptoLevel(cryptoLevel)
 	return nil
 }
 
+// Ping checks the database connection is alive
+func (ps PeerStore) Ping(ctx context.Context) error {
+	return ps.db.Ping(ctx)
+}
+
 // Close will close the underlying database connection
 func (ps PeerStore) Close() error {
 	c, cancel := context.WithDeadline(ps.ctx, time.Now().Add(15*time.Second))
@@ -566,9 +706,9 @@ func (ud userDriver) New(cfg interface{}) (store.UserStore, error) {
 	if !ok {
 		return nil, consts.ErrInvalidConfig
 	}
-	db, err := pgx.Connect(context.Background(), c.DSN())
+	db, err := connect(c.DSN(), "user")
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to connect to postgres user store")
+		return nil, err
 	}
 	return NewUserStore(db), nil
 }
@@ -581,9 +721,9 @@ func (pd peerDriver) New(cfg interface{}) (store.PeerStore, error) {
 	if !ok {
 		return nil, consts.ErrInvalidConfig
 	}
-	db, err := pgx.Connect(context.Background(), c.DSN())
+	db, err := connect(c.DSN(), "peer")
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to connect to postgres peer store")
+		return nil, err
 	}
 	return NewPeerStore(db), nil
 }
@@ -611,13 +751,26 @@ func (td torrentDriver) New(cfg interface{}) (store.TorrentStore, error) {
 	if !ok {
 		return nil, consts.ErrInvalidConfig
 	}
-	db, err := pgx.Connect(context.Background(), c.DSN())
+	db, err := connect(c.DSN(), "torrent")
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to connect to postgres torrent store")
+		return nil, err
 	}
 	return NewTorrentStore(db), nil
 }
 
+// connect opens a store connection, applying any pending migrations first
+func connect(dsn string, kind string) (*pgx.Conn, error) {
+	db, err := pgx.Connect(context.Background(), dsn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to postgres %s store", kind)
+	}
+	if err := Migrate(context.Background(), db); err != nil {
+		_ = db.Close(context.Background())
+		return nil, err
+	}
+	return db, nil
+}
+
 func makeDSN(c *config.StoreConfig) string {
 	return fmt.Sprintf("postgres://%s:%s@%s:%d/%s%s",
 		c.Username, c.Password, c.Host, c.Port, c.Database, c.Properties)
@@ -627,4 +780,5 @@ func init() {
 	store.AddUserDriver(driverName, userDriver{})
 	store.AddPeerDriver(driverName, peerDriver{})
 	store.AddTorrentDriver(driverName, torrentDriver{})
+	store.AddBusDriver(driverName, busDriver{})
 }
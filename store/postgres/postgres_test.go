@@ -9,9 +9,11 @@ import (
 	"github.com/leighmacdonald/mika/store/memory"
 	"github.com/leighmacdonald/mika/util"
 	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestTorrentDriver(t *testing.T) {
@@ -48,9 +50,75 @@ func TestPeerDriver(t *testing.T) {
 	store.TestPeerStore(t, NewPeerStore(db), memory.NewTorrentStore(), memory.NewUserStore())
 }
 
+func TestBus(t *testing.T) {
+	c := config.GetStoreConfig(config.Users)
+	db, err := pgx.Connect(context.Background(), makeDSN(c))
+	if err != nil {
+		t.Skipf("failed to connect to postgres bus: %s", err.Error())
+		return
+	}
+	setupDB(t, db)
+	_, err = NewBus(makeDSN(c))
+	require.Error(t, err, "Bus started without migrations")
+	require.NoError(t, Migrate(context.Background(), db))
+	pub, err := NewBus(makeDSN(c))
+	require.NoError(t, err)
+	sub, err := NewBus(makeDSN(c))
+	require.NoError(t, err)
+	store.TestInvalidationBus(t, pub, sub)
+
+	// Changes made directly to the tables are sent by the triggers
+	bus, err := NewBus(makeDSN(c))
+	require.NoError(t, err)
+	defer func() { _ = bus.Close() }()
+	received := make(chan store.InvalidationMsg, 10)
+	require.NoError(t, bus.Subscribe(func(msg store.InvalidationMsg) {
+		received <- msg
+	}))
+	us := NewUserStore(db)
+	usr := store.GenerateTestUser()
+	require.NoError(t, us.Add(usr))
+	require.NoError(t, us.Sync(map[string]store.UserStats{usr.Passkey: {Uploaded: 10}}))
+	usr.DownloadEnabled = !usr.DownloadEnabled
+	require.NoError(t, us.Update(usr, ""))
+	ts := NewTorrentStore(db)
+	require.NoError(t, ts.WhiteListAdd(store.WhiteListClient{ClientPrefix: "UT", ClientName: "uTorrent"}))
+	var items []store.Invalidation
+	for len(items) < 3 {
+		select {
+		case msg := <-received:
+			require.Equal(t, "postgres", msg.Node)
+			items = append(items, msg.Items...)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Timed out waiting for notifications, received: %v", items)
+		}
+	}
+	// The stat only Sync update is not sent
+	require.Equal(t, []store.Invalidation{
+		{Kind: store.InvalidateUser, Action: store.ActionEvict, Key: usr.Passkey},
+		{Kind: store.InvalidateUser, Action: store.ActionRefresh, Key: usr.Passkey},
+		{Kind: store.InvalidateWhitelist, Action: store.ActionRefresh},
+	}, items)
+}
+
+func TestMigrate(t *testing.T) {
+	db, err := pgx.Connect(context.Background(), makeDSN(config.GetStoreConfig(config.Peers)))
+	if err != nil {
+		t.Skipf("failed to connect to postgres peer store: %s", err.Error())
+		return
+	}
+	setupDB(t, db)
+	// A peers table created by an older schema.sql
+	_, err = db.Exec(context.Background(), `ALTER TABLE peers DROP COLUMN crypto_level`)
+	require.NoError(t, err)
+	require.NoError(t, Migrate(context.Background(), db))
+	require.NoError(t, Migrate(context.Background(), db), "Migrations not idempotent")
+	store.TestPeerStore(t, NewPeerStore(db), memory.NewTorrentStore(), memory.NewUserStore())
+}
+
 func clearDB(db *pgx.Conn) {
 	ctx := context.Background()
-	for _, table := range []string{"peers", "torrent", "users", "whitelist"} {
+	for _, table := range []string{"peers", "torrent", "users", "whitelist", "bans", "schema_migrations"} {
 		q := fmt.Sprintf(`drop table if exists %s cascade;`, table)
 		if _, err := db.Exec(ctx, q); err != nil {
 			log.Panicf("Failed to prep database: %s", err.Error())
@@ -34,6 +34,7 @@ create table users
     downloaded bigint default 0 not null,
     uploaded bigint default 0 not null,
     announces int default 0 not null,
+    class varchar(32) default '' not null,
     constraint user_passkey_uindex
         unique (passkey)
 );
@@ -43,7 +44,8 @@ create table peers
     peer_id bytea  check (octet_length(peer_id) = 20) not null,
     info_hash bytea  check (octet_length(info_hash) = 20) not null,
     user_id int not null,
-    addr_ip inet not null,
+    addr_ip inet,
+    addr_ip6 inet,
     addr_port uint2 not null,
     downloaded int default 0 not null,
     uploaded int default 0 not null,
@@ -57,6 +59,7 @@ create table peers
     location geometry not null,
     announce_first timestamptz not null,
     announce_last timestamptz not null,
+    crypto_level smallint default 0 not null,
     primary key (info_hash, peer_id)
 );
 
@@ -65,4 +68,14 @@ create table whitelist
     client_prefix varchar(10) not null
         primary key,
     client_name varchar(20) not null
+);
+
+create table bans
+(
+    cidr cidr not null
+        primary key,
+    reason varchar(255) not null,
+    created_by varchar(64) not null,
+    created_on timestamp not null,
+    expires timestamp
 );
\ No newline at end of file
@@ -0,0 +1,83 @@
+package redis
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/leighmacdonald/mika/config"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/store"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// busChannel is the pub/sub channel the invalidation messages are published on
+const busChannel = "mika:invalidate"
+
+// Bus is the redis pub/sub backed store.InvalidationBus implementation
+type Bus struct {
+	client redis.UniversalClient
+	pubSub *redis.PubSub
+}
+
+// Publish sends the message to every node subscribed to the channel
+func (b *Bus) Publish(msg store.InvalidationMsg) error {
+	body, err := msg.Encode()
+	if err != nil {
+		return err
+	}
+	if err := b.client.Publish(busChannel, body).Err(); err != nil {
+		return errors.Wrap(err, "Failed to publish invalidation message")
+	}
+	return nil
+}
+
+// Subscribe listens on the channel, delivering messages to the handler from a background
+// goroutine until the bus is closed
+func (b *Bus) Subscribe(handler func(msg store.InvalidationMsg)) error {
+	if b.pubSub != nil {
+		return consts.ErrInvalidState
+	}
+	b.pubSub = b.client.Subscribe(busChannel)
+	// Wait for the subscription to be confirmed so no messages published after
+	// returning are missed
+	if _, err := b.pubSub.Receive(); err != nil {
+		return errors.Wrap(err, "Failed to subscribe to invalidation channel")
+	}
+	go b.receive(b.pubSub.Channel(), handler)
+	return nil
+}
+
+func (b *Bus) receive(messages <-chan *redis.Message, handler func(msg store.InvalidationMsg)) {
+	for m := range messages {
+		var msg store.InvalidationMsg
+		if err := store.DecodeInvalidationMsg(&msg, []byte(m.Payload)); err != nil {
+			log.Errorf("Dropped invalidation message: %s", err)
+			continue
+		}
+		handler(msg)
+	}
+}
+
+// Close will unsubscribe and close the underlying redis client
+func (b *Bus) Close() error {
+	if b.pubSub != nil {
+		if err := b.pubSub.Close(); err != nil {
+			log.Errorf("Failed to close invalidation subscription: %s", err)
+		}
+	}
+	return b.client.Close()
+}
+
+type busDriver struct{}
+
+// New initialize a InvalidationBus implementation using redis pub/sub
+func (bd busDriver) New(cfg interface{}) (store.InvalidationBus, error) {
+	c, ok := cfg.(*config.StoreConfig)
+	if !ok {
+		return nil, consts.ErrInvalidConfig
+	}
+	client, err := newClient(c)
+	if err != nil {
+		return nil, err
+	}
+	return &Bus{client: client}, nil
+}
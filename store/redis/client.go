@@ -0,0 +1,160 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	"github.com/leighmacdonald/mika/config"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The deployment modes selected with the mode store property
+const (
+	modeSingle   = "single"
+	modeSentinel = "sentinel"
+	modeCluster  = "cluster"
+)
+
+// clientOpts are the connection settings parsed from the StoreConfig. The redis specific
+// settings are read from the store properties, eg:
+//
+// mode=sentinel&master_name=mymaster&addrs=10.0.0.1:26379,10.0.0.2:26379
+// mode=cluster&addrs=10.0.0.1:7000,10.0.0.2:7000,10.0.0.3:7000
+type clientOpts struct {
+	mode string
+	// addrs are the sentinels or cluster seed nodes, defaulting to the store host:port
+	addrs            []string
+	masterName       string
+	sentinelPassword string
+	password         string
+	db               int
+}
+
+func parseClientOpts(c *config.StoreConfig) (clientOpts, error) {
+	props, err := url.ParseQuery(strings.TrimPrefix(c.Properties, "?"))
+	if err != nil {
+		return clientOpts{}, errors.Wrap(consts.ErrInvalidConfig, "Failed to parse redis properties")
+	}
+	opts := clientOpts{
+		mode:             props.Get("mode"),
+		masterName:       props.Get("master_name"),
+		sentinelPassword: props.Get("sentinel_password"),
+		password:         c.Password,
+	}
+	if opts.mode == "" {
+		opts.mode = modeSingle
+	}
+	for _, addr := range strings.Split(props.Get("addrs"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			opts.addrs = append(opts.addrs, addr)
+		}
+	}
+	if len(opts.addrs) == 0 {
+		opts.addrs = []string{fmt.Sprintf("%s:%d", c.Host, c.Port)}
+	}
+	if c.Database != "" {
+		database, err := strconv.ParseInt(c.Database, 10, 32)
+		if err != nil {
+			return clientOpts{}, errors.Wrapf(consts.ErrInvalidConfig,
+				"Failed to parse redis database integer: %s", c.Database)
+		}
+		opts.db = int(database)
+	}
+	switch opts.mode {
+	case modeSingle:
+		if len(opts.addrs) > 1 {
+			return clientOpts{}, errors.Wrap(consts.ErrInvalidConfig, "Single redis mode only accepts one address")
+		}
+	case modeSentinel:
+		if opts.masterName == "" {
+			return clientOpts{}, errors.Wrap(consts.ErrInvalidConfig, "Redis sentinel mode requires master_name")
+		}
+	case modeCluster:
+		// Redis cluster only has the one database
+		if opts.db != 0 {
+			return clientOpts{}, errors.Wrap(consts.ErrInvalidConfig, "Redis cluster mode only supports database 0")
+		}
+	default:
+		return clientOpts{}, errors.Wrapf(consts.ErrInvalidConfig, "Unknown redis mode: %s", opts.mode)
+	}
+	return opts, nil
+}
+
+// newClient creates the client for the configured mode. Sentinel mode connects to the
+// current master of masterName and follows failovers, cluster mode routes each key to the
+// node serving its slot.
+func newClient(c *config.StoreConfig) (redis.UniversalClient, error) {
+	opts, err := parseClientOpts(c)
+	if err != nil {
+		return nil, err
+	}
+	onConnect := func(conn *redis.Conn) error {
+		if err := conn.ClientSetName(clientName).Err(); err != nil {
+			log.Fatalf("Could not SetName, bailing: %s", err)
+		}
+		return nil
+	}
+	switch opts.mode {
+	case modeSentinel:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       opts.masterName,
+			SentinelAddrs:    opts.addrs,
+			SentinelPassword: opts.sentinelPassword,
+			Password:         opts.password,
+			DB:               opts.db,
+			OnConnect:        onConnect,
+		}), nil
+	case modeCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     opts.addrs,
+			Password:  opts.password,
+			OnConnect: onConnect,
+		}), nil
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:      opts.addrs[0],
+			Password:  opts.password,
+			DB:        opts.db,
+			OnConnect: onConnect,
+		}), nil
+	}
+}
+
+// ping checks the server is reachable
+func ping(ctx context.Context, client redis.UniversalClient) error {
+	cmd := redis.NewStatusCmd("ping")
+	if err := client.ProcessContext(ctx, cmd); err != nil {
+		return err
+	}
+	return cmd.Err()
+}
+
+// findKeys returns the keys matching the pattern. KEYS only searches the node it is sent
+// to so a cluster queries every master.
+func findKeys(client redis.UniversalClient, pattern string) ([]string, error) {
+	cc, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return client.Keys(pattern).Result()
+	}
+	var (
+		mu   sync.Mutex
+		keys []string
+	)
+	err := cc.ForEachMaster(func(node *redis.Client) error {
+		found, err := node.Keys(pattern).Result()
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		keys = append(keys, found...)
+		mu.Unlock()
+		return nil
+	})
+	return keys, err
+}
@@ -0,0 +1,47 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+// legacyKeyPrefixes are the prefixes of the keys which were stored without a hash tag
+// before redis cluster support was added, eg. t:<info_hash> is now t:{<info_hash>}.
+// Peer keys are not migrated, they expire and are re-added on the next announce.
+var legacyKeyPrefixes = []string{prefixTorrent, prefixUser}
+
+// migrateKeys renames the torrent and user keys written by older releases to the hash
+// tagged format. Cluster mode was added along with the hash tags so only single and
+// sentinel deployments can hold legacy keys. A legacy key is left in place when its
+// hash tagged key already exists.
+func migrateKeys(client redis.UniversalClient) error {
+	if _, ok := client.(*redis.ClusterClient); ok {
+		return nil
+	}
+	migrated := 0
+	for _, prefix := range legacyKeyPrefixes {
+		keys, err := findKeys(client, prefix+":[^{]*")
+		if err != nil {
+			return errors.Wrap(err, "Failed to find legacy keys")
+		}
+		for _, key := range keys {
+			newKey := fmt.Sprintf("%s:{%s}", prefix, strings.TrimPrefix(key, prefix+":"))
+			renamed, err := client.RenameNX(key, newKey).Result()
+			if err != nil {
+				return errors.Wrapf(err, "Failed to migrate key: %s", key)
+			}
+			if !renamed {
+				log.Warnf("Not migrating legacy key %s, %s already exists", key, newKey)
+				continue
+			}
+			migrated++
+		}
+	}
+	if migrated > 0 {
+		log.Infof("Migrated %d redis keys to the hash tagged format", migrated)
+	}
+	return nil
+}
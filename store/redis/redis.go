@@ -1,6 +1,8 @@
 package redis
 
 import (
+	"context"
+	"encoding/hex"
 	"fmt"
 	"github.com/go-redis/redis/v7"
 	"github.com/leighmacdonald/mika/config"
@@ -10,6 +12,7 @@ import (
 	"github.com/leighmacdonald/mika/util"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"math/rand"
 	"net"
 	"strconv"
 	"strings"
@@ -23,30 +26,46 @@ const (
 
 const (
 	prefixWhitelist = "whitelist"
+	prefixBan       = "ban"
 	prefixTorrent   = "t"
 	prefixPeer      = "p"
+	prefixSwarm     = "s"
 	prefixUser      = "u"
 	prefixUserID    = "user_id_pk"
+	// swarmsKey is the set of info hashes with a swarm index
+	swarmsKey = "swarms"
 )
 
 func whiteListKey(prefix string) string {
 	return fmt.Sprintf("%s%s", prefixWhitelist, prefix)
 }
 
+func banKey(cidr string) string {
+	return fmt.Sprintf("%s:%s", prefixBan, cidr)
+}
+
+// The info hash is wrapped in a hash tag so a torrent and its swarm are stored in the
+// same slot when using redis cluster, allowing them to be used together in pipelines and
+// scripts
+
 func torrentKey(t store.InfoHash) string {
-	return fmt.Sprintf("%s:%s", prefixTorrent, t.String())
+	return fmt.Sprintf("%s:{%s}", prefixTorrent, t.String())
+}
+
+func swarmKey(t store.InfoHash) string {
+	return fmt.Sprintf("%s:{%s}", prefixSwarm, t.String())
 }
 
-func torrentPeersKey(t store.InfoHash) string {
-	return fmt.Sprintf("%s:%s:*", prefixPeer, t.String())
+func peerKeyPrefix(t store.InfoHash) string {
+	return fmt.Sprintf("%s:{%s}:", prefixPeer, t.String())
 }
 
 func peerKey(t store.InfoHash, p store.PeerID) string {
-	return fmt.Sprintf("%s:%s:%s", prefixPeer, t.String(), p.String())
+	return peerKeyPrefix(t) + p.String()
 }
 
 func userKey(passkey string) string {
-	return fmt.Sprintf("%s:%s", prefixUser, passkey)
+	return fmt.Sprintf("%s:{%s}", prefixUser, passkey)
 }
 
 func userIDKey(userID uint32) string {
@@ -55,42 +74,30 @@ func userIDKey(userID uint32) string {
 
 // UserStore is the redis backed store.TorrentStore implementation
 type UserStore struct {
-	client *redis.Client
+	client redis.UniversalClient
 }
 
 func (us UserStore) Name() string {
 	return driverName
 }
 
-// Sync batch updates the backing store with the new UserStats provided
-// TODO leverage cache layer so we can pipeline the updates w/o query first
+// Sync batch updates the backing store with the new UserStats provided. The stats are
+// added by a script for each user, atomically per user and pipelined across the batch.
 func (us UserStore) Sync(b map[string]store.UserStats) error {
+	calls := make([]scriptCall, 0, len(b))
 	for passkey, stats := range b {
-		old, err := us.client.HGetAll(userKey(passkey)).Result()
-		if err != nil {
-			return errors.Wrap(err, "Failed to get user from redis")
-		}
-		var downloaded uint64
-		var uploaded uint64
-		var announces uint32
-		downloadedStr, found := old["downloaded"]
-		if found {
-			downloaded = util.StringToUInt64(downloadedStr, 0)
-		}
-		uploadedStr, found := old["uploaded"]
-		if found {
-			uploaded = util.StringToUInt64(uploadedStr, 0)
-		}
-		announcesStr, found := old["announces"]
-		if found {
-			announces = util.StringToUInt32(announcesStr, 0)
-		}
-		us.client.HSet(userKey(passkey), map[string]interface{}{
-			"downloaded": downloaded + stats.Downloaded,
-			"uploaded":   uploaded + stats.Uploaded,
-			"announces":  announces + stats.Announces,
+		calls = append(calls, scriptCall{
+			keys: []string{userKey(passkey)},
+			args: []interface{}{
+				"downloaded", stats.Downloaded,
+				"uploaded", stats.Uploaded,
+				"announces", stats.Announces,
+			},
 		})
 	}
+	if _, err := runScript(us.client, statsSyncScript, calls); err != nil {
+		return errors.Wrap(err, "Failed to sync users")
+	}
 	return nil
 }
 
@@ -103,16 +110,42 @@ func userMap(u store.User) map[string]interface{} {
 		"downloaded":       u.Downloaded,
 		"uploaded":         u.Uploaded,
 		"announces":        u.Announces,
+		"class":            u.Class,
+	}
+}
+
+// writeUser runs the writes of a user and its user id index in order. The index is not
+// stored in the slot of the user, with redis cluster a transaction would be split per
+// slot and sent to the nodes concurrently, so each write is sent on its own instead.
+// Other modes use a single transaction.
+func (us UserStore) writeUser(writes ...func(pipe redis.Pipeliner)) error {
+	if _, ok := us.client.(*redis.ClusterClient); ok {
+		for _, write := range writes {
+			pipe := us.client.Pipeline()
+			write(pipe)
+			if _, err := pipe.Exec(); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
+	pipe := us.client.TxPipeline()
+	for _, write := range writes {
+		write(pipe)
+	}
+	_, err := pipe.Exec()
+	return err
 }
 
 // Add inserts a user into redis via at the string provided by the userKey function
-// This additionally sets the passkey->user_id mapping
+// This additionally sets the passkey->user_id mapping. The user is written first so the
+// index never points to a user which was not added.
 func (us UserStore) Add(u store.User) error {
-	pipe := us.client.TxPipeline()
-	pipe.HSet(userKey(u.Passkey), userMap(u))
-	pipe.Set(userIDKey(u.UserID), u.Passkey, 0)
-	if _, err := pipe.Exec(); err != nil {
+	err := us.writeUser(
+		func(pipe redis.Pipeliner) { pipe.HSet(userKey(u.Passkey), userMap(u)) },
+		func(pipe redis.Pipeliner) { pipe.Set(userIDKey(u.UserID), u.Passkey, 0) },
+	)
+	if err != nil {
 		return errors.Wrap(err, "Failed to add user to store")
 	}
 	return nil
@@ -131,6 +164,7 @@ func (us UserStore) GetByPasskey(user *store.User, passkey string) error {
 	user.Announces = util.StringToUInt32(v["announces"], 0)
 	user.DownloadEnabled = util.StringToBool(v["download_enabled"], false)
 	user.IsDeleted = util.StringToBool(v["is_deleted"], false)
+	user.Class = v["class"]
 	if !user.Valid() {
 		return consts.ErrInvalidState
 	}
@@ -161,6 +195,8 @@ func (us UserStore) Delete(user store.User) error {
 	return nil
 }
 
+// Update replaces the user, moving it to the new passkey when oldPasskey is set. The old
+// passkey is removed last so a failed update leaves the user reachable.
 func (us UserStore) Update(user store.User, oldPasskey string) error {
 	passkey := user.Passkey
 	if oldPasskey != "" {
@@ -170,19 +206,25 @@ func (us UserStore) Update(user store.User, oldPasskey string) error {
 	if err != nil || exists == 0 {
 		return err
 	}
-	pipe := us.client.TxPipeline()
-	pipe.HSet(userKey(user.Passkey), userMap(user))
-	pipe.Set(userIDKey(user.UserID), user.Passkey, 0)
+	writes := []func(pipe redis.Pipeliner){
+		func(pipe redis.Pipeliner) { pipe.HSet(userKey(user.Passkey), userMap(user)) },
+		func(pipe redis.Pipeliner) { pipe.Set(userIDKey(user.UserID), user.Passkey, 0) },
+	}
 	if oldPasskey != "" {
 		// remove old user object when switching to a new passkey as its the key
-		pipe.Del(userKey(passkey))
+		writes = append(writes, func(pipe redis.Pipeliner) { pipe.Del(userKey(passkey)) })
 	}
-	if _, err := pipe.Exec(); err != nil {
+	if err := us.writeUser(writes...); err != nil {
 		return errors.Wrap(err, "Failed to add user to store")
 	}
 	return nil
 }
 
+// Ping checks the redis server is reachable
+func (us UserStore) Ping(ctx context.Context) error {
+	return ping(ctx, us.client)
+}
+
 // Close will shutdown the underlying redis connection
 func (us UserStore) Close() error {
 	return us.client.Close()
@@ -190,7 +232,7 @@ func (us UserStore) Close() error {
 
 // TorrentStore is the redis backed store.TorrentStore implementation
 type TorrentStore struct {
-	client *redis.Client
+	client redis.UniversalClient
 }
 
 func (ts *TorrentStore) Name() string {
@@ -210,19 +252,25 @@ func (ts *TorrentStore) Update(torrent store.Torrent) error {
 	return ts.Add(torrent)
 }
 
-// Sync batch updates the backing store with the new TorrentStats provided
+// Sync batch updates the backing store with the new TorrentStats provided. The stats are
+// added by a script for each torrent, atomically per torrent and pipelined across the batch.
 func (ts *TorrentStore) Sync(batch map[store.InfoHash]store.TorrentStats) error {
-	pipe := ts.client.TxPipeline()
+	calls := make([]scriptCall, 0, len(batch))
 	for ih, s := range batch {
-		pipe.HIncrBy(torrentKey(ih), "seeders", int64(s.Seeders))
-		pipe.HIncrBy(torrentKey(ih), "leechers", int64(s.Leechers))
-		pipe.HIncrBy(torrentKey(ih), "total_completed", int64(s.Snatches))
-		pipe.HIncrBy(torrentKey(ih), "total_uploaded", int64(s.Uploaded))
-		pipe.HIncrBy(torrentKey(ih), "total_downloaded", int64(s.Downloaded))
-		pipe.HIncrBy(torrentKey(ih), "announces", int64(s.Announces))
+		calls = append(calls, scriptCall{
+			keys: []string{torrentKey(ih)},
+			args: []interface{}{
+				"seeders", s.Seeders,
+				"leechers", s.Leechers,
+				"total_completed", s.Snatches,
+				"total_uploaded", s.Uploaded,
+				"total_downloaded", s.Downloaded,
+				"announces", s.Announces,
+			},
+		})
 	}
-	if _, err := pipe.Exec(); err != nil {
-		return err
+	if _, err := runScript(ts.client, statsSyncScript, calls); err != nil {
+		return errors.Wrap(err, "Failed to sync torrents")
 	}
 	return nil
 }
@@ -259,7 +307,7 @@ func (ts *TorrentStore) WhiteListAdd(client store.WhiteListClient) error {
 
 // WhiteListGetAll fetches all known whitelisted clients
 func (ts *TorrentStore) WhiteListGetAll() ([]store.WhiteListClient, error) {
-	prefixes, err := ts.client.Keys(fmt.Sprintf("%s*", prefixWhitelist)).Result()
+	prefixes, err := findKeys(ts.client, fmt.Sprintf("%s*", prefixWhitelist))
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch whitelist keys")
 	}
@@ -277,6 +325,56 @@ func (ts *TorrentStore) WhiteListGetAll() ([]store.WhiteListClient, error) {
 	return wl, nil
 }
 
+// BanAdd will insert a new IP/CIDR ban, replacing any existing ban for the same network
+func (ts *TorrentStore) BanAdd(ban store.Ban) error {
+	valueMap := map[string]interface{}{
+		"cidr":       ban.CIDR,
+		"reason":     ban.Reason,
+		"created_by": ban.CreatedBy,
+		"created_on": util.TimeToString(ban.CreatedOn),
+		"expires":    util.TimeToString(ban.Expires),
+	}
+	if err := ts.client.HSet(banKey(ban.CIDR), valueMap).Err(); err != nil {
+		return errors.Wrapf(err, "failed to add new ban: %s", ban.CIDR)
+	}
+	return nil
+}
+
+// BanDelete removes the ban matching the CIDR of the ban provided
+func (ts *TorrentStore) BanDelete(ban store.Ban) error {
+	res, err := ts.client.Del(banKey(ban.CIDR)).Result()
+	if err != nil {
+		return errors.Wrap(err, "Failed to remove ban")
+	}
+	if res != 1 {
+		return consts.ErrInvalidBan
+	}
+	return nil
+}
+
+// BanGetAll fetches all known bans, including expired bans
+func (ts *TorrentStore) BanGetAll() ([]store.Ban, error) {
+	keys, err := findKeys(ts.client, banKey("*"))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch ban keys")
+	}
+	var bans []store.Ban
+	for _, key := range keys {
+		valueMap, err := ts.client.HGetAll(key).Result()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to fetch ban value for: %s", key)
+		}
+		bans = append(bans, store.Ban{
+			CIDR:      valueMap["cidr"],
+			Reason:    valueMap["reason"],
+			CreatedBy: valueMap["created_by"],
+			CreatedOn: util.StringToTime(valueMap["created_on"]),
+			Expires:   util.StringToTime(valueMap["expires"]),
+		})
+	}
+	return bans, nil
+}
+
 func torrentMap(t store.Torrent) map[string]interface{} {
 	return map[string]interface{}{
 		"total_completed":  t.Snatches,
@@ -351,15 +449,53 @@ func (ts *TorrentStore) Get(t *store.Torrent, hash store.InfoHash, deletedOk boo
 	return nil
 }
 
+// InfoHashes returns the info hash of every torrent which has not been deleted. The
+// torrent keys are found with KEYS so this should only be used on startup.
+func (ts *TorrentStore) InfoHashes() ([]store.InfoHash, error) {
+	keys, err := findKeys(ts.client, prefixTorrent+":{*}")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to find torrent keys")
+	}
+	pipe := ts.client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.HGet(key, "is_deleted")
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, errors.Wrap(err, "Failed to fetch torrents")
+	}
+	var hashes []store.InfoHash
+	for i, key := range keys {
+		if util.StringToBool(cmds[i].Val(), false) {
+			continue
+		}
+		var ih store.InfoHash
+		hexStr := strings.TrimSuffix(strings.TrimPrefix(key, prefixTorrent+":{"), "}")
+		if err := store.InfoHashFromHex(&ih, hexStr); err != nil {
+			log.Warnf("Ignoring invalid torrent key: %s", key)
+			continue
+		}
+		hashes = append(hashes, ih)
+	}
+	return hashes, nil
+}
+
+// Ping checks the redis server is reachable
+func (ts *TorrentStore) Ping(ctx context.Context) error {
+	return ping(ctx, ts.client)
+}
+
 // Close will close the underlying redis client and clear the caches
 func (ts *TorrentStore) Close() error {
 	return ts.client.Close()
 }
 
-// PeerStore is the redis backed store.PeerStore implementation
+// PeerStore is the redis backed store.PeerStore implementation. Each swarm has an index,
+// a sorted set of its peer ids scored by their last announce, which is used to list and
+// reap the swarm. The swarms with peers are tracked in the swarms set.
 type PeerStore struct {
-	client  *redis.Client
-	pubSub  *redis.PubSub
+	client redis.UniversalClient
+	// peerTTL is how long a peer may go without announcing before it is reaped
 	peerTTL time.Duration
 }
 
@@ -367,33 +503,218 @@ func (ps *PeerStore) Name() string {
 	return driverName
 }
 
+// keyTTL is the expiry set on the peer hashes so they are removed even if the reaper
+// is not running
+func (ps *PeerStore) keyTTL() int64 {
+	return int64(ps.peerTTL.Seconds()) * 2
+}
+
 // Sync batch updates the backing store with the new PeerStats provided
 func (ps *PeerStore) Sync(batch map[store.PeerHash]store.PeerStats) error {
-	pipe := ps.client.Pipeline()
+	calls := make([]scriptCall, 0, len(batch))
 	for ph, stats := range batch {
 		sum := stats.Totals()
-		k := peerKey(ph.InfoHash(), ph.PeerID())
-		pipe.HIncrBy(k, "announces", int64(len(stats.Hist)))
-		pipe.HIncrBy(k, "downloaded", int64(sum.TotalDn))
-		pipe.HIncrBy(k, "uploaded", int64(sum.TotalUp))
-		pipe.HSet(k, "last_announce", util.TimeToString(sum.LastAnn))
-		pipe.Expire(k, ps.peerTTL)
+		ih, pid := ph.InfoHash(), ph.PeerID()
+		score, lastAnn := "", ""
+		if !sum.LastAnn.IsZero() {
+			score = strconv.FormatInt(sum.LastAnn.Unix(), 10)
+			lastAnn = util.TimeToString(sum.LastAnn)
+		}
+		calls = append(calls, scriptCall{
+			keys: []string{peerKey(ih, pid), swarmKey(ih)},
+			args: []interface{}{pid.String(), score, ps.keyTTL(), len(stats.Hist),
+				sum.TotalDn, sum.TotalUp, stats.Left, lastAnn},
+		})
 	}
-	if _, err := pipe.Exec(); err != nil {
+	if _, err := runScript(ps.client, peerSyncScript, calls); err != nil {
 		return errors.Wrap(err, "Error trying to Sync peerstore (redis)")
 	}
 	return nil
 }
 
-// Reap will loop through the peers removing any stale entries from active swarms
-func (ps *PeerStore) Reap() []store.PeerHash {
+// Reap will loop through the swarms removing any peers which have not announced within
+// the peer TTL, returning the removed peers. Swarms left empty are removed from the
+// swarms set.
+func (ps *PeerStore) Reap() []store.ReapedPeer {
+	var (
+		peerHashes []store.ReapedPeer
+		cursor     uint64
+	)
+	cutoff := strconv.FormatInt(time.Now().Add(-ps.peerTTL).Unix(), 10)
+	for {
+		hashes, next, err := ps.client.SScan(swarmsKey, cursor, "", 1000).Result()
+		if err != nil {
+			log.Errorf("Failed to scan swarms: %s", err)
+			return peerHashes
+		}
+		peerHashes = append(peerHashes, ps.reapSwarms(hashes, cutoff)...)
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	log.Debugf("Reaped %d peers", len(peerHashes))
+	return peerHashes
+}
+
+func (ps *PeerStore) reapSwarms(hashes []string, cutoff string) []store.ReapedPeer {
+	var peerHashes []store.ReapedPeer
+	infoHashes := make([]store.InfoHash, 0, len(hashes))
+	calls := make([]scriptCall, 0, len(hashes))
+	for _, h := range hashes {
+		var ih store.InfoHash
+		if err := store.InfoHashFromHex(&ih, h); err != nil {
+			log.Warnf("Invalid info_hash in swarms set: %s", h)
+			continue
+		}
+		infoHashes = append(infoHashes, ih)
+		calls = append(calls, scriptCall{
+			keys: []string{swarmKey(ih)},
+			args: []interface{}{cutoff},
+		})
+	}
+	cmds, err := runScript(ps.client, peerReapScript, calls)
+	if err != nil {
+		log.Errorf("Failed to reap peers: %s", err)
+	}
+	var (
+		empty    []store.InfoHash
+		reaped   []store.PeerHash
+		hashCall []scriptCall
+	)
+	for i, cmd := range cmds {
+		res, ok := cmd.Val().([]interface{})
+		if !ok || len(res) == 0 {
+			continue
+		}
+		if remaining, ok := res[0].(int64); ok && remaining == 0 {
+			empty = append(empty, infoHashes[i])
+		}
+		// The removed peer ids follow the remaining count
+		for _, v := range res[1:] {
+			id, ok := v.(string)
+			if !ok {
+				continue
+			}
+			b, err := hex.DecodeString(id)
+			if err != nil {
+				log.Warnf("Invalid peer_id in swarm index: %s", id)
+				continue
+			}
+			peerID := store.PeerIDFromString(string(b))
+			reaped = append(reaped, store.NewPeerHash(infoHashes[i], peerID))
+			hashCall = append(hashCall, scriptCall{
+				keys: []string{peerKey(infoHashes[i], peerID), swarmKey(infoHashes[i])},
+				args: []interface{}{id},
+			})
+		}
+	}
+	hashCmds, err := runScript(ps.client, peerReapHashScript, hashCall)
+	if err != nil {
+		log.Errorf("Failed to remove reaped peers: %s", err)
+	}
+	for i, cmd := range hashCmds {
+		// Peers failing to be removed are counted as leechers, their hash expires
+		seeder, _ := cmd.Val().(int64)
+		if seeder == -1 {
+			continue
+		}
+		peerHashes = append(peerHashes, store.ReapedPeer{PeerHash: reaped[i], Seeder: seeder == 1})
+	}
+	ps.removeSwarms(empty)
+	return peerHashes
+}
+
+// swarmCounts returns the number of peers in each swarm index
+func (ps *PeerStore) swarmCounts(infoHashes []store.InfoHash) ([]int64, error) {
+	pipe := ps.client.Pipeline()
+	cmds := make([]*redis.IntCmd, len(infoHashes))
+	for i, ih := range infoHashes {
+		cmds[i] = pipe.ZCard(swarmKey(ih))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+	counts := make([]int64, len(cmds))
+	for i, cmd := range cmds {
+		counts[i] = cmd.Val()
+	}
+	return counts, nil
+}
+
+// removeSwarms drops the empty swarms from the swarms set. The swarms set is not stored in
+// the slot of the swarm indexes so they cannot be checked and removed atomically, swarms
+// gaining a peer between the check and the removal are added back.
+func (ps *PeerStore) removeSwarms(infoHashes []store.InfoHash) {
+	if len(infoHashes) == 0 {
+		return
+	}
+	counts, err := ps.swarmCounts(infoHashes)
+	if err != nil {
+		log.Errorf("Failed to check empty swarms: %s", err)
+		return
+	}
+	var (
+		removed []store.InfoHash
+		members []interface{}
+	)
+	for i, ih := range infoHashes {
+		if counts[i] == 0 {
+			removed = append(removed, ih)
+			members = append(members, ih.String())
+		}
+	}
+	if len(members) == 0 {
+		return
+	}
+	if err := ps.client.SRem(swarmsKey, members...).Err(); err != nil {
+		log.Errorf("Failed to remove empty swarms: %s", err)
+		return
+	}
+	counts, err = ps.swarmCounts(removed)
+	if err != nil {
+		// Unknown state, every removed swarm is added back to be checked on the next reap
+		log.Errorf("Failed to check removed swarms: %s", err)
+		if err := ps.client.SAdd(swarmsKey, members...).Err(); err != nil {
+			log.Errorf("Failed to restore removed swarms: %s", err)
+		}
+		return
+	}
+	var restore []interface{}
+	for i, ih := range removed {
+		if counts[i] > 0 {
+			restore = append(restore, ih.String())
+		}
+	}
+	if len(restore) > 0 {
+		if err := ps.client.SAdd(swarmsKey, restore...).Err(); err != nil {
+			log.Errorf("Failed to restore swarms with new peers: %s", err)
+		}
+	}
+}
+
+// set writes the peer fields, refreshing the peer in the swarm index
+func (ps *PeerStore) set(ih store.InfoHash, p store.Peer, fields map[string]interface{}) error {
+	args := make([]interface{}, 0, 3+len(fields)*2)
+	args = append(args, p.PeerID.String(), p.AnnounceLast.Unix(), ps.keyTTL())
+	for k, v := range fields {
+		args = append(args, k, v)
+	}
+	pipe := ps.client.Pipeline()
+	cmd := peerAddScript.EvalSha(pipe, []string{peerKey(ih, p.PeerID), swarmKey(ih)}, args...)
+	pipe.SAdd(swarmsKey, ih.String())
+	if _, err := pipe.Exec(); err != nil {
+		if cmd.Err() == nil || !strings.HasPrefix(cmd.Err().Error(), "NOSCRIPT") {
+			return err
+		}
+		return peerAddScript.Eval(ps.client, []string{peerKey(ih, p.PeerID), swarmKey(ih)}, args...).Err()
+	}
 	return nil
 }
 
 // Add inserts a peer into the active swarm for the torrent provided
 func (ps *PeerStore) Add(ih store.InfoHash, p store.Peer) error {
-	ipv6 := strings.Count(p.IP.String(), ":") > 1
-	err := ps.client.HSet(peerKey(ih, p.PeerID), map[string]interface{}{
+	err := ps.set(ih, p, map[string]interface{}{
 		"speed_up":       p.SpeedUP,
 		"speed_dn":       p.SpeedDN,
 		"speed_up_max":   p.SpeedUPMax,
@@ -402,8 +723,8 @@ func (ps *PeerStore) Add(ih store.InfoHash, p store.Peer) error {
 		"downloaded":     p.Downloaded,
 		"total_left":     p.Left,
 		"total_time":     p.TotalTime,
-		"ipv6":           ipv6,
-		"addr_ip":        p.IP.String(),
+		"addr_ip":        ipString(p.IPv4),
+		"addr_ip6":       ipString(p.IPv6),
 		"addr_port":      p.Port,
 		"last_announce":  util.TimeToString(p.AnnounceLast),
 		"first_announce": util.TimeToString(p.AnnounceFirst),
@@ -415,25 +736,17 @@ func (ps *PeerStore) Add(ih store.InfoHash, p store.Peer) error {
 		"asn":            p.ASN,
 		"as_name":        p.AS,
 		"crypto_level":   int(p.CryptoLevel),
-	}).Err()
+	})
 	if err != nil {
 		return errors.Wrap(err, "Failed to Add")
 	}
 	return nil
 }
 
-func (ps *PeerStore) findKeys(prefix string) []string {
-	v, err := ps.client.Keys(prefix).Result()
-	if err != nil {
-		log.Errorf("Failed to query for key prefix: %s", err.Error())
-	}
-	return v
-}
-
 // Update will sync any new peer data with the backing store
 // Note that this OVERWRITES the values, doesnt add
 func (ps *PeerStore) Update(ih store.InfoHash, p store.Peer) error {
-	err := ps.client.HSet(peerKey(ih, p.PeerID), map[string]interface{}{
+	err := ps.set(ih, p, map[string]interface{}{
 		"speed_up":       p.SpeedUP,
 		"speed_dn":       p.SpeedDN,
 		"speed_up_max":   p.SpeedUPMax,
@@ -445,7 +758,7 @@ func (ps *PeerStore) Update(ih store.InfoHash, p store.Peer) error {
 		"total_time":     p.TotalTime,
 		"last_announce":  util.TimeToString(p.AnnounceLast),
 		"first_announce": util.TimeToString(p.AnnounceFirst),
-	}).Err()
+	})
 	if err != nil {
 		return errors.Wrap(err, "Failed to Update")
 	}
@@ -454,7 +767,7 @@ func (ps *PeerStore) Update(ih store.InfoHash, p store.Peer) error {
 
 // Delete will remove a user from a torrents swarm
 func (ps *PeerStore) Delete(ih store.InfoHash, p store.PeerID) error {
-	return ps.client.Del(peerKey(ih, p)).Err()
+	return peerDeleteScript.Run(ps.client, []string{peerKey(ih, p), swarmKey(ih)}, p.String()).Err()
 }
 
 // Get will fetch the peer from the swarm if it exists
@@ -470,6 +783,15 @@ func (ps *PeerStore) Get(p *store.Peer, ih store.InfoHash, peerID store.PeerID)
 	return nil
 }
 
+// ipString returns the string form of the address, or an empty string for peers
+// missing an address of that family
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
 func mapPeerValues(p *store.Peer, v map[string]string) {
 	p.SpeedUP = util.StringToUInt32(v["speed_up"], 0)
 	p.SpeedDN = util.StringToUInt32(v["speed_dn"], 0)
@@ -480,8 +802,8 @@ func mapPeerValues(p *store.Peer, v map[string]string) {
 	p.Left = util.StringToUInt32(v["total_left"], 0)
 	p.Announces = util.StringToUInt32(v["announces"], 0)
 	p.TotalTime = util.StringToUInt32(v["total_time"], 0)
-	p.IPv6 = util.StringToBool(v["ipv6"], false)
-	p.IP = net.ParseIP(v["addr_ip"])
+	p.IPv4 = net.ParseIP(v["addr_ip"]).To4()
+	p.IPv6 = net.ParseIP(v["addr_ip6"])
 	p.Port = util.StringToUInt16(v["addr_port"], 0)
 	p.AnnounceLast = util.StringToTime(v["last_announce"])
 	p.AnnounceFirst = util.StringToTime(v["first_announce"])
@@ -494,22 +816,66 @@ func mapPeerValues(p *store.Peer, v map[string]string) {
 	p.CryptoLevel = consts.CryptoLevel(util.StringToUInt(v["crypto_level"], 0))
 }
 
-// GetN will fetch peers for a torrents active swarm up to N users
-func (ps *PeerStore) GetN(ih store.InfoHash, limit int) (store.Swarm, error) {
-	swarm := store.NewSwarm()
-	for i, key := range ps.findKeys(torrentPeersKey(ih)) {
-		if i == limit {
-			break
+// GetN returns up to limit peers matching the filter, chosen uniformly at random.
+// A bounded random sample of the peer ids which have announced within the peer TTL is
+// read from the swarm index and fetched in a pipeline. The first sample only covers a
+// filter excluding the requesting peer, it is doubled while too few peers match until
+// the swarm is exhausted. A limit of 0 returns every peer matching the filter.
+func (ps *PeerStore) GetN(ih store.InfoHash, limit int, filter store.PeerFilter) ([]store.Peer, error) {
+	cutoff := strconv.FormatInt(time.Now().Add(-ps.peerTTL).Unix(), 10)
+	seed := rand.Int31()
+	prefix := peerKeyPrefix(ih)
+	// The swarm may change between samples, in which case the permutation differs and
+	// ids can be returned again
+	seen := make(map[string]struct{})
+	skip, count := 0, limit+1
+	if limit <= 0 {
+		count = 0
+	}
+	peers := make([]store.Peer, 0, count)
+	for {
+		res, err := peerSampleScript.Run(ps.client, []string{swarmKey(ih)}, cutoff, skip, count, seed).Result()
+		if err != nil && err != redis.Nil {
+			return nil, errors.Wrap(err, "Error trying to GetN")
 		}
-		v, err := ps.client.HGetAll(key).Result()
-		if err != nil {
-			return swarm, errors.Wrap(err, "Error trying to GetN")
+		ids, _ := res.([]interface{})
+		pipe := ps.client.Pipeline()
+		cmds := make([]*redis.StringStringMapCmd, 0, len(ids))
+		for _, v := range ids {
+			id, _ := v.(string)
+			if _, found := seen[id]; found {
+				continue
+			}
+			seen[id] = struct{}{}
+			cmds = append(cmds, pipe.HGetAll(prefix+id))
+		}
+		if len(cmds) > 0 {
+			if _, err := pipe.Exec(); err != nil {
+				return nil, errors.Wrap(err, "Error trying to GetN")
+			}
+		}
+		for _, cmd := range cmds {
+			// The peer hash expired without being reaped
+			if len(cmd.Val()) == 0 {
+				continue
+			}
+			var p store.Peer
+			mapPeerValues(&p, cmd.Val())
+			if filter.Match(&p) && (limit <= 0 || len(peers) < limit) {
+				peers = append(peers, p)
+			}
+		}
+		if count == 0 || len(peers) >= limit || len(ids) < count {
+			return peers, nil
 		}
-		var p store.Peer
-		mapPeerValues(&p, v)
-		swarm.Peers[p.PeerID] = p
+		skip += count
+		count *= 2
 	}
-	return swarm, nil
+}
+
+// Ping checks the redis server is reachable
+func (ps *PeerStore) Ping(ctx context.Context) error {
+	return ping(ctx, ps.client)
 }
 
 // Close will close the underlying redis client and clear in-memory caches
@@ -517,24 +883,6 @@ func (ps *PeerStore) Close() error {
 	return ps.client.Close()
 }
 
-func newRedisConfig(c *config.StoreConfig) *redis.Options {
-	database, err := strconv.ParseInt(c.Database, 10, 32)
-	if err != nil {
-		log.Panicf("Failed to parse redis database integer: %s", c.Database)
-	}
-	return &redis.Options{
-		Addr:     fmt.Sprintf("%s:%d", c.Host, c.Port),
-		Password: c.Password,
-		DB:       int(database),
-		OnConnect: func(conn *redis.Conn) error {
-			if err := conn.ClientSetName(clientName).Err(); err != nil {
-				log.Fatalf("Could not SetName, bailing: %s", err)
-			}
-			return nil
-		},
-	}
-}
-
 type torrentDriver struct{}
 
 // New initialize a TorrentStore implementation using the redis backing store
@@ -543,21 +891,18 @@ func (td torrentDriver) New(cfg interface{}) (store.TorrentStore, error) {
 	if !ok {
 		return nil, consts.ErrInvalidConfig
 	}
-	client := redis.NewClient(newRedisConfig(c))
+	client, err := newClient(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateKeys(client); err != nil {
+		return nil, err
+	}
 	return &TorrentStore{
 		client: client,
 	}, nil
 }
 
-func (ps *PeerStore) peerExpireHandler() {
-	psChan := ps.pubSub.Channel()
-	for {
-		m := <-psChan
-		// TODO cleanup any cache if it exists?
-		log.Println(m)
-	}
-}
-
 type peerDriver struct{}
 
 // New initialize a New implementation using the redis backing store
@@ -566,14 +911,14 @@ func (pd peerDriver) New(cfg interface{}) (store.PeerStore, error) {
 	if !ok {
 		return nil, consts.ErrInvalidConfig
 	}
-	client := redis.NewClient(newRedisConfig(c))
-	ps := &PeerStore{
-		client:  client,
-		pubSub:  client.Subscribe("peer_expired"),
-		peerTTL: time.Minute * 10,
+	client, err := newClient(c)
+	if err != nil {
+		return nil, err
 	}
-	go ps.peerExpireHandler()
-	return ps, nil
+	return &PeerStore{
+		client:  client,
+		peerTTL: time.Second * 300,
+	}, nil
 }
 
 type userDriver struct{}
@@ -584,11 +929,19 @@ func (pd userDriver) New(cfg interface{}) (store.UserStore, error) {
 	if !ok {
 		return nil, consts.ErrInvalidConfig
 	}
-	return &UserStore{client: redis.NewClient(newRedisConfig(c))}, nil
+	client, err := newClient(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateKeys(client); err != nil {
+		return nil, err
+	}
+	return &UserStore{client: client}, nil
 }
 
 func init() {
 	store.AddUserDriver(driverName, userDriver{})
 	store.AddPeerDriver(driverName, peerDriver{})
 	store.AddTorrentDriver(driverName, torrentDriver{})
+	store.AddBusDriver(driverName, busDriver{})
 }
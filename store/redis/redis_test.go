@@ -1,66 +1,313 @@
 package redis
 
 import (
-	"github.com/go-redis/redis/v7"
 	"github.com/leighmacdonald/mika/config"
+	"github.com/leighmacdonald/mika/consts"
 	"github.com/leighmacdonald/mika/store"
 	"github.com/leighmacdonald/mika/store/memory"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 	"os"
+	"sync"
 	"testing"
+	"time"
 )
 
+// skipDB is set when no test server is configured
+var skipDB bool
+
+// testModes returns the store configs to run the tests against. The configured server is
+// always used, sentinel and cluster deployments are tested when their store properties are
+// set with the MIKA_REDIS_SENTINEL and MIKA_REDIS_CLUSTER environment variables.
+func testModes(t *testing.T, storeType config.StoreType) map[string]*config.StoreConfig {
+	if skipDB {
+		t.Skip("Skipping database tests, no redis test config")
+	}
+	modes := map[string]*config.StoreConfig{modeSingle: config.GetStoreConfig(storeType)}
+	for mode, env := range map[string]string{modeSentinel: "MIKA_REDIS_SENTINEL", modeCluster: "MIKA_REDIS_CLUSTER"} {
+		if props := os.Getenv(env); props != "" {
+			c := config.GetStoreConfig(storeType)
+			c.Properties = props
+			if mode == modeCluster {
+				c.Database = ""
+			}
+			modes[mode] = c
+		}
+	}
+	return modes
+}
+
 func TestRedisTorrentStore(t *testing.T) {
-	ts, e := store.NewTorrentStore("redis", config.GetStoreConfig(config.Torrent))
-	require.NoError(t, e, e)
-	store.TestTorrentStore(t, ts)
+	for mode, c := range testModes(t, config.Torrent) {
+		t.Run(mode, func(t *testing.T) {
+			setupDB(t, c)
+			ts, e := store.NewTorrentStore("redis", c)
+			require.NoError(t, e, e)
+			store.TestTorrentStore(t, ts)
+		})
+	}
 }
 
 func TestRedisUserStore(t *testing.T) {
-	us, e := store.NewUserStore("redis", config.GetStoreConfig(config.Users))
-	require.NoError(t, e, e)
-	store.TestUserStore(t, us)
+	for mode, c := range testModes(t, config.Users) {
+		t.Run(mode, func(t *testing.T) {
+			setupDB(t, c)
+			us, e := store.NewUserStore("redis", c)
+			require.NoError(t, e, e)
+			store.TestUserStore(t, us)
+		})
+	}
 }
 
 func TestRedisPeerStore(t *testing.T) {
-	client := redis.NewClient(newRedisConfig(config.GetStoreConfig(config.Torrent)))
-	setupDB(t, client)
-	ts, err := store.NewTorrentStore("redis", config.GetStoreConfig(config.Torrent))
+	for mode, c := range testModes(t, config.Peers) {
+		t.Run(mode, func(t *testing.T) {
+			setupDB(t, c)
+			ts, err := store.NewTorrentStore("redis", c)
+			require.NoError(t, err)
+			ps, err := store.NewPeerStore("redis", c)
+			require.NoError(t, err, err)
+			store.TestPeerStore(t, ps, ts, memory.NewUserStore())
+		})
+	}
+}
+
+func TestRedisPeerStoreReap(t *testing.T) {
+	for mode, c := range testModes(t, config.Peers) {
+		t.Run(mode, func(t *testing.T) {
+			setupDB(t, c)
+			ps, err := peerDriver{}.New(c)
+			require.NoError(t, err)
+			client := ps.(*PeerStore).client
+			var hashes []store.InfoHash
+			// The expected reaped peers and whether they are seeders
+			expected := map[store.PeerHash]bool{}
+			for i := 0; i < 50; i++ {
+				ih := store.GenerateTestTorrent().InfoHash
+				hashes = append(hashes, ih)
+				expired := store.GenerateTestPeer()
+				expired.AnnounceLast = time.Now().Add(-time.Hour)
+				if i%3 != 0 {
+					expired.Left = 1000
+				}
+				require.NoError(t, ps.Add(ih, expired))
+				expected[store.NewPeerHash(ih, expired.PeerID)] = expired.Left == 0
+				if i%2 == 0 {
+					require.NoError(t, ps.Add(ih, store.GenerateTestPeer()))
+				}
+			}
+			reaped := ps.Reap()
+			require.Len(t, reaped, len(expected))
+			for _, ph := range reaped {
+				seeder, found := expected[ph.PeerHash]
+				require.True(t, found, "Unexpected peer reaped")
+				require.Equal(t, seeder, ph.Seeder)
+				exists, err := client.Exists(peerKey(ph.InfoHash(), ph.PeerID())).Result()
+				require.NoError(t, err)
+				require.Equal(t, int64(0), exists, "Reaped peer hash not removed")
+			}
+			for i, ih := range hashes {
+				peers, err := ps.GetN(ih, 10, store.PeerFilter{})
+				require.NoError(t, err)
+				isMember, err := client.SIsMember(swarmsKey, ih.String()).Result()
+				require.NoError(t, err)
+				if i%2 == 0 {
+					require.Len(t, peers, 1)
+					require.True(t, isMember)
+				} else {
+					require.Len(t, peers, 0)
+					require.False(t, isMember, "Empty swarm not removed")
+				}
+			}
+			require.Len(t, ps.Reap(), 0)
+		})
+	}
+}
+
+func TestRedisSyncConcurrent(t *testing.T) {
+	const (
+		writers = 8
+		syncs   = 50
+	)
+	for mode, c := range testModes(t, config.Users) {
+		t.Run(mode, func(t *testing.T) {
+			setupDB(t, c)
+			// Each writer uses its own stores, as separate tracker nodes would
+			userStores := make([]store.UserStore, writers)
+			torrentStores := make([]store.TorrentStore, writers)
+			for i := 0; i < writers; i++ {
+				us, err := store.NewUserStore("redis", c)
+				require.NoError(t, err)
+				ts, err := store.NewTorrentStore("redis", c)
+				require.NoError(t, err)
+				userStores[i], torrentStores[i] = us, ts
+			}
+			user := store.GenerateTestUser()
+			torrent := store.GenerateTestTorrent()
+			require.NoError(t, userStores[0].Add(user))
+			require.NoError(t, torrentStores[0].Add(torrent))
+			missing := store.GenerateTestUser()
+			errs := make(chan error, writers*syncs*2)
+			var wg sync.WaitGroup
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func(us store.UserStore, ts store.TorrentStore) {
+					defer wg.Done()
+					for j := 0; j < syncs; j++ {
+						errs <- us.Sync(map[string]store.UserStats{
+							user.Passkey:    {Uploaded: 10, Downloaded: 20, Announces: 1},
+							missing.Passkey: {Uploaded: 10, Downloaded: 20, Announces: 1},
+						})
+						errs <- ts.Sync(map[store.InfoHash]store.TorrentStats{
+							torrent.InfoHash: {Seeders: 1, Leechers: -1, Snatches: 1, Uploaded: 10, Downloaded: 20, Announces: 1},
+						})
+					}
+				}(userStores[i], torrentStores[i])
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				require.NoError(t, err)
+			}
+			const total = writers * syncs
+			var u store.User
+			require.NoError(t, userStores[0].GetByPasskey(&u, user.Passkey))
+			require.Equal(t, user.Uploaded+10*total, u.Uploaded)
+			require.Equal(t, user.Downloaded+20*total, u.Downloaded)
+			require.Equal(t, user.Announces+total, u.Announces)
+			require.Error(t, userStores[0].GetByPasskey(&u, missing.Passkey), "Sync created a missing user")
+			var tor store.Torrent
+			require.NoError(t, torrentStores[0].Get(&tor, torrent.InfoHash, false))
+			require.Equal(t, torrent.Seeders+total, tor.Seeders)
+			require.Equal(t, torrent.Leechers-total, tor.Leechers)
+			require.Equal(t, torrent.Snatches+total, tor.Snatches)
+			require.Equal(t, torrent.Uploaded+10*total, tor.Uploaded)
+			require.Equal(t, torrent.Downloaded+20*total, tor.Downloaded)
+			require.Equal(t, torrent.Announces+total, tor.Announces)
+			for i := 0; i < writers; i++ {
+				require.NoError(t, userStores[i].Close())
+				require.NoError(t, torrentStores[i].Close())
+			}
+		})
+	}
+}
+
+func TestRedisBus(t *testing.T) {
+	for mode, c := range testModes(t, config.Peers) {
+		t.Run(mode, func(t *testing.T) {
+			pub, err := store.NewInvalidationBus("redis", c)
+			require.NoError(t, err)
+			sub, err := store.NewInvalidationBus("redis", c)
+			require.NoError(t, err)
+			store.TestInvalidationBus(t, pub, sub)
+		})
+	}
+}
+
+func TestParseClientOpts(t *testing.T) {
+	base := config.StoreConfig{Host: "localhost", Port: 6379, Database: "2", Password: "pw"}
+	tests := []struct {
+		props string
+		want  clientOpts
+		err   bool
+	}{
+		{"", clientOpts{mode: modeSingle, addrs: []string{"localhost:6379"}, password: "pw", db: 2}, false},
+		{"mode=sentinel&master_name=mymaster&addrs=a:26379, b:26379&sentinel_password=spw",
+			clientOpts{mode: modeSentinel, addrs: []string{"a:26379", "b:26379"}, masterName: "mymaster",
+				sentinelPassword: "spw", password: "pw", db: 2}, false},
+		{"mode=sentinel&addrs=a:26379", clientOpts{}, true},
+		{"mode=cluster&addrs=a:7000,b:7000", clientOpts{}, true},
+		{"mode=single&addrs=a:6379,b:6379", clientOpts{}, true},
+		{"mode=ring", clientOpts{}, true},
+	}
+	for _, tc := range tests {
+		c := base
+		c.Properties = tc.props
+		opts, err := parseClientOpts(&c)
+		if tc.err {
+			require.Equal(t, consts.ErrInvalidConfig, errors.Cause(err), tc.props)
+			continue
+		}
+		require.NoError(t, err, tc.props)
+		require.Equal(t, tc.want, opts, tc.props)
+	}
+	c := base
+	c.Database = ""
+	c.Properties = "mode=cluster&addrs=a:7000,b:7000"
+	opts, err := parseClientOpts(&c)
 	require.NoError(t, err)
-	ps, err := store.NewPeerStore("redis", config.GetStoreConfig(config.Peers))
-	require.NoError(t, err, err)
-	store.TestPeerStore(t, ps, ts, memory.NewUserStore())
+	require.Equal(t, []string{"a:7000", "b:7000"}, opts.addrs)
 }
 
-func clearDB(c *redis.Client) {
-	keys, err := c.Keys("*").Result()
+func TestKeys(t *testing.T) {
+	// Swarm keys must share the hash tag of the torrent so they are stored in the same slot
+	ih := store.GenerateTestTorrent().InfoHash
+	tag := "{" + ih.String() + "}"
+	require.Contains(t, torrentKey(ih), tag)
+	require.Contains(t, peerKey(ih, store.GenerateTestPeer().PeerID), tag)
+	require.Contains(t, swarmKey(ih), tag)
+}
+
+func TestMigrateKeys(t *testing.T) {
+	for mode, c := range testModes(t, config.Torrent) {
+		if mode == modeCluster {
+			continue
+		}
+		t.Run(mode, func(t *testing.T) {
+			setupDB(t, c)
+			client, err := newClient(c)
+			require.NoError(t, err)
+			defer func() { _ = client.Close() }()
+			torrent := store.GenerateTestTorrent()
+			user := store.GenerateTestUser()
+			require.NoError(t, client.HSet(prefixTorrent+":"+torrent.InfoHash.String(), torrentMap(torrent)).Err())
+			require.NoError(t, client.HSet(prefixUser+":"+user.Passkey, userMap(user)).Err())
+			require.NoError(t, client.Set(userIDKey(user.UserID), user.Passkey, 0).Err())
+			ts, err := torrentDriver{}.New(c)
+			require.NoError(t, err)
+			var tor store.Torrent
+			require.NoError(t, ts.Get(&tor, torrent.InfoHash, false))
+			require.Equal(t, torrent.Seeders, tor.Seeders)
+			us, err := userDriver{}.New(c)
+			require.NoError(t, err)
+			var u store.User
+			require.NoError(t, us.GetByID(&u, user.UserID))
+			require.Equal(t, user.Uploaded, u.Uploaded)
+			// Already migrated keys are left as is
+			require.NoError(t, migrateKeys(client))
+			require.NoError(t, ts.Get(&tor, torrent.InfoHash, false))
+		})
+	}
+}
+
+func clearDB(t *testing.T, c *config.StoreConfig) {
+	client, err := newClient(c)
+	require.NoError(t, err)
+	defer func() { _ = client.Close() }()
+	keys, err := findKeys(client, "*")
 	if err != nil {
 		log.Panicf("Could not initialize redis db: %s", err.Error())
 	}
 	for _, k := range keys {
-		c.Del(k)
+		client.Del(k)
 	}
 }
 
-func setupDB(t *testing.T, c *redis.Client) {
-	clearDB(c)
+func setupDB(t *testing.T, c *config.StoreConfig) {
+	clearDB(t, c)
 	t.Cleanup(func() {
-		clearDB(c)
+		clearDB(t, c)
 	})
 }
 
 func TestMain(m *testing.M) {
 	if err := config.Read("mika_testing_redis"); err != nil {
 		log.Info("Skipping database tests, failed to find config: mika_testing_redis.yaml")
-		os.Exit(0)
-		return
-	}
-	if config.GetString(config.GeneralRunMode) != "test" {
+		skipDB = true
+	} else if config.GetString(config.GeneralRunMode) != "test" {
 		log.Info("Skipping database tests, not running in testing mode")
-		os.Exit(0)
-		return
+		skipDB = true
 	}
-	exitCode := m.Run()
-	os.Exit(exitCode)
+	os.Exit(m.Run())
 }
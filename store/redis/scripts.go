@@ -0,0 +1,175 @@
+package redis
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// The peer scripts keep a peers hash and its entry in the swarm index, a sorted set of the
+// swarms peer ids scored by their last announce, in sync. Both keys share the info hash
+// hash tag so the scripts can be used with redis cluster.
+
+// peerAddScript sets the peer hash fields and refreshes the peer in the swarm index
+//
+// KEYS: peer, swarm
+// ARGV: peer_id, last announce, ttl, field, value, [field, value...]
+var peerAddScript = redis.NewScript(`
+redis.call('HSET', KEYS[1], unpack(ARGV, 4))
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[1])
+return 1
+`)
+
+// peerDeleteScript removes the peer hash and its swarm index entry
+//
+// KEYS: peer, swarm
+// ARGV: peer_id
+var peerDeleteScript = redis.NewScript(`
+redis.call('DEL', KEYS[1])
+return redis.call('ZREM', KEYS[2], ARGV[1])
+`)
+
+// peerSyncScript adds the stats to an existing peer, peers which have been reaped or
+// deleted are ignored. The last announce is left as is when empty.
+//
+// KEYS: peer, swarm
+// ARGV: peer_id, last announce, ttl, announces, downloaded, uploaded, left, last_announce
+var peerSyncScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HINCRBY', KEYS[1], 'announces', ARGV[4])
+redis.call('HINCRBY', KEYS[1], 'downloaded', ARGV[5])
+redis.call('HINCRBY', KEYS[1], 'uploaded', ARGV[6])
+redis.call('HSET', KEYS[1], 'total_left', ARGV[7])
+if ARGV[2] ~= '' then
+	redis.call('HSET', KEYS[1], 'last_announce', ARGV[8])
+	redis.call('ZADD', KEYS[2], ARGV[2], ARGV[1])
+end
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+return 1
+`)
+
+// peerSampleScript returns up to count peer ids chosen uniformly at random from the peers
+// of the swarm which announced after the cutoff. The live peers are the tail of the swarm
+// index so each id is read by its rank. The ids are the positions skip to skip+count of
+// a random permutation of the live peers generated from the seed, calling it again with
+// the same seed and a larger skip continues the same sample. A count of 0 returns every
+// live peer.
+//
+// KEYS: swarm
+// ARGV: cutoff, skip, count, seed
+var peerSampleScript = redis.NewScript(`
+local first = redis.call('ZCOUNT', KEYS[1], '-inf', ARGV[1])
+local live = redis.call('ZCARD', KEYS[1]) - first
+local skip = tonumber(ARGV[2])
+local count = tonumber(ARGV[3])
+if count <= 0 then
+	return redis.call('ZRANGE', KEYS[1], first, -1)
+end
+local stop = math.min(skip + count, live)
+math.randomseed(tonumber(ARGV[4]))
+local swapped = {}
+local ids = {}
+for i = 0, stop - 1 do
+	local j = math.random(i, live - 1)
+	local rank = swapped[j] or j
+	swapped[j] = swapped[i] or i
+	if i >= skip then
+		table.insert(ids, redis.call('ZRANGE', KEYS[1], first + rank, first + rank)[1])
+	end
+end
+return ids
+`)
+
+// peerReapScript removes the peers of the swarm index which last announced at or before
+// the cutoff, returning the number of peers left followed by the removed peer ids. The
+// peer hashes are removed afterwards with peerReapHashScript.
+//
+// KEYS: swarm
+// ARGV: cutoff
+var peerReapScript = redis.NewScript(`
+local expired = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if #expired > 0 then
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+end
+local reaped = {redis.call('ZCARD', KEYS[1])}
+for _, id in ipairs(expired) do
+	table.insert(reaped, id)
+end
+return reaped
+`)
+
+// peerReapHashScript removes the hash of a peer reaped by peerReapScript, returning 1 if
+// the peer was a seeder and 0 otherwise. A peer hash which already expired is counted as a
+// leecher. Peers which announced again since being reaped are back in the swarm index and
+// are kept, -1 is returned for them.
+//
+// KEYS: peer, swarm
+// ARGV: peer_id
+var peerReapHashScript = redis.NewScript(`
+if redis.call('ZSCORE', KEYS[2], ARGV[1]) then
+	return -1
+end
+local left = redis.call('HGET', KEYS[1], 'total_left')
+redis.call('DEL', KEYS[1])
+return left == '0' and 1 or 0
+`)
+
+// statsSyncScript adds the stat deltas to the fields of an existing user or torrent hash
+// in one step, so concurrent syncs from several nodes are never lost. Hashes which have
+// been deleted are not recreated.
+//
+// KEYS: user or torrent
+// ARGV: field, delta, [field, delta...]
+var statsSyncScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+for i = 1, #ARGV, 2 do
+	redis.call('HINCRBY', KEYS[1], ARGV[i], ARGV[i + 1])
+end
+return 1
+`)
+
+// scriptCall is a single execution of a script in a batch
+type scriptCall struct {
+	keys []string
+	args []interface{}
+}
+
+// runScript executes the script once for every call using a single pipeline. The script
+// is called by its hash, any calls failing because the server does not have the script
+// cached, eg. after a failover or on a new cluster node, are resent with the script body.
+// Calls which were executed are never resent.
+func runScript(client redis.UniversalClient, script *redis.Script, calls []scriptCall) ([]*redis.Cmd, error) {
+	cmds := make([]*redis.Cmd, len(calls))
+	if len(calls) == 0 {
+		return cmds, nil
+	}
+	pipe := client.Pipeline()
+	for i, c := range calls {
+		cmds[i] = script.EvalSha(pipe, c.keys, c.args...)
+	}
+	_, _ = pipe.Exec()
+	var missing []int
+	for i, cmd := range cmds {
+		if err := cmd.Err(); err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) > 0 {
+		pipe = client.Pipeline()
+		for _, i := range missing {
+			cmds[i] = script.Eval(pipe, calls[i].keys, calls[i].args...)
+		}
+		_, _ = pipe.Exec()
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil && err != redis.Nil {
+			return cmds, errors.Wrap(err, "Failed to run script")
+		}
+	}
+	return cmds, nil
+}
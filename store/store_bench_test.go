@@ -1,7 +1,160 @@
-package store
+package store_test
 
-import "testing"
+import (
+	"fmt"
+	"github.com/leighmacdonald/mika/store"
+	"github.com/leighmacdonald/mika/store/memory"
+	"math/rand"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	benchSwarms        = 1000
+	benchPeersPerSwarm = 100
+)
+
+// newBenchPeerStore returns a memory peer store holding benchSwarms * benchPeersPerSwarm
+// peers, a tenth of which are expired
+func newBenchPeerStore(b *testing.B) (*memory.PeerStore, []store.InfoHash, []store.PeerID) {
+	ps := memory.NewPeerStore()
+	hashes := make([]store.InfoHash, benchSwarms)
+	peerIDs := make([]store.PeerID, benchPeersPerSwarm)
+	for i := range peerIDs {
+		peerIDs[i] = store.GenerateTestPeer().PeerID
+	}
+	for i := range hashes {
+		hashes[i] = store.GenerateTestTorrent().InfoHash
+		for j, peerID := range peerIDs {
+			p := store.GenerateTestPeer()
+			p.PeerID = peerID
+			if j%10 == 0 {
+				p.AnnounceLast = time.Now().Add(-time.Hour)
+			}
+			if err := ps.Add(hashes[i], p); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	return ps, hashes, peerIDs
+}
 
 func BenchmarkGetTorrent(b *testing.B) {
+	ts := memory.NewTorrentStore()
+	t := store.GenerateTestTorrent()
+	if err := ts.Add(t); err != nil {
+		b.Fatal(err)
+	}
+	var torrent store.Torrent
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ts.Get(&torrent, t.InfoHash, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPeerStoreGet(b *testing.B) {
+	ps, hashes, peerIDs := newBenchPeerStore(b)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		var p store.Peer
+		for pb.Next() {
+			_ = ps.Get(&p, hashes[r.Intn(len(hashes))], peerIDs[r.Intn(len(peerIDs))])
+		}
+	})
+}
+
+func BenchmarkPeerStoreAdd(b *testing.B) {
+	ps, hashes, _ := newBenchPeerStore(b)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for pb.Next() {
+			_ = ps.Add(hashes[r.Intn(len(hashes))], store.GenerateTestPeer())
+		}
+	})
+}
+
+// BenchmarkPeerStoreAnnounceDuringReap measures announce lookups and updates while the
+// reaper and batch syncs run in the background every millisecond
+func BenchmarkPeerStoreAnnounceDuringReap(b *testing.B) {
+	ps, hashes, peerIDs := newBenchPeerStore(b)
+	var stop int32
+	done := make(chan struct{})
+	go func() {
+		batch := make(map[store.PeerHash]store.PeerStats)
+		for i := 0; i < 1000; i++ {
+			batch[store.NewPeerHash(hashes[i%len(hashes)], peerIDs[i%len(peerIDs)])] =
+				store.PeerStats{Hist: []store.AnnounceHist{{Uploaded: 1, Timestamp: time.Now()}}}
+		}
+		for atomic.LoadInt32(&stop) == 0 {
+			ps.Reap()
+			_ = ps.Sync(batch)
+			time.Sleep(time.Millisecond)
+		}
+		close(done)
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		var p store.Peer
+		for pb.Next() {
+			ih := hashes[r.Intn(len(hashes))]
+			if err := ps.Get(&p, ih, peerIDs[1+r.Intn(len(peerIDs)-1)]); err == nil {
+				p.AnnounceLast = time.Now()
+				_ = ps.Update(ih, p)
+			}
+		}
+	})
+	b.StopTimer()
+	atomic.StoreInt32(&stop, 1)
+	<-done
+}
+
+func BenchmarkPeerStoreReap(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		ps, _, _ := newBenchPeerStore(b)
+		b.StartTimer()
+		ps.Reap()
+	}
+}
 
+// BenchmarkPeerStoreMemory reports the heap bytes retained per peer in the memory store.
+// Each peer is built with its own addresses and strings as it would be by an announce.
+func BenchmarkPeerStoreMemory(b *testing.B) {
+	const peers = 100000
+	hashes := make([]store.InfoHash, peers/benchPeersPerSwarm)
+	for i := range hashes {
+		hashes[i] = store.GenerateTestTorrent().InfoHash
+	}
+	peerIDs := make([]store.PeerID, peers)
+	for i := range peerIDs {
+		peerIDs[i] = store.GenerateTestPeer().PeerID
+	}
+	clients := []string{"qBittorrent/4.2.5", "Transmission/3.00", "rtorrent/0.9.8"}
+	asNames := []string{"COMCAST-7922", "OVH SAS", "HETZNER-AS"}
+	var before, after runtime.MemStats
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		ps := memory.NewPeerStore()
+		for j, peerID := range peerIDs {
+			p := store.NewPeer(uint32(j), peerID, net.IPv4(10, 0, byte(j>>8), byte(j)),
+				net.ParseIP(fmt.Sprintf("2001:db8::%x", j)), uint16(j))
+			p.Client = string([]byte(clients[j%len(clients)]))
+			p.AS = string([]byte(asNames[j%len(asNames)]))
+			p.CountryCode = string([]byte("CA"))
+			_ = ps.Add(hashes[j%len(hashes)], p)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/peers, "bytes/peer")
+		runtime.KeepAlive(ps)
+	}
 }
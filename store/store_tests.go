@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"errors"
 	"github.com/leighmacdonald/mika/consts"
 	"github.com/leighmacdonald/mika/util"
@@ -22,6 +23,7 @@ func GenerateTestUser() User {
 		Downloaded:      1000,
 		Uploaded:        2000,
 		Announces:       500,
+		Class:           "user",
 	}
 }
 
@@ -43,20 +45,23 @@ func GenerateTestPeer() Peer {
 		uint32(rand.Intn(1000000)),
 		ih,
 		net.ParseIP("1.2.3.4"),
+		nil,
 		uint16(rand.Intn(60000)))
 	return p
 }
 
-func findPeer(swarm Swarm, p1 Peer) (Peer, error) {
-	p, found := swarm.Peers[p1.PeerID]
-	if !found {
-		return Peer{}, errors.New("unknown peer")
+func findPeer(peers []Peer, p1 Peer) (Peer, error) {
+	for _, p := range peers {
+		if p.PeerID == p1.PeerID {
+			return p, nil
+		}
 	}
-	return p, nil
+	return Peer{}, errors.New("unknown peer")
 }
 
 // TestPeerStore tests the interface implementation
 func TestPeerStore(t *testing.T, ps PeerStore, ts TorrentStore, _ UserStore) {
+	require.NoError(t, ps.Ping(context.Background()))
 	torrentA := GenerateTestTorrent()
 	defer func() { _ = ts.Delete(torrentA.InfoHash, true) }()
 	require.NoError(t, ts.Add(torrentA))
@@ -69,18 +74,30 @@ func TestPeerStore(t *testing.T, ps PeerStore, ts TorrentStore, _ UserStore) {
 	for _, peer := range swarm.Peers {
 		require.NoError(t, ps.Add(torrentA.InfoHash, peer))
 	}
-	fetchedPeers, err := ps.GetN(torrentA.InfoHash, 5)
+	fetchedPeers, err := ps.GetN(torrentA.InfoHash, 5, PeerFilter{})
 	require.NoError(t, err)
-	require.Equal(t, len(swarm.Peers), len(fetchedPeers.Peers))
+	require.Equal(t, len(swarm.Peers), len(fetchedPeers))
 	for _, peer := range swarm.Peers {
-		fp, err := findPeer(swarm, peer)
+		fp, err := findPeer(fetchedPeers, peer)
 		require.NoError(t, err)
-		require.NotNil(t, fp)
 		require.Equal(t, fp.PeerID, peer.PeerID)
-		require.Equal(t, fp.IP, peer.IP)
 		require.Equal(t, fp.Port, peer.Port)
-		require.Equal(t, fp.Location, peer.Location)
 	}
+	// Limits and filters
+	sampled, err := ps.GetN(torrentA.InfoHash, 2, PeerFilter{})
+	require.NoError(t, err)
+	require.Len(t, sampled, 2)
+	excluded, err := ps.GetN(torrentA.InfoHash, 5, PeerFilter{IPv4: true, Exclude: sampled[0].PeerID})
+	require.NoError(t, err)
+	require.Len(t, excluded, 4)
+	_, err = findPeer(excluded, sampled[0])
+	require.Error(t, err, "Excluded peer returned")
+	ipv6, err := ps.GetN(torrentA.InfoHash, 5, PeerFilter{IPv6: true})
+	require.NoError(t, err)
+	require.Len(t, ipv6, 0, "IPv4 only peers returned for ipv6 filter")
+	encrypted, err := ps.GetN(torrentA.InfoHash, 5, PeerFilter{CryptoLevel: consts.Required})
+	require.NoError(t, err)
+	require.Len(t, encrypted, 0, "Unencrypted peers returned for required crypto filter")
 	if len(swarm.Peers) < 5 {
 		t.Fatalf("Invalid peer count")
 	}
@@ -119,9 +136,8 @@ func TestPeerStore(t *testing.T, ps PeerStore, ts TorrentStore, _ UserStore) {
 		uploaded += h.Uploaded
 		downloaded += h.Downloaded
 	}
-	updatedPeers, err2 := ps.GetN(torrentA.InfoHash, 5)
-	require.NoError(t, err2)
-	p1Updated, _ := findPeer(updatedPeers, p1)
+	var p1Updated Peer
+	require.NoError(t, ps.Get(&p1Updated, torrentA.InfoHash, p1.PeerID))
 	require.Equal(t, uint32(len(hist)), p1Updated.Announces)
 	require.Equal(t, p1.TotalTime, p1Updated.TotalTime)
 	require.Equal(t, downloaded, p1Updated.Downloaded)
@@ -133,6 +149,7 @@ func TestPeerStore(t *testing.T, ps PeerStore, ts TorrentStore, _ UserStore) {
 
 // TestTorrentStore tests the interface implementation
 func TestTorrentStore(t *testing.T, ts TorrentStore) {
+	require.NoError(t, ts.Ping(context.Background()))
 	torrentA := GenerateTestTorrent()
 	require.NoError(t, ts.Add(torrentA))
 	var fetchedTorrent Torrent
@@ -140,6 +157,9 @@ func TestTorrentStore(t *testing.T, ts TorrentStore) {
 	require.Equal(t, torrentA.InfoHash, fetchedTorrent.InfoHash)
 	require.Equal(t, torrentA.IsDeleted, fetchedTorrent.IsDeleted)
 	require.Equal(t, torrentA.IsEnabled, fetchedTorrent.IsEnabled)
+	hashes, err := ts.InfoHashes()
+	require.NoError(t, err)
+	require.Contains(t, hashes, torrentA.InfoHash)
 	batch := map[InfoHash]TorrentStats{
 		torrentA.InfoHash: {
 			Seeders:    rand.Intn(100000),
@@ -176,10 +196,36 @@ func TestTorrentStore(t *testing.T, ts TorrentStore) {
 	require.NoError(t, ts.WhiteListDelete(wlClients[0]))
 	clientsUpdated, _ := ts.WhiteListGetAll()
 	require.Equal(t, len(wlClients)-1, len(clientsUpdated))
+
+	banA, _ := NewBan("10.0.0.0/8", "Bad network", "admin", 0)
+	banB, _ := NewBan("2600::1", "Bad host", "admin", time.Hour)
+	for _, b := range []Ban{banA, banB} {
+		require.NoError(t, ts.BanAdd(b))
+	}
+	bans, errBans := ts.BanGetAll()
+	require.NoError(t, errBans)
+	require.Equal(t, 2, len(bans))
+	for _, b := range bans {
+		switch b.CIDR {
+		case banA.CIDR:
+			require.Equal(t, banA.Reason, b.Reason)
+			require.True(t, b.Expires.IsZero())
+		case banB.CIDR:
+			require.Equal(t, banB.CreatedBy, b.CreatedBy)
+			require.WithinDuration(t, banB.Expires, b.Expires, time.Second)
+		default:
+			t.Fatalf("Unexpected ban returned: %s", b.CIDR)
+		}
+	}
+	require.NoError(t, ts.BanDelete(banA))
+	bansUpdated, _ := ts.BanGetAll()
+	require.Equal(t, 1, len(bansUpdated))
+	require.True(t, errors.Is(ts.BanDelete(banA), consts.ErrInvalidBan))
 }
 
 // TestUserStore tests the user store for conformance to our interface
 func TestUserStore(t *testing.T, s UserStore) {
+	require.NoError(t, s.Ping(context.Background()))
 	var users []User
 	for i := 0; i < 5; i++ {
 		users = append(users, GenerateTestUser())
@@ -221,6 +267,34 @@ func TestUserStore(t *testing.T, s UserStore) {
 	require.Equal(t, newUser.Downloaded, fetchedNewUser.Downloaded)
 	require.Equal(t, newUser.Uploaded, fetchedNewUser.Uploaded)
 	require.Equal(t, newUser.Announces, fetchedNewUser.Announces)
+	require.Equal(t, newUser.Class, fetchedNewUser.Class)
+}
+
+// TestInvalidationBus checks that a message published on pub is delivered intact to the
+// subscriber of sub
+func TestInvalidationBus(t *testing.T, pub InvalidationBus, sub InvalidationBus) {
+	received := make(chan InvalidationMsg, 1)
+	require.NoError(t, sub.Subscribe(func(msg InvalidationMsg) {
+		received <- msg
+	}))
+	require.Error(t, sub.Subscribe(func(msg InvalidationMsg) {}), "Subscribed twice")
+	msg := InvalidationMsg{
+		Node: "node-a",
+		Items: []Invalidation{
+			{Kind: InvalidateTorrent, Action: ActionEvict, Key: GenerateTestTorrent().InfoHash.String()},
+			{Kind: InvalidateUser, Action: ActionRefresh, Key: GenerateTestUser().Passkey},
+			{Kind: InvalidateWhitelist, Action: ActionRefresh},
+		},
+	}
+	require.NoError(t, pub.Publish(msg))
+	select {
+	case got := <-received:
+		require.Equal(t, msg, got)
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Timed out waiting for invalidation message")
+	}
+	require.NoError(t, sub.Close())
+	require.NoError(t, pub.Close())
 }
 
 func init() {
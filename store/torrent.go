@@ -42,6 +42,14 @@ func (ph PeerHash) PeerID() PeerID {
 	return buf
 }
 
+// ReapedPeer is a peer removed from its swarm by PeerStore.Reap. Seeder is set when the
+// peer had nothing left to download, or was paused, so the torrent seeder count is
+// decremented rather than the leechers.
+type ReapedPeer struct {
+	PeerHash
+	Seeder bool
+}
+
 // InfoHash is a unique 20byte identifier for a torrent
 type InfoHash [20]byte
 
@@ -11,6 +11,8 @@ type User struct {
 	Downloaded      uint64 `json:"downloaded"`
 	Uploaded        uint64 `json:"uploaded"`
 	Announces       uint32 `json:"announces"`
+	// Class is the user class (group) used to select per-class policy overrides
+	Class string `db:"class" json:"class"`
 }
 
 // Valid performs basic validation of the user info ensuring we have the minimum required
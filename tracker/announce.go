@@ -5,6 +5,7 @@ import (
 	"github.com/chihaya/bencode"
 	"github.com/gin-gonic/gin"
 	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/geo"
 	"github.com/leighmacdonald/mika/metrics"
 	"github.com/leighmacdonald/mika/store"
 	"github.com/leighmacdonald/mika/util"
@@ -65,8 +66,8 @@ type announceRequest struct {
 	// it only if the IP address that the request came in on is in RFC1918 space. Others honor it
 	// unconditionally, while others ignore it completely. In case of IPv6 address (e.g.: 2001:db8:1:2::100)
 	// it indicates only that client can communicate via IPv6.
-	IP   net.IP
-	IPv6 bool
+	IPv4 net.IP
+	IPv6 net.IP
 	// urlencoded 20-byte SHA1 hash of the value of the info key from the Metainfo file. Note that the
 	// value will be a bencoded dictionary, given the definition of the info key above.
 	InfoHash store.InfoHash
@@ -116,14 +117,25 @@ func (h *BitTorrentHandler) newAnnounce(c *gin.Context) (*announceRequest, errCo
 	if !exists || len(peerID) != 20 {
 		return nil, msgInvalidPeerID
 	}
-	ipAddr, ipv6, err2 := getIP(q, h.tracker.AllowClientIP, c)
+	ipv4, ipv6, err2 := getIP(q, h.tracker.AllowClientIP, h.tracker.TrustedProxies, h.tracker.ProxyHeader, c)
 	if err2 != nil {
 		log.Errorf("Failed to parse client ip: %s", c.Request.RemoteAddr)
 		return nil, msgMalformedRequest
 	}
-	if !h.tracker.AllowNonRoutable && util.IsPrivateIP(ipAddr) {
-		log.Warnf("Attempt to use non-routable IP value: %s", ipAddr.String())
-		return nil, msgMalformedRequest
+	if !h.tracker.IPv6 {
+		ipv6 = nil
+	}
+	if h.tracker.IPv6Only {
+		ipv4 = nil
+	}
+	if ipv4 == nil && ipv6 == nil {
+		return nil, msgUnsupportedAddr
+	}
+	for _, ipAddr := range []net.IP{ipv4, ipv6} {
+		if ipAddr != nil && !h.tracker.AllowNonRoutable && util.IsPrivateIP(ipAddr) {
+			log.Warnf("Attempt to use non-routable IP value: %s", ipAddr.String())
+			return nil, msgMalformedRequest
+		}
 	}
 	port := getUint16Key(q, paramPort, 0)
 	if port < 1024 {
@@ -141,8 +153,8 @@ func (h *BitTorrentHandler) newAnnounce(c *gin.Context) (*announceRequest, errCo
 		Corrupt:     getUint32Key(q, paramCorrupt, 0),
 		Downloaded:  getUint32Key(q, paramDownloaded, 0),
 		Event:       consts.ParseAnnounceType(q.Params[paramEvent]),
+		IPv4:        ipv4,
 		IPv6:        ipv6,
-		IP:          ipAddr,
 		InfoHash:    infoHash,
 		Left:        getUint32Key(q, paramLeft, 0),
 		NumWant:     getUintKey(q, paramNumWant, 30),
@@ -164,9 +176,12 @@ func (h *BitTorrentHandler) announce(c *gin.Context) {
 	atomic.AddInt64(&metrics.AnnounceTotal, 1)
 	pk := c.Param("passkey")
 	var usr store.User
-	if valid := h.tracker.preFlightChecks(&usr, pk, c); !valid {
-		oops(c, msgInvalidAuth)
-		atomic.AddInt64(&metrics.AnnounceStatusUnauthorized, 1)
+	if code := h.tracker.preFlightChecks(&usr, pk, c); code != msgOk {
+		if code == msgBanned {
+			atomic.AddInt64(&metrics.AnnounceStatusBanned, 1)
+		} else {
+			atomic.AddInt64(&metrics.AnnounceStatusUnauthorized, 1)
+		}
 		return
 	}
 	// Parse the announce into an announceRequest
@@ -176,6 +191,16 @@ func (h *BitTorrentHandler) announce(c *gin.Context) {
 		atomic.AddInt64(&metrics.AnnounceStatusMalformed, 1)
 		return
 	}
+	event := string(req.Event)
+	if req.Event == consts.ANNOUNCE {
+		event = "announce"
+	}
+	metrics.AnnounceEvents.Inc(event)
+	client := store.ClientString(req.PeerID).Name
+	if client == "" {
+		client = "unknown"
+	}
+	metrics.AnnounceClients.Inc(client)
 	if !h.tracker.ClientWhitelisted(req.PeerID) {
 		oops(c, msgBadClient)
 		return
@@ -217,7 +242,7 @@ func (h *BitTorrentHandler) announce(c *gin.Context) {
 	if err != nil {
 		if err == consts.ErrInvalidPeerID {
 			// Create a new peer for the swarm
-			peer = store.NewPeer(usr.UserID, req.PeerID, req.IP, req.Port)
+			peer = store.NewPeer(usr.UserID, req.PeerID, req.IPv4, req.IPv6, req.Port)
 			// Dont add download/upload stats because they would be doubled if applied in the
 			// state update. Left is set because its always a static value being set and a (safe) data race
 			// can occur for counting seeder/leecher states
@@ -225,11 +250,15 @@ func (h *BitTorrentHandler) announce(c *gin.Context) {
 			peer.Left = req.Left
 			// TODO allow this to be updated in the perm storage when a client changes settings
 			peer.CryptoLevel = req.CryptoLevel
-			l := h.tracker.Geodb.GetLocation(peer.IP)
+			l := h.tracker.Geodb.GetLocation(peer.Addr())
 			peer.Location = l.LatLong
 			peer.ASN = l.ASN
 			peer.AS = l.AS
 			peer.CountryCode = l.ISOCode
+			if res := h.tracker.GeoPolicyCheck(usr, l, req.Left > 0); !res.Allowed {
+				geoDenied(c, res)
+				return
+			}
 			if err := h.tracker.PeerAdd(tor.InfoHash, peer); err != nil {
 				log.Errorf("Failed to insert peer into swarm: %s", err.Error())
 				oops(c, msgGenericError)
@@ -240,26 +269,37 @@ func (h *BitTorrentHandler) announce(c *gin.Context) {
 			return
 		}
 	} else {
+		loc := geo.Location{ISOCode: peer.CountryCode, ASN: peer.ASN, AS: peer.AS}
+		if res := h.tracker.GeoPolicyCheck(usr, loc, req.Left > 0); !res.Allowed {
+			geoDenied(c, res)
+			return
+		}
 		peer.AnnounceLast = time.Now()
 	}
-	peers, err2 := h.tracker.PeerGetN(tor.InfoHash, h.tracker.MaxPeers)
+	peers, err2 := h.tracker.PeerGetN(tor.InfoHash, h.tracker.MaxPeers, store.PeerFilter{
+		IPv4:        req.IPv4 != nil,
+		IPv6:        req.IPv6 != nil,
+		CryptoLevel: req.CryptoLevel,
+		Exclude:     peer.PeerID,
+	})
 	if err2 != nil {
 		log.Errorf("Could not read peers from swarm: %s", err2.Error())
 		oops(c, msgGenericError)
 		return
 	}
+	interval, minInterval := h.tracker.announceInterval()
 	dict := bencode.Dict{
 		"complete":     tor.Seeders,
 		"incomplete":   tor.Leechers,
-		"interval":     int(h.tracker.AnnInterval.Seconds()),
-		"min interval": int(h.tracker.AnnIntervalMin.Seconds()),
+		"interval":     int(interval.Seconds()),
+		"min interval": int(minInterval.Seconds()),
 	}
-	// TODO IP.To16() != nil validation for v4 in v6 addresses
-	if !req.IPv6 || (req.IPv6 && !h.tracker.IPv6Only) {
-		dict["peers"] = makeCompactPeers(peers, peer.PeerID, false, req.CryptoLevel)
+	// Dual-stack peers receive both peer lists
+	if req.IPv4 != nil {
+		dict["peers"] = makeCompactPeers(peers, false)
 	}
-	if req.IPv6 {
-		dict["peers6"] = makeCompactPeers(peers, peer.PeerID, true, req.CryptoLevel)
+	if req.IPv6 != nil {
+		dict["peers6"] = makeCompactPeers(peers, true)
 	}
 	var outBytes bytes.Buffer
 	if err := bencode.NewEncoder(&outBytes).Encode(dict); err != nil {
@@ -269,7 +309,7 @@ func (h *BitTorrentHandler) announce(c *gin.Context) {
 	c.Data(int(msgOk), gin.MIMEPlain, outBytes.Bytes())
 	// Send state to another go channel for updating outside of the announce request
 	// so that we can respond asap
-	h.tracker.StateUpdateChan <- store.UpdateState{
+	h.tracker.enqueue(store.UpdateState{
 		Passkey:    pk,
 		InfoHash:   tor.InfoHash,
 		PeerID:     peer.PeerID,
@@ -279,35 +319,30 @@ func (h *BitTorrentHandler) announce(c *gin.Context) {
 		Event:      req.Event,
 		Timestamp:  time.Now(),
 		Paused:     peer.Paused,
-	}
+	})
 	atomic.AddInt64(&metrics.AnnounceStatusOK, 1)
 	metrics.AddAnnounceTime(time.Since(start).Nanoseconds())
 }
 
+// geoDenied sends the geo policy failure reason to the client
+func geoDenied(c *gin.Context, res geo.Result) {
+	log.Debugf("Geo policy rule %s denied %s", res.Rule, c.Request.RemoteAddr)
+	c.Data(int(msgGeoDenied), gin.MIMEPlain, responseError(res.Reason))
+}
+
 // Generate a compact peer field array containing the byte representations
-// of a peers IP+Port appended to each other
-func makeCompactPeers(swarm store.Swarm, skipID store.PeerID, v6 bool, cl consts.CryptoLevel) []byte {
+// of a peers IP+Port appended to each other. The peers have already been filtered
+// by the store so only the address family is checked.
+func makeCompactPeers(peers []store.Peer, v6 bool) []byte {
 	var buf bytes.Buffer
-	swarm.RLock()
-	for _, peer := range swarm.Peers {
-		if cl == consts.Required {
-			if !(peer.CryptoLevel == consts.Required || peer.CryptoLevel == consts.Supported) {
-				continue
-			}
-		}
-		if peer.PeerID == skipID {
-			// Skip the peers own peer_id
-			continue
-		}
-		if v6 && peer.IPv6 {
-			buf.Write(peer.IP.To16())
+	for _, peer := range peers {
+		if v6 && peer.IPv6 != nil {
+			buf.Write(peer.IPv6.To16())
 			buf.Write([]byte{byte(peer.Port >> 8), byte(peer.Port & 0xff)})
-		} else if !v6 && !peer.IPv6 {
-			buf.Write(peer.IP.To4())
+		} else if !v6 && peer.IPv4 != nil {
+			buf.Write(peer.IPv4.To4())
 			buf.Write([]byte{byte(peer.Port >> 8), byte(peer.Port & 0xff)})
 		}
-
 	}
-	swarm.RUnlock()
 	return buf.Bytes()
 }
@@ -13,6 +13,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -59,6 +60,7 @@ func (a *AdminAPI) whitelistAdd(c *gin.Context) {
 	a.t.Lock()
 	a.t.Whitelist[wcl.ClientPrefix] = wcl
 	a.t.Unlock()
+	a.t.publish([]store.Invalidation{{Kind: store.InvalidateWhitelist, Action: store.ActionRefresh}})
 	c.JSON(http.StatusOK, nil)
 }
 
@@ -87,6 +89,7 @@ func (a *AdminAPI) whitelistDelete(c *gin.Context) {
 	a.t.Lock()
 	a.t.Whitelist = newWL
 	a.t.Unlock()
+	a.t.publish([]store.Invalidation{{Kind: store.InvalidateWhitelist, Action: store.ActionRefresh}})
 	c.JSON(http.StatusOK, nil)
 }
 
@@ -100,6 +103,60 @@ func (a *AdminAPI) whitelistGet(c *gin.Context) {
 	c.JSON(http.StatusOK, wl)
 }
 
+func (a *AdminAPI) banAdd(c *gin.Context) {
+	var ban store.Ban
+	if err := c.BindJSON(&ban); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, StatusResp{Err: "Malformed request"})
+		return
+	}
+	network, err := store.ParseBanCIDR(ban.CIDR)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, StatusResp{Err: err.Error()})
+		return
+	}
+	ban.CIDR = network.String()
+	if ban.CreatedOn.IsZero() {
+		ban.CreatedOn = time.Now()
+	}
+	if err := a.t.torrents.BanAdd(ban); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to add ban"})
+		return
+	}
+	if err := a.t.Bans.Add(ban); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: err.Error()})
+		return
+	}
+	a.t.publish([]store.Invalidation{{Kind: store.InvalidateBans, Action: store.ActionRefresh}})
+	c.JSON(http.StatusOK, StatusResp{Message: "Ban added successfully"})
+}
+
+func (a *AdminAPI) banDelete(c *gin.Context) {
+	network, err := store.ParseBanCIDR(strings.TrimPrefix(c.Param("cidr"), "/"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, StatusResp{Err: err.Error()})
+		return
+	}
+	if err := a.t.torrents.BanDelete(store.Ban{CIDR: network.String()}); err != nil {
+		if errors.Is(err, consts.ErrInvalidBan) {
+			c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: "Ban not found"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to delete ban"})
+		return
+	}
+	a.t.Bans.Delete(network.String())
+	a.t.publish([]store.Invalidation{{Kind: store.InvalidateBans, Action: store.ActionRefresh}})
+	c.JSON(http.StatusOK, StatusResp{Message: "Ban deleted successfully"})
+}
+
+func (a *AdminAPI) banGet(c *gin.Context) {
+	bans := a.t.Bans.All()
+	if bans == nil {
+		bans = []store.Ban{}
+	}
+	c.JSON(http.StatusOK, bans)
+}
+
 func (a *AdminAPI) ping(c *gin.Context) {
 	var r PingRequest
 	if err := c.BindJSON(&r); err != nil {
@@ -163,7 +220,7 @@ func (a *AdminAPI) torrentAdd(c *gin.Context) {
 	} else {
 		t.MultiDn = req.MultiDn
 	}
-	if err := a.t.torrents.Add(t); err != nil {
+	if err := a.t.TorrentAdd(t); err != nil {
 		if errors.Is(err, consts.ErrDuplicate) {
 			c.AbortWithStatusJSON(http.StatusConflict, StatusResp{
 				Err: err.Error(),
@@ -181,7 +238,7 @@ func (a *AdminAPI) torrentDelete(c *gin.Context) {
 	if !infoHashFromCtx(&infoHash, c, true) {
 		return
 	}
-	if err := a.t.torrents.Delete(infoHash, true); err != nil {
+	if err := a.t.TorrentDelete(infoHash, true); err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{})
 		return
 	}
@@ -238,6 +295,7 @@ func (a *AdminAPI) torrentUpdate(c *gin.Context) {
 	if err := a.t.torrents.Update(t); err != nil {
 		c.JSON(http.StatusBadRequest, StatusResp{Err: err.Error()})
 	} else {
+		a.t.InvalidateTorrent(ih)
 		c.JSON(http.StatusOK, StatusResp{Message: "Updated successfully"})
 	}
 }
@@ -266,6 +324,7 @@ func (a *AdminAPI) userUpdate(c *gin.Context) {
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	a.t.InvalidateUser(passkey, update.Passkey)
 	c.AbortWithStatus(http.StatusOK)
 }
 
@@ -285,6 +344,7 @@ func (a *AdminAPI) userDelete(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: "Failed to delete user"})
 		return
 	}
+	a.t.InvalidateUser(user.Passkey)
 	c.JSON(http.StatusOK, StatusResp{Message: "Deleted user successfully"})
 }
 
@@ -297,7 +357,7 @@ func (a *AdminAPI) userAdd(c *gin.Context) {
 	if user.Passkey == "" {
 		user.Passkey = util.NewPasskey()
 	}
-	if err := a.t.users.Add(user); err != nil {
+	if err := a.t.UserAdd(user); err != nil {
 		log.Error(err)
 		c.AbortWithStatusJSON(http.StatusBadRequest, StatusResp{Err: "Failed to add user"})
 		return
@@ -438,7 +498,22 @@ func (a *AdminAPI) configUpdate(c *gin.Context) {
 
 func (a *AdminAPI) metrics(c *gin.Context) {
 	stats := metrics.Get()
-	c.String(200, stats.String())
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(stats.String()))
+}
+
+// stats returns the current global tracker stats
+func (a *AdminAPI) stats(c *gin.Context) {
+	c.JSON(http.StatusOK, a.t.Stats())
+}
+
+// latencyGet returns the announce latency quantiles of the current window
+func (a *AdminAPI) latencyGet(c *gin.Context) {
+	c.JSON(http.StatusOK, metrics.AnnounceLatency.Snapshot())
+}
+
+// latencyReset closes the current announce latency window returning its quantiles
+func (a *AdminAPI) latencyReset(c *gin.Context) {
+	c.JSON(http.StatusOK, metrics.AnnounceLatency.Reset())
 }
 
 // NewAPIHandler configures a router to handle API requests
@@ -447,7 +522,12 @@ func NewAPIHandler(tkr *Tracker) *gin.Engine {
 	h := AdminAPI{t: tkr}
 
 	r.GET("/metrics", h.metrics)
+	r.GET("/metrics/latency", h.latencyGet)
+	r.DELETE("/metrics/latency", h.latencyReset)
+	r.GET("/stats", h.stats)
 
+	r.GET("/healthz", healthz)
+	r.GET("/readyz", tkr.readyz)
 	r.POST("/ping", h.ping)
 	r.PATCH("/config", h.configUpdate)
 	r.GET("/config", h.configGet)
@@ -463,6 +543,10 @@ func NewAPIHandler(tkr *Tracker) *gin.Engine {
 	r.POST("/whitelist", h.whitelistAdd)
 	r.DELETE("/whitelist/:prefix", h.whitelistDelete)
 	r.GET("/whitelist", h.whitelistGet)
+
+	r.POST("/ban", h.banAdd)
+	r.DELETE("/ban/*cidr", h.banDelete)
+	r.GET("/ban", h.banGet)
 	r.NoRoute(noRoute)
 	return r
 }
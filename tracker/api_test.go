@@ -2,14 +2,17 @@ package tracker
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/leighmacdonald/mika/config"
 	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/metrics"
 	"github.com/leighmacdonald/mika/store"
 	"github.com/stretchr/testify/require"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -30,6 +33,28 @@ func TestMetrics(t *testing.T) {
 	w := httptest.NewRecorder()
 	handler.ServeHTTP(w, req)
 	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Header().Get("Content-Type"), "version=0.0.4")
+	for _, family := range []string{"t_requests_total counter", "t_ann_duration_seconds histogram",
+		"t_store_duration_seconds histogram", "t_swarms gauge", "t_peers gauge"} {
+		require.Contains(t, w.Body.String(), "# TYPE "+family+"\n")
+	}
+}
+
+func TestLatency(t *testing.T) {
+	_, handler := newTestAPI()
+	metrics.AnnounceLatency.Reset()
+	metrics.AddAnnounceTime(int64(time.Millisecond))
+	var summary metrics.LatencySummary
+	w := performRequest(handler, "GET", "/metrics/latency", nil, &summary)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, uint64(1), summary.Count)
+	require.Equal(t, time.Millisecond, summary.Max)
+	w = performRequest(handler, "DELETE", "/metrics/latency", nil, &summary)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, uint64(1), summary.Count)
+	w = performRequest(handler, "GET", "/metrics/latency", nil, &summary)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, uint64(0), summary.Count)
 }
 
 func TestPing(t *testing.T) {
@@ -43,6 +68,47 @@ func TestPing(t *testing.T) {
 	require.Equal(t, http.StatusBadRequest, w2.Code)
 }
 
+func TestHealth(t *testing.T) {
+	tkr, handler := newTestAPI()
+	var health HealthResponse
+	w := performRequest(handler, "GET", "/healthz", nil, &health)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "ok", health.Status)
+
+	var rs ReadyStatus
+	w = performRequest(handler, "GET", "/readyz", nil, &rs)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.True(t, rs.Ready)
+	require.Len(t, rs.Stores, 3)
+	for _, status := range rs.Stores {
+		require.True(t, status.OK)
+		require.Equal(t, "memory", status.Driver)
+	}
+	require.Equal(t, cap(tkr.StateUpdateChan), rs.StateUpdates.Cap)
+
+	// Enabled without a loaded database
+	tkr.GeodbEnabled = true
+	w = performRequest(handler, "GET", "/readyz", nil, nil)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rs))
+	require.False(t, rs.Ready)
+	require.False(t, rs.Geo.Loaded)
+	tkr.GeodbEnabled = false
+
+	for i := 0; i < cap(tkr.StateUpdateChan); i++ {
+		tkr.StateUpdateChan <- store.UpdateState{}
+	}
+	w = performRequest(handler, "GET", "/readyz", nil, nil)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rs))
+	require.Equal(t, rs.StateUpdates.Cap, rs.StateUpdates.Len)
+
+	// Only served by the tracker router when enabled
+	require.Equal(t, http.StatusNotFound, performRequest(NewBitTorrentHandler(tkr), "GET", "/healthz", nil, nil).Code)
+	tkr.HealthEndpoints = true
+	require.Equal(t, http.StatusOK, performRequest(NewBitTorrentHandler(tkr), "GET", "/healthz", nil, nil).Code)
+}
+
 func equalUser(t *testing.T, a store.User, b store.User) {
 	require.Equal(t, a.UserID, b.UserID)
 	require.Equal(t, a.Passkey, b.Passkey)
@@ -192,6 +258,41 @@ func TestConfigUpdate(t *testing.T) {
 	require.Equal(t, args.TrackerAllowNonRoutable, tkr.AllowNonRoutable)
 }
 
+func TestBan(t *testing.T) {
+	tkr, handler := newTestAPI()
+	bt := NewBitTorrentHandler(tkr)
+	ban, err := store.NewBan("172.16.0.0/12", "Naughty network", "admin", time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, performRequest(handler, "POST", "/ban", ban, nil).Code)
+	require.Equal(t, http.StatusBadRequest, performRequest(handler, "POST", "/ban", store.Ban{CIDR: "x"}, nil).Code)
+	var bans []store.Ban
+	require.Equal(t, http.StatusOK, performRequest(handler, "GET", "/ban", nil, &bans).Code)
+	require.Equal(t, 1, len(bans))
+	require.Equal(t, ban.CIDR, bans[0].CIDR)
+	stored, err := tkr.torrents.BanGetAll()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(stored))
+
+	// performRequest always comes from 172.16.1.22
+	bannedBody := string(responseError("Banned: " + ban.Reason))
+	banned := atomic.LoadInt64(&metrics.AnnounceStatusBanned)
+	unauthorized := atomic.LoadInt64(&metrics.AnnounceStatusUnauthorized)
+	for _, path := range []string{"/scrape/12345678901234567890", "/announce/12345678901234567890"} {
+		w := performRequest(bt, "GET", path, nil, nil)
+		require.Equal(t, int(msgBanned), w.Code, path)
+		require.Equal(t, bannedBody, w.Body.String(), path)
+	}
+	require.Equal(t, banned+1, atomic.LoadInt64(&metrics.AnnounceStatusBanned))
+	require.Equal(t, unauthorized, atomic.LoadInt64(&metrics.AnnounceStatusUnauthorized))
+
+	require.Equal(t, http.StatusOK, performRequest(handler, "DELETE", "/ban/172.16.0.0/12", nil, nil).Code)
+	require.Equal(t, http.StatusNotFound, performRequest(handler, "DELETE", "/ban/172.16.0.0/12", nil, nil).Code)
+	require.Equal(t, 0, tkr.Bans.Len())
+	w2 := performRequest(bt, "GET", "/announce/12345678901234567890", nil, nil)
+	require.Equal(t, int(msgInvalidAuth), w2.Code)
+	require.Equal(t, string(responseError(responseStringMap[msgInvalidAuth].Error())), w2.Body.String())
+}
+
 func TestMain(m *testing.M) {
 	_ = config.Read("")
 	retVal := m.Run()
@@ -0,0 +1,120 @@
+package tracker
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readyTimeout is the maximum time we wait on each store to respond to a ping
+const readyTimeout = time.Second * 2
+
+// StoreStatus is the readiness of a single backing store
+type StoreStatus struct {
+	Driver  string        `json:"driver"`
+	OK      bool          `json:"ok"`
+	Latency time.Duration `json:"latency"`
+	Err     string        `json:"error,omitempty"`
+}
+
+// GeoStatus is the load state of the geo database
+type GeoStatus struct {
+	Enabled bool `json:"enabled"`
+	Loaded  bool `json:"loaded"`
+}
+
+// QueueStatus is the backlog of the state update channel waiting on the StatWorker
+type QueueStatus struct {
+	Len int `json:"len"`
+	Cap int `json:"cap"`
+}
+
+// ReadyStatus describes whether the tracker is able to serve requests. The tracker is
+// ready when all stores respond, the geo database is loaded when enabled and the state
+// update queue is not full.
+type ReadyStatus struct {
+	Ready        bool                   `json:"ready"`
+	Stores       map[string]StoreStatus `json:"stores"`
+	Geo          GeoStatus              `json:"geo"`
+	StateUpdates QueueStatus            `json:"state_updates"`
+}
+
+// HealthResponse is returned by the liveness check
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+type pinger interface {
+	Ping(ctx context.Context) error
+	Name() string
+}
+
+// Ready pings each of the backing stores concurrently and reports the readiness of
+// the tracker
+func (t *Tracker) Ready(ctx context.Context) ReadyStatus {
+	stores := map[string]pinger{
+		"torrent": t.torrents,
+		"user":    t.users,
+		"peer":    t.peers,
+	}
+	rs := ReadyStatus{
+		Ready:  true,
+		Stores: make(map[string]StoreStatus, len(stores)),
+		StateUpdates: QueueStatus{
+			Len: len(t.StateUpdateChan),
+			Cap: cap(t.StateUpdateChan),
+		},
+	}
+	mu := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for kind, s := range stores {
+		wg.Add(1)
+		go func(kind string, s pinger) {
+			defer wg.Done()
+			c, cancel := context.WithTimeout(ctx, readyTimeout)
+			defer cancel()
+			start := time.Now()
+			err := s.Ping(c)
+			status := StoreStatus{Driver: s.Name(), OK: err == nil, Latency: time.Since(start)}
+			if err != nil {
+				status.Err = err.Error()
+			}
+			mu.Lock()
+			rs.Stores[kind] = status
+			mu.Unlock()
+		}(kind, s)
+	}
+	wg.Wait()
+	for _, status := range rs.Stores {
+		if !status.OK {
+			rs.Ready = false
+		}
+	}
+	t.RLock()
+	rs.Geo = GeoStatus{Enabled: t.GeodbEnabled, Loaded: t.Geodb != nil && t.Geodb.Loaded()}
+	t.RUnlock()
+	if rs.Geo.Enabled && !rs.Geo.Loaded {
+		rs.Ready = false
+	}
+	if rs.StateUpdates.Cap > 0 && rs.StateUpdates.Len >= rs.StateUpdates.Cap {
+		rs.Ready = false
+	}
+	return rs
+}
+
+// healthz is the liveness check, it only confirms the process is serving requests
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// readyz is the readiness check, responding with 503 when the tracker is not ready
+func (t *Tracker) readyz(c *gin.Context) {
+	rs := t.Ready(c.Request.Context())
+	code := http.StatusOK
+	if !rs.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, rs)
+}
@@ -3,15 +3,19 @@ package tracker
 import (
 	"bytes"
 	"crypto/tls"
+	"fmt"
 	"github.com/chihaya/bencode"
 	"github.com/gin-gonic/gin"
 	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/metrics"
 	"github.com/leighmacdonald/mika/store"
+	"github.com/leighmacdonald/mika/util"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/toorop/gin-logrus"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -24,6 +28,7 @@ const (
 	msgMissingPeerID        errCode = 102
 	msgMissingPort          errCode = 103
 	msgInvalidPort          errCode = 104
+	msgUnsupportedAddr      errCode = 105
 	msgInvalidInfoHash      errCode = 150
 	msgInvalidPeerID        errCode = 151
 	msgInvalidNumWant       errCode = 152
@@ -31,6 +36,8 @@ const (
 	msgOk                   errCode = 200
 	msgInfoHashNotFound     errCode = 480
 	msgInvalidAuth          errCode = 490
+	msgBanned               errCode = 491
+	msgGeoDenied            errCode = 492
 	msgClientRequestTooFast errCode = 500
 	msgGenericError         errCode = 900
 	msgMalformedRequest     errCode = 901
@@ -45,7 +52,10 @@ var (
 		msgMissingPeerID:        errors.New("peer_id missing from request"),
 		msgMissingPort:          errors.New("port missing from request"),
 		msgInvalidPort:          errors.New("Invalid port"),
+		msgUnsupportedAddr:      errors.New("Unsupported address family"),
 		msgInvalidAuth:          errors.New("Invalid passkey"),
+		msgBanned:               errors.New("Banned"),
+		msgGeoDenied:            errors.New("Location not permitted"),
 		msgInvalidInfoHash:      errors.New("Invalid info hash"),
 		msgInvalidPeerID:        errors.New("Peer ID invalid"),
 		msgInvalidNumWant:       errors.New("num_want invalid"),
@@ -64,44 +74,182 @@ func Err(code errCode) error {
 	return responseStringMap[code]
 }
 
-// getIP Parses and returns a IP from a query
-// If a IP header exists, it will be used instead of the client provided query parameter
-// If no query IP is provided, the
-func getIP(q *query, allowClientIP bool, c *gin.Context) (net.IP, bool, error) {
-	if allowClientIP {
-		for i, k := range [3]announceParam{paramIP, paramIPv4, paramIPv6} {
-			// Use client provided IP
+// getIP returns the ipv4 and ipv6 addresses of the client. The address the request came
+// from is always used for its own family, the other family is filled in from the ipv4 or
+// ipv6 query parameter (BEP 7) so dual-stack peers are recorded under both addresses.
+// When allowClientIP is set the ip, ipv4 and ipv6 parameters may also replace the
+// address the request came from.
+func getIP(q *query, allowClientIP bool, trustedProxies []*net.IPNet, proxyHeader string, c *gin.Context) (net.IP, net.IP, error) {
+	var ipv4, ipv6 net.IP
+	if addr := remoteAddr(trustedProxies, proxyHeader, c); addr != nil {
+		ipv4, ipv6, _ = splitFamily(addr)
+	}
+	if q != nil {
+		params := []announceParam{paramIPv4, paramIPv6}
+		if allowClientIP {
+			params = []announceParam{paramIP, paramIPv4, paramIPv6}
+		}
+		var clientIPv4, clientIPv6 net.IP
+		for _, k := range params {
 			ipStr, found := q.Params[k]
-			if found {
-				switch i {
-				case 0:
-					return net.ParseIP(ipStr), false, nil
-				case 1:
-					return net.ParseIP(ipStr), false, nil
-				case 2:
-					return net.ParseIP(ipStr), true, nil
+			if !found {
+				continue
+			}
+			addr := parseIP(ipStr)
+			if addr == nil {
+				continue
+			}
+			if v4 := addr.To4(); v4 != nil {
+				if k != paramIPv6 {
+					clientIPv4 = v4
 				}
-
+			} else if k != paramIPv4 {
+				clientIPv6 = addr
 			}
 		}
-	}
-	// Look for forwarded ip in headers
-	for _, header := range []string{"X-Real-IP", "X-Forwarded-For"} {
-		if headerIP := c.Request.Header.Get(header); headerIP != "" {
-			addr := net.ParseIP(headerIP)
-			return addr, strings.Count(headerIP, ":") > 1, nil
+		if clientIPv4 != nil && (allowClientIP || ipv4 == nil) {
+			ipv4 = clientIPv4
 		}
+		if clientIPv6 != nil && (allowClientIP || ipv6 == nil) {
+			ipv6 = clientIPv6
+		}
+	}
+	if ipv4 == nil && ipv6 == nil {
+		return nil, nil, consts.ErrInvalidClient
 	}
+	return ipv4, ipv6, nil
+}
+
+// The forwarding headers which can be used as the ProxyHeader, in canonical form
+const (
+	headerForwarded     = "Forwarded"
+	headerXForwardedFor = "X-Forwarded-For"
+	headerXRealIP       = "X-Real-Ip"
+)
+
+// validProxyHeader returns true if the header is one getIP knows how to parse
+func validProxyHeader(header string) bool {
+	switch http.CanonicalHeaderKey(header) {
+	case headerForwarded, headerXForwardedFor, headerXRealIP:
+		return true
+	default:
+		return false
+	}
+}
+
+// remoteAddr returns the address of the client. Requests from a trusted proxy are
+// resolved using only the proxyHeader, which is walked from the right past any trusted
+// hops. Other forwarding headers are never read as a client behind the proxy could
+// have sent them itself. The proxy address is returned if the header is missing or
+// its client hop is invalid or unknown.
+func remoteAddr(trustedProxies []*net.IPNet, proxyHeader string, c *gin.Context) net.IP {
 	httpAddr, _, _ := net.SplitHostPort(c.Request.RemoteAddr)
-	for i := 0; i < len(httpAddr); i++ {
-		switch httpAddr[i] {
-		case '.':
-			return net.ParseIP(httpAddr), false, nil
-		case ':':
-			return net.ParseIP(httpAddr), true, nil
+	remoteIP := net.ParseIP(httpAddr)
+	if remoteIP == nil || proxyHeader == "" || !util.ContainsIP(trustedProxies, remoteIP) {
+		// Forwarding headers are only honored when set by a trusted proxy
+		return remoteIP
+	}
+	values := c.Request.Header.Values(proxyHeader)
+	if len(values) == 0 {
+		return remoteIP
+	}
+	var hops []net.IP
+	if http.CanonicalHeaderKey(proxyHeader) == headerForwarded {
+		hops = parseForwarded(strings.Join(values, ","))
+	} else {
+		for _, hop := range strings.Split(strings.Join(values, ","), ",") {
+			hops = append(hops, parseIP(strings.TrimSpace(hop)))
 		}
 	}
-	return net.IP{}, false, consts.ErrInvalidClient
+	if addr := firstUntrusted(hops, trustedProxies); addr != nil {
+		return addr
+	}
+	return remoteIP
+}
+
+// firstUntrusted walks a proxy chain from right (closest hop) to left returning
+// the first address which is not one of our trusted proxies. If every hop is trusted
+// the left-most (originating) address is returned. A nil value is returned if the chain
+// contains an invalid or unknown hop before an untrusted address is found.
+func firstUntrusted(hops []net.IP, trustedProxies []*net.IPNet) net.IP {
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i] == nil {
+			return nil
+		}
+		if i == 0 || !util.ContainsIP(trustedProxies, hops[i]) {
+			return hops[i]
+		}
+	}
+	return nil
+}
+
+// parseForwarded parses the RFC 7239 Forwarded header returning the for= address
+// of each forwarded element in the order they were appended. Obfuscated identifiers and
+// "unknown" values are returned as nil entries.
+//
+//	Forwarded: for=192.0.2.60;proto=http;by=203.0.113.43, for="[2001:db8:cafe::17]:4711"
+func parseForwarded(header string) []net.IP {
+	var hops []net.IP
+	for _, element := range splitQuoted(header, ',') {
+		if strings.TrimSpace(element) == "" {
+			continue
+		}
+		var addr net.IP
+		for _, pair := range splitQuoted(element, ';') {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+				continue
+			}
+			value := strings.Trim(kv[1], `"`)
+			addr = parseIP(value)
+			if addr == nil && strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+				addr = net.ParseIP(value[1 : len(value)-1])
+			}
+		}
+		hops = append(hops, addr)
+	}
+	return hops
+}
+
+// splitQuoted splits the string on sep ignoring any sep values inside quoted strings
+func splitQuoted(s string, sep rune) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseIP parses a client supplied address which may optionally include a port
+// as permitted by BEP 7, eg: 1.2.3.4:6881 or [2600::1]:6881
+func parseIP(ipStr string) net.IP {
+	if addr := net.ParseIP(ipStr); addr != nil {
+		return addr
+	}
+	host, _, err := net.SplitHostPort(ipStr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// splitFamily returns the address in the ipv4 or ipv6 position depending on its family
+func splitFamily(addr net.IP) (net.IP, net.IP, error) {
+	if addr == nil {
+		return nil, nil, consts.ErrInvalidClient
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return v4, nil, nil
+	}
+	return nil, addr, nil
 }
 
 // oops will output a bencoded error code to the torrent client using
@@ -117,27 +265,60 @@ func oops(ctx *gin.Context, errCode errCode) {
 
 // preFlightChecks ensures our user meets the requirements to make an authorized request
 // THis is used within the request handler itself and not as a middleware because of the
-// slightly higher cost of passing data in through the request context
-func (t *Tracker) preFlightChecks(usr *store.User, pk string, c *gin.Context) bool {
-
+// slightly higher cost of passing data in through the request context.
+// When the request is rejected the error response has already been written to the client
+// and the returned code is only used by the caller for accounting.
+func (t *Tracker) preFlightChecks(usr *store.User, pk string, c *gin.Context) errCode {
+	// Reject banned addresses before touching any of the stores
+	if ban, banned := t.bannedAddr(c); banned {
+		log.Debugf("Rejected banned address %s (%s)", c.Request.RemoteAddr, ban.CIDR)
+		c.Data(int(msgBanned), gin.MIMEPlain, responseError(fmt.Sprintf("%s: %s",
+			responseStringMap[msgBanned].Error(), ban.Reason)))
+		return msgBanned
+	}
 	// Check that the user is valid before parsing anything
 	if t.Public {
 		usr.UserID = 1
-		return true
+		return msgOk
 	} else {
 		if pk == "" {
 			oops(c, msgInvalidAuth)
-			return false
+			return msgInvalidAuth
 		}
 		if err := t.UserGet(usr, pk); err != nil {
 			log.Debugf("Got invalid passkey")
 			oops(c, msgInvalidAuth)
-			return false
+			return msgInvalidAuth
+		}
+		if !usr.Valid() {
+			oops(c, msgInvalidAuth)
+			return msgInvalidAuth
 		}
-		return usr.Valid()
+		return msgOk
 	}
 }
 
+// bannedAddr checks the clients connecting addresses against the ban list. Client supplied
+// ip parameters are not considered.
+func (t *Tracker) bannedAddr(c *gin.Context) (store.Ban, bool) {
+	t.RLock()
+	bans := t.Bans
+	t.RUnlock()
+	if bans == nil || bans.Len() == 0 {
+		return store.Ban{}, false
+	}
+	ipv4, ipv6, err := getIP(nil, false, t.TrustedProxies, t.ProxyHeader, c)
+	if err != nil {
+		return store.Ban{}, false
+	}
+	for _, ip := range []net.IP{ipv4, ipv6} {
+		if ban, found := bans.Match(ip); found {
+			return ban, true
+		}
+	}
+	return store.Ban{}, false
+}
+
 // handleTrackerErrors is used as the default error handler for tracker requests
 // the error is returned to the client as a bencoded error string as defined in the
 // bittorrent specs.
@@ -157,6 +338,24 @@ func handleTrackerErrors(ctx *gin.Context) {
 	}
 }
 
+// observeRequest records the response status and latency of tracker requests
+func observeRequest(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	var handler string
+	switch {
+	case strings.HasPrefix(c.FullPath(), "/announce"):
+		handler = "announce"
+		metrics.AnnounceDuration.Since(start)
+	case strings.HasPrefix(c.FullPath(), "/scrape"):
+		handler = "scrape"
+		metrics.ScrapeDuration.Since(start)
+	default:
+		return
+	}
+	metrics.RequestStatus.Inc(handler, strconv.Itoa(c.Writer.Status()))
+}
+
 // responseError generates a bencoded error response for the torrent client to
 // parse and display to the user
 //
@@ -187,7 +386,12 @@ func noRoute(c *gin.Context) {
 // NewBitTorrentHandler configures a router to handle tracker announce/scrape requests
 func NewBitTorrentHandler(tkr *Tracker) *gin.Engine {
 	r := newRouter()
-	r.Use(handleTrackerErrors)
+	// Registered before the tracker middleware so checks are not rate limited or counted
+	if tkr.HealthEndpoints {
+		r.GET("/healthz", healthz)
+		r.GET("/readyz", tkr.readyz)
+	}
+	r.Use(observeRequest, handleTrackerErrors, tkr.rateLimit)
 	h := BitTorrentHandler{
 		tracker: tkr,
 	}
@@ -208,6 +412,10 @@ type HTTPOpts struct {
 	WriteTimeout   time.Duration
 	MaxHeaderBytes int
 	TLSConfig      *tls.Config
+	// ProxyProtocol enables parsing of HAProxy PROXY protocol headers
+	ProxyProtocol bool
+	// ProxyTrusted are the upstream addresses allowed to send PROXY headers
+	ProxyTrusted []*net.IPNet
 }
 
 // DefaultHTTPOpts returns a default set of options for http.Server instances
@@ -220,6 +428,8 @@ func DefaultHTTPOpts() *HTTPOpts {
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 		TLSConfig:      nil,
+		ProxyProtocol:  false,
+		ProxyTrusted:   nil,
 	}
 }
 
@@ -0,0 +1,111 @@
+package tracker
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/leighmacdonald/mika/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetIP(t *testing.T) {
+	trusted, err := util.ParseCIDRs([]string{"10.0.0.0/8", "2600:1::/32"})
+	require.NoError(t, err)
+	cases := []struct {
+		query      string
+		remoteAddr string
+		headers    map[string]string
+		allow      bool
+		ipv4       string
+		ipv6       string
+	}{
+		{"", "1.2.3.4:5000", nil, false, "1.2.3.4", ""},
+		{"", "[2600::1]:5000", nil, false, "", "2600::1"},
+		{"ip=2600::2", "1.2.3.4:5000", nil, false, "1.2.3.4", ""},
+		// The connection address is kept for its own family
+		{"ip=2600::2", "1.2.3.4:5000", nil, true, "1.2.3.4", "2600::2"},
+		{"ipv4=4.3.2.1&ipv6=2600::2", "1.2.3.4:5000", nil, true, "4.3.2.1", "2600::2"},
+		// Only the missing family is filled in unless client addresses are allowed
+		{"ipv4=4.3.2.1&ipv6=2600::2", "1.2.3.4:5000", nil, false, "1.2.3.4", "2600::2"},
+		{"ipv4=4.3.2.1&ipv6=2600::2", "[2600::1]:5000", nil, false, "4.3.2.1", "2600::1"},
+		{"ip=4.3.2.1", "[2600::1]:5000", nil, false, "", "2600::1"},
+		{"ip=4.3.2.1&ipv6=[2600::2]:6881", "1.2.3.4:5000", nil, true, "4.3.2.1", "2600::2"},
+		{"ipv4=2600::2", "1.2.3.4:5000", nil, true, "1.2.3.4", ""},
+		// Headers from untrusted sources are ignored
+		{"", "1.2.3.4:5000", map[string]string{"X-Real-IP": "4.3.2.1"}, false, "1.2.3.4", ""},
+		{"", "1.2.3.4:5000", map[string]string{"X-Forwarded-For": "4.3.2.1"}, false, "1.2.3.4", ""},
+		{"", "1.2.3.4:5000", map[string]string{"Forwarded": "for=4.3.2.1"}, false, "1.2.3.4", ""},
+		// Trusted proxies
+		{"", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "6.6.6.6, 4.3.2.1, 10.0.0.2"},
+			false, "4.3.2.1", ""},
+		{"", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "4.3.2.1, 10.0.0.3, 10.0.0.2"},
+			false, "4.3.2.1", ""},
+		{"", "[2600:1::1]:5000", map[string]string{"X-Forwarded-For": "2600::5"}, false, "", "2600::5"},
+		{"", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "garbage"}, false, "10.0.0.1", ""},
+		{"", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "unknown"}, false, "10.0.0.1", ""},
+		// Only the configured header is read, clients behind the proxy can set the others
+		{"", "10.0.0.1:5000", map[string]string{"X-Real-IP": "6.6.6.6", "X-Forwarded-For": "4.3.2.1"},
+			false, "4.3.2.1", ""},
+		{"", "10.0.0.1:5000", map[string]string{"Forwarded": "for=6.6.6.6", "X-Forwarded-For": "4.3.2.1"},
+			false, "4.3.2.1", ""},
+		{"", "10.0.0.1:5000", map[string]string{"Forwarded": "for=6.6.6.6"}, false, "10.0.0.1", ""},
+	}
+	for i, tc := range cases {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/announce?"+tc.query, nil)
+		c.Request.RemoteAddr = tc.remoteAddr
+		for k, v := range tc.headers {
+			c.Request.Header.Set(k, v)
+		}
+		q, err := queryStringParser(c.Request.URL.RawQuery)
+		require.NoError(t, err)
+		ipv4, ipv6, err := getIP(q, tc.allow, trusted, "X-Forwarded-For", c)
+		require.NoError(t, err, "Failed to get ip (%d)", i)
+		if tc.ipv4 == "" {
+			require.Nil(t, ipv4, "Unexpected ipv4 (%d)", i)
+		} else {
+			require.Equal(t, tc.ipv4, ipv4.String(), "Invalid ipv4 (%d)", i)
+		}
+		if tc.ipv6 == "" {
+			require.Nil(t, ipv6, "Unexpected ipv6 (%d)", i)
+		} else {
+			require.Equal(t, tc.ipv6, ipv6.String(), "Invalid ipv6 (%d)", i)
+		}
+	}
+}
+
+func TestGetIPProxyHeader(t *testing.T) {
+	trusted, err := util.ParseCIDRs([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	cases := []struct {
+		header  string
+		headers map[string]string
+		ipv4    string
+	}{
+		{"X-Forwarded-For", map[string]string{"X-Forwarded-For": "4.3.2.1"}, "4.3.2.1"},
+		// The client prepends its own hops to a header the proxy appends to
+		{"X-Forwarded-For", map[string]string{"X-Forwarded-For": "6.6.6.6, 10.0.0.5, 4.3.2.1"}, "4.3.2.1"},
+		{"X-Forwarded-For", map[string]string{"X-Real-IP": "6.6.6.6", "Forwarded": "for=6.6.6.6"}, "10.0.0.1"},
+		{"Forwarded", map[string]string{"Forwarded": `for=6.6.6.6, for="4.3.2.1:1234"`}, "4.3.2.1"},
+		{"Forwarded", map[string]string{"Forwarded": "for=4.3.2.1, for=unknown"}, "10.0.0.1"},
+		{"Forwarded", map[string]string{"X-Real-IP": "6.6.6.6", "X-Forwarded-For": "6.6.6.6"}, "10.0.0.1"},
+		{"X-Real-IP", map[string]string{"X-Real-IP": "4.3.2.1"}, "4.3.2.1"},
+		{"x-real-ip", map[string]string{"X-Real-IP": "4.3.2.1"}, "4.3.2.1"},
+		{"X-Real-IP", map[string]string{"Forwarded": "for=6.6.6.6", "X-Forwarded-For": "6.6.6.6"}, "10.0.0.1"},
+		{"", map[string]string{"X-Forwarded-For": "6.6.6.6"}, "10.0.0.1"},
+	}
+	for i, tc := range cases {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/announce", nil)
+		c.Request.RemoteAddr = "10.0.0.1:5000"
+		for k, v := range tc.headers {
+			c.Request.Header.Set(k, v)
+		}
+		ipv4, _, err := getIP(nil, false, trusted, tc.header, c)
+		require.NoError(t, err, "Failed to get ip (%d)", i)
+		require.Equal(t, tc.ipv4, ipv4.String(), "Invalid ipv4 (%d)", i)
+	}
+	require.True(t, validProxyHeader("x-forwarded-for"))
+	require.False(t, validProxyHeader("X-Client-IP"))
+}
@@ -0,0 +1,111 @@
+package tracker
+
+import (
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxInvalidationItems limits the size of a single bus message, larger batches such as
+// those sent after a stat sync are split
+const maxInvalidationItems = 1000
+
+// publish sends the invalidations to the other nodes sharing the bus, if enabled. Failures
+// are logged as the change has already been applied to the backing store, the other
+// nodes will see it once their cached entries expire.
+func (t *Tracker) publish(items []store.Invalidation) {
+	if t.bus == nil {
+		return
+	}
+	for len(items) > 0 {
+		n := len(items)
+		if n > maxInvalidationItems {
+			n = maxInvalidationItems
+		}
+		if err := t.bus.Publish(store.InvalidationMsg{Node: t.nodeID, Items: items[:n]}); err != nil {
+			log.Errorf("Failed to publish cache invalidation: %s", err)
+		}
+		items = items[n:]
+	}
+}
+
+// InvalidateTorrent evicts the torrent from the local cache and those of the other nodes
+func (t *Tracker) InvalidateTorrent(infoHash store.InfoHash) {
+	if t.TorrentsCache != nil {
+		t.TorrentsCache.Invalidate(infoHash)
+	}
+	t.publish([]store.Invalidation{{
+		Kind: store.InvalidateTorrent, Action: store.ActionEvict, Key: infoHash.String()}})
+}
+
+// InvalidateUser evicts the passkeys from the local cache and those of the other nodes
+func (t *Tracker) InvalidateUser(passkeys ...string) {
+	items := make([]store.Invalidation, len(passkeys))
+	for i, passkey := range passkeys {
+		if t.UsersCache != nil {
+			t.UsersCache.Delete(passkey)
+		}
+		items[i] = store.Invalidation{Kind: store.InvalidateUser, Action: store.ActionEvict, Key: passkey}
+	}
+	t.publish(items)
+}
+
+// handleInvalidation applies the invalidations received from another node
+func (t *Tracker) handleInvalidation(msg store.InvalidationMsg) {
+	if msg.Node == t.nodeID {
+		return
+	}
+	for _, item := range msg.Items {
+		switch item.Kind {
+		case store.InvalidateTorrent:
+			var ih store.InfoHash
+			if err := store.InfoHashFromHex(&ih, item.Key); err != nil {
+				log.Warnf("Invalid info hash in cache invalidation: %s", item.Key)
+				continue
+			}
+			if t.TorrentsCache == nil {
+				continue
+			}
+			if item.Action == store.ActionRefresh {
+				t.TorrentsCache.Reload(ih, consts.ErrInvalidInfoHash, t.loadTorrent)
+			} else {
+				t.TorrentsCache.Invalidate(ih)
+			}
+		case store.InvalidateUser:
+			if t.UsersCache == nil {
+				continue
+			}
+			if item.Action == store.ActionRefresh {
+				t.UsersCache.Reload(item.Key, consts.ErrInvalidUser, t.loadUser)
+			} else {
+				t.UsersCache.Delete(item.Key)
+			}
+		case store.InvalidateWhitelist:
+			if err := t.LoadWhitelist(); err != nil {
+				log.Errorf("Failed to reload whitelist: %s", err)
+			}
+		case store.InvalidateBans:
+			if err := t.LoadBans(); err != nil {
+				log.Errorf("Failed to reload bans: %s", err)
+			}
+		default:
+			log.Warnf("Unknown cache invalidation kind: %s", item.Kind)
+		}
+	}
+}
+
+// loadTorrent reads the torrent from the backing store for the cache, deleted torrents
+// are cached so both lookups of TorrentGet can be served
+func (t *Tracker) loadTorrent(torrent *store.Torrent, hash store.InfoHash) error {
+	return t.torrents.Get(torrent, hash, true)
+}
+
+// loadUser reads the user from the backing store for the cache. Stores report unknown
+// passkeys differently so they are normalized to consts.ErrInvalidUser.
+func (t *Tracker) loadUser(user *store.User, passkey string) error {
+	err := t.users.GetByPasskey(user, passkey)
+	if isUnknownUser(err) {
+		return consts.ErrInvalidUser
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package tracker
+
+import (
+	"context"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/store"
+	"github.com/leighmacdonald/mika/store/memory"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// sharedUserStore and sharedTorrentStore report a non memory driver name so the trackers
+// using them enable caching
+type sharedUserStore struct {
+	store.UserStore
+}
+
+func (s sharedUserStore) Name() string {
+	return "shared"
+}
+
+type sharedTorrentStore struct {
+	store.TorrentStore
+}
+
+func (s sharedTorrentStore) Name() string {
+	return "shared"
+}
+
+func TestTracker_Invalidation(t *testing.T) {
+	users := sharedUserStore{memory.NewUserStore()}
+	torrents := sharedTorrentStore{memory.NewTorrentStore()}
+	newNode := func() *Tracker {
+		opts := NewDefaultOpts()
+		opts.Users = users
+		opts.Torrents = torrents
+		opts.UserCacheEnabled = true
+		opts.TorrentCacheEnabled = true
+		opts.Bus = memory.NewBus(t.Name())
+		tkr, err := New(context.Background(), opts)
+		require.NoError(t, err)
+		return tkr
+	}
+	nodeA, nodeB := newNode(), newNode()
+	usr := store.GenerateTestUser()
+	require.NoError(t, nodeA.UserAdd(usr))
+	torrent := store.GenerateTestTorrent()
+	require.NoError(t, nodeA.TorrentAdd(torrent))
+	var u store.User
+	var tor store.Torrent
+	for _, node := range []*Tracker{nodeA, nodeB} {
+		require.NoError(t, node.UserGet(&u, usr.Passkey))
+		require.NoError(t, node.TorrentGet(&tor, torrent.InfoHash, false))
+	}
+
+	// A stat sync on one node reloads the entries cached by the others
+	require.NoError(t, nodeA.UserSync(map[string]store.UserStats{usr.Passkey: {Uploaded: 100}}))
+	require.NoError(t, nodeA.TorrentSync(map[store.InfoHash]store.TorrentStats{torrent.InfoHash: {Seeders: 3}}))
+	found, err := nodeB.UsersCache.Get(&u, usr.Passkey)
+	require.True(t, found)
+	require.NoError(t, err)
+	require.Equal(t, usr.Uploaded+100, u.Uploaded)
+	found, err = nodeB.TorrentsCache.Get(&tor, torrent.InfoHash)
+	require.True(t, found)
+	require.NoError(t, err)
+	require.Equal(t, torrent.Seeders+3, tor.Seeders)
+
+	// Admin changes evict the cached entries of every node
+	updated := u
+	updated.DownloadEnabled = !u.DownloadEnabled
+	require.NoError(t, users.Update(updated, usr.Passkey))
+	require.NoError(t, nodeB.UserGet(&u, usr.Passkey))
+	require.Equal(t, usr.DownloadEnabled, u.DownloadEnabled, "Cached user changed before invalidation")
+	nodeA.InvalidateUser(usr.Passkey)
+	require.NoError(t, nodeB.UserGet(&u, usr.Passkey))
+	require.Equal(t, updated.DownloadEnabled, u.DownloadEnabled)
+
+	require.NoError(t, nodeA.TorrentDelete(torrent.InfoHash, true))
+	require.Equal(t, consts.ErrInvalidInfoHash, nodeB.TorrentGet(&tor, torrent.InfoHash, false))
+
+	// Messages from the node itself are ignored
+	require.NoError(t, nodeB.TorrentAdd(torrent))
+	require.NoError(t, nodeB.TorrentGet(&tor, torrent.InfoHash, false))
+	nodeB.handleInvalidation(store.InvalidationMsg{Node: nodeB.nodeID, Items: []store.Invalidation{
+		{Kind: store.InvalidateTorrent, Action: store.ActionEvict, Key: torrent.InfoHash.String()}}})
+	found, _ = nodeB.TorrentsCache.Get(&tor, torrent.InfoHash)
+	require.True(t, found)
+
+	require.NoError(t, nodeA.Shutdown(context.Background()))
+}
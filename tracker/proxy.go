@@ -0,0 +1,230 @@
+package tracker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/leighmacdonald/mika/util"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// proxyV2Sig is the fixed signature which prefixes all v2 PROXY protocol headers
+	proxyV2Sig = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+	// proxyV1Prefix is the prefix of the human readable v1 PROXY protocol headers
+	proxyV1Prefix = []byte("PROXY ")
+
+	errProxyHeader = errors.New("Invalid PROXY protocol header")
+)
+
+const (
+	// Max length of a v1 header including the CRLF
+	proxyV1MaxLen = 107
+	// Length of the fixed v2 header fields, signature + ver/cmd + fam + len
+	proxyV2HeaderLen = 16
+)
+
+// ProxyListener wraps a net.Listener and parses HAProxy PROXY protocol v1 & v2 headers
+// sent by trusted upstream load balancers. The original client address supplied in the
+// header replaces the connections RemoteAddr.
+//
+// Connections from addresses outside of Trusted are passed through unmodified and their
+// header, if any, is never parsed so they cannot spoof their address.
+type ProxyListener struct {
+	net.Listener
+	// Trusted upstream addresses allowed to send PROXY headers
+	Trusted []*net.IPNet
+	// HeaderTimeout is how long we will wait to receive the header after accepting
+	HeaderTimeout time.Duration
+}
+
+// NewProxyListener wraps the listener with PROXY protocol support
+func NewProxyListener(l net.Listener, trusted []*net.IPNet) *ProxyListener {
+	if len(trusted) == 0 {
+		log.Warnf("PROXY protocol enabled on %s without any trusted upstreams", l.Addr().String())
+	}
+	return &ProxyListener{
+		Listener:      l,
+		Trusted:       trusted,
+		HeaderTimeout: 5 * time.Second,
+	}
+}
+
+// Accept waits for and returns the next connection. The PROXY header is read lazily
+// on the first Read or RemoteAddr call so that slow upstreams cannot block the accept loop.
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !util.ContainsIP(l.Trusted, addr.IP) {
+		return conn, nil
+	}
+	return &proxyConn{
+		Conn:    conn,
+		reader:  bufio.NewReaderSize(conn, 512),
+		timeout: l.HeaderTimeout,
+		once:    &sync.Once{},
+	}, nil
+}
+
+// proxyConn is a connection from a trusted upstream that is prefixed with a PROXY header
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	timeout    time.Duration
+	once       *sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		}
+		c.remoteAddr, c.err = readProxyHeader(c.reader)
+		if c.timeout > 0 {
+			_ = c.Conn.SetReadDeadline(time.Time{})
+		}
+		if c.err != nil {
+			log.Warnf("Failed to read PROXY header from %s: %s", c.Conn.RemoteAddr().String(), c.err)
+			_ = c.Conn.Close()
+		}
+	})
+}
+
+// Read reads data from the connection after the PROXY header
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the original client address sent in the PROXY header. If the header
+// was a LOCAL (health check) command the upstream address is returned.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads either a v1 or v2 PROXY header from the reader. A nil address
+// with a nil error is returned for LOCAL or UNKNOWN connections.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	prefix, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read PROXY header")
+	}
+	if bytes.Equal(prefix, proxyV1Prefix) {
+		return readProxyHeaderV1(r)
+	}
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err != nil || !bytes.Equal(sig, proxyV2Sig) {
+		return nil, errProxyHeader
+	}
+	return readProxyHeaderV2(r)
+}
+
+// readProxyHeaderV1 parses the text based header format
+//
+//	PROXY TCP4 255.255.255.255 255.255.255.255 65535 65535\r\n
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read PROXY v1 header")
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 parses the binary header format
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2HeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.Wrap(err, "Failed to read PROXY v2 header")
+	}
+	if header[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errors.Wrap(err, "Failed to read PROXY v2 addresses")
+	}
+	if cmd := header[12] & 0x0F; cmd == 0x00 {
+		// LOCAL command, the connection was made by the proxy itself
+		return nil, nil
+	} else if cmd != 0x01 {
+		return nil, errProxyHeader
+	}
+	switch header[13] >> 4 {
+	case 0x1:
+		if len(payload) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x2:
+		if len(payload) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	default:
+		// AF_UNSPEC or AF_UNIX, nothing we can use
+		return nil, nil
+	}
+}
+
+// NewListener creates a TCP listener for the server options, wrapping it with
+// PROXY protocol support when enabled
+func NewListener(opts *HTTPOpts) (net.Listener, error) {
+	l, err := net.Listen("tcp", opts.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ProxyProtocol {
+		return NewProxyListener(l, opts.ProxyTrusted), nil
+	}
+	return l, nil
+}
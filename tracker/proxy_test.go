@@ -0,0 +1,96 @@
+package tracker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/leighmacdonald/mika/util"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func proxyV2Header(src net.IP, port uint16) []byte {
+	var fam byte = 0x11
+	addrLen := 12
+	if src.To4() == nil {
+		fam = 0x21
+		addrLen = 36
+	} else {
+		src = src.To4()
+	}
+	h := append([]byte{}, proxyV2Sig...)
+	h = append(h, 0x21, fam, 0, 0)
+	binary.BigEndian.PutUint16(h[14:16], uint16(addrLen))
+	payload := make([]byte, addrLen)
+	copy(payload, src)
+	copy(payload[len(src):], src)
+	binary.BigEndian.PutUint16(payload[len(src)*2:], port)
+	binary.BigEndian.PutUint16(payload[len(src)*2+2:], 34000)
+	return append(h, payload...)
+}
+
+func TestProxyListener(t *testing.T) {
+	cases := []struct {
+		trusted  []string
+		header   []byte
+		expected string
+	}{
+		{[]string{"127.0.0.1"}, []byte("PROXY TCP4 1.2.3.4 127.0.0.1 5000 34000\r\n"), "1.2.3.4:5000"},
+		{[]string{"127.0.0.1"}, []byte("PROXY TCP6 2600::1 ::1 5000 34000\r\n"), "[2600::1]:5000"},
+		{[]string{"127.0.0.1"}, []byte("PROXY UNKNOWN\r\n"), "127.0.0.1"},
+		{[]string{"127.0.0.1"}, proxyV2Header(net.ParseIP("4.3.2.1"), 6881), "4.3.2.1:6881"},
+		{[]string{"127.0.0.1"}, proxyV2Header(net.ParseIP("2600::2"), 6881), "[2600::2]:6881"},
+		// Untrusted upstreams are passed through untouched
+		{[]string{"10.0.0.0/8"}, nil, "127.0.0.1"},
+	}
+	for i, tc := range cases {
+		trusted, err := util.ParseCIDRs(tc.trusted)
+		require.NoError(t, err)
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		pl := NewProxyListener(l, trusted)
+		go func(header []byte) {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write(append(header, []byte("hello\n")...))
+			_ = conn.Close()
+		}(tc.header)
+		conn, err := pl.Accept()
+		require.NoError(t, err)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		require.NoError(t, err, "Failed to read body (%d)", i)
+		require.Equal(t, "hello\n", line, "Invalid body (%d)", i)
+		addr := conn.RemoteAddr().String()
+		if tc.expected == "127.0.0.1" {
+			host, _, _ := net.SplitHostPort(addr)
+			require.Equal(t, tc.expected, host, "Invalid remote addr (%d)", i)
+		} else {
+			require.Equal(t, tc.expected, addr, "Invalid remote addr (%d)", i)
+		}
+		require.NoError(t, conn.Close())
+		require.NoError(t, pl.Close())
+	}
+}
+
+func TestProxyListenerInvalidHeader(t *testing.T) {
+	trusted, err := util.ParseCIDRs([]string{"127.0.0.1"})
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pl := NewProxyListener(l, trusted)
+	defer func() { _ = pl.Close() }()
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("GET /announce HTTP/1.1\r\n\r\n"))
+		_ = conn.Close()
+	}()
+	conn, err := pl.Accept()
+	require.NoError(t, err)
+	_, err = conn.Read(make([]byte, 10))
+	require.Error(t, err)
+}
@@ -0,0 +1,172 @@
+package tracker
+
+import (
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/journal"
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/leighmacdonald/mika/store"
+	log "github.com/sirupsen/logrus"
+	"sync/atomic"
+	"time"
+)
+
+// QueuePolicy defines what happens to a state update when the StateUpdateChan is full
+type QueuePolicy string
+
+const (
+	// QueueBlock waits for space in the queue, up to QueueTimeout if set, dropping the
+	// update once the timeout expires
+	QueueBlock QueuePolicy = "block"
+	// QueueDrop drops the update immediately
+	QueueDrop QueuePolicy = "drop"
+	// QueueSpill writes the update to the on disk spill journal, which is read back into
+	// the StatWorker once the queue has drained
+	QueueSpill QueuePolicy = "spill"
+)
+
+// ParseQueuePolicy returns the QueuePolicy matching the string provided
+func ParseQueuePolicy(s string) (QueuePolicy, error) {
+	switch p := QueuePolicy(s); p {
+	case QueueBlock, QueueDrop, QueueSpill:
+		return p, nil
+	case "":
+		return QueueBlock, nil
+	default:
+		return "", consts.ErrInvalidConfig
+	}
+}
+
+// queueDepth returns the fraction of the StateUpdateChan in use
+func (t *Tracker) queueDepth() float64 {
+	if cap(t.StateUpdateChan) == 0 {
+		return 0
+	}
+	return float64(len(t.StateUpdateChan)) / float64(cap(t.StateUpdateChan))
+}
+
+// Overloaded returns true while the StateUpdateChan is above the overload threshold or
+// updates are being shed
+func (t *Tracker) Overloaded() bool {
+	return atomic.LoadInt32(&t.overloaded) == 1
+}
+
+// setOverloaded updates the overload state. The state is entered when the queue reaches
+// OverloadThreshold and only cleared once it drops below half of it so that clients
+// are not sent alternating intervals.
+func (t *Tracker) setOverloaded(shedding bool) {
+	if t.OverloadThreshold <= 0 {
+		return
+	}
+	depth := t.queueDepth()
+	if shedding || depth >= t.OverloadThreshold {
+		if atomic.CompareAndSwapInt32(&t.overloaded, 0, 1) {
+			log.Warnf("Tracker overloaded, stat update queue at %.0f%%", depth*100)
+		}
+	} else if depth < t.OverloadThreshold/2 {
+		if atomic.CompareAndSwapInt32(&t.overloaded, 1, 0) {
+			log.Infof("Tracker no longer overloaded")
+		}
+	}
+}
+
+// announceInterval returns the intervals sent to clients, scaled by the OverloadFactor
+// while the tracker is overloaded to reduce the incoming announce rate
+func (t *Tracker) announceInterval() (time.Duration, time.Duration) {
+	if t.OverloadFactor > 1 && t.Overloaded() {
+		return time.Duration(float64(t.AnnInterval) * t.OverloadFactor),
+			time.Duration(float64(t.AnnIntervalMin) * t.OverloadFactor)
+	}
+	return t.AnnInterval, t.AnnIntervalMin
+}
+
+// enqueue sends the state update to the StatWorker, applying the QueuePolicy when the
+// StateUpdateChan is full
+func (t *Tracker) enqueue(u store.UpdateState) {
+	select {
+	case t.StateUpdateChan <- u:
+		t.setOverloaded(false)
+		return
+	default:
+	}
+	t.setOverloaded(true)
+	switch t.QueuePolicy {
+	case QueueDrop:
+		metrics.StateUpdatesDropped.Inc("full")
+	case QueueSpill:
+		if t.spill == nil {
+			metrics.StateUpdatesDropped.Inc("spill_error")
+			return
+		}
+		if _, err := t.spill.Append(u); err != nil {
+			log.Errorf("Failed to spill state update: %s", err)
+			metrics.StateUpdatesDropped.Inc("spill_error")
+			return
+		}
+		// Recovered updates are only summed into a batch so the live effects are
+		// applied now
+		t.announceEffects(u)
+		metrics.StateUpdatesSpilled.Inc()
+	default:
+		if t.QueueTimeout <= 0 {
+			t.StateUpdateChan <- u
+			return
+		}
+		timer := time.NewTimer(t.QueueTimeout)
+		select {
+		case t.StateUpdateChan <- u:
+			timer.Stop()
+		case <-timer.C:
+			metrics.StateUpdatesDropped.Inc("timeout")
+		}
+	}
+}
+
+// spillChunk is the most spilled state updates recovered into a single batch
+const spillChunk = 10000
+
+// recoverSpill sums the next chunk of spilled state updates into the batch, any further
+// updates are recovered by the following batches. Unless force is set this is skipped
+// while the tracker is overloaded so recovery does not compete with the queue. Each
+// store acknowledges the spilled updates once it has synced them successfully.
+func (t *Tracker) recoverSpill(b *statBatch, force bool) {
+	if t.spill == nil || (!force && t.Overloaded()) {
+		return
+	}
+	after := b.spillSeq
+	if acked := t.spill.Acked(); acked > after {
+		after = acked
+	}
+	if t.spill.Seq() <= after {
+		return
+	}
+	cursors := journalCursors(t.spill)
+	recovered, err := t.spill.Read(after, spillChunk, func(r journal.Record) error {
+		t.replayUpdate(b, r, cursors)
+		b.spillSeq = r.Seq
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Failed to read spilled state updates: %s", err)
+	}
+	if recovered > 0 {
+		log.Infof("Recovered %d spilled state updates", recovered)
+	}
+}
+
+// registerQueueGauges exposes the state of the StateUpdateChan as prometheus gauges
+func (t *Tracker) registerQueueGauges() {
+	metrics.RegisterGaugeFunc("t_queue_depth",
+		"t_queue_depth is the number of state updates waiting on the stat worker",
+		func() float64 { return float64(len(t.StateUpdateChan)) })
+	metrics.RegisterGaugeFunc("t_queue_capacity",
+		"t_queue_capacity is the capacity of the state update queue",
+		func() float64 { return float64(cap(t.StateUpdateChan)) })
+	metrics.RegisterGaugeFunc("t_overloaded",
+		"t_overloaded is 1 while the tracker is overloaded and sending scaled announce intervals",
+		func() float64 {
+			if t.Overloaded() {
+				return 1
+			}
+			return 0
+		})
+}
@@ -0,0 +1,154 @@
+package tracker
+
+import (
+	"context"
+	"github.com/leighmacdonald/mika/journal"
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/leighmacdonald/mika/store"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTracker_QueueDrop(t *testing.T) {
+	opts := NewDefaultOpts()
+	opts.QueueSize = 4
+	opts.QueuePolicy = QueueDrop
+	tkr, err := New(context.Background(), opts)
+	require.NoError(t, err)
+	dropped := metrics.StateUpdatesDropped.Get("full")
+	for i := 0; i < 2; i++ {
+		tkr.enqueue(store.UpdateState{})
+	}
+	require.False(t, tkr.Overloaded(), "Overloaded below threshold")
+	interval, minInterval := tkr.announceInterval()
+	require.Equal(t, opts.AnnInterval, interval)
+	require.Equal(t, opts.AnnIntervalMin, minInterval)
+
+	for i := 0; i < 3; i++ {
+		tkr.enqueue(store.UpdateState{})
+	}
+	require.Equal(t, dropped+1, metrics.StateUpdatesDropped.Get("full"))
+	require.True(t, tkr.Overloaded())
+	interval, minInterval = tkr.announceInterval()
+	require.Equal(t, opts.AnnInterval*2, interval)
+	require.Equal(t, opts.AnnIntervalMin*2, minInterval)
+
+	// Recovery requires the queue to fall below half the threshold
+	<-tkr.StateUpdateChan
+	<-tkr.StateUpdateChan
+	tkr.setOverloaded(false)
+	require.True(t, tkr.Overloaded(), "Overload cleared above half the threshold")
+	<-tkr.StateUpdateChan
+	tkr.setOverloaded(false)
+	require.False(t, tkr.Overloaded())
+}
+
+func TestTracker_QueueBlockTimeout(t *testing.T) {
+	opts := NewDefaultOpts()
+	opts.QueueSize = 1
+	opts.QueueTimeout = time.Millisecond * 10
+	tkr, err := New(context.Background(), opts)
+	require.NoError(t, err)
+	dropped := metrics.StateUpdatesDropped.Get("timeout")
+	tkr.enqueue(store.UpdateState{})
+	tkr.enqueue(store.UpdateState{})
+	require.Equal(t, dropped+1, metrics.StateUpdatesDropped.Get("timeout"))
+}
+
+func TestTracker_QueueSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mika-spill")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	opts := NewDefaultOpts()
+	opts.QueueSize = 1
+	opts.QueuePolicy = QueueSpill
+	_, err = New(context.Background(), opts)
+	require.Error(t, err, "Spill policy without journal accepted")
+
+	users := &syncRecorder{UserStore: opts.Users}
+	opts.Users = users
+	opts.BatchInterval = time.Hour
+	opts.Spill, err = journal.Open(journal.Opts{Dir: dir})
+	require.NoError(t, err)
+	usr := store.GenerateTestUser()
+	require.NoError(t, opts.Users.Add(usr))
+	torrent := store.GenerateTestTorrent()
+	require.NoError(t, opts.Torrents.Add(torrent))
+	tkr, err := New(context.Background(), opts)
+	require.NoError(t, err)
+	spilled := metrics.StateUpdatesSpilled.Get()
+	for i := 0; i < 3; i++ {
+		tkr.enqueue(store.UpdateState{
+			InfoHash: torrent.InfoHash,
+			PeerID:   store.PeerID{1},
+			Passkey:  usr.Passkey,
+			Uploaded: 100,
+		})
+	}
+	require.Equal(t, spilled+2, metrics.StateUpdatesSpilled.Get())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	require.NoError(t, tkr.Shutdown(ctx))
+	var announces uint32
+	for _, b := range users.batches {
+		announces += b[usr.Passkey].Announces
+	}
+	require.Equal(t, uint32(3), announces)
+	// Spilled updates are counted when spilled and not again when recovered
+	require.Equal(t, uint64(3), tkr.Stats().Announces)
+
+	j, err := journal.Open(journal.Opts{Dir: dir})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), j.Acked())
+	require.NoError(t, j.Close())
+}
+
+func TestTracker_QueueSpillSyncFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mika-spill")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	opts := NewDefaultOpts()
+	opts.QueuePolicy = QueueSpill
+	users := &syncRecorder{UserStore: opts.Users, fails: 1}
+	opts.Users = users
+	opts.Spill, err = journal.Open(journal.Opts{Dir: dir})
+	require.NoError(t, err)
+	usr := store.GenerateTestUser()
+	require.NoError(t, opts.Users.Add(usr))
+	torrent := store.GenerateTestTorrent()
+	require.NoError(t, opts.Torrents.Add(torrent))
+	tkr, err := New(context.Background(), opts)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = opts.Spill.Append(store.UpdateState{
+			InfoHash: torrent.InfoHash,
+			PeerID:   store.PeerID{1},
+			Passkey:  usr.Passkey,
+			Uploaded: 100,
+		})
+		require.NoError(t, err)
+	}
+	requireSynced := func(userAnnounces uint32, torrentAnnounces uint64) {
+		var u store.User
+		require.NoError(t, opts.Users.GetByPasskey(&u, usr.Passkey))
+		require.Equal(t, usr.Announces+userAnnounces, u.Announces)
+		var tor store.Torrent
+		require.NoError(t, opts.Torrents.Get(&tor, torrent.InfoHash, false))
+		require.Equal(t, torrent.Announces+torrentAnnounces, tor.Announces)
+	}
+	p := tkr.newStatPipeline(1)
+	defer p.close()
+	p.flush(true)
+	requireSynced(0, 3)
+	require.Equal(t, uint64(0), opts.Spill.Acked())
+	// The retried user stats must not be recovered from the spill a second time
+	p.flush(true)
+	requireSynced(3, 3)
+	require.Equal(t, uint64(3), opts.Spill.Acked())
+	p.flush(true)
+	requireSynced(3, 3)
+	require.NoError(t, opts.Spill.Close())
+}
@@ -0,0 +1,168 @@
+package tracker
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/leighmacdonald/mika/metrics"
+	log "github.com/sirupsen/logrus"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// limiterShards is the number of independently locked bucket maps per limiter
+	limiterShards = 64
+	// limiterSweepInterval is how often each shard drops idle buckets
+	limiterSweepInterval = time.Minute
+)
+
+// bucket holds the token state for a single key
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiterShard is a subset of buckets guarded by their own lock
+type limiterShard struct {
+	*sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// RateLimiter is a token-bucket rate limiter keyed by arbitrary strings. Keys are spread
+// over a fixed number of shards so concurrent requests for different keys rarely contend
+// on the same lock. Idle buckets are swept lazily so no background worker is required.
+type RateLimiter struct {
+	// rate is the number of tokens added per second
+	rate float64
+	// burst is the bucket capacity
+	burst  float64
+	shards [limiterShards]*limiterShard
+}
+
+// NewRateLimiter creates a limiter allowing rate requests per second per key with bursts
+// of up to burst requests. A burst less than 1 is raised to 1.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	rl := &RateLimiter{
+		rate:  rate,
+		burst: float64(burst),
+	}
+	for i := range rl.shards {
+		rl.shards[i] = &limiterShard{
+			Mutex:     &sync.Mutex{},
+			buckets:   make(map[string]*bucket),
+			lastSweep: time.Now(),
+		}
+	}
+	return rl
+}
+
+func (rl *RateLimiter) shard(key string) *limiterShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return rl.shards[h.Sum32()%limiterShards]
+}
+
+// Allow consumes a token for the key returning false if none are available
+func (rl *RateLimiter) Allow(key string) bool {
+	return rl.allowAt(key, time.Now())
+}
+
+func (rl *RateLimiter) allowAt(key string, now time.Time) bool {
+	s := rl.shard(key)
+	s.Lock()
+	if now.Sub(s.lastSweep) >= limiterSweepInterval {
+		rl.sweep(s, now)
+	}
+	b, found := s.buckets[key]
+	if !found {
+		b = &bucket{tokens: rl.burst, last: now}
+		s.buckets[key] = b
+	} else {
+		b.tokens = rl.refill(b, now)
+		b.last = now
+	}
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	s.Unlock()
+	return allowed
+}
+
+// refill returns the token count for the bucket at the time provided
+func (rl *RateLimiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*rl.rate
+	if tokens > rl.burst {
+		tokens = rl.burst
+	}
+	return tokens
+}
+
+// sweep removes buckets which have refilled completely, they are equivalent to a new bucket.
+// Must be called with the shard lock held.
+func (rl *RateLimiter) sweep(s *limiterShard, now time.Time) {
+	for key, b := range s.buckets {
+		if rl.refill(b, now) >= rl.burst {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+// Len returns the number of keys currently tracked
+func (rl *RateLimiter) Len() int {
+	size := 0
+	for _, s := range rl.shards {
+		s.Lock()
+		size += len(s.buckets)
+		s.Unlock()
+	}
+	return size
+}
+
+// limiterIPKey returns the rate limit key for the address. IPv6 clients are keyed by
+// their /64 network since a single host is typically assigned the whole prefix.
+func limiterIPKey(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// rateLimit is the tracker middleware enforcing the per address and per passkey request
+// rate limits. Limited requests receive a bencoded failure response.
+func (t *Tracker) rateLimit(c *gin.Context) {
+	if t.IPLimiter != nil {
+		ipv4, ipv6, err := getIP(nil, false, t.TrustedProxies, t.ProxyHeader, c)
+		if err == nil {
+			for _, ip := range []net.IP{ipv4, ipv6} {
+				if ip == nil {
+					continue
+				}
+				if !t.IPLimiter.Allow(limiterIPKey(ip)) {
+					log.Debugf("Rate limited address: %s", ip.String())
+					metrics.RateLimited.Inc("ip")
+					oops(c, msgClientRequestTooFast)
+					c.Abort()
+					return
+				}
+				break
+			}
+		}
+	}
+	if t.PasskeyLimiter != nil {
+		if pk := c.Param("passkey"); pk != "" && !t.PasskeyLimiter.Allow(pk) {
+			log.Debugf("Rate limited passkey: %s", pk)
+			metrics.RateLimited.Inc("passkey")
+			oops(c, msgClientRequestTooFast)
+			c.Abort()
+			return
+		}
+	}
+	c.Next()
+}
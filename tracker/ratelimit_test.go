@@ -0,0 +1,73 @@
+package tracker
+
+import (
+	"fmt"
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := NewRateLimiter(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		require.True(t, rl.allowAt("a", now), "Burst not allowed (%d)", i)
+	}
+	require.False(t, rl.allowAt("a", now))
+	// Independent keys have their own buckets
+	require.True(t, rl.allowAt("b", now))
+	// 2 tokens/sec refills 1 token every 500ms
+	require.False(t, rl.allowAt("a", now.Add(250*time.Millisecond)))
+	require.True(t, rl.allowAt("a", now.Add(500*time.Millisecond)))
+	require.False(t, rl.allowAt("a", now.Add(500*time.Millisecond)))
+	require.Equal(t, 2, rl.Len())
+	// Full buckets are swept lazily
+	later := now.Add(limiterSweepInterval * 2)
+	for _, s := range rl.shards {
+		s.Lock()
+		rl.sweep(s, later)
+		s.Unlock()
+	}
+	require.Equal(t, 0, rl.Len())
+}
+
+func TestLimiterIPKey(t *testing.T) {
+	require.Equal(t, "1.2.3.4", limiterIPKey(net.ParseIP("1.2.3.4")))
+	require.Equal(t, "2600:1:2:3::", limiterIPKey(net.ParseIP("2600:1:2:3:4:5:6:7")))
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err)
+	tkr.IPLimiter = NewRateLimiter(0.001, 2)
+	tkr.PasskeyLimiter = NewRateLimiter(0.001, 1)
+	rh := NewBitTorrentHandler(tkr)
+	before := metrics.RateLimited.Get("ip")
+	for i := 0; i < 2; i++ {
+		w := performRequest(rh, "GET", fmt.Sprintf("/scrape/pk%d", i), nil, nil)
+		require.NotEqual(t, int(msgClientRequestTooFast), w.Code, "Limited too early (%d)", i)
+	}
+	w := performRequest(rh, "GET", "/scrape/pk3", nil, nil)
+	require.Equal(t, int(msgClientRequestTooFast), w.Code)
+	require.Contains(t, w.Body.String(), "failure reason")
+	require.Equal(t, before+1, metrics.RateLimited.Get("ip"))
+
+	tkr.IPLimiter = nil
+	before = metrics.RateLimited.Get("passkey")
+	require.NotEqual(t, int(msgClientRequestTooFast), performRequest(rh, "GET", "/scrape/pk4", nil, nil).Code)
+	require.Equal(t, int(msgClientRequestTooFast), performRequest(rh, "GET", "/scrape/pk4", nil, nil).Code)
+	require.Equal(t, before+1, metrics.RateLimited.Get("passkey"))
+}
+
+func BenchmarkRateLimiter(b *testing.B) {
+	rl := NewRateLimiter(1000000, 1000000)
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			rl.Allow(fmt.Sprintf("10.0.%d.%d", (i>>8)&0xff, i&0xff))
+			i++
+		}
+	})
+}
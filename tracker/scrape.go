@@ -12,7 +12,7 @@ import (
 // scrape handles the bittorrent scrape protocol for
 func (h *BitTorrentHandler) scrape(c *gin.Context) {
 	var user store.User
-	if !h.tracker.preFlightChecks(&user, c.Param("passkey"), c) {
+	if code := h.tracker.preFlightChecks(&user, c.Param("passkey"), c); code != msgOk {
 		return
 	}
 	q, err := queryStringParser(c.Request.URL.RawQuery)
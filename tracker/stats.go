@@ -0,0 +1,318 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/leighmacdonald/mika/store"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// GlobalStats holds basic stats for the running tracker
+type GlobalStats struct {
+	// Torrents is the number of torrents known to the tracker
+	Torrents int `json:"torrents"`
+	// Swarms is the number of torrents with at least one peer
+	Swarms   int `json:"swarms"`
+	Seeders  int `json:"seeders"`
+	Leechers int `json:"leechers"`
+	// Peers is the total number of peers across all swarms
+	Peers int `json:"peers"`
+	// PeersIPv4 and PeersIPv6 count the peers with an endpoint of each family, dual-stack
+	// peers are counted in both
+	PeersIPv4 int `json:"peers_ipv4"`
+	PeersIPv6 int `json:"peers_ipv6"`
+	// Users is the number of distinct users who announced during the last announce interval
+	Users int `json:"users"`
+	// AnnouncesPerSec is the average announce rate during the last announce interval
+	AnnouncesPerSec float64 `json:"announces_per_sec"`
+	// Announces, Uploaded and Downloaded are totals since Started
+	Announces  uint64    `json:"announces"`
+	Uploaded   uint64    `json:"uploaded"`
+	Downloaded uint64    `json:"downloaded"`
+	Started    time.Time `json:"started"`
+}
+
+// peerState flags track what each peer currently contributes to the counters
+type peerState uint8
+
+const (
+	peerSeeding peerState = 1 << iota
+	peerIPv4
+	peerIPv6
+)
+
+// statShards is the number of shards the torrent and peer counters are split into
+const statShards = 32
+
+// statShard holds the torrent and peer counters of the swarms it owns, selected by
+// info_hash, so announces and reaps in different swarms do not contend on one lock
+type statShard struct {
+	*sync.Mutex
+	torrents map[store.InfoHash]struct{}
+	// swarms holds the peer count of each active swarm
+	swarms  map[store.InfoHash]int
+	peers   map[store.PeerHash]peerState
+	seeders int
+	peersV4 int
+	peersV6 int
+}
+
+// statCounter maintains the GlobalStats counters incrementally as torrents, peers and
+// users come and go so that reporting them never requires scanning the backing stores.
+type statCounter struct {
+	*sync.Mutex
+	started  time.Time
+	shards   [statShards]*statShard
+	total    uint64
+	uploaded uint64
+	download uint64
+	// Active users and the announce rate are counted in two generations, each
+	// spanning an announce interval
+	usersCur     map[string]struct{}
+	usersPrev    map[string]struct{}
+	annCur       uint64
+	annPrev      uint64
+	prevDuration time.Duration
+	rotated      time.Time
+}
+
+func newStatCounter() *statCounter {
+	now := time.Now()
+	s := &statCounter{
+		Mutex:    &sync.Mutex{},
+		started:  now,
+		usersCur: make(map[string]struct{}),
+		rotated:  now,
+	}
+	for i := range s.shards {
+		s.shards[i] = &statShard{
+			Mutex:    &sync.Mutex{},
+			torrents: make(map[store.InfoHash]struct{}),
+			swarms:   make(map[store.InfoHash]int),
+			peers:    make(map[store.PeerHash]peerState),
+		}
+	}
+	return s
+}
+
+// shard returns the shard owning the swarm. Info hashes are uniformly distributed so
+// the leading bytes are used directly.
+func (s *statCounter) shard(ih store.InfoHash) *statShard {
+	return s.shards[binary.BigEndian.Uint32(ih[:4])%statShards]
+}
+
+func (s *statCounter) torrentSeen(ih store.InfoHash) {
+	sh := s.shard(ih)
+	sh.Lock()
+	sh.torrents[ih] = struct{}{}
+	sh.Unlock()
+}
+
+func (s *statCounter) torrentRemoved(ih store.InfoHash) {
+	sh := s.shard(ih)
+	sh.Lock()
+	delete(sh.torrents, ih)
+	sh.Unlock()
+}
+
+// setState applies the difference between the old and new peer state to the counters.
+// Must be called with the lock held.
+func (sh *statShard) setState(old peerState, state peerState) {
+	for _, f := range []struct {
+		flag    peerState
+		counter *int
+	}{{peerSeeding, &sh.seeders}, {peerIPv4, &sh.peersV4}, {peerIPv6, &sh.peersV6}} {
+		if old&f.flag != 0 {
+			*f.counter--
+		}
+		if state&f.flag != 0 {
+			*f.counter++
+		}
+	}
+}
+
+func (s *statCounter) peerAdded(ih store.InfoHash, peer store.Peer) {
+	var state peerState
+	if peer.Left == 0 {
+		state |= peerSeeding
+	}
+	if peer.IPv4 != nil {
+		state |= peerIPv4
+	}
+	if peer.IPv6 != nil {
+		state |= peerIPv6
+	}
+	ph := store.NewPeerHash(ih, peer.PeerID)
+	sh := s.shard(ih)
+	sh.Lock()
+	old, found := sh.peers[ph]
+	if !found {
+		sh.swarms[ih]++
+	}
+	sh.peers[ph] = state
+	sh.setState(old, state)
+	sh.Unlock()
+}
+
+func (s *statCounter) peerRemoved(ih store.InfoHash, peerID store.PeerID) {
+	ph := store.NewPeerHash(ih, peerID)
+	sh := s.shard(ih)
+	sh.Lock()
+	if old, found := sh.peers[ph]; found {
+		delete(sh.peers, ph)
+		sh.setState(old, 0)
+		if sh.swarms[ih] <= 1 {
+			delete(sh.swarms, ih)
+		} else {
+			sh.swarms[ih]--
+		}
+	}
+	sh.Unlock()
+}
+
+// rotate starts a new active user and announce rate generation once the interval has
+// elapsed. Must be called with the lock held.
+func (s *statCounter) rotate(interval time.Duration) {
+	elapsed := time.Since(s.rotated)
+	if elapsed < interval {
+		return
+	}
+	s.usersPrev = s.usersCur
+	s.usersCur = make(map[string]struct{}, len(s.usersPrev))
+	s.annPrev = s.annCur
+	s.annCur = 0
+	s.prevDuration = elapsed
+	s.rotated = time.Now()
+}
+
+// peerSeeding updates the seeding state of a counted peer
+func (s *statCounter) peerSeeding(ph store.PeerHash, seeding bool) {
+	sh := s.shard(ph.InfoHash())
+	sh.Lock()
+	if old, found := sh.peers[ph]; found {
+		state := old &^ peerSeeding
+		if seeding {
+			state |= peerSeeding
+		}
+		sh.peers[ph] = state
+		sh.setState(old, state)
+	}
+	sh.Unlock()
+}
+
+// announced applies an announce state update to the announce and user counters
+func (s *statCounter) announced(u store.UpdateState, interval time.Duration) {
+	s.Lock()
+	s.rotate(interval)
+	s.usersCur[u.Passkey] = struct{}{}
+	s.annCur++
+	s.total++
+	s.uploaded += u.Uploaded
+	s.download += u.Downloaded
+	s.Unlock()
+}
+
+// update applies an announce state update to the counters
+func (s *statCounter) update(u store.UpdateState, interval time.Duration) {
+	s.announced(u, interval)
+	s.peerSeeding(store.NewPeerHash(u.InfoHash, u.PeerID), u.Left == 0 || u.Paused)
+}
+
+// peerStatListener counts the peers reported by a store.ListenedPeerStore
+type peerStatListener struct {
+	*statCounter
+}
+
+func (l peerStatListener) PeerAdded(ih store.InfoHash, p store.Peer) {
+	l.peerAdded(ih, p)
+}
+
+func (l peerStatListener) PeerSynced(ph store.PeerHash, stats store.PeerStats) {
+	l.peerSeeding(ph, stats.Left == 0 || stats.Paused)
+}
+
+func (l peerStatListener) PeerRemoved(ih store.InfoHash, id store.PeerID) {
+	l.peerRemoved(ih, id)
+}
+
+func (s *statCounter) get(interval time.Duration) GlobalStats {
+	var gs GlobalStats
+	for _, sh := range s.shards {
+		sh.Lock()
+		gs.Torrents += len(sh.torrents)
+		gs.Swarms += len(sh.swarms)
+		gs.Seeders += sh.seeders
+		gs.Peers += len(sh.peers)
+		gs.PeersIPv4 += sh.peersV4
+		gs.PeersIPv6 += sh.peersV6
+		sh.Unlock()
+	}
+	gs.Leechers = gs.Peers - gs.Seeders
+	s.Lock()
+	s.rotate(interval)
+	gs.Users = len(s.usersCur)
+	gs.Announces = s.total
+	gs.Uploaded = s.uploaded
+	gs.Downloaded = s.download
+	gs.Started = s.started
+	// Report the last complete interval once we have one
+	if s.usersPrev != nil {
+		gs.Users = len(s.usersPrev)
+		gs.AnnouncesPerSec = float64(s.annPrev) / s.prevDuration.Seconds()
+	} else if elapsed := time.Since(s.rotated).Seconds(); elapsed > 0 {
+		gs.AnnouncesPerSec = float64(s.annCur) / elapsed
+	}
+	s.Unlock()
+	return gs
+}
+
+// seedStats loads the torrents already in the TorrentStore into the torrent count
+func (t *Tracker) seedStats() {
+	hashes, err := t.torrents.InfoHashes()
+	if err != nil {
+		log.Errorf("Failed to load torrents for the tracker stats: %s", err)
+		return
+	}
+	for _, ih := range hashes {
+		t.stats.torrentSeen(ih)
+	}
+}
+
+// Stats returns the current cumulative stats for the tracker
+func (t *Tracker) Stats() GlobalStats {
+	return t.stats.get(t.AnnInterval)
+}
+
+// registerGauges exposes the tracker stats as prometheus gauges
+func (t *Tracker) registerGauges() {
+	gauges := []struct {
+		name string
+		help string
+		fn   func(s GlobalStats) float64
+	}{
+		{"t_torrents", "t_torrents is the number of torrents known to the tracker",
+			func(s GlobalStats) float64 { return float64(s.Torrents) }},
+		{"t_swarms", "t_swarms is the number of swarms with at least one peer",
+			func(s GlobalStats) float64 { return float64(s.Swarms) }},
+		{"t_seeders", "t_seeders is the number of seeding peers across all swarms",
+			func(s GlobalStats) float64 { return float64(s.Seeders) }},
+		{"t_leechers", "t_leechers is the number of leeching peers across all swarms",
+			func(s GlobalStats) float64 { return float64(s.Leechers) }},
+		{"t_peers", "t_peers is the number of peers across all swarms",
+			func(s GlobalStats) float64 { return float64(s.Peers) }},
+		{"t_peers_ipv4", "t_peers_ipv4 is the number of peers with an ipv4 endpoint",
+			func(s GlobalStats) float64 { return float64(s.PeersIPv4) }},
+		{"t_peers_ipv6", "t_peers_ipv6 is the number of peers with an ipv6 endpoint",
+			func(s GlobalStats) float64 { return float64(s.PeersIPv6) }},
+		{"t_users", "t_users is the number of users active in the last announce interval",
+			func(s GlobalStats) float64 { return float64(s.Users) }},
+		{"t_ann_per_second", "t_ann_per_second is the announce rate over the last announce interval",
+			func(s GlobalStats) float64 { return s.AnnouncesPerSec }},
+	}
+	for _, g := range gauges {
+		fn := g.fn
+		metrics.RegisterGaugeFunc(g.name, g.help, func() float64 { return fn(t.Stats()) })
+	}
+}
@@ -0,0 +1,87 @@
+package tracker
+
+import (
+	"context"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/store"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatCounter(t *testing.T) {
+	s := newStatCounter()
+	ih0 := store.InfoHash{1}
+	ih1 := store.InfoHash{2}
+	v4 := net.ParseIP("1.2.3.4")
+	v6 := net.ParseIP("2600::1")
+	p0 := store.NewPeer(1, store.PeerID{1}, v4, v6, 6881)
+	p1 := store.NewPeer(2, store.PeerID{2}, v4, nil, 6881)
+	p1.Left = 1000
+	p2 := store.NewPeer(2, store.PeerID{3}, nil, v6, 6881)
+	p2.Left = 1000
+	s.torrentSeen(ih0)
+	s.torrentSeen(ih0)
+	s.torrentSeen(ih1)
+	s.peerAdded(ih0, p0)
+	s.peerAdded(ih0, p1)
+	s.peerAdded(ih1, p2)
+	for _, u := range []store.UpdateState{
+		{Passkey: "a", InfoHash: ih0, PeerID: p0.PeerID, Uploaded: 100, Event: consts.STARTED},
+		{Passkey: "b", InfoHash: ih0, PeerID: p1.PeerID, Downloaded: 50, Left: 500},
+		// p2 completes
+		{Passkey: "b", InfoHash: ih1, PeerID: p2.PeerID, Downloaded: 50, Event: consts.COMPLETED},
+	} {
+		s.update(u, time.Hour)
+	}
+	stats := s.get(time.Hour)
+	require.Equal(t, 2, stats.Torrents)
+	require.Equal(t, 2, stats.Swarms)
+	require.Equal(t, 3, stats.Peers)
+	require.Equal(t, 2, stats.Seeders)
+	require.Equal(t, 1, stats.Leechers)
+	require.Equal(t, 2, stats.PeersIPv4)
+	require.Equal(t, 2, stats.PeersIPv6)
+	require.Equal(t, 2, stats.Users)
+	require.Equal(t, uint64(3), stats.Announces)
+	require.Equal(t, uint64(100), stats.Uploaded)
+	require.Equal(t, uint64(100), stats.Downloaded)
+	require.True(t, stats.AnnouncesPerSec > 0)
+
+	s.peerRemoved(ih1, p2.PeerID)
+	// Unknown peers must not push the counts negative
+	s.peerRemoved(ih1, p2.PeerID)
+	s.peerRemoved(ih0, p0.PeerID)
+	s.torrentRemoved(ih1)
+	stats = s.get(time.Hour)
+	require.Equal(t, 1, stats.Torrents)
+	require.Equal(t, 1, stats.Swarms)
+	require.Equal(t, 1, stats.Peers)
+	require.Equal(t, 0, stats.Seeders)
+	require.Equal(t, 1, stats.Leechers)
+	require.Equal(t, 1, stats.PeersIPv4)
+	require.Equal(t, 0, stats.PeersIPv6)
+
+	// Once an interval elapses the completed generation is reported
+	s.rotated = time.Now().Add(-2 * time.Hour)
+	s.update(store.UpdateState{Passkey: "c", InfoHash: ih0, PeerID: p1.PeerID}, time.Hour)
+	stats = s.get(time.Hour)
+	require.Equal(t, 2, stats.Users)
+	require.InDelta(t, 3.0/7200, stats.AnnouncesPerSec, 0.0001)
+	// p1 reported left=0 so is now a seeder
+	require.Equal(t, 1, stats.Seeders)
+}
+
+func TestTracker_StatsSeeded(t *testing.T) {
+	opts := NewDefaultOpts()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, opts.Torrents.Add(store.GenerateTestTorrent()))
+	}
+	tkr, err := New(context.Background(), opts)
+	require.NoError(t, err)
+	// Torrents added before startup are counted without being announced
+	require.Equal(t, 3, tkr.Stats().Torrents)
+	require.NoError(t, tkr.TorrentAdd(store.GenerateTestTorrent()))
+	require.Equal(t, 4, tkr.Stats().Torrents)
+}
@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"github.com/leighmacdonald/mika/consts"
 	"github.com/leighmacdonald/mika/geo"
+	"github.com/leighmacdonald/mika/journal"
 	"github.com/leighmacdonald/mika/metrics"
 	"github.com/leighmacdonald/mika/store"
 	"github.com/leighmacdonald/mika/store/memory"
 	"github.com/leighmacdonald/mika/util"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"sync/atomic"
 	"time"
 
@@ -37,24 +40,71 @@ type Tracker struct {
 	Geodb geo.Provider
 	// GeodbEnabled will enable the lookup of location data for peers
 	GeodbEnabled bool
+	// GeoPolicy is the country/ASN policy applied to peers when GeodbEnabled is set
+	GeoPolicy *geo.Policy
 	// Public if true means we dont require a passkey / authorized user
 	Public bool
 	// If Public is true, this will allow unknown info_hashes to be automatically tracked
 	AutoRegister     bool
 	AllowNonRoutable bool
 	AllowClientIP    bool
+	// TrustedProxies are the networks we accept forwarding headers from
+	TrustedProxies []*net.IPNet
+	// ProxyHeader is the forwarding header read from the TrustedProxies
+	ProxyHeader string
 	// ReaperInterval is how often we can for dead peers in swarms
 	ReaperInterval time.Duration
 	AnnInterval    time.Duration
 	AnnIntervalMin time.Duration
 	BatchInterval  time.Duration
-	IPv6Only       bool
+	// IPv6 enables storing and returning the ipv6 endpoints of peers
+	IPv6     bool
+	IPv6Only bool
 	// MaxPeers is the max number of peers we send in an announce
 	MaxPeers        int
 	StateUpdateChan chan store.UpdateState
 	// Whitelist and whitelist lock
 	Whitelist   map[string]store.WhiteListClient
 	WhitelistMu *sync.RWMutex
+	// Bans is the in-memory prefix tree of banned networks
+	Bans *store.BanTree
+	// IPLimiter and PasskeyLimiter limit the request rate of clients, nil when disabled
+	IPLimiter      *RateLimiter
+	PasskeyLimiter *RateLimiter
+	// HealthEndpoints enables the /healthz and /readyz checks on the tracker router
+	HealthEndpoints bool
+	// stats holds the incrementally maintained GlobalStats counters
+	stats *statCounter
+	// peersListened is set when the peer store reports the changes to the peers it holds,
+	// the peer counters are then only updated by its listener
+	peersListened bool
+	// journal is the optional write-ahead journal of state updates
+	journal *journal.Journal
+	// StatWorkers is the number of shards the StatWorker sums state updates with
+	StatWorkers int
+	// QueuePolicy is applied to state updates when the StateUpdateChan is full
+	QueuePolicy QueuePolicy
+	// QueueTimeout is how long the QueueBlock policy waits before dropping, 0 waits forever
+	QueueTimeout time.Duration
+	// OverloadThreshold is the fraction of the queue in use which marks the tracker as
+	// overloaded, 0 disables overload detection
+	OverloadThreshold float64
+	// OverloadFactor scales the announce intervals sent to clients while overloaded
+	OverloadFactor float64
+	// CacheRefreshInterval is how often the CacheRefresher runs
+	CacheRefreshInterval time.Duration
+	// bus shares cache invalidations with the other nodes, nodeID identifies our messages
+	bus    store.InvalidationBus
+	nodeID string
+	// spill holds the state updates shed by the QueueSpill policy
+	spill      *journal.Journal
+	overloaded int32
+	// stop is closed by Shutdown to stop the background workers
+	stop     chan struct{}
+	stopOnce *sync.Once
+	// statWorkerDone is closed once the StatWorker has performed its final sync
+	statWorkerDone  chan struct{}
+	statWorkerState int32
 }
 
 // Opts is used to configure tracker instances
@@ -69,13 +119,23 @@ type Opts struct {
 	// GeodbEnabled will enable the lookup of location data for peers
 	// TODO the dummy provider is probably sufficient
 	GeodbEnabled bool
+	// GeoPolicy is the optional country/ASN allow/deny policy applied to peers
+	GeoPolicy *geo.Policy
 	// Public if true means we dont require a passkey / authorized user
 	Public bool
 	// If Public is true, this will allow unknown info_hashes to be automatically tracked
 	AutoRegister     bool
 	AllowNonRoutable bool
 	AllowClientIP    bool
-	// Dont enable dual-stack replies in ipv6 mode
+	// TrustedProxies are the networks which are allowed to set the client address using
+	// the ProxyHeader
+	TrustedProxies []*net.IPNet
+	// ProxyHeader is the forwarding header, X-Forwarded-For, Forwarded or X-Real-IP, the
+	// TrustedProxies set the client address in. Any other forwarding headers are ignored.
+	ProxyHeader string
+	// IPv6 enables storing and returning the ipv6 endpoints of dual-stack peers
+	IPv6 bool
+	// Dont enable dual-stack replies in ipv6 mode, implies IPv6
 	IPv6Only bool
 	// ReaperInterval is how often we can for dead peers in swarms
 	ReaperInterval time.Duration
@@ -85,15 +145,49 @@ type Opts struct {
 	BatchInterval time.Duration
 	// MaxPeers is the max number of peers we send in an announce
 	MaxPeers int
+	// RateLimitIP is the allowed requests per second for a single address, 0 disables it
+	RateLimitIP      float64
+	RateLimitIPBurst int
+	// RateLimitPasskey is the allowed requests per second for a single passkey, 0 disables it
+	RateLimitPasskey      float64
+	RateLimitPasskeyBurst int
+	// HealthEndpoints serves the health checks on the tracker router as well as the API
+	HealthEndpoints bool
+	// Journal is the optional write-ahead journal the StatWorker records updates to
+	// before batching them, unacknowledged updates are replayed when it starts
+	Journal *journal.Journal
+	// StatWorkers is the number of shards, partitioned by info_hash, summing state updates
+	StatWorkers int
+	// QueueSize is the capacity of the state update queue
+	QueueSize int
+	// QueuePolicy is what happens to state updates when the queue is full
+	QueuePolicy QueuePolicy
+	// QueueTimeout is how long the QueueBlock policy waits for space, 0 waits forever
+	QueueTimeout time.Duration
+	// Spill is the journal state updates are written to under the QueueSpill policy
+	Spill *journal.Journal
+	// OverloadThreshold is the fraction of the queue in use which marks the tracker as
+	// overloaded, 0 disables it
+	OverloadThreshold float64
+	// OverloadFactor scales the announce intervals sent to clients while overloaded
+	OverloadFactor float64
+	// TorrentCache, UserCache and PeerCache bound the size and entry lifetime of the caches
+	TorrentCache store.CacheOpts
+	UserCache    store.CacheOpts
+	PeerCache    store.CacheOpts
+	// CacheRefreshInterval is how often cached entries in use are reloaded before they expire
+	CacheRefreshInterval time.Duration
+	// Bus is the optional transport used to invalidate the caches of other nodes
+	Bus store.InvalidationBus
 }
 
 // NewDefaultOpts returns a new tracker configuration using in-memory
 // stores and default interval values
 func NewDefaultOpts() *Opts {
 	return &Opts{
-		Torrents:            memory.NewTorrentStore(),
-		Peers:               memory.NewPeerStore(),
-		Users:               memory.NewUserStore(),
+		Torrents:            store.InstrumentTorrentStore("memory", memory.NewTorrentStore()),
+		Peers:               store.InstrumentPeerStore("memory", memory.NewPeerStore()),
+		Users:               store.InstrumentUserStore("memory", memory.NewUserStore()),
 		UserCacheEnabled:    false,
 		TorrentCacheEnabled: false,
 		PeerCacheEnabled:    false,
@@ -103,12 +197,24 @@ func NewDefaultOpts() *Opts {
 		AutoRegister:        false,
 		AllowNonRoutable:    false,
 		AllowClientIP:       false,
+		ProxyHeader:         "X-Forwarded-For",
+		IPv6:                false,
 		IPv6Only:            false,
 		ReaperInterval:      time.Second * 300,
 		AnnInterval:         time.Second * 60,
 		AnnIntervalMin:      time.Second * 30,
 		BatchInterval:       time.Second * 60,
 		MaxPeers:            100,
+		StatWorkers:         1,
+		QueueSize:           1000,
+		QueuePolicy:         QueueBlock,
+		OverloadThreshold:   0.8,
+		OverloadFactor:      2,
+
+		TorrentCache:         store.CacheOpts{MaxEntries: 100000, TTL: time.Minute * 5, NegativeTTL: time.Second * 30},
+		UserCache:            store.CacheOpts{MaxEntries: 100000, TTL: time.Minute * 5, NegativeTTL: time.Second * 30},
+		PeerCache:            store.CacheOpts{MaxEntries: 500000, TTL: time.Minute * 10},
+		CacheRefreshInterval: time.Second * 30,
 	}
 }
 
@@ -119,187 +225,524 @@ func (t *Tracker) PeerReaper() {
 	for {
 		select {
 		case <-peerTimer.C:
-			expired := t.peers.Reap()
-			if t.PeerCache != nil {
-				for _, ph := range expired {
-					t.PeerCache.Delete(ph.InfoHash(), ph.PeerID())
-				}
-			}
+			t.reapPeers()
 			// We use a timer here so that config updates for the interval get applied
 			// on the next tick
 			peerTimer.Reset(t.ReaperInterval)
+		case <-t.stop:
+			return
 		case <-t.ctx.Done():
 			return
 		}
 	}
 }
 
+// reapPeers removes the expired peers and decrements the seeder or leecher count of their
+// torrents, as a stopped announce would have
+func (t *Tracker) reapPeers() {
+	expired := t.peers.Reap()
+	if len(expired) == 0 {
+		return
+	}
+	counts := make(map[store.InfoHash]store.TorrentStats)
+	for _, rp := range expired {
+		ih, pid := rp.InfoHash(), rp.PeerID()
+		if t.PeerCache != nil {
+			t.PeerCache.Delete(ih, pid)
+		}
+		if !t.peersListened {
+			t.stats.peerRemoved(ih, pid)
+		}
+		tb := counts[ih]
+		if rp.Seeder {
+			tb.Seeders--
+		} else {
+			tb.Leechers--
+		}
+		counts[ih] = tb
+	}
+	if err := t.TorrentSync(counts); err != nil {
+		log.Errorf("Failed to update torrent peer counts after reaping: %s", err)
+	}
+}
+
+// CacheRefresher periodically reloads the cached torrents and users in use before they
+// expire, so changes made directly to the backing store are picked up without the
+// announce path waiting on the store. Expired and unused entries are removed.
+func (t *Tracker) CacheRefresher() {
+	if t.CacheRefreshInterval <= 0 ||
+		(t.TorrentsCache == nil && t.UsersCache == nil && t.PeerCache == nil) {
+		return
+	}
+	refreshTimer := time.NewTimer(t.CacheRefreshInterval)
+	for {
+		select {
+		case <-refreshTimer.C:
+			t.refreshCaches()
+			refreshTimer.Reset(t.CacheRefreshInterval)
+		case <-t.stop:
+			return
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// refreshCaches reloads the entries expiring before the next refresh
+func (t *Tracker) refreshCaches() {
+	window := t.CacheRefreshInterval * 2
+	if t.TorrentsCache != nil {
+		t.TorrentsCache.Refresh(window, consts.ErrInvalidInfoHash, t.loadTorrent)
+	}
+	if t.UsersCache != nil {
+		t.UsersCache.Refresh(window, consts.ErrInvalidUser, t.loadUser)
+	}
+	if t.PeerCache != nil {
+		t.PeerCache.Expire()
+	}
+}
+
+// States of the StatWorker, used so Shutdown knows whether it must wait on the worker
+const (
+	workerIdle int32 = iota
+	workerRunning
+	workerStopped
+)
+
+// statBatch holds the summed stats waiting to be sent to the backing stores
+type statBatch struct {
+	users    map[string]store.UserStats
+	peers    map[store.PeerHash]store.PeerStats
+	torrents map[store.InfoHash]store.TorrentStats
+	// seq is the journal sequence number of the last update summed into the batch
+	seq uint64
+	// spillSeq is the spill journal sequence number of the last recovered update, the
+	// next chunk of spilled updates is recovered from the one following it
+	spillSeq uint64
+}
+
+func newStatBatch() *statBatch {
+	return &statBatch{
+		users:    make(map[string]store.UserStats),
+		peers:    make(map[store.PeerHash]store.PeerStats),
+		torrents: make(map[store.InfoHash]store.TorrentStats),
+	}
+}
+
+// applyUpdate applies the live effects of the announce state update and sums it into
+// the batch
+func (t *Tracker) applyUpdate(b *statBatch, u store.UpdateState) {
+	t.announceEffects(u)
+	t.sumUpdate(b, u)
+}
+
+// announceEffects updates the global stats and removes stopped peers from the swarm.
+// These are applied once when the update is received, updates replayed from the journal
+// or recovered from the spill journal are only summed.
+func (t *Tracker) announceEffects(u store.UpdateState) {
+	if t.peersListened {
+		t.stats.announced(u, t.AnnInterval)
+	} else {
+		t.stats.update(u, t.AnnInterval)
+	}
+	if u.Event == consts.STOPPED {
+		if err := t.peerDelete(u.InfoHash, u.PeerID); err != nil {
+			log.Errorf("Could not remove peer from swarm: %s", err.Error())
+		}
+	}
+}
+
+// sumUpdate sums the announce state update into the batch
+func (t *Tracker) sumUpdate(b *statBatch, u store.UpdateState) {
+	ub, found := b.users[u.Passkey]
+	if !found {
+		ub = store.UserStats{}
+	}
+	tb, found := b.torrents[u.InfoHash]
+	if !found {
+		tb = store.TorrentStats{}
+	}
+	pHash := store.NewPeerHash(u.InfoHash, u.PeerID)
+	pb, peerFound := b.peers[pHash]
+	if !peerFound {
+		pb = store.PeerStats{}
+	}
+	var torrent store.Torrent
+	// Keep deleted true so that we can record any buffered stat updates from
+	// the client even though we deleted/disabled the torrent itself.
+	if err := t.TorrentGet(&torrent, u.InfoHash, false); err != nil {
+		log.Errorf("No torrent found in batch update")
+		return
+	}
+	// Global user stats
+	ub.Uploaded += uint64(float64(u.Uploaded) * torrent.MultiUp)
+	ub.Downloaded += uint64(float64(u.Downloaded) * torrent.MultiDn)
+	ub.Announces++
+
+	// Peer stats
+	pb.Hist = append(pb.Hist, store.AnnounceHist{
+		Downloaded: u.Downloaded,
+		Uploaded:   u.Uploaded,
+		Timestamp:  u.Timestamp,
+	})
+	pb.Left = u.Left
+
+	// Global torrent stats
+	tb.Announces++
+	tb.Uploaded += u.Uploaded
+	tb.Downloaded += u.Downloaded
+
+	switch u.Event {
+	case consts.PAUSED:
+		if !pb.Paused {
+			tb.Seeders++
+		}
+	case consts.STARTED:
+		if u.Left == 0 {
+			tb.Seeders++
+		} else {
+			tb.Leechers++
+		}
+	case consts.COMPLETED:
+		tb.Snatches++
+		tb.Seeders++
+		tb.Leechers--
+	case consts.STOPPED:
+		// Paused considered a seeder
+		if u.Paused || u.Left == 0 {
+			tb.Seeders--
+		} else {
+			tb.Leechers--
+		}
+	}
+	b.users[u.Passkey] = ub
+	b.torrents[u.InfoHash] = tb
+	b.peers[pHash] = pb
+}
+
+// The journal cursors of the stores synced from each batch. Each store acknowledges the
+// journaled updates it has synced separately so a partially failed sync is never
+// replayed into the stores which succeeded.
+const (
+	cursorUsers    = "users"
+	cursorPeers    = "peers"
+	cursorTorrents = "torrents"
+)
+
+var statCursors = []string{cursorUsers, cursorPeers, cursorTorrents}
+
+// journalCursors returns the last update synced by each store
+func journalCursors(j *journal.Journal) map[string]uint64 {
+	cursors := make(map[string]uint64, len(statCursors))
+	for _, name := range statCursors {
+		cursors[name] = j.Cursor(name)
+	}
+	return cursors
+}
+
+// replayUpdate sums a journaled update into the batch for only the stores which have
+// not already synced it. Its live effects were applied when it was first received.
+func (t *Tracker) replayUpdate(b *statBatch, r journal.Record, cursors map[string]uint64) {
+	if r.Seq > cursors[cursorUsers] && r.Seq > cursors[cursorPeers] && r.Seq > cursors[cursorTorrents] {
+		t.sumUpdate(b, r.State)
+		return
+	}
+	scratch := newStatBatch()
+	t.sumUpdate(scratch, r.State)
+	if r.Seq <= cursors[cursorUsers] {
+		scratch.users = nil
+	}
+	if r.Seq <= cursors[cursorPeers] {
+		scratch.peers = nil
+	}
+	if r.Seq <= cursors[cursorTorrents] {
+		scratch.torrents = nil
+	}
+	b.merge(scratch)
+}
+
+// replayJournal sums the journaled updates which were never acknowledged by a successful
+// sync into the batch
+func (t *Tracker) replayJournal(b *statBatch) {
+	if t.journal == nil {
+		return
+	}
+	replayed := 0
+	cursors := journalCursors(t.journal)
+	if err := t.journal.Replay(func(r journal.Record) error {
+		t.replayUpdate(b, r, cursors)
+		b.seq = r.Seq
+		replayed++
+		return nil
+	}); err != nil {
+		log.Errorf("Failed to replay journal: %s", err)
+	}
+	if replayed > 0 {
+		log.Infof("Replayed %d journaled state updates", replayed)
+	}
+}
+
+// syncBatch sends the batch to the backing stores. The stats of each store are only
+// removed from the batch once that store has synced successfully, any store which fails
+// is sent its stats again along with the next batch. Each store acknowledges the
+// journaled and spilled updates it has synced on its own cursor and both journals are
+// acknowledged up to the lowest of them.
+func (t *Tracker) syncBatch(b *statBatch) {
+	log.Debugf("Calling Sync() on %d users", len(b.users))
+	if err := t.UserSync(b.users); err != nil {
+		log.Errorf(err.Error())
+	} else {
+		b.users = make(map[string]store.UserStats)
+		t.ackStore(b, cursorUsers)
+	}
+	log.Debugf("Calling Sync() on %d peers", len(b.peers))
+	if err := t.PeerSync(b.peers); err != nil {
+		log.Errorf(err.Error())
+	} else {
+		b.peers = make(map[store.PeerHash]store.PeerStats)
+		t.ackStore(b, cursorPeers)
+	}
+	log.Debugf("Calling Sync() on %d torrents", len(b.torrents))
+	if err := t.TorrentSync(b.torrents); err != nil {
+		log.Errorf(err.Error())
+	} else {
+		b.torrents = make(map[store.InfoHash]store.TorrentStats)
+		t.ackStore(b, cursorTorrents)
+	}
+	ackJournal(t.journal)
+	ackJournal(t.spill)
+}
+
+// ackStore acknowledges the journaled and spilled updates in the batch as synced by the store
+func (t *Tracker) ackStore(b *statBatch, cursor string) {
+	if t.journal != nil && b.seq > 0 {
+		if err := t.journal.AckCursor(cursor, b.seq); err != nil {
+			log.Errorf("Failed to acknowledge journal for %s: %s", cursor, err)
+		}
+	}
+	if t.spill != nil && b.spillSeq > 0 {
+		if err := t.spill.AckCursor(cursor, b.spillSeq); err != nil {
+			log.Errorf("Failed to acknowledge spilled state updates for %s: %s", cursor, err)
+		}
+	}
+}
+
+// ackJournal acknowledges the journaled updates synced by every store
+func ackJournal(j *journal.Journal) {
+	if j == nil {
+		return
+	}
+	seq := j.Cursor(statCursors[0])
+	for _, name := range statCursors[1:] {
+		if cursor := j.Cursor(name); cursor < seq {
+			seq = cursor
+		}
+	}
+	if err := j.Ack(seq); err != nil {
+		log.Errorf("Failed to acknowledge journal: %s", err)
+	}
+}
+
+// drain hands any updates still queued in the StateUpdateChan to the pipeline
+func (t *Tracker) drain(p *statPipeline) int {
+	drained := 0
+	for {
+		select {
+		case u := <-t.StateUpdateChan:
+			p.receive(u)
+			drained++
+		default:
+			return drained
+		}
+	}
+}
+
 // StatWorker handles summing up stats for users/peers/torrents to be sent to the
 // backing stores for long term storage.
-// No locking required for these data sets
+// Updates are summed in parallel by StatWorkers shards, partitioned by info_hash, and
+// merged into a single Sync call per store every BatchInterval.
+// When the tracker is shut down or its context closed, any queued updates are drained
+// and a final sync is performed before returning.
 func (t *Tracker) StatWorker() {
+	if !atomic.CompareAndSwapInt32(&t.statWorkerState, workerIdle, workerRunning) {
+		log.Warnf("Stat worker already running or shut down")
+		return
+	}
+	defer close(t.statWorkerDone)
+	p := t.newStatPipeline(t.StatWorkers)
+	defer p.close()
+	t.replayJournal(p.batch)
+	t.recoverSpill(p.batch, true)
+	if p.batch.seq > 0 || p.batch.spillSeq > 0 {
+		t.syncBatch(p.batch)
+	}
 	syncTimer := time.NewTimer(t.BatchInterval)
-	userBatch := make(map[string]store.UserStats)
-	peerBatch := make(map[store.PeerHash]store.PeerStats)
-	torrentBatch := make(map[store.InfoHash]store.TorrentStats)
 	for {
 		select {
 		case <-syncTimer.C:
-			// Copy the maps to pass into the go routine call. At the same time deleting
-			// the existing values
-			userBatchCopy := make(map[string]store.UserStats)
-			for k, v := range userBatch {
-				userBatchCopy[k] = v
-				delete(userBatch, k)
-			}
-
-			peerBatchCopy := make(map[store.PeerHash]store.PeerStats)
-			for k, v := range peerBatch {
-				peerBatchCopy[k] = v
-				delete(peerBatch, k)
-			}
-
-			torrentBatchCopy := make(map[store.InfoHash]store.TorrentStats)
-			for k, v := range torrentBatch {
-				torrentBatchCopy[k] = v
-				delete(torrentBatch, k)
-			}
-			// Send current copies of data to stores
-			log.Debugf("Calling Sync() on %d users", len(userBatchCopy))
-			if err := t.UserSync(userBatchCopy); err != nil {
-				log.Errorf(err.Error())
-			}
-			log.Debugf("Calling Sync() on %d peers", len(userBatchCopy))
-			if err := t.PeerSync(peerBatchCopy); err != nil {
-				log.Errorf(err.Error())
-			}
-			log.Debugf("Calling Sync() on %d torrents", len(userBatchCopy))
-			if err := t.TorrentSync(torrentBatchCopy); err != nil {
-				log.Errorf(err.Error())
-			}
+			t.setOverloaded(false)
+			p.flush(false)
 			syncTimer.Reset(t.BatchInterval)
 		case u := <-t.StateUpdateChan:
-			ub, found := userBatch[u.Passkey]
-			if !found {
-				ub = store.UserStats{}
-			}
-			tb, found := torrentBatch[u.InfoHash]
-			if !found {
-				tb = store.TorrentStats{}
-			}
-			pHash := store.NewPeerHash(u.InfoHash, u.PeerID)
-			pb, peerFound := peerBatch[pHash]
-			if !peerFound {
-				pb = store.PeerStats{}
-			}
-			var torrent store.Torrent
-			// Keep deleted true so that we can record any buffered stat updates from
-			// the client even though we deleted/disabled the torrent itself.
-			if err := t.TorrentGet(&torrent, u.InfoHash, false); err != nil {
-				log.Errorf("No torrent found in batch update")
-				continue
-			}
-			// Global user stats
-			ub.Uploaded += uint64(float64(u.Uploaded) * torrent.MultiUp)
-			ub.Downloaded += uint64(float64(u.Downloaded) * torrent.MultiDn)
-			ub.Announces++
-
-			// Peer stats
-			pb.Hist = append(pb.Hist, store.AnnounceHist{
-				Downloaded: u.Downloaded,
-				Uploaded:   u.Uploaded,
-				Timestamp:  u.Timestamp,
-			})
-			pb.Left = u.Left
-
-			// Global torrent stats
-			tb.Announces++
-			tb.Uploaded += u.Uploaded
-			tb.Downloaded += u.Downloaded
-
-			switch u.Event {
-			case consts.PAUSED:
-				if !pb.Paused {
-					tb.Seeders++
-				}
-			case consts.STARTED:
-				if u.Left == 0 {
-					tb.Seeders++
-				} else {
-					tb.Leechers++
-				}
-			case consts.COMPLETED:
-				tb.Snatches++
-				tb.Seeders++
-				tb.Leechers--
-			case consts.STOPPED:
-				// Paused considered a seeder
-				if u.Paused || u.Left == 0 {
-					tb.Seeders--
-				} else {
-					tb.Leechers--
-				}
-				if err := t.peerDelete(u.InfoHash, u.PeerID); err != nil {
-					log.Errorf("Could not remove peer from swarm: %s", err.Error())
-				}
-			}
-			userBatch[u.Passkey] = ub
-			torrentBatch[u.InfoHash] = tb
-			peerBatch[pHash] = pb
+			p.receive(u)
+		case <-t.stop:
+			log.Infof("Flushing %d queued stat updates", t.drain(p))
+			p.flush(true)
+			return
 		case <-t.ctx.Done():
-			log.Debugf("Batch context closed")
+			log.Debugf("Batch context closed, flushed %d queued stat updates", t.drain(p))
+			p.flush(true)
 			return
 		}
 	}
 }
 
+// Shutdown stops the background workers, flushing any queued stat updates to the
+// backing stores before closing the stores, journal and the geo database.
+// The tracker http server must be shut down before calling this so that no further
+// updates are queued.
+func (t *Tracker) Shutdown(ctx context.Context) error {
+	t.stopOnce.Do(func() {
+		close(t.stop)
+	})
+	var err error
+	if atomic.CompareAndSwapInt32(&t.statWorkerState, workerIdle, workerStopped) {
+		// The worker never started, so flush anything journaled or queued ourselves
+		p := t.newStatPipeline(t.StatWorkers)
+		t.replayJournal(p.batch)
+		log.Infof("Flushing %d queued stat updates", t.drain(p))
+		p.flush(true)
+		p.close()
+	} else if atomic.LoadInt32(&t.statWorkerState) == workerRunning {
+		select {
+		case <-t.statWorkerDone:
+		case <-ctx.Done():
+			err = errors.Wrap(ctx.Err(), "Timed out waiting for final stat sync")
+		}
+	}
+	// The bus is closed first as received invalidations read from the stores
+	if t.bus != nil {
+		if errClose := t.bus.Close(); errClose != nil {
+			log.Errorf("Failed to close invalidation bus: %s", errClose)
+		}
+	}
+	for _, closer := range []struct {
+		name  string
+		close func() error
+	}{{"torrent", t.torrents.Close}, {"user", t.users.Close}, {"peer", t.peers.Close}} {
+		if errClose := closer.close(); errClose != nil {
+			log.Errorf("Failed to close %s store: %s", closer.name, errClose)
+			if err == nil {
+				err = errors.Wrapf(errClose, "Failed to close %s store", closer.name)
+			}
+		}
+	}
+	for _, j := range []*journal.Journal{t.journal, t.spill} {
+		if j == nil {
+			continue
+		}
+		if errClose := j.Close(); errClose != nil && err == nil {
+			err = errClose
+		}
+	}
+	if t.Geodb != nil {
+		t.Geodb.Close()
+	}
+	return err
+}
+
 // New creates a new Tracker instance with configured backend stores
 func New(ctx context.Context, opts *Opts) (*Tracker, error) {
 	t := &Tracker{
-		RWMutex:          &sync.RWMutex{},
-		ctx:              ctx,
-		torrents:         opts.Torrents,
-		peers:            opts.Peers,
-		users:            opts.Users,
-		Geodb:            opts.Geodb,
-		GeodbEnabled:     opts.GeodbEnabled,
-		Public:           opts.Public,
-		AllowNonRoutable: opts.AllowNonRoutable,
-		AllowClientIP:    opts.AllowClientIP,
-		IPv6Only:         opts.IPv6Only,
-		AutoRegister:     opts.AutoRegister,
-		ReaperInterval:   opts.ReaperInterval,
-		AnnInterval:      opts.AnnInterval,
-		AnnIntervalMin:   opts.AnnIntervalMin,
-		BatchInterval:    opts.BatchInterval,
-		MaxPeers:         opts.MaxPeers,
-		StateUpdateChan:  make(chan store.UpdateState, 1000),
-		Whitelist:        make(map[string]store.WhiteListClient),
-		WhitelistMu:      &sync.RWMutex{},
+		RWMutex:              &sync.RWMutex{},
+		ctx:                  ctx,
+		torrents:             opts.Torrents,
+		peers:                opts.Peers,
+		users:                opts.Users,
+		Geodb:                opts.Geodb,
+		GeodbEnabled:         opts.GeodbEnabled,
+		GeoPolicy:            opts.GeoPolicy,
+		Public:               opts.Public,
+		AllowNonRoutable:     opts.AllowNonRoutable,
+		AllowClientIP:        opts.AllowClientIP,
+		TrustedProxies:       opts.TrustedProxies,
+		ProxyHeader:          opts.ProxyHeader,
+		IPv6:                 opts.IPv6 || opts.IPv6Only,
+		IPv6Only:             opts.IPv6Only,
+		AutoRegister:         opts.AutoRegister,
+		ReaperInterval:       opts.ReaperInterval,
+		CacheRefreshInterval: opts.CacheRefreshInterval,
+		AnnInterval:          opts.AnnInterval,
+		AnnIntervalMin:       opts.AnnIntervalMin,
+		BatchInterval:        opts.BatchInterval,
+		MaxPeers:             opts.MaxPeers,
+		StateUpdateChan:      make(chan store.UpdateState, opts.QueueSize),
+		Whitelist:            make(map[string]store.WhiteListClient),
+		WhitelistMu:          &sync.RWMutex{},
+		Bans:                 store.NewBanTree(),
+		stats:                newStatCounter(),
+		stop:                 make(chan struct{}),
+		stopOnce:             &sync.Once{},
+		statWorkerDone:       make(chan struct{}),
+		HealthEndpoints:      opts.HealthEndpoints,
+		journal:              opts.Journal,
+		StatWorkers:          opts.StatWorkers,
+		QueuePolicy:          opts.QueuePolicy,
+		QueueTimeout:         opts.QueueTimeout,
+		OverloadThreshold:    opts.OverloadThreshold,
+		OverloadFactor:       opts.OverloadFactor,
+		spill:                opts.Spill,
+	}
+	if opts.QueueSize <= 0 {
+		t.StateUpdateChan = make(chan store.UpdateState, 1000)
+	}
+	if t.ProxyHeader != "" && !validProxyHeader(t.ProxyHeader) {
+		return nil, errors.Wrapf(consts.ErrInvalidConfig, "Unsupported proxy header: %s", t.ProxyHeader)
+	}
+	if t.QueuePolicy == QueueSpill && t.spill == nil {
+		return nil, errors.Wrap(consts.ErrInvalidConfig, "Spill queue policy requires a spill journal")
+	}
+	if ls, ok := t.peers.(store.ListenedPeerStore); ok {
+		ls.SetListener(peerStatListener{t.stats})
+		t.peersListened = true
+	}
+	t.seedStats()
+	t.registerGauges()
+	t.registerQueueGauges()
+	if opts.RateLimitIP > 0 {
+		t.IPLimiter = NewRateLimiter(opts.RateLimitIP, opts.RateLimitIPBurst)
+	}
+	if opts.RateLimitPasskey > 0 {
+		t.PasskeyLimiter = NewRateLimiter(opts.RateLimitPasskey, opts.RateLimitPasskeyBurst)
 	}
 	// Don't enable caching if we are already configured for a memory store.
+	// Stores may be wrapped so the driver name is checked rather than the type.
 	if opts.TorrentCacheEnabled {
-		switch t.torrents.(type) {
-		case *memory.TorrentStore:
+		if t.torrents.Name() == "memory" {
 			log.Warnf("Not enabling cache for in-memory torrent store, already in-memory")
-		default:
-			t.TorrentsCache = store.NewTorrentCache()
+		} else {
+			t.TorrentsCache = store.NewTorrentCache(opts.TorrentCache)
 		}
 	}
 	if opts.UserCacheEnabled {
-		switch t.users.(type) {
-		case *memory.UserStore:
+		if t.users.Name() == "memory" {
 			log.Warnf("Not enabling cache for in-memory user store, already in-memory.")
-		default:
-			t.UsersCache = store.NewUserCache()
+		} else {
+			t.UsersCache = store.NewUserCache(opts.UserCache)
 		}
 	}
 	if opts.PeerCacheEnabled {
-		switch t.peers.(type) {
-		case *memory.PeerStore:
+		if t.peers.Name() == "memory" {
 			log.Warnf("Not enabling cache for in-memory peer store, already in-memory.")
-		default:
-			t.PeerCache = store.NewPeerCache()
+		} else {
+			t.PeerCache = store.NewPeerCache(opts.PeerCache)
+		}
+	}
+	if opts.Bus != nil {
+		t.bus = opts.Bus
+		t.nodeID = util.NewPasskey()
+		if err := t.bus.Subscribe(t.handleInvalidation); err != nil {
+			return nil, errors.Wrap(err, "Failed to subscribe to the invalidation bus")
 		}
 	}
 	return t, nil
@@ -320,6 +763,7 @@ func NewTestTracker() (*Tracker, error) {
 	opts.MaxPeers = 50
 	opts.AllowNonRoutable = false
 	opts.AllowClientIP = true
+	opts.IPv6 = true
 	tracker, err := New(ctx, opts)
 	if err != nil {
 		return nil, err
@@ -327,6 +771,9 @@ func NewTestTracker() (*Tracker, error) {
 	if err := tracker.LoadWhitelist(); err != nil {
 		return nil, err
 	}
+	if err := tracker.LoadBans(); err != nil {
+		return nil, err
+	}
 	for i := 0; i < userCount; i++ {
 		usr := store.GenerateTestUser()
 		usr.Passkey = fmt.Sprintf("1234567890123456789%d", i)
@@ -349,6 +796,26 @@ func (t *Tracker) ClientWhitelisted(peerID store.PeerID) bool {
 	return found
 }
 
+// GeoPolicyCheck evaluates the geo policy for a peer of the user at the location provided,
+// counting each matched rule. Peers are always allowed when geo lookups are disabled or no
+// policy is configured.
+func (t *Tracker) GeoPolicyCheck(usr store.User, loc geo.Location, leeching bool) geo.Result {
+	if !t.GeodbEnabled || t.GeoPolicy == nil {
+		return geo.Result{Allowed: true}
+	}
+	res := t.GeoPolicy.Check(usr.Class, loc, leeching)
+	for _, rule := range res.Flagged {
+		log.Infof("Geo policy rule %s flagged user %d (%s/AS%d)", rule, usr.UserID, loc.ISOCode, loc.ASN)
+		metrics.GeoPolicyMatches.Inc(rule, string(geo.Flag))
+	}
+	action := geo.Allow
+	if !res.Allowed {
+		action = geo.Deny
+	}
+	metrics.GeoPolicyMatches.Inc(res.Rule, string(action))
+	return res
+}
+
 // LoadWhitelist will read the client white list from the tracker store and
 // load it into memory for quick lookups.
 func (t *Tracker) LoadWhitelist() error {
@@ -366,14 +833,60 @@ func (t *Tracker) LoadWhitelist() error {
 	t.Unlock()
 	return nil
 }
+
+// LoadBans will read the IP/CIDR ban list from the tracker store and load it into
+// a prefix tree for quick lookups. Expired bans are skipped.
+func (t *Tracker) LoadBans() error {
+	bans, err := t.torrents.BanGetAll()
+	if err != nil {
+		return errors.Wrap(err, "Failed to load bans")
+	}
+	tree := store.NewBanTree()
+	for _, ban := range bans {
+		if ban.Expired() {
+			continue
+		}
+		if err := tree.Add(ban); err != nil {
+			log.Warnf("Skipping invalid ban: %s", err)
+		}
+	}
+	t.Lock()
+	t.Bans = tree
+	t.Unlock()
+	return nil
+}
+
 func (t *Tracker) TorrentAdd(torrent store.Torrent) error {
-	return t.torrents.Add(torrent)
+	err := t.torrents.Add(torrent)
+	if err != nil {
+		return err
+	}
+	t.InvalidateTorrent(torrent.InfoHash)
+	t.stats.torrentSeen(torrent.InfoHash)
+	return nil
+}
+
+// TorrentDelete removes a torrent from the backing store
+func (t *Tracker) TorrentDelete(infoHash store.InfoHash, dropRow bool) error {
+	err := t.torrents.Delete(infoHash, dropRow)
+	if err != nil {
+		return err
+	}
+	if t.TorrentsCache != nil {
+		t.TorrentsCache.Delete(infoHash, dropRow)
+	}
+	t.publish([]store.Invalidation{{
+		Kind: store.InvalidateTorrent, Action: store.ActionEvict, Key: infoHash.String()}})
+	t.stats.torrentRemoved(infoHash)
+	return nil
 }
 
 func (t *Tracker) TorrentGet(torrent *store.Torrent, hash store.InfoHash, deletedOk bool) error {
-	cached := false
 	if t.TorrentsCache != nil {
-		cached = t.TorrentsCache.Get(torrent, hash)
+		cached, err := t.TorrentsCache.Get(torrent, hash)
+		if err != nil {
+			return err
+		}
 		if cached {
 			if torrent.IsDeleted && !deletedOk {
 				return consts.ErrInvalidInfoHash
@@ -381,36 +894,57 @@ func (t *Tracker) TorrentGet(torrent *store.Torrent, hash store.InfoHash, delete
 			return nil
 		}
 	}
-	if err := t.torrents.Get(torrent, hash, deletedOk); err != nil {
+	// Deleted torrents are always loaded so the cached entry is valid for either lookup
+	err := t.torrents.Get(torrent, hash, t.TorrentsCache != nil || deletedOk)
+	if err != nil {
+		if t.TorrentsCache != nil && errors.Is(err, consts.ErrInvalidInfoHash) {
+			t.TorrentsCache.SetMissing(hash, err)
+		}
 		return err
 	}
-	if t.TorrentsCache != nil && !cached {
+	if t.TorrentsCache != nil {
 		t.TorrentsCache.Set(*torrent)
+		if torrent.IsDeleted && !deletedOk {
+			return consts.ErrInvalidInfoHash
+		}
+	}
+	if !torrent.IsDeleted {
+		t.stats.torrentSeen(hash)
 	}
 	return nil
 }
 
 func (t *Tracker) UserGet(user *store.User, passkey string) error {
-	cached := false
 	if t.UsersCache != nil {
-		cached = t.UsersCache.Get(user, passkey)
-		if cached {
-			return nil
+		cached, err := t.UsersCache.Get(user, passkey)
+		if cached || err != nil {
+			return err
 		}
 	}
-	if err := t.users.GetByPasskey(user, passkey); err != nil {
+	err := t.users.GetByPasskey(user, passkey)
+	if err != nil {
+		if t.UsersCache != nil && isUnknownUser(err) {
+			t.UsersCache.SetMissing(passkey, err)
+		}
 		return err
 	}
-	if t.UsersCache != nil && !cached {
+	if t.UsersCache != nil {
 		t.UsersCache.Set(*user)
 	}
 	return nil
 }
 
+// isUnknownUser returns true if the error is a store reporting that no user has the passkey
+func isUnknownUser(err error) bool {
+	return errors.Is(err, consts.ErrInvalidUser) || errors.Is(err, consts.ErrUnauthorized)
+}
+
 func (t *Tracker) UserAdd(user store.User) error {
-	if err := t.users.Add(user); err != nil {
+	err := t.users.Add(user)
+	if err != nil {
 		return err
 	}
+	t.InvalidateUser(user.Passkey)
 	return nil
 }
 
@@ -418,7 +952,8 @@ func (t *Tracker) PeerGet(peer *store.Peer, infoHash store.InfoHash, peerID stor
 	if t.PeerCache != nil && t.PeerCache.Get(peer, infoHash, peerID) {
 		return nil
 	}
-	if err := t.peers.Get(peer, infoHash, peerID); err != nil {
+	err := t.peers.Get(peer, infoHash, peerID)
+	if err != nil {
 		return err
 	}
 	if t.PeerCache != nil {
@@ -427,71 +962,79 @@ func (t *Tracker) PeerGet(peer *store.Peer, infoHash store.InfoHash, peerID stor
 	return nil
 }
 
-func (t *Tracker) PeerGetN(infoHash store.InfoHash, max int) (store.Swarm, error) {
-	swarm, err := t.peers.GetN(infoHash, max)
+// PeerGetN returns up to max randomly selected peers from the swarm matching the filter
+func (t *Tracker) PeerGetN(infoHash store.InfoHash, max int, filter store.PeerFilter) ([]store.Peer, error) {
+	peers, err := t.peers.GetN(infoHash, max, filter)
 	if err != nil {
-		return store.Swarm{}, err
+		return nil, err
 	}
-	return swarm, nil
+	return peers, nil
 }
 
 func (t *Tracker) PeerAdd(infoHash store.InfoHash, peer store.Peer) error {
-	if err := t.peers.Add(infoHash, peer); err != nil {
+	err := t.peers.Add(infoHash, peer)
+	if err != nil {
 		return err
 	}
+	if !t.peersListened {
+		t.stats.peerAdded(infoHash, peer)
+	}
 	if t.PeerCache != nil {
 		t.PeerCache.Set(infoHash, peer)
-		atomic.AddInt64(&metrics.PeersTotalCached, 1)
 	}
 	return nil
 }
 func (t *Tracker) peerDelete(infoHash store.InfoHash, peerID store.PeerID) error {
-	t.PeerCache.Delete(infoHash, peerID)
-	return t.peers.Delete(infoHash, peerID)
+	if t.PeerCache != nil {
+		t.PeerCache.Delete(infoHash, peerID)
+	}
+	err := t.peers.Delete(infoHash, peerID)
+	if err != nil {
+		return err
+	}
+	if !t.peersListened {
+		t.stats.peerRemoved(infoHash, peerID)
+	}
+	return nil
 }
 
 func (t *Tracker) UserSync(batch map[string]store.UserStats) error {
-	if err := t.users.Sync(batch); err != nil {
+	err := t.users.Sync(batch)
+	if err != nil {
 		return err
 	}
 	if t.UsersCache != nil {
-		var usr store.User
 		for passkey, stats := range batch {
-			if t.UsersCache.Get(&usr, passkey) {
-				usr.Downloaded += stats.Downloaded
-				usr.Uploaded += stats.Uploaded
-				usr.Announces += stats.Announces
-				t.UsersCache.Set(usr)
-			}
+			t.UsersCache.Update(passkey, stats)
+		}
+	}
+	if t.bus != nil {
+		items := make([]store.Invalidation, 0, len(batch))
+		for passkey := range batch {
+			items = append(items, store.Invalidation{
+				Kind: store.InvalidateUser, Action: store.ActionRefresh, Key: passkey})
 		}
+		t.publish(items)
 	}
 	return nil
 }
 
 func (t *Tracker) PeerSync(batch map[store.PeerHash]store.PeerStats) error {
-	if err := t.peers.Sync(batch); err != nil {
+	err := t.peers.Sync(batch)
+	if err != nil {
 		return err
 	}
 	if t.PeerCache != nil {
-		var peer store.Peer
 		for ph, stats := range batch {
-			sum := stats.Totals()
-			if t.PeerCache.Get(&peer, ph.InfoHash(), ph.PeerID()) {
-				peer.Downloaded += sum.TotalDn
-				peer.Uploaded += sum.TotalUp
-				peer.SpeedDN = uint32(sum.SpeedDn)
-				peer.SpeedUP = uint32(sum.SpeedUp)
-				peer.SpeedDNMax = util.UMax32(peer.SpeedDNMax, uint32(sum.SpeedDn))
-				peer.SpeedUPMax = util.UMax32(peer.SpeedUPMax, uint32(sum.SpeedUp))
-				t.PeerCache.Set(ph.InfoHash(), peer)
-			}
+			t.PeerCache.Update(ph, stats)
 		}
 	}
 	return nil
 }
 
 func (t *Tracker) TorrentSync(batch map[store.InfoHash]store.TorrentStats) error {
-	if err := t.torrents.Sync(batch); err != nil {
+	err := t.torrents.Sync(batch)
+	if err != nil {
 		return err
 	}
 	if t.TorrentsCache != nil {
@@ -499,16 +1042,13 @@ func (t *Tracker) TorrentSync(batch map[store.InfoHash]store.TorrentStats) error
 			t.TorrentsCache.Update(ih, stats)
 		}
 	}
+	if t.bus != nil {
+		items := make([]store.Invalidation, 0, len(batch))
+		for ih := range batch {
+			items = append(items, store.Invalidation{
+				Kind: store.InvalidateTorrent, Action: store.ActionRefresh, Key: ih.String()})
+		}
+		t.publish(items)
+	}
 	return nil
 }
-
-// Stats returns the current cumulative stats for the tracker
-func (t *Tracker) Stats() GlobalStats {
-	var s GlobalStats
-
-	return s
-}
-
-// GlobalStats holds basic stats for the running tracker
-type GlobalStats struct {
-}
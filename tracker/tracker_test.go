@@ -2,15 +2,23 @@ package tracker
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/chihaya/bencode"
 	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/geo"
+	"github.com/leighmacdonald/mika/journal"
+	"github.com/leighmacdonald/mika/metrics"
 	"github.com/leighmacdonald/mika/store"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -297,18 +305,270 @@ func TestBitTorrentHandler_Announce(t *testing.T) {
 				require.Equal(t, a.state.Downloaded, peer.Downloaded, "Invalid downloaded (%d)", i)
 				require.Equal(t, a.state.Left, peer.Left, "Invalid left (%d)", i)
 				require.Equal(t, a.state.Port, peer.Port, "Invalid port (%d)", i)
-				require.Equal(t, a.state.IP, peer.IP.String(), "Invalid ip (%d)", i)
+				require.Equal(t, a.state.IP, peer.Addr().String(), "Invalid ip (%d)", i)
 			} else {
 				require.Error(t, tkr.peers.Get(&peer, a.req.Ih, a.req.PID), "Got peer when we shouldn't (%d)", i)
 			}
-			swarm, err := tkr.peers.GetN(torrent0.InfoHash, 1000)
+			peers, err := tkr.peers.GetN(torrent0.InfoHash, 1000, store.PeerFilter{})
 			require.NoError(t, err, "Failed to fetch all peers (%d)", i)
 			var torrent store.Torrent
 			require.NoError(t, tkr.torrents.Get(&torrent, torrent0.InfoHash, false))
-			require.Equal(t, a.state.SwarmSize, len(swarm.Peers), "Invalid swarm size (%d)", i)
+			require.Equal(t, a.state.SwarmSize, len(peers), "Invalid swarm size (%d)", i)
 			require.Equal(t, a.state.Seeders, torrent.Seeders, "Invalid seeder count (%d)", i)
 			require.Equal(t, a.state.Leechers, torrent.Leechers, "Invalid leecher count (%d)", i)
 			require.Equal(t, a.state.Snatches, torrent.Snatches, "invalid snatch count (%d)", i)
 		}
 	}
 }
+
+func TestTracker_GeoPolicyCheck(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err)
+	policy := &geo.Policy{
+		RuleSet: geo.RuleSet{Rules: []geo.Rule{{Name: "embargo", Countries: []string{"KP"}, Action: geo.Deny}}},
+		Classes: map[string]geo.RuleSet{"staff": {Default: geo.Allow}},
+	}
+	require.NoError(t, policy.Validate())
+	tkr.GeoPolicy = policy
+	loc := geo.Location{ISOCode: "KP"}
+	// Policies are only applied when geo lookups are enabled
+	require.True(t, tkr.GeoPolicyCheck(store.User{}, loc, true).Allowed)
+	tkr.GeodbEnabled = true
+	before := metrics.GeoPolicyMatches.Get("embargo", string(geo.Deny))
+	res := tkr.GeoPolicyCheck(store.User{}, loc, true)
+	require.False(t, res.Allowed)
+	require.Equal(t, "Access not permitted from country KP", res.Reason)
+	require.Equal(t, before+1, metrics.GeoPolicyMatches.Get("embargo", string(geo.Deny)))
+	require.True(t, tkr.GeoPolicyCheck(store.User{Class: "staff"}, loc, true).Allowed)
+}
+
+// syncRecorder is a UserStore recording the batches passed to Sync, the first fails
+// calls to Sync return an error
+type syncRecorder struct {
+	store.UserStore
+	batches []map[string]store.UserStats
+	closed  bool
+	fails   int
+}
+
+func (s *syncRecorder) Sync(b map[string]store.UserStats) error {
+	if s.fails > 0 {
+		s.fails--
+		return errors.New("sync failed")
+	}
+	s.batches = append(s.batches, b)
+	return s.UserStore.Sync(b)
+}
+
+func (s *syncRecorder) Close() error {
+	s.closed = true
+	return s.UserStore.Close()
+}
+
+// startStatWorker starts the stat worker and waits for it to be running, otherwise
+// Shutdown may find the worker idle and flush the updates itself
+func startStatWorker(t *testing.T, tkr *Tracker) {
+	go tkr.StatWorker()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&tkr.statWorkerState) == workerRunning
+	}, time.Second*5, time.Millisecond)
+}
+
+func TestTracker_Shutdown(t *testing.T) {
+	opts := NewDefaultOpts()
+	users := &syncRecorder{UserStore: opts.Users}
+	opts.Users = users
+	// Long enough that only the final sync can send the updates
+	opts.BatchInterval = time.Hour
+	tkr, err := New(context.Background(), opts)
+	require.NoError(t, err)
+	usr := store.GenerateTestUser()
+	require.NoError(t, tkr.UserAdd(usr))
+	torrent := store.GenerateTestTorrent()
+	require.NoError(t, tkr.TorrentAdd(torrent))
+	startStatWorker(t, tkr)
+	for i := 0; i < 10; i++ {
+		tkr.StateUpdateChan <- store.UpdateState{
+			InfoHash: torrent.InfoHash,
+			PeerID:   store.PeerID{1},
+			Passkey:  usr.Passkey,
+			Uploaded: 100,
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	require.NoError(t, tkr.Shutdown(ctx))
+	require.Len(t, tkr.StateUpdateChan, 0)
+	var synced store.UserStats
+	for _, b := range users.batches {
+		synced.Announces += b[usr.Passkey].Announces
+		synced.Uploaded += b[usr.Passkey].Uploaded
+	}
+	require.Equal(t, uint32(10), synced.Announces)
+	require.True(t, users.closed)
+	// Shutting down again must not block or panic
+	require.NoError(t, tkr.Shutdown(ctx))
+}
+
+func TestTracker_JournalReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mika-journal")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	jOpts := journal.Opts{Dir: dir}
+	opts := NewDefaultOpts()
+	users := &syncRecorder{UserStore: opts.Users}
+	opts.Users = users
+	opts.BatchInterval = time.Hour
+	usr := store.GenerateTestUser()
+	require.NoError(t, opts.Users.Add(usr))
+	torrent := store.GenerateTestTorrent()
+	require.NoError(t, opts.Torrents.Add(torrent))
+	update := store.UpdateState{
+		InfoHash: torrent.InfoHash,
+		PeerID:   store.PeerID{1},
+		Passkey:  usr.Passkey,
+		Uploaded: 100,
+	}
+	// Updates journaled by a previous run which crashed before syncing
+	j, err := journal.Open(jOpts)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = j.Append(update)
+		require.NoError(t, err)
+	}
+	// The peer stopped before the crash and started again since
+	restarted := store.GenerateTestPeer()
+	_, err = j.Append(store.UpdateState{
+		InfoHash: torrent.InfoHash,
+		PeerID:   restarted.PeerID,
+		Passkey:  usr.Passkey,
+		Event:    consts.STOPPED,
+	})
+	require.NoError(t, err)
+	require.NoError(t, j.Close())
+	require.NoError(t, opts.Peers.Add(torrent.InfoHash, restarted))
+
+	opts.Journal, err = journal.Open(jOpts)
+	require.NoError(t, err)
+	tkr, err := New(context.Background(), opts)
+	require.NoError(t, err)
+	startStatWorker(t, tkr)
+	tkr.StateUpdateChan <- update
+	// The journal is replayed before any queued update is received. Replayed updates were
+	// counted by the previous run and are only synced.
+	require.Eventually(t, func() bool {
+		return tkr.Stats().Announces == 1
+	}, time.Second*5, time.Millisecond*10)
+	var p store.Peer
+	require.NoError(t, opts.Peers.Get(&p, torrent.InfoHash, restarted.PeerID), "Replay removed the peer")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	require.NoError(t, tkr.Shutdown(ctx))
+	var announces uint32
+	for _, b := range users.batches {
+		announces += b[usr.Passkey].Announces
+	}
+	require.Equal(t, uint32(5), announces)
+	require.Equal(t, uint64(1), tkr.Stats().Announces)
+
+	j, err = journal.Open(jOpts)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), j.Acked())
+	require.NoError(t, j.Replay(func(r journal.Record) error {
+		t.Errorf("Acknowledged record replayed: %d", r.Seq)
+		return nil
+	}))
+	require.NoError(t, j.Close())
+}
+
+func TestTracker_JournalSyncFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mika-journal")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	jOpts := journal.Opts{Dir: dir}
+	opts := NewDefaultOpts()
+	users := &syncRecorder{UserStore: opts.Users, fails: 1}
+	opts.Users = users
+	usr := store.GenerateTestUser()
+	require.NoError(t, opts.Users.Add(usr))
+	torrent := store.GenerateTestTorrent()
+	require.NoError(t, opts.Torrents.Add(torrent))
+	update := store.UpdateState{
+		InfoHash: torrent.InfoHash,
+		PeerID:   store.PeerID{1},
+		Passkey:  usr.Passkey,
+		Uploaded: 100,
+	}
+	requireSynced := func(userAnnounces uint32, torrentAnnounces uint64) {
+		var u store.User
+		require.NoError(t, opts.Users.GetByPasskey(&u, usr.Passkey))
+		require.Equal(t, usr.Announces+userAnnounces, u.Announces)
+		var tor store.Torrent
+		require.NoError(t, opts.Torrents.Get(&tor, torrent.InfoHash, false))
+		require.Equal(t, torrent.Announces+torrentAnnounces, tor.Announces)
+	}
+	opts.Journal, err = journal.Open(jOpts)
+	require.NoError(t, err)
+	tkr, err := New(context.Background(), opts)
+	require.NoError(t, err)
+	p := tkr.newStatPipeline(1)
+	p.receive(update)
+	p.receive(update)
+	p.flush(false)
+	// The user stats are kept for the next sync while the torrents are not resent
+	requireSynced(0, 2)
+	p.receive(update)
+	p.flush(false)
+	requireSynced(3, 3)
+	require.Equal(t, uint64(3), opts.Journal.Acked())
+
+	// The user store fails until the tracker crashes, leaving the journal partially synced
+	users.fails = 100
+	p.receive(update)
+	p.receive(update)
+	p.flush(false)
+	p.close()
+	requireSynced(3, 5)
+	require.Equal(t, uint64(3), opts.Journal.Acked())
+	require.NoError(t, opts.Journal.Close())
+
+	// Only the user store is sent the replayed updates
+	users.fails = 0
+	opts.Journal, err = journal.Open(jOpts)
+	require.NoError(t, err)
+	tkr, err = New(context.Background(), opts)
+	require.NoError(t, err)
+	p = tkr.newStatPipeline(1)
+	tkr.replayJournal(p.batch)
+	tkr.syncBatch(p.batch)
+	p.close()
+	requireSynced(5, 5)
+	require.Equal(t, uint64(5), opts.Journal.Acked())
+	require.NoError(t, opts.Journal.Close())
+}
+
+func TestTracker_ReapPeers(t *testing.T) {
+	opts := NewDefaultOpts()
+	torrent := store.GenerateTestTorrent()
+	torrent.Seeders, torrent.Leechers = 5, 5
+	require.NoError(t, opts.Torrents.Add(torrent))
+	tkr, err := New(context.Background(), opts)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		p := store.GenerateTestPeer()
+		p.AnnounceLast = time.Now().Add(-time.Hour)
+		if i > 0 {
+			p.Left = 1000
+		}
+		require.NoError(t, opts.Peers.Add(torrent.InfoHash, p))
+	}
+	require.NoError(t, opts.Peers.Add(torrent.InfoHash, store.GenerateTestPeer()))
+	tkr.reapPeers()
+	var tor store.Torrent
+	require.NoError(t, opts.Torrents.Get(&tor, torrent.InfoHash, false))
+	require.Equal(t, 4, tor.Seeders)
+	require.Equal(t, 3, tor.Leechers)
+	require.NoError(t, tkr.TorrentGet(&tor, torrent.InfoHash, false))
+	require.Equal(t, 4, tor.Seeders)
+	require.Equal(t, 3, tor.Leechers)
+}
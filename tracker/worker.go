@@ -0,0 +1,132 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"github.com/leighmacdonald/mika/store"
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+// shardQueueSize is the buffer of each stat shard, the StateUpdateChan absorbs bursts
+const shardQueueSize = 128
+
+// shardMsg is either a state update or a request for the shards current batch. Both are
+// sent over the same channel so a flush always includes every update dispatched before it.
+type shardMsg struct {
+	update store.UpdateState
+	flush  chan *statBatch
+}
+
+// statPipeline fans the state updates out to a set of shard workers, each summing the
+// swarms selected by info_hash into its own batch. The shard batches are merged into
+// a single batch when flushed so each store still receives one Sync call per interval.
+type statPipeline struct {
+	t      *Tracker
+	shards []chan shardMsg
+	wg     *sync.WaitGroup
+	// batch holds the merged shard batches along with any journal replayed or spilled
+	// updates, its seq is the last journaled update dispatched to the shards
+	batch *statBatch
+}
+
+// newStatPipeline starts the shard workers, at least one is always started
+func (t *Tracker) newStatPipeline(workers int) *statPipeline {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &statPipeline{
+		t:      t,
+		shards: make([]chan shardMsg, workers),
+		wg:     &sync.WaitGroup{},
+		batch:  newStatBatch(),
+	}
+	for i := range p.shards {
+		p.shards[i] = make(chan shardMsg, shardQueueSize)
+		p.wg.Add(1)
+		go p.run(p.shards[i])
+	}
+	return p
+}
+
+func (p *statPipeline) run(msgs chan shardMsg) {
+	defer p.wg.Done()
+	batch := newStatBatch()
+	for msg := range msgs {
+		if msg.flush != nil {
+			msg.flush <- batch
+			batch = newStatBatch()
+			continue
+		}
+		p.t.applyUpdate(batch, msg.update)
+	}
+}
+
+// receive journals the update, if enabled, and hands it to the shard owning the swarm.
+// Info hashes are uniformly distributed so the leading bytes are used directly.
+func (p *statPipeline) receive(u store.UpdateState) {
+	if p.t.journal != nil {
+		seq, err := p.t.journal.Append(u)
+		if err != nil {
+			log.Errorf("Failed to journal state update: %s", err)
+		} else {
+			p.batch.seq = seq
+		}
+	}
+	shard := binary.BigEndian.Uint32(u.InfoHash[:4]) % uint32(len(p.shards))
+	p.shards[shard] <- shardMsg{update: u}
+}
+
+// collect merges the current batch of every shard into the pipeline batch
+func (p *statPipeline) collect() {
+	replies := make([]chan *statBatch, len(p.shards))
+	for i, shard := range p.shards {
+		replies[i] = make(chan *statBatch, 1)
+		shard <- shardMsg{flush: replies[i]}
+	}
+	for _, reply := range replies {
+		p.batch.merge(<-reply)
+	}
+}
+
+// flush collects the shard batches and any spilled updates and syncs them to the stores
+func (p *statPipeline) flush(forceSpill bool) {
+	p.collect()
+	p.t.recoverSpill(p.batch, forceSpill)
+	p.t.syncBatch(p.batch)
+}
+
+// close stops the shard workers, any updates not yet collected are discarded
+func (p *statPipeline) close() {
+	for _, shard := range p.shards {
+		close(shard)
+	}
+	p.wg.Wait()
+}
+
+// merge sums the newer batch into b. Peers belong to a single shard so their entries
+// only need combining when b also holds replayed or spilled updates for the peer.
+func (b *statBatch) merge(newer *statBatch) {
+	for k, v := range newer.users {
+		ub := b.users[k]
+		ub.Uploaded += v.Uploaded
+		ub.Downloaded += v.Downloaded
+		ub.Announces += v.Announces
+		b.users[k] = ub
+	}
+	for k, v := range newer.torrents {
+		tb := b.torrents[k]
+		tb.Seeders += v.Seeders
+		tb.Leechers += v.Leechers
+		tb.Snatches += v.Snatches
+		tb.Uploaded += v.Uploaded
+		tb.Downloaded += v.Downloaded
+		tb.Announces += v.Announces
+		b.torrents[k] = tb
+	}
+	for k, v := range newer.peers {
+		if pb, found := b.peers[k]; found {
+			v.Hist = append(pb.Hist, v.Hist...)
+		}
+		b.peers[k] = v
+	}
+}
@@ -0,0 +1,66 @@
+package tracker
+
+import (
+	"context"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/store"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestTracker_StatWorkers(t *testing.T) {
+	opts := NewDefaultOpts()
+	users := &syncRecorder{UserStore: opts.Users}
+	opts.Users = users
+	opts.BatchInterval = time.Hour
+	opts.StatWorkers = 4
+	usr := store.GenerateTestUser()
+	require.NoError(t, opts.Users.Add(usr))
+	var torrents []store.Torrent
+	for i := 0; i < 16; i++ {
+		torrent := store.GenerateTestTorrent()
+		require.NoError(t, opts.Torrents.Add(torrent))
+		torrents = append(torrents, torrent)
+	}
+	tkr, err := New(context.Background(), opts)
+	require.NoError(t, err)
+	startStatWorker(t, tkr)
+	for i := 0; i < 320; i++ {
+		tkr.StateUpdateChan <- store.UpdateState{
+			InfoHash: torrents[i%len(torrents)].InfoHash,
+			PeerID:   store.PeerID{byte(i % 5)},
+			Passkey:  usr.Passkey,
+			Uploaded: 10,
+			Event:    consts.ANNOUNCE,
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	require.NoError(t, tkr.Shutdown(ctx))
+	// Every shard is merged into one sync
+	require.Len(t, users.batches, 1)
+	require.Equal(t, uint32(320), users.batches[0][usr.Passkey].Announces)
+	require.Equal(t, uint64(3200), users.batches[0][usr.Passkey].Uploaded)
+}
+
+func TestStatBatch_Merge(t *testing.T) {
+	ih := store.InfoHash{1}
+	ph := store.NewPeerHash(ih, store.PeerID{2})
+	older := newStatBatch()
+	older.users["pk"] = store.UserStats{Uploaded: 10, Announces: 1}
+	older.torrents[ih] = store.TorrentStats{Seeders: 1, Announces: 1}
+	older.peers[ph] = store.PeerStats{Left: 100, Hist: []store.AnnounceHist{{Uploaded: 1}}}
+	newer := newStatBatch()
+	newer.users["pk"] = store.UserStats{Uploaded: 5, Announces: 2}
+	newer.users["pk2"] = store.UserStats{Announces: 1}
+	newer.torrents[ih] = store.TorrentStats{Leechers: 1, Announces: 2}
+	newer.peers[ph] = store.PeerStats{Left: 50, Hist: []store.AnnounceHist{{Uploaded: 2}}}
+	older.merge(newer)
+	require.Equal(t, store.UserStats{Uploaded: 15, Announces: 3}, older.users["pk"])
+	require.Equal(t, uint32(1), older.users["pk2"].Announces)
+	require.Equal(t, store.TorrentStats{Seeders: 1, Leechers: 1, Announces: 3}, older.torrents[ih])
+	require.Equal(t, uint32(50), older.peers[ph].Left)
+	require.Len(t, older.peers[ph].Hist, 2)
+	require.Equal(t, uint64(2), older.peers[ph].Hist[1].Uploaded)
+}
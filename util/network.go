@@ -3,6 +3,7 @@ package util
 import (
 	"fmt"
 	"net"
+	"strings"
 )
 
 var privateIPBlocks []*net.IPNet
@@ -38,3 +39,39 @@ func IsPrivateIP(ip net.IP) bool {
 	}
 	return false
 }
+
+// ParseCIDRs parses a list of networks in CIDR notation. Plain addresses are accepted
+// and treated as a single host network, /32 for dotted IPv4 and /128 for any IPv6
+// notation including IPv4-mapped addresses.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", cidr)
+			}
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ContainsIP returns true if the ip is contained within any of the networks
+func ContainsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -23,3 +23,17 @@ func TestIsPrivateIP(t *testing.T) {
 		require.Equal(t, i.private, IsPrivateIP(net.ParseIP(i.ip)))
 	}
 }
+
+func TestParseCIDRs(t *testing.T) {
+	networks, err := ParseCIDRs([]string{"10.0.0.0/8", "192.168.1.10", "2600::/16", "::1"})
+	require.NoError(t, err)
+	require.Len(t, networks, 4)
+	require.True(t, ContainsIP(networks, net.ParseIP("10.1.2.3")))
+	require.True(t, ContainsIP(networks, net.ParseIP("192.168.1.10")))
+	require.False(t, ContainsIP(networks, net.ParseIP("192.168.1.11")))
+	require.True(t, ContainsIP(networks, net.ParseIP("2600::1")))
+	require.True(t, ContainsIP(networks, net.ParseIP("::1")))
+	require.False(t, ContainsIP(networks, net.ParseIP("8.8.8.8")))
+	_, err = ParseCIDRs([]string{"not-an-ip"})
+	require.Error(t, err)
+}
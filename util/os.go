@@ -5,6 +5,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"os"
 	"os/signal"
+	"os/user"
 	"path"
 	"path/filepath"
 	"strings"
@@ -53,3 +54,13 @@ func FindFile(p string) string {
 	}
 	return p
 }
+
+// CurrentUser returns the username of the user running the process, or "admin"
+// if it cannot be determined
+func CurrentUser() string {
+	u, err := user.Current()
+	if err != nil || u.Username == "" {
+		return "admin"
+	}
+	return u.Username
+}